@@ -0,0 +1,336 @@
+/*
+NAME
+  client
+
+DESCRIPTION
+  client provides the run loop shared by netsender clients.
+
+LICENSE
+  client is Copyright (C) 2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with client in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+// Package client provides the run loop shared by netsender clients, which
+// polls the service, sends logs, fetches changed vars and sleeps for the
+// monitor period, with hooks for client-specific behaviour. A minimal
+// client is:
+//
+//	c, err := client.New(log, client.OnPinRead(readPin), client.OnVars(setVars))
+//	if err != nil {
+//		log.Fatal("could not create client", "error", err)
+//	}
+//	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+//	defer stop()
+//	c.Run(ctx)
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ausocean/client/pi/logsend"
+	"github.com/ausocean/client/pi/netlogger"
+	"github.com/ausocean/client/pi/netsender"
+	"github.com/ausocean/client/pi/status"
+)
+
+// Loop timing.
+const (
+	retryTime        = 5 * time.Second  // Time to wait after a failed run.
+	defaultSleepTime = 60 * time.Second // Sleep time if the monitor period is invalid.
+	closeTimeout     = 10 * time.Second // Time allowed for closing the Sender.
+)
+
+// Client implements a netsender client run loop.
+type Client struct {
+	ns     *netsender.Sender
+	log    netsender.Logger
+	logs   logSender
+	status *status.Server
+	init   netsender.PinInit
+	read   netsender.PinReadWrite
+	write  netsender.PinReadWrite
+	onVars func(vars map[string]string)
+	onMode func(mode string)
+	onPoll func(ctx context.Context, ns *netsender.Sender)
+	opts   []netsender.Option
+}
+
+// Option is a functional option for New.
+type Option func(*Client) error
+
+// logSender is implemented by logsend.Logger and netlogger.Logger, which
+// send the client's logs.
+type logSender interface {
+	Send(ns *netsender.Sender) error
+	Flush(ctx context.Context, ns *netsender.Sender) (int, error)
+	SetLevelVar(v string) error
+}
+
+// New returns a Client with a new Sender which logs to log, configured by
+// the given options.
+func New(log netsender.Logger, options ...Option) (*Client, error) {
+	c := &Client{log: log}
+	for i, o := range options {
+		if o == nil {
+			return nil, errors.New("cannot apply nil option")
+		}
+		err := o(c)
+		if err != nil {
+			return nil, fmt.Errorf("could not apply option no. %d, %w", i, err)
+		}
+	}
+	ns, err := netsender.New(log, c.init, c.read, c.write, c.opts...)
+	if err != nil {
+		return nil, err
+	}
+	if c.logs != nil {
+		ns.AddFlusher("logs", c.logs.Flush)
+		ns.OnVar(netlogger.LevelVar, c.logs.SetLevelVar)
+	}
+	c.ns = ns
+	return c, nil
+}
+
+// OnPinInit returns an option that sets the pin initialization function.
+func OnPinInit(f netsender.PinInit) Option {
+	return func(c *Client) error {
+		c.init = f
+		return nil
+	}
+}
+
+// OnPinRead returns an option that sets the function which reads input
+// pins for each poll.
+func OnPinRead(f netsender.PinReadWrite) Option {
+	return func(c *Client) error {
+		c.read = f
+		return nil
+	}
+}
+
+// OnPinWrite returns an option that sets the function which writes
+// output pins.
+func OnPinWrite(f netsender.PinReadWrite) Option {
+	return func(c *Client) error {
+		c.write = f
+		return nil
+	}
+}
+
+// OnVars returns an option that sets a function which is called with
+// the vars whenever they change, and once they are first fetched.
+func OnVars(f func(vars map[string]string)) Option {
+	return func(c *Client) error {
+		c.onVars = f
+		return nil
+	}
+}
+
+// OnMode returns an option that sets a function which is called with
+// the mode whenever it changes.
+func OnMode(f func(mode string)) Option {
+	return func(c *Client) error {
+		c.onMode = f
+		return nil
+	}
+}
+
+// OnPoll returns an option that sets a function which is called after
+// each successful poll with the client's Sender, before the logs are
+// sent, for client-specific work which is done once per monitor period.
+func OnPoll(f func(ctx context.Context, ns *netsender.Sender)) Option {
+	return func(c *Client) error {
+		c.onPoll = f
+		return nil
+	}
+}
+
+// WithLogSender returns an option that sends the logs written to ls to
+// the service after each poll, and flushes them on close. The level of
+// streamed logs is set by the CloudLogLevel var (see netlogger.LevelVar).
+func WithLogSender(ls *logsend.Logger) Option {
+	return func(c *Client) error {
+		c.logs = ls
+		return nil
+	}
+}
+
+// WithNetLogger is like WithLogSender, but for a netlogger.Logger.
+//
+// Deprecated: Use WithLogSender with a logsend.Logger.
+func WithNetLogger(nl *netlogger.Logger) Option {
+	return func(c *Client) error {
+		c.logs = nl
+		return nil
+	}
+}
+
+// WithStatusServer returns an option that runs s, which serves the state
+// of the client on the local network, while Run is running.
+func WithStatusServer(s *status.Server) Option {
+	return func(c *Client) error {
+		c.status = s
+		return nil
+	}
+}
+
+// WithSenderOptions returns an option that applies opts to the Sender.
+func WithSenderOptions(opts ...netsender.Option) Option {
+	return func(c *Client) error {
+		c.opts = append(c.opts, opts...)
+		return nil
+	}
+}
+
+// Sender returns the client's Sender.
+func (c *Client) Sender() *netsender.Sender {
+	return c.ns
+}
+
+// Run runs the client loop until ctx is done, then closes the Sender and
+// returns ctx.Err(). Each iteration polls the service, calls the OnPoll
+// hook, sends any logs, fetches the vars if the var sum has changed,
+// calling the OnVars and OnMode hooks, and sleeps for the monitor period
+// (mp). If the first iterations fail and there are cached vars, OnVars is
+// called with them while waiting for fresh vars (see
+// netsender.WithVarsCache). Meanwhile, output pins are written once per
+// act period (ap), if set (see RunActs), changes to the config file are
+// applied (see WatchConfig) and the status server, if any, is run (see
+// WithStatusServer).
+func (c *Client) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		c.ns.RunActs(ctx)
+		wg.Done()
+	}()
+	go func() {
+		c.ns.WatchConfig(ctx, 0)
+		wg.Done()
+	}()
+	if c.status != nil {
+		wg.Add(1)
+		go func() {
+			err := c.status.Run(ctx, c.ns)
+			if err != nil && ctx.Err() == nil {
+				c.log.Log(netsender.WarningLevel, "status server failed", "error", err.Error())
+			}
+			wg.Done()
+		}()
+	}
+
+	vs := -1
+	mode := c.ns.Mode()
+	stale := false
+	for ctx.Err() == nil {
+		c.log.Log(netsender.DebugLevel, "running netsender")
+		err := c.ns.RunContext(ctx)
+		if err != nil {
+			c.log.Log(netsender.WarningLevel, "run failed, retrying", "error", err.Error())
+			if vs == -1 && !stale {
+				stale = c.staleVars(ctx)
+			}
+			sleep(ctx, retryTime)
+			continue
+		}
+
+		if c.onPoll != nil {
+			c.onPoll(ctx, c.ns)
+		}
+
+		if c.logs != nil {
+			c.log.Log(netsender.DebugLevel, "sending logs")
+			err = c.logs.Send(c.ns)
+			if err != nil {
+				c.log.Log(netsender.WarningLevel, "logs could not be sent", "error", err.Error())
+			}
+		}
+
+		if newVs := c.ns.VarSum(); newVs != vs {
+			c.log.Log(netsender.InfoLevel, "varsum changed", "vs", newVs)
+			vars, err := c.ns.VarsContext(ctx)
+			if err != nil {
+				c.log.Log(netsender.ErrorLevel, "could not get vars", "error", err.Error())
+				sleep(ctx, retryTime)
+				continue
+			}
+			vs = newVs
+			c.log.Log(netsender.InfoLevel, "got new vars", "vars", vars)
+			if c.onVars != nil {
+				c.onVars(vars)
+			}
+			if m := c.ns.Mode(); m != mode {
+				mode = m
+				if c.onMode != nil {
+					c.onMode(mode)
+				}
+			}
+		}
+
+		c.sleep(ctx)
+	}
+	wg.Wait()
+
+	closeCtx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	err := c.ns.Close(closeCtx)
+	if err != nil {
+		c.log.Log(netsender.WarningLevel, "could not close netsender", "error", err.Error())
+	}
+	return ctx.Err()
+}
+
+// staleVars calls the OnVars hook with the cached vars, if any, when the
+// service cannot be reached (see netsender.WithVarsCache), returning true
+// if it was called.
+func (c *Client) staleVars(ctx context.Context) bool {
+	vars, err := c.ns.VarsContext(ctx)
+	if !errors.Is(err, netsender.ErrStaleVars) {
+		return false
+	}
+	c.log.Log(netsender.WarningLevel, "using cached vars", "vars", vars)
+	if c.onVars != nil {
+		c.onVars(vars)
+	}
+	return true
+}
+
+// sleep sleeps for the monitor period, or until ctx is done.
+func (c *Client) sleep(ctx context.Context) {
+	c.log.Log(netsender.DebugLevel, "sleeping")
+	d := defaultSleepTime
+	mp, err := strconv.Atoi(c.ns.Param("mp"))
+	if err != nil || mp <= 0 {
+		c.log.Log(netsender.ErrorLevel, "could not get sleep time, using default", "mp", c.ns.Param("mp"))
+	} else {
+		d = time.Duration(mp) * time.Second
+	}
+	sleep(ctx, d)
+}
+
+// sleep sleeps for d or until ctx is done, whichever is first.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,128 @@
+/*
+NAME
+  client_test.go
+
+LICENSE
+  client is Copyright (C) 2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with client in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ausocean/client/pi/netsender"
+)
+
+// testLogger implements a netsender.Logger which discards logs.
+type testLogger struct{}
+
+func (testLogger) SetLevel(int8)                    {}
+func (testLogger) Log(int8, string, ...interface{}) {}
+
+// TestRun tests that the run loop polls with read pins, calls the OnPoll
+// hook after each poll and the other hooks when the vars change, and
+// closes the Sender when ctx is done.
+func TestRun(t *testing.T) {
+	polls := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/poll":
+			polls <- r.URL.Query().Get("X10")
+			io.WriteString(w, `{"rc":0,"vs":1}`)
+		case "/vars":
+			io.WriteString(w, `{"vs":"1","mode":"Paused","Light":"On"}`)
+		default:
+			io.WriteString(w, `{"rc":0}`)
+		}
+	}))
+	defer srv.Close()
+
+	conf := filepath.Join(t.TempDir(), "netsender.conf")
+	err := os.WriteFile(conf, []byte("ma 00:00:00:00:00:01\ndk 10000001\nip X10\nmp 1\nsh "+srv.URL+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("could not write config: %v", err)
+	}
+
+	vars := make(chan map[string]string, 1)
+	modes := make(chan string, 1)
+	polled := make(chan *netsender.Sender, 10)
+	c, err := New(testLogger{},
+		OnPinRead(func(pin *netsender.Pin) error { pin.Value = 42; return nil }),
+		OnVars(func(v map[string]string) { vars <- v }),
+		OnMode(func(m string) { modes <- m }),
+		OnPoll(func(ctx context.Context, ns *netsender.Sender) { polled <- ns }),
+		WithSenderOptions(netsender.WithConfigFile(conf)),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error from New: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+
+	timeout := time.After(5 * time.Second)
+	select {
+	case got := <-polls:
+		if got != "42" {
+			t.Errorf("unexpected polled value: got %s, want 42", got)
+		}
+	case <-timeout:
+		t.Fatalf("no poll")
+	}
+	select {
+	case ns := <-polled:
+		if ns != c.Sender() {
+			t.Errorf("OnPoll called with another Sender")
+		}
+	case <-timeout:
+		t.Fatalf("OnPoll not called")
+	}
+	select {
+	case v := <-vars:
+		if v["Light"] != "On" {
+			t.Errorf("unexpected vars: %v", v)
+		}
+	case <-timeout:
+		t.Fatalf("OnVars not called")
+	}
+	select {
+	case m := <-modes:
+		if m != "Paused" {
+			t.Errorf("unexpected mode: got %s, want Paused", m)
+		}
+	case <-timeout:
+		t.Fatalf("OnMode not called")
+	}
+
+	cancel()
+	err = <-done
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+	if !errors.Is(c.Sender().Close(context.Background()), netsender.ErrClosed) {
+		t.Errorf("expected Sender to be closed")
+	}
+}
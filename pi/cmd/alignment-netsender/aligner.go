@@ -60,6 +60,14 @@ const (
 	defaultRefAngle = 90
 )
 
+// defaultMinFitQuality is the default minimum calibration fit quality (R²)
+// below which a calibration is rejected.
+const defaultMinFitQuality = 0.5
+
+// errPoorFit is returned by calibrate when the calibration fit quality is
+// below the minimum, in which case the previous calibration is kept.
+var errPoorFit = errors.New("calibration fit quality below minimum")
+
 // Amount of time to wait before doing anything if in error state.
 const errStateWait = 5 * time.Second
 
@@ -130,9 +138,11 @@ type CPEAligner struct {
 	log           logging.Logger
 	calSignal     chan struct{}
 
-	mu       sync.Mutex
-	refAngle float64     // Holds a reference servo angle that corresponded to best CPE position.
-	ctrl     *controller // Controller for determining servo correction.
+	mu         sync.Mutex
+	refAngle   float64     // Holds a reference servo angle that corresponded to best CPE position.
+	ctrl       *controller // Controller for determining servo correction.
+	fitQuality float64     // Holds the fit quality (R²) of the latest calibration attempt.
+	minQuality float64     // Minimum fit quality for a calibration to be adopted.
 }
 
 // NewCPEAligner returns a new CPEAligner adopting the provided logging.Logger
@@ -151,6 +161,7 @@ func NewCPEAligner(l logging.Logger, link Link) (*CPEAligner, error) {
 	return &CPEAligner{
 		ctrl:          newController(defaultCoeff, defaultThres),
 		refAngle:      defaultRefAngle,
+		minQuality:    defaultMinFitQuality,
 		log:           l,
 		mag:           m,
 		servo:         s,
@@ -175,6 +186,10 @@ func (a *CPEAligner) Align() {
 		case <-a.calSignal:
 			a.log.Info("got calibrate signal")
 			err := a.calibrate()
+			if errors.Is(err, errPoorFit) {
+				a.log.Warning("rejected calibration, keeping previous", "error", err)
+				continue
+			}
 			if err != nil {
 				a.errState("could not calibrate", "error", err)
 				continue
@@ -211,6 +226,8 @@ func (a *CPEAligner) Align() {
 // magnetometer and signal strength stats are collected. Polynomials are then
 // fitted to the data and "best signal" angle is derived to be set as a
 // reference angle. The fitted calibration data is finally saved.
+// If the fit quality is below the minimum, errPoorFit is returned and the
+// previous calibration is kept.
 func (a *CPEAligner) calibrate() error {
 	res, err := a.Sweep()
 	if err != nil {
@@ -224,18 +241,32 @@ func (a *CPEAligner) calibrate() error {
 		}
 	}
 
-	a.cal, _, err = res.Fit()
+	cal, _, err := res.Fit()
 	if err != nil {
 		return fmt.Errorf("could not fit data: %w", err)
 	}
 
 	if canPlot {
-		err = calibration.PlotFitResults(res, a.cal)
+		err = calibration.PlotFitResults(res, cal)
 		if err != nil {
 			return fmt.Errorf("could not plot fit results: %w", err)
 		}
 	}
 
+	q, err := res.Quality(cal)
+	if err != nil {
+		return fmt.Errorf("could not get fit quality: %w", err)
+	}
+	a.log.Info("got calibration fit quality", "magX", q.MagX, "magY", q.MagY, "signal", q.Signal)
+	a.mu.Lock()
+	a.fitQuality = q.Min()
+	min := a.minQuality
+	a.mu.Unlock()
+	if q.Min() < min {
+		return fmt.Errorf("%w: %f < %f", errPoorFit, q.Min(), min)
+	}
+	a.cal = cal
+
 	ref, err := a.cal.BestSignalAngle()
 	if err != nil {
 		return fmt.Errorf("could not get servo angle corresponding to best signal: %w", err)
@@ -501,6 +532,29 @@ func (a *CPEAligner) MedianError() float64 {
 	return me
 }
 
+// FitQuality returns the fit quality (R²) of the latest calibration attempt,
+// whether or not it was adopted.
+// Concurrency safe.
+func (a *CPEAligner) FitQuality() float64 {
+	a.mu.Lock()
+	q := a.fitQuality
+	a.mu.Unlock()
+	return q
+}
+
+// SetMinFitQuality sets the minimum fit quality (R²) for a calibration to be
+// adopted.
+// Concurrency safe.
+func (a *CPEAligner) SetMinFitQuality(q float64) error {
+	if q < 0 || 1 < q {
+		return errors.New("minimum fit quality not within valid range of 0-1")
+	}
+	a.mu.Lock()
+	a.minQuality = q
+	a.mu.Unlock()
+	return nil
+}
+
 // SetRefAngle allows for manual setting of the CPEAligners reference angle.
 // Concurrency safe.
 func (a *CPEAligner) SetRefAngle(t float64) error {
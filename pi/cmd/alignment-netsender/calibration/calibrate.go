@@ -125,3 +125,33 @@ func (cr *Results) AngleFromMag(x, y float64) (float64, error) {
 	}
 	return cr.Angles[minDstIdx], nil
 }
+
+// Quality holds the coefficients of determination (R²) of the fits to the
+// magnetometer axis values and signal strength values. A value of 1
+// indicates a perfect fit.
+type Quality struct {
+	MagX, MagY, Signal float64
+}
+
+// Min returns the worst of the fit qualities.
+func (q Quality) Min() float64 {
+	return math.Min(q.MagX, math.Min(q.MagY, q.Signal))
+}
+
+// Quality returns the quality of the given fitted Results, as returned by Fit,
+// relative to the raw data points held by cr. A poor quality indicates a noisy
+// sweep, e.g., one performed while the link was dropping.
+func (cr *Results) Quality(fitted *Results) (Quality, error) {
+	n := len(cr.Angles)
+	if n == 0 {
+		return Quality{}, errors.New("no data points")
+	}
+	if len(fitted.MagX) != n || len(fitted.MagY) != n || len(fitted.Signal) != n {
+		return Quality{}, errors.New("fitted results do not match raw results")
+	}
+	return Quality{
+		MagX:   rSquared(cr.MagX, fitted.MagX),
+		MagY:   rSquared(cr.MagY, fitted.MagY),
+		Signal: rSquared(cr.Signal, fitted.Signal),
+	}, nil
+}
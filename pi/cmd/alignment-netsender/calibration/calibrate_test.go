@@ -155,3 +155,53 @@ func TestPlot(t *testing.T) {
 		t.Errorf("could not plot fitted results: %v", err)
 	}
 }
+
+// TestQuality checks that fit quality is high for the sample data, perfect for
+// data that is exactly polynomial, and low for noisy data.
+func TestQuality(t *testing.T) {
+	c := &Results{
+		Angles: anglesSample,
+		MagX:   magXSample,
+		MagY:   magYSample,
+		Signal: signalSample,
+	}
+	fitted, _, err := c.Fit()
+	if err != nil {
+		t.Fatalf("could not fit data: %v", err)
+	}
+	q, err := c.Quality(fitted)
+	if err != nil {
+		t.Fatalf("could not get fit quality: %v", err)
+	}
+	if q.Min() < 0.5 || q.Min() > 1 {
+		t.Errorf("unexpected fit quality for sample data: %+v", q)
+	}
+
+	perfect := NewResults(0)
+	noisy := NewResults(0)
+	for i := 0; i < 180; i++ {
+		x := float64(i)
+		perfect.Add(x, x, x*x, 2*x+1)
+		noisy.Add(x, x, x*x, float64((i*7919)%13))
+	}
+	for _, test := range []struct {
+		name string
+		res  *Results
+		ok   func(Quality) bool
+	}{
+		{name: "perfect", res: perfect, ok: func(q Quality) bool { return q.Min() > 0.9999 }},
+		{name: "noisy", res: noisy, ok: func(q Quality) bool { return q.Signal < 0.5 }},
+	} {
+		fitted, _, err := test.res.Fit()
+		if err != nil {
+			t.Fatalf("could not fit %s data: %v", test.name, err)
+		}
+		q, err := test.res.Quality(fitted)
+		if err != nil {
+			t.Fatalf("could not get fit quality for %s data: %v", test.name, err)
+		}
+		if !test.ok(q) {
+			t.Errorf("unexpected fit quality for %s data: %+v", test.name, q)
+		}
+	}
+}
@@ -67,3 +67,27 @@ func vandermonde(a []float64, degree int) *mat.Dense {
 	}
 	return x
 }
+
+// rSquared returns the coefficient of determination of the fitted values
+// relative to the observed values y. A value of 1 indicates a perfect fit,
+// while values near or below 0 indicate the fit explains none of the variance.
+func rSquared(y, fitted []float64) float64 {
+	var mean float64
+	for _, v := range y {
+		mean += v
+	}
+	mean /= float64(len(y))
+
+	var ssRes, ssTot float64
+	for i, v := range y {
+		ssRes += (v - fitted[i]) * (v - fitted[i])
+		ssTot += (v - mean) * (v - mean)
+	}
+	if ssTot == 0 {
+		if ssRes == 0 {
+			return 1
+		}
+		return 0
+	}
+	return 1 - ssRes/ssTot
+}
@@ -34,17 +34,19 @@ LICENSE
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"math"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	"time"
+	"syscall"
 
-	"github.com/ausocean/client/pi/netlogger"
+	"github.com/ausocean/client/pi/client"
+	"github.com/ausocean/client/pi/logsend"
 	"github.com/ausocean/client/pi/netsender"
 	"github.com/ausocean/utils/logging"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 // Logging configuration.
@@ -57,12 +59,6 @@ const (
 	logSuppress  = false
 )
 
-// Sleep times.
-const (
-	netSendRetryTime = 5 * time.Second
-	defaultSleepTime = 60 * time.Second
-)
-
 // Software defined pins.
 const (
 	pinMedianAlignErr = "X23"
@@ -72,8 +68,18 @@ const (
 	pinLinkNoise      = "X27"
 	pinLinkBitrate    = "X28"
 	pinRefAngle       = "X29"
+	pinFitQuality     = "X31"
 )
 
+// Metadata for software defined pins, so that the cloud can recover the
+// floats which are multiplied by 1000 before sending.
+var pinMeta = map[string]netsender.PinMeta{
+	pinMedianAlignErr: {Units: "°", Description: "median alignment error"},
+	pinErrorStdDev:    {Units: "°", Scale: 1000, Description: "alignment error standard deviation"},
+	pinRefAngle:       {Units: "°", Description: "aligner reference angle"},
+	pinFitQuality:     {Scale: 1000, Description: "calibration fit quality"},
+}
+
 // Default link configuration.
 const (
 	defaultDevice = "wlan0"
@@ -157,6 +163,21 @@ var variables = []struct {
 			return nil
 		},
 	},
+	{
+		name: "MinFitQuality",
+		typ:  "float",
+		update: func(a *CPEAligner, v string) error {
+			q, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("could not convert MinFitQuality variable value to float: %w", err)
+			}
+			err = a.SetMinFitQuality(q)
+			if err != nil {
+				return fmt.Errorf("could not set minimum fit quality: %w", err)
+			}
+			return nil
+		},
+	},
 	{
 		name: "LinkConfig",
 		typ:  "string",
@@ -195,16 +216,14 @@ func createVarMap() map[string]string {
 }
 
 func main() {
-	fileLog := &lumberjack.Logger{
-		Filename:   logPath,
-		MaxSize:    logMaxSize,
-		MaxBackups: logMaxBackup,
-		MaxAge:     logMaxAge,
+	// Create a log sender to handle logging to file and to the cloud.
+	logSender, err := logsend.New(logsend.WithFile(logPath, logMaxSize, logMaxBackup, logMaxAge), logsend.WithStream())
+	if err != nil {
+		panic("could not create log sender: " + err.Error())
 	}
 
-	netLog := netlogger.New()
-
-	log := logging.New(logVerbosity, io.MultiWriter(fileLog, netLog), logSuppress)
+	// Create logger that we call methods on to log, which in turn writes to the log sender.
+	log := logging.New(logVerbosity, logSender, logSuppress)
 
 	l, err := newLink(defaultDevice, defaultIP, defaultPort, defaultUser, defaultPass)
 	if err != nil {
@@ -218,82 +237,48 @@ func main() {
 	}
 
 	log.Debug("initialising netsender client")
-	ns, err := netsender.New(log, nil, readPin(aligner, log), nil)
+	c, err := client.New(log,
+		client.OnPinRead(readPin(aligner, log)),
+		client.OnVars(updateVars(aligner, log)),
+		client.WithLogSender(logSender),
+		client.WithSenderOptions(netsender.WithPinMetadata(pinMeta)),
+	)
 	if err != nil {
 		log.Fatal("could not initialise netsender client: " + err.Error())
 	}
 
-	run(aligner, ns, log, netLog)
-}
-
-// run starts the main loop. This will run netsender on every pass of the loop
-// (sleeping inbetween), check vars, and if changed, update the CPE aligner as appropriate.
-func run(aligner *CPEAligner, ns *netsender.Sender, l *logging.JSONLogger, nl *netlogger.Logger) {
 	go aligner.Align()
 
-	var vs int
-	for {
-		l.Debug("running netsender")
-		err := ns.Run()
-		if err != nil {
-			l.Warning("Run Failed. Retrying...", "error", err.Error())
-			time.Sleep(netSendRetryTime)
-			continue
-		}
-
-		l.Debug("sending logs")
-		err = nl.Send(ns)
-		if err != nil {
-			l.Warning("Logs could not be sent", "error", err.Error())
-		}
-
-		l.Debug("checking varsum")
-		newVs := ns.VarSum()
-		if vs == newVs {
-			sleep(ns, l)
-			continue
-		}
-		vs = newVs
-		l.Info("varsum changed", "vs", vs)
-
-		l.Debug("getting new vars")
-		vars, err := ns.Vars()
-		if err != nil {
-			l.Error("netSender failed to get vars", "error", err.Error())
-			time.Sleep(netSendRetryTime)
-			continue
-		}
-		l.Debug("got new vars", "vars", vars)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	c.Run(ctx)
+}
 
-		// Var sum has changed, so loop through variables []struct and use each variables
-		// Update func to update the appropriate fields of the aligner.
+// updateVars returns a function, called with the vars whenever they
+// change, which updates the aligner with each changed variable, so that
+// unchanged settings, such as the link config, are not re-applied. A
+// variable whose update fails is retried when the vars next change.
+func updateVars(aligner *CPEAligner, l *logging.JSONLogger) func(vars map[string]string) {
+	prev := make(map[string]string)
+	return func(vars map[string]string) {
 		for _, value := range variables {
-			if v, ok := vars[value.name]; ok && value.update != nil {
-				err := value.update(aligner, v)
-				if err != nil {
-					l.Warning("could not update variable", "name", value.name, "error", err)
-				}
+			v, ok := vars[value.name]
+			if !ok || value.update == nil {
+				continue
+			}
+			if p, seen := prev[value.name]; seen && p == v {
+				continue
 			}
+			err := value.update(aligner, v)
+			if err != nil {
+				l.Warning("could not update variable", "name", value.name, "error", err)
+				continue
+			}
+			prev[value.name] = v
 		}
-
-		sleep(ns, l)
 	}
 }
 
-// sleep uses a delay to halt the program based on the monitoring period
-// netsender parameter (mp) defined in the netsender.conf config.
-func sleep(ns *netsender.Sender, l *logging.JSONLogger) {
-	l.Debug("sleeping")
-	mp, err := strconv.Atoi(ns.Param("mp"))
-	t := time.Duration(mp) * time.Second
-	if err != nil {
-		l.Error("could not get sleep time, using default", "error", err)
-		t = defaultSleepTime
-	}
-	time.Sleep(t)
-	l.Debug("finished sleeping")
-}
-
 // readPin provides a callback function of consistent signature for use by
 // netsender to retrieve software defined pin values e.g. revid bitrate.
 // Here we report the median difference of bearing with target bearing.
@@ -316,7 +301,8 @@ func readPin(aligner *CPEAligner, log *logging.JSONLogger) func(pin *netsender.P
 				log.Error("could not get link signal strength", "error", err)
 				return nil
 			}
-			pin.Value = v
+			// Signal strength is in dBm, so may legitimately be -1.
+			pin.SetValue(v)
 			log.Info("sending signal strength", "strength", pin.Value)
 		case pinLinkQuality:
 			v, err := aligner.LinkQuality()
@@ -332,7 +318,7 @@ func readPin(aligner *CPEAligner, log *logging.JSONLogger) func(pin *netsender.P
 				log.Error("could not get link noise", "error", err)
 				return nil
 			}
-			pin.Value = v
+			pin.SetValue(v)
 			log.Info("sending link noise", "noise", pin.Value)
 		case pinLinkBitrate:
 			v, err := aligner.LinkBitrate()
@@ -345,6 +331,11 @@ func readPin(aligner *CPEAligner, log *logging.JSONLogger) func(pin *netsender.P
 		case pinRefAngle:
 			pin.Value = int(math.Round(aligner.RefAngle()))
 			log.Info("sending aligner reference angle", "angle", pin.Value)
+		case pinFitQuality:
+			// As with the error standard deviation, multiply by 1000 so the
+			// cloud can recover a float.
+			pin.Value = int(math.Round(aligner.FitQuality() * 1000))
+			log.Info("sending calibration fit quality", "quality", pin.Value)
 		default:
 			log.Warning("unknown pin specified for device", "name", pin.Name)
 		}
@@ -39,14 +39,15 @@ import (
 	"errors"
 	"flag"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"time"
 
 	//TODO: Investigate broken dependancy
 	dht "github.com/d2r2/go-dht"
 
+	"github.com/ausocean/client/pi/logsend"
 	"github.com/ausocean/client/pi/netsender"
-	"github.com/ausocean/client/pi/smartlogger"
 	"github.com/ausocean/utils/filemap"
 	"github.com/ausocean/utils/logging"
 )
@@ -108,8 +109,11 @@ func main() {
 		validLogLevel = false
 	}
 
-	logSender := smartlogger.New(logPath)
-	log = logging.New(int8(logLevel), &logSender.LogRoller, true)
+	logSender, err := logsend.New(logsend.WithFile(filepath.Join(logPath, "netsender.log"), 0, 0, 0))
+	if err != nil {
+		panic("could not create log sender: " + err.Error())
+	}
+	log = logging.New(int8(logLevel), logSender, true)
 	log.Info("log-netsender: Logger Initialized")
 	if !validLogLevel {
 		log.Error("Invalid log level was defaulted to Info")
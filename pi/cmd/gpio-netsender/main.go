@@ -31,15 +31,13 @@ package main
 
 import (
 	"flag"
-	"io"
 	"os"
 	"time"
 
 	_ "github.com/kidoman/embd/host/all"
-	"gopkg.in/natefinch/lumberjack.v2"
 
 	"github.com/ausocean/client/pi/gpio"
-	"github.com/ausocean/client/pi/netlogger"
+	"github.com/ausocean/client/pi/logsend"
 	"github.com/ausocean/client/pi/netsender"
 	"github.com/ausocean/client/pi/sds"
 	"github.com/ausocean/utils/logging"
@@ -71,20 +69,14 @@ func main() {
 		logVerbosity = logging.Debug
 	}
 
-	// Create lumberjack logger to handle logging to file.
-	fileLog := &lumberjack.Logger{
-		Filename:   logPath,
-		MaxSize:    logMaxSize,
-		MaxBackups: logMaxBackup,
-		MaxAge:     logMaxAge,
+	// Create a log sender to handle logging to file and to the cloud.
+	logSender, err := logsend.New(logsend.WithFile(logPath, logMaxSize, logMaxBackup, logMaxAge), logsend.WithStream())
+	if err != nil {
+		panic("could not create log sender: " + err.Error())
 	}
 
-	// Create netlogger to handle logging to cloud.
-	netLog := netlogger.New()
-
-	// Create logger that we call methods on to log, which in turn writes to the
-	// lumberjack and netloggers.
-	log := logging.New(logVerbosity, io.MultiWriter(fileLog, netLog), logSuppress)
+	// Create logger that we call methods on to log, which in turn writes to the log sender.
+	log := logging.New(logVerbosity, logSender, logSuppress)
 
 	var init netsender.PinInit
 	var read netsender.PinReadWrite = sds.ReadSystem
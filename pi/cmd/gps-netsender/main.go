@@ -31,6 +31,7 @@ import (
 	"flag"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -38,8 +39,8 @@ import (
 	"github.com/adrianmo/go-nmea"
 	"github.com/jacobsa/go-serial/serial"
 
+	"github.com/ausocean/client/pi/logsend"
 	"github.com/ausocean/client/pi/netsender"
-	"github.com/ausocean/client/pi/smartlogger"
 	"github.com/ausocean/utils/logging"
 )
 
@@ -104,8 +105,11 @@ func main() {
 	}
 
 	// Create logger
-	logSender := smartlogger.New(*logPath)
-	log = logging.New(int8(*logLevel), &logSender.LogRoller, true)
+	logSender, err := logsend.New(logsend.WithFile(filepath.Join(*logPath, "netsender.log"), 0, 0, 0))
+	if err != nil {
+		panic("could not create log sender: " + err.Error())
+	}
+	log = logging.New(int8(*logLevel), logSender, true)
 	log.Info( "log-netsender: Logger Initialized")
 	if !validLogLevel {
 		log.Error( "Invalid log level was defaulted to Info")
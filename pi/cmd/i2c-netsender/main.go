@@ -27,20 +27,23 @@ LICENSE
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"math"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/kidoman/embd"
 	_ "github.com/kidoman/embd/host/rpi"
-	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 
+	"github.com/ausocean/client/pi/client"
 	"github.com/ausocean/client/pi/gpio"
-	"github.com/ausocean/client/pi/netlogger"
+	"github.com/ausocean/client/pi/logsend"
 	"github.com/ausocean/client/pi/netsender"
 	"github.com/ausocean/utils/logging"
 )
@@ -55,12 +58,6 @@ const (
 	logSuppress  = true
 )
 
-// Netsender timeouts.
-const (
-	netSendRetryTime = 5 * time.Second
-	defaultSleepTime = 60 // Seconds
-)
-
 // Software defined pins for netsender and cloud use.
 const (
 	salinityPin    = "X35"
@@ -89,85 +86,32 @@ const (
 const floatAccuracy = 1000
 
 func main() {
-	// Create lumberjack logger to handle logging to file.
-	fileLog := &lumberjack.Logger{
-		Filename:   logPath,
-		MaxSize:    logMaxSize,
-		MaxBackups: logMaxBackup,
-		MaxAge:     logMaxAge,
+	// Create a log sender to handle logging to file and to the cloud.
+	logSender, err := logsend.New(logsend.WithFile(logPath, logMaxSize, logMaxBackup, logMaxAge), logsend.WithStream())
+	if err != nil {
+		panic("could not create log sender: " + err.Error())
 	}
 
-	// Create netlogger to handle logging to cloud.
-	netLog := netlogger.New()
-
-	// Create logger that we call methods on to log, which in turn writes to the
-	// lumberjack and netloggers.
-	log := logging.New(logVerbosity, io.MultiWriter(fileLog, netLog), logSuppress)
+	// Create logger that we call methods on to log, which in turn writes to the log sender.
+	log := logging.New(logVerbosity, logSender, logSuppress)
 
 	// The netsender client will handle communication with netreceiver and GPIO stuff.
 	log.Debug("initialising netsender client")
-	ns, err := netsender.New(log, gpio.InitPin, readPin(log), gpio.WritePin, nil)
+	c, err := client.New(log,
+		client.OnPinInit(gpio.InitPin),
+		client.OnPinRead(readPin(log)),
+		client.OnPinWrite(gpio.WritePin),
+		client.WithLogSender(logSender),
+	)
 	if err != nil {
 		log.Fatal("could not initialise netsender client", "error", err)
 	}
 
 	// Start the control loop.
 	log.Debug("starting control loop")
-	run(ns, log, netLog)
-}
-
-// run starts a control loop that runs netsender, sends logs, checks for var changes.
-func run(ns *netsender.Sender, l logging.Logger, nl *netlogger.Logger) {
-	var vs int
-
-	for {
-		l.Debug("running netsender")
-		err := ns.Run()
-		if err != nil {
-			l.Warning("run failed. Retrying...", "error", err)
-			time.Sleep(netSendRetryTime)
-			continue
-		}
-
-		l.Debug("sending logs")
-		err = nl.Send(ns)
-		if err != nil {
-			l.Warning("Logs could not be sent", "error", err)
-		}
-
-		l.Debug("checking varsum")
-		newVs := ns.VarSum()
-		if vs == newVs {
-			sleep(ns, l)
-			continue
-		}
-		vs = newVs
-		l.Info("varsum changed", "vs", vs)
-
-		l.Debug("getting new vars")
-		vars, err := ns.Vars()
-		if err != nil {
-			l.Error("netSender failed to get vars", "error", err)
-			time.Sleep(netSendRetryTime)
-			continue
-		}
-		l.Info("got new vars", "vars", vars)
-
-		sleep(ns, l)
-	}
-}
-
-// sleep uses a delay to halt the program based on the monitoring period
-// netsender parameter (mp) defined in the netsender.conf config.
-func sleep(ns *netsender.Sender, l logging.Logger) {
-	l.Debug("sleeping")
-	t, err := strconv.Atoi(ns.Param("mp"))
-	if err != nil {
-		l.Error("could not get sleep time, using default", "error", err)
-		t = defaultSleepTime
-	}
-	time.Sleep(time.Duration(t) * time.Second)
-	l.Debug("finished sleeping")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	c.Run(ctx)
 }
 
 // readPin provides a callback function of consistent signature for use by
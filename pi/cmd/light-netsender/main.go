@@ -27,23 +27,20 @@ LICENSE
 package main
 
 import (
-	"io"
-	"strconv"
-	"time"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/ausocean/client/pi/client"
 	"github.com/ausocean/client/pi/gpio"
-	"github.com/ausocean/client/pi/netlogger"
+	"github.com/ausocean/client/pi/logsend"
 	"github.com/ausocean/client/pi/netsender"
 	"github.com/ausocean/utils/logging"
 	_ "github.com/kidoman/embd/host/rpi"
-	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 )
 
-const (
-	netSendRetryTime = 5 * time.Second
-	defaultSleepTime = 60 // Seconds
-	pkg              = "light-netsender: "
-)
+const pkg = "light-netsender: "
 
 // Logging configuration.
 const (
@@ -66,131 +63,79 @@ const (
 var varMap = map[string]string{"lightFlashingMode": "enum:" + modeOff + "," + modeOn + "," + modeFlashing}
 
 func main() {
-	// Create lumberjack logger to handle logging to file.
-	fileLog := &lumberjack.Logger{
-		Filename:   logPath,
-		MaxSize:    logMaxSize,
-		MaxBackups: logMaxBackup,
-		MaxAge:     logMaxAge,
+	// Create a log sender to handle logging to file and to the cloud.
+	logSender, err := logsend.New(logsend.WithFile(logPath, logMaxSize, logMaxBackup, logMaxAge), logsend.WithStream())
+	if err != nil {
+		panic("could not create log sender: " + err.Error())
 	}
 
-	// Create netlogger to handle logging to cloud.
-	netLog := netlogger.New()
-
-	// Create logger that we call methods on to log, which in turn writes to the
-	// lumberjack and netloggers.
-	log := logging.New(logVerbosity, io.MultiWriter(fileLog, netLog), logSuppress)
+	// Create logger that we call methods on to log, which in turn writes to the log sender.
+	log := logging.New(logVerbosity, logSender, logSuppress)
 
 	// The netsender client will handle communication with netreceiver and GPIO control.
 	log.Debug("initialising netsender client")
-	ns, err := netsender.New(log, gpio.InitPin, nil, gpio.WritePin, netsender.WithVarTypes(varMap))
+	c, err := client.New(log,
+		client.OnPinInit(gpio.InitPin),
+		client.OnPinWrite(gpio.WritePin),
+		client.OnVars(func(vars map[string]string) { setLight(vars, log) }),
+		client.WithLogSender(logSender),
+		client.WithSenderOptions(netsender.WithVarTypes(varMap)),
+	)
 	if err != nil {
 		log.Fatal("could not initialise netsender client", "error", err)
 	}
 
 	// Start the control loop.
 	log.Debug("starting control loop")
-	run(ns, log, netLog)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	c.Run(ctx)
 }
 
-// run starts a control loop that runs netsender, sends logs, checks for var changes, and
-// if var changes, changes current lightFlashingMode (Off, On, Flashing).
-func run(ns *netsender.Sender, l logging.Logger, nl *netlogger.Logger) {
-	var vs int
-	for {
-		l.Debug("running netsender")
-		err := ns.Run()
-		if err != nil {
-			l.Warning("run failed. Retrying...", "error", err)
-			time.Sleep(netSendRetryTime)
-			continue
-		}
+// setLight changes the current lightFlashingMode (Off, On, Flashing) of
+// the lightModePin according to the vars.
+func setLight(vars map[string]string, l logging.Logger) {
+	modePin, modePinOk := vars["lightModePin"]
+	mode, flashingModeOk := vars["lightFlashingMode"]
+	if !modePinOk || !flashingModeOk {
+		l.Info(pkg + "either lightModePin or lightFlashingMode doesn't exist")
+		return
+	}
 
-		l.Debug("sending logs")
-		err = nl.Send(ns)
-		if err != nil {
-			l.Warning(pkg+"logs could not be sent", "error", err)
-		}
+	if modePin == "" || mode == "" {
+		l.Warning(pkg + "either lightModePin or lightFlashingMode is empty")
+		return
+	}
 
-		l.Debug("checking varsum")
-		newVs := ns.VarSum()
-		if vs == newVs {
-			sleep(ns, l)
-			continue
-		}
-		vs = newVs
-		l.Info(pkg+"varsum changed", "vs", vs)
+	p := &netsender.Pin{Name: modePin}
+	err := gpio.InitPin(p, netsender.PinOut)
+	if err != nil {
+		l.Error(pkg+"failed to initialise pin", "error", err)
+		return
+	}
 
-		l.Debug("getting new vars")
-		vars, err := ns.Vars()
+	// Checking lightFlashingMode from VidGrind and changing pin for different cases.
+	switch mode {
+	case modeOff:
+		p.Value = 0
+		err = gpio.WritePin(p)
 		if err != nil {
-			l.Error(pkg+"netSender failed to get vars", "error", err)
-			time.Sleep(netSendRetryTime)
-			continue
-		}
-		l.Info(pkg+"got new vars", "vars", vars)
-
-		modePin, modePinOk := vars["lightModePin"]
-		mode, flashingModeOk := vars["lightFlashingMode"]
-		if !modePinOk || !flashingModeOk {
-			l.Info(pkg+"either lightModePin or lightFlashingMode doesn't exist, sleeping", "error", err)
-			sleep(ns, l)
-			continue
-		}
-
-		if modePin == "" || mode == "" {
-			l.Warning(pkg+"either lightModePin or lightFlashingMode is empty, sleeping", "error", err)
-			sleep(ns, l)
-			continue
+			l.Error(pkg+"error writing 0 to pin", "pin", p.Name, "error", err)
+			return
 		}
-
-		p := &netsender.Pin{Name: modePin}
-		err = gpio.InitPin(p, netsender.PinOut)
+		l.Info(pkg+"pin turned off", "pin", p.Name)
+	case modeOn:
+		p.Value = 1
+		err = gpio.WritePin(p)
 		if err != nil {
-			l.Error(pkg+"failed to initialise pin", "error", err)
-			sleep(ns, l)
-			continue
+			l.Error(pkg+"error writing 1 to pin", "pin", p.Name, "error", err)
+			return
 		}
-
-		// Checking lightFlashingMode from VidGrind and changing pin for different cases.
-		switch mode {
-		case modeOff:
-			p.Value = 0
-			err = gpio.WritePin(p)
-			if err != nil {
-				l.Error(pkg+"error writing 0 to pin", "pin", p.Name, "error", err)
-				sleep(ns, l)
-				continue
-			}
-			l.Info(pkg+"pin turned off", "pin", p.Name)
-		case modeOn:
-			p.Value = 1
-			err = gpio.WritePin(p)
-			if err != nil {
-				l.Error(pkg+"error writing 1 to pin", "pin", p.Name, "error", err)
-				sleep(ns, l)
-				continue
-			}
-			l.Info(pkg+"pin turned on", "pin", p.Name)
-		case modeFlashing:
-			// TODO: implement flashing mode.
-			l.Warning(pkg+"modeFlashing is not implemented yet and is not valid", "lightFlashingMode", mode)
-		default:
-			l.Warning(pkg+"mode is not valid", "lightFlashingMode", mode)
-		}
-		sleep(ns, l)
-	}
-}
-
-// sleep uses a delay to halt the program based on the monitoring period
-// netsender parameter (mp) defined in the netsender.conf config.
-func sleep(ns *netsender.Sender, l logging.Logger) {
-	l.Debug("sleeping")
-	t, err := strconv.Atoi(ns.Param("mp"))
-	if err != nil {
-		l.Error(pkg+"could not get sleep time, using default", "error", err)
-		t = defaultSleepTime
+		l.Info(pkg+"pin turned on", "pin", p.Name)
+	case modeFlashing:
+		// TODO: implement flashing mode.
+		l.Warning(pkg+"modeFlashing is not implemented yet and is not valid", "lightFlashingMode", mode)
+	default:
+		l.Warning(pkg+"mode is not valid", "lightFlashingMode", mode)
 	}
-	time.Sleep(time.Duration(t) * time.Second)
-	l.Debug("finished sleeping")
 }
@@ -28,18 +28,20 @@ LICENSE
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"strconv"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/kidoman/embd/host/rpi"
-	"gopkg.in/natefinch/lumberjack.v2"
 
-	"github.com/ausocean/client/pi/netlogger"
+	"github.com/ausocean/client/pi/client"
+	"github.com/ausocean/client/pi/logsend"
 	"github.com/ausocean/client/pi/netsender"
 	"github.com/ausocean/client/pi/remote"
 	"github.com/ausocean/utils/logging"
@@ -70,12 +72,8 @@ const (
 	dmesgRead  = "existing remote dmesg log read"
 )
 
-// Netsender timeouts.
-const (
-	netSendRetryTime = 5 * time.Second
-	defaultSleepTime = 60 // Seconds
-	remoteCmdTime    = 20 * time.Second
-)
+// Remote command timeout.
+const remoteCmdTime = 20 * time.Second
 
 // Option defaults.
 const (
@@ -94,21 +92,24 @@ func main() {
 	readExist := flag.Bool("read-exist", defaultReadExisting, "Set true to perform initial reading of existing logs.")
 	flag.Parse()
 
-	// Create loggers to handle logging to file and to the cloud.
-	fileLog := &lumberjack.Logger{
-		Filename:   logPath,
-		MaxSize:    logMaxSize,
-		MaxBackups: logMaxBackup,
-		MaxAge:     logMaxAge,
+	// Create a log sender to handle logging to file and to the cloud.
+	logSender, err := logsend.New(logsend.WithFile(logPath, logMaxSize, logMaxBackup, logMaxAge), logsend.WithStream())
+	if err != nil {
+		panic("could not create log sender: " + err.Error())
 	}
-	netLog := netlogger.New()
-	l := logging.New(logVerbosity, io.MultiWriter(fileLog, netLog), logSuppress)
+
+	// Create logger that we call methods on to log, which in turn writes to the log sender.
+	l := logging.New(logVerbosity, logSender, logSuppress)
 
 	router := remote.New(*user, *pass, *remoteIP)
 
 	// The netsender client will handle communication with netreceiver.
 	l.Debug("initialising netsender client")
-	ns, err := netsender.New(l, nil, readPin(l, router), nil, nil)
+	c, err := client.New(l,
+		client.OnPinRead(readPin(l, router)),
+		client.OnPoll(onPoll(router, l)),
+		client.WithLogSender(logSender),
+	)
 	if err != nil {
 		l.Fatal("could not initialise netsender client", "error", err)
 	}
@@ -126,7 +127,9 @@ func main() {
 
 	// Start the control loop.
 	l.Debug("starting control loop")
-	run(ns, router, l, netLog)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	c.Run(ctx)
 }
 
 // readExisting logs into a remote target via SSH and writes logs into the given logger.
@@ -183,38 +186,25 @@ func logDmesg(router *remote.Remote, l logging.Logger) error {
 	return nil
 }
 
-// run starts a control loop that runs netsender, checks for var changes, performs any updates with new variables, sends logs.
-func run(ns *netsender.Sender, router *remote.Remote, l logging.Logger, nl *netlogger.Logger) {
-	for {
-		err := ns.TestDownload()
+// onPoll returns a function, called after each poll, which tests the
+// network speed and reads any new dmesg logs from the router, which are
+// then sent with the client's logs.
+func onPoll(router *remote.Remote, l logging.Logger) func(ctx context.Context, ns *netsender.Sender) {
+	return func(ctx context.Context, ns *netsender.Sender) {
+		err := ns.TestDownloadContext(ctx)
 		if err != nil {
-			l.Error("could not test download speed: %w", err)
+			l.Error("could not test download speed", "error", err)
 		}
 
-		err = ns.TestUpload()
+		err = ns.TestUploadContext(ctx)
 		if err != nil {
-			l.Error("could not test upload speed: %w", err)
-		}
-
-		l.Debug("running netsender")
-		err = ns.Run()
-		if err != nil {
-			l.Warning("run failed, retrying...", "error", err)
-			time.Sleep(netSendRetryTime)
-			continue
+			l.Error("could not test upload speed", "error", err)
 		}
 
 		err = logRouterDmesg(router, ns, l)
 		if err != nil {
 			l.Error("could not get router logs", "error", err)
 		}
-
-		err = nl.Send(ns)
-		if err != nil {
-			l.Error("could not send logs to cloud", "error", err)
-		}
-
-		sleep(ns, l)
 	}
 }
 
@@ -238,19 +228,6 @@ func logRouterDmesg(router *remote.Remote, ns *netsender.Sender, l logging.Logge
 	return nil
 }
 
-// sleep uses a delay to halt the program based on the monitoring period
-// netsender parameter (mp) defined in the netsender.conf config.
-func sleep(ns *netsender.Sender, l logging.Logger) {
-	l.Debug("sleeping")
-	t, err := strconv.Atoi(ns.Param("mp"))
-	if err != nil {
-		l.Error("could not get sleep time, using default", "error", err)
-		t = defaultSleepTime
-	}
-	time.Sleep(time.Duration(t) * time.Second)
-	l.Debug("finished sleeping")
-}
-
 // readPin provides a callback function of consistent signature for use by
 // netsender to read and update software defined pin values.
 func readPin(l logging.Logger, router *remote.Remote) func(pin *netsender.Pin) error {
@@ -32,13 +32,14 @@ LICENSE
 package main
 
 import (
-	"io"
-	"strconv"
-	"time"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"gopkg.in/natefinch/lumberjack.v2"
 
-	"github.com/ausocean/client/pi/netlogger"
+	"github.com/ausocean/client/pi/client"
+	"github.com/ausocean/client/pi/logsend"
 	"github.com/ausocean/client/pi/netsender"
 	"github.com/ausocean/utils/logging"
 )
@@ -53,25 +54,18 @@ const (
 	logSuppress  = false
 )
 
-// Misc constants.
-const (
-	netSendRetryTime = 5 * time.Second
-	defaultSleepTime = 60 // Seconds.
-	runPreDelay      = 20 * time.Second
-	turbidityPin     = "X34"
-)
+// turbidityPin is the pin on which turbidity is reported.
+const turbidityPin = "X34"
 
 func main() {
-	fileLog := &lumberjack.Logger{
-		Filename:   logPath,
-		MaxSize:    logMaxSize,
-		MaxBackups: logMaxBackup,
-		MaxAge:     logMaxAge,
+	// Create a log sender to handle logging to file and to the cloud.
+	logSender, err := logsend.New(logsend.WithFile(logPath, logMaxSize, logMaxBackup, logMaxAge), logsend.WithStream())
+	if err != nil {
+		panic("could not create log sender: " + err.Error())
 	}
 
-	netLog := netlogger.New()
-
-	log := logging.New(logVerbosity, io.MultiWriter(fileLog, netLog), logSuppress)
+	// Create logger that we call methods on to log, which in turn writes to the log sender.
+	log := logging.New(logVerbosity, logSender, logSuppress)
 
 	log.Debug("initialising turbidity sensor")
 	sensor, err := NewTurbiditySensor(log)
@@ -80,66 +74,14 @@ func main() {
 	}
 
 	log.Debug("initialising netsender client")
-	ns, err := netsender.New(log, nil, readPin(sensor, log), nil)
+	c, err := client.New(log, client.OnPinRead(readPin(sensor, log)), client.WithLogSender(logSender))
 	if err != nil {
 		log.Fatal("could not initialise netsender client", "error", err)
 	}
 
-	run(ns, log, netLog)
-}
-
-// run starts the main loop. This will run netsender on every pass of the loop
-// (sleeping inbetween), check vars, and if changed, update as appropriate.
-func run(ns *netsender.Sender, l logging.Logger, nl *netlogger.Logger) {
-	var vs int
-	for {
-		l.Debug("running netsender")
-		err := ns.Run()
-		if err != nil {
-			l.Warning("run failed, retrying", "error", err)
-			time.Sleep(netSendRetryTime)
-			continue
-		}
-
-		l.Debug("sending logs")
-		err = nl.Send(ns)
-		if err != nil {
-			l.Warning("Logs could not be sent", "error", err)
-		}
-
-		l.Debug("checking VarSum")
-		newVs := ns.VarSum()
-		if vs == newVs {
-			sleep(ns, l)
-			continue
-		}
-		vs = newVs
-		l.Info("VarSum changed", "vs", vs)
-
-		l.Debug("getting new vars")
-		vars, err := ns.Vars()
-		if err != nil {
-			l.Error("netSender failed to get vars", "error", err)
-			time.Sleep(netSendRetryTime)
-			continue
-		}
-		l.Debug("got new vars", "vars", vars)
-
-		sleep(ns, l)
-	}
-}
-
-// sleep uses a delay to halt the program based on the monitoring period
-// netsender parameter (mp) defined in the netsender.conf config.
-func sleep(ns *netsender.Sender, l logging.Logger) {
-	l.Debug("sleeping")
-	t, err := strconv.Atoi(ns.Param("mp"))
-	if err != nil {
-		l.Error("could not get sleep time, using default", "error", err)
-		t = defaultSleepTime
-	}
-	time.Sleep(time.Duration(t) * time.Second)
-	l.Debug("finished sleeping")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	c.Run(ctx)
 }
 
 // readPin provides a callback function of consistent signature for use by
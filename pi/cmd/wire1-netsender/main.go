@@ -32,12 +32,13 @@ import (
 	"errors"
 	"flag"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/yryz/ds18b20"
 
+	"github.com/ausocean/client/pi/logsend"
 	"github.com/ausocean/client/pi/netsender"
-	"github.com/ausocean/client/pi/smartlogger"
 	"github.com/ausocean/utils/logging"
 )
 
@@ -79,8 +80,11 @@ func main() {
 	}
 
 	// Create logger
-	logSender := smartlogger.New(logPath)
-	log = logging.New(int8(logLevel), &logSender.LogRoller, true)
+	logSender, err := logsend.New(logsend.WithFile(filepath.Join(logPath, "netsender.log"), 0, 0, 0))
+	if err != nil {
+		panic("could not create log sender: " + err.Error())
+	}
+	log = logging.New(int8(logLevel), logSender, true)
 	log.Info( "log-netsender: Logger Initialized")
 	if !validLogLevel {
 		log.Error( "Invalid log level was defaulted to Info")
@@ -0,0 +1,359 @@
+/*
+NAME
+  logsend
+
+DESCRIPTION
+  logsend provides a single transport for sending the logs of a netsender
+  client, either streamed from memory or as a backlog of log files.
+
+LICENSE
+  logsend is Copyright (C) 2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with logsend in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+// Package logsend provides a Logger which writes the logs of a netsender
+// client to a local, rotated log file and sends them to the service in
+// one of two ways:
+//
+//   - streamed: messages are buffered in memory and sent as they are
+//     written (see WithStream and the netlogger package), or
+//   - backlog: the log file is rotated periodically and whole log files
+//     are sent, so that logs survive restarts and long outages (see
+//     WithBacklog and the smartlogger package).
+//
+// A Logger is an io.Writer, e.g.,
+//
+//	ls, err := logsend.New(logsend.WithFile(logPath, 500, 10, 28), logsend.WithStream())
+//	if err != nil {
+//		...
+//	}
+//	log := logging.New(logVerbosity, ls, logSuppress)
+//
+// Logs are sent by calling Send after each poll, which the client run
+// loop does (see client.WithLogSender).
+package logsend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ausocean/client/pi/netlogger"
+	"github.com/ausocean/client/pi/netsender"
+	"github.com/ausocean/client/pi/smartlogger"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Defaults.
+const (
+	DefaultMaxSize      = 500            // Maximum size in megabytes of the log file before it is rotated.
+	DefaultMaxBackups   = 10             // Maximum number of rotated log files kept.
+	DefaultMaxAge       = 28             // Maximum age in days of rotated log files kept.
+	DefaultRotatePeriod = 24 * time.Hour // Typical period at which a backlog log file is rotated for sending.
+)
+
+// backlogFile is the name of the log file whose rotated backups are sent
+// as the backlog, as expected by smartlogger.
+const backlogFile = "netsender.log"
+
+// Logger writes logs to a local log file and sends them to the service,
+// either streamed or as a backlog of log files. Logger implements
+// io.Writer, and is safe for concurrent use.
+type Logger struct {
+	w       io.Writer                // Writes to the log file and stream.
+	file    *lumberjack.Logger       // Local log file, or nil.
+	stream  *netlogger.Logger        // Stream, or nil.
+	backlog *smartlogger.Smartlogger // Backlog, or nil.
+
+	mu      sync.Mutex    // Guards the fields below, and serializes backlog sends.
+	period  time.Duration // Backlog rotation period, or 0 to never rotate for sending.
+	rotated time.Time     // Time the backlog log file was last rotated.
+}
+
+// config holds the configuration applied by options.
+type config struct {
+	path       string
+	maxSize    int
+	maxBackups int
+	maxAge     int
+
+	stream     bool
+	streamOpts []netlogger.Option
+
+	backlog        bool
+	period         time.Duration
+	keepLogs       bool
+	compress       bool
+	quota          int64
+	minUpload      int
+	deferStreaming bool
+}
+
+// Option is a functional option for New.
+type Option func(*config) error
+
+// WithFile returns an option that writes logs to the local log file at
+// path, which is rotated once it reaches maxSize megabytes, keeping at
+// most maxBackups rotated files, for at most maxAge days. Zero values
+// select the defaults.
+func WithFile(path string, maxSize, maxBackups, maxAge int) Option {
+	return func(c *config) error {
+		if path == "" {
+			return errors.New("empty log file path")
+		}
+		c.path = path
+		c.maxSize = orDefault(maxSize, DefaultMaxSize)
+		c.maxBackups = orDefault(maxBackups, DefaultMaxBackups)
+		c.maxAge = orDefault(maxAge, DefaultMaxAge)
+		return nil
+	}
+}
+
+// WithStream returns an option that streams logs to the service, buffering
+// unsent logs in memory, configured by opts (see netlogger.New).
+func WithStream(opts ...netlogger.Option) Option {
+	return func(c *config) error {
+		c.stream = true
+		c.streamOpts = append(c.streamOpts, opts...)
+		return nil
+	}
+}
+
+// WithBacklog returns an option that sends logs as a backlog of whole log
+// files, rather than streaming them. The log file, which must be set by
+// WithFile and be named netsender.log, is rotated by Send once per
+// period, and each rotated log file is then sent and deleted (but see
+// WithKeepLogs). A zero period means that the log file is only rotated
+// once it reaches its maximum size. A typical period is
+// DefaultRotatePeriod.
+func WithBacklog(period time.Duration) Option {
+	return func(c *config) error {
+		if period < 0 {
+			return errors.New("negative rotation period")
+		}
+		c.backlog = true
+		c.period = period
+		return nil
+	}
+}
+
+// WithKeepLogs returns an option that keeps backlog log files once they
+// have been sent, in a backups directory, rather than deleting them.
+func WithKeepLogs() Option {
+	return func(c *config) error {
+		c.keepLogs = true
+		return nil
+	}
+}
+
+// WithCompression returns an option that compresses backlog log files
+// with gzip before sending them, which requires a service which accepts
+// gzip log files. By default they are sent uncompressed.
+func WithCompression() Option {
+	return func(c *config) error {
+		c.compress = true
+		return nil
+	}
+}
+
+// WithQuota returns an option that limits the total size in bytes of the
+// backlog log files, deleting the oldest beyond it (see
+// smartlogger.Smartlogger.SetQuota).
+func WithQuota(bytes int64) Option {
+	return func(c *config) error {
+		if bytes < 0 {
+			return errors.New("negative quota")
+		}
+		c.quota = bytes
+		return nil
+	}
+}
+
+// WithMinUploadSpeed returns an option that defers sending backlog log
+// files while the upload speed is below bps bits per second (see
+// smartlogger.Smartlogger.SetMinUploadSpeed).
+func WithMinUploadSpeed(bps int) Option {
+	return func(c *config) error {
+		if bps < 0 {
+			return errors.New("negative upload speed")
+		}
+		c.minUpload = bps
+		return nil
+	}
+}
+
+// WithDeferWhileStreaming returns an option that defers sending backlog
+// log files while the Sender is sending MTS data, e.g., video.
+func WithDeferWhileStreaming() Option {
+	return func(c *config) error {
+		c.deferStreaming = true
+		return nil
+	}
+}
+
+// New returns a Logger configured by the given options. Logs are only
+// written to a local file if WithFile is given, and only sent if WithStream
+// or WithBacklog is given, which are mutually exclusive, since the same
+// logs would otherwise be sent twice.
+func New(options ...Option) (*Logger, error) {
+	var c config
+	for i, o := range options {
+		if o == nil {
+			return nil, errors.New("cannot apply nil option")
+		}
+		err := o(&c)
+		if err != nil {
+			return nil, fmt.Errorf("could not apply option no. %d, %w", i, err)
+		}
+	}
+	if c.stream && c.backlog {
+		return nil, errors.New("cannot both stream logs and send a backlog")
+	}
+
+	l := &Logger{period: c.period, rotated: time.Now()}
+	var ws []io.Writer
+	switch {
+	case c.backlog:
+		if c.path == "" || filepath.Base(c.path) != backlogFile {
+			return nil, errors.New("backlog log file must be set and named " + backlogFile)
+		}
+		sl := smartlogger.New(filepath.Dir(c.path))
+		sl.LogRoller.MaxSize = c.maxSize
+		sl.LogRoller.MaxBackups = c.maxBackups
+		sl.LogRoller.MaxAge = c.maxAge
+		sl.SetKeepLogs(c.keepLogs)
+		sl.SetCompressLogs(c.compress)
+		sl.SetQuota(c.quota)
+		sl.SetMinUploadSpeed(c.minUpload)
+		sl.SetDeferWhileStreaming(c.deferStreaming)
+		l.backlog = sl
+		l.file = &sl.LogRoller
+	case c.path != "":
+		l.file = &lumberjack.Logger{
+			Filename:   c.path,
+			MaxSize:    c.maxSize,
+			MaxBackups: c.maxBackups,
+			MaxAge:     c.maxAge,
+		}
+	}
+	if l.file != nil {
+		ws = append(ws, l.file)
+	}
+	if c.stream {
+		l.stream = netlogger.New(c.streamOpts...)
+		ws = append(ws, l.stream)
+	}
+	l.w = io.MultiWriter(ws...)
+	return l, nil
+}
+
+// orDefault returns v, or def if v is zero.
+func orDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// Write implements io.Writer, writing p to the log file and stream.
+func (l *Logger) Write(p []byte) (int, error) {
+	return l.w.Write(p)
+}
+
+// Send sends unsent logs to the service. Streamed logs are sent as they
+// are by netlogger.Logger.Send. For a backlog, the log file is rotated if
+// the rotation period has elapsed, and rotated log files are then sent,
+// unless sending is deferred. Send does nothing if logs are not sent.
+func (l *Logger) Send(ns *netsender.Sender) error {
+	switch {
+	case l.stream != nil:
+		return l.stream.Send(ns)
+	case l.backlog != nil:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.period != 0 && time.Since(l.rotated) >= l.period {
+			err := l.backlog.Rotate()
+			if err != nil {
+				return fmt.Errorf("could not rotate log file: %w", err)
+			}
+			l.rotated = time.Now()
+		}
+		l.backlog.SendLogs(ns)
+	}
+	return nil
+}
+
+// Flush sends streamed logs which have not been sent, returning the number
+// of bytes sent. Flush satisfies netsender.FlushFunc, so that a Logger may
+// be registered with netsender.Sender.AddFlusher. Backlog log files are
+// not sent by Flush, since they are kept on disk until they can be sent.
+func (l *Logger) Flush(ctx context.Context, ns *netsender.Sender) (int, error) {
+	if l.stream == nil {
+		return 0, ctx.Err()
+	}
+	return l.stream.Flush(ctx, ns)
+}
+
+// SetLevelVar sets the minimum level of streamed messages from the value
+// of the CloudLogLevel var (see netlogger.Logger.SetLevelVar). It has no
+// effect on a backlog, which contains all messages written.
+func (l *Logger) SetLevelVar(v string) error {
+	if l.stream == nil {
+		return nil
+	}
+	return l.stream.SetLevelVar(v)
+}
+
+// Rotate rotates the log file, if any, so that a backlog includes the
+// most recent messages when next sent.
+func (l *Logger) Rotate() error {
+	switch {
+	case l.backlog != nil:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.rotated = time.Now()
+		return l.backlog.Rotate()
+	case l.file != nil:
+		return l.file.Rotate()
+	}
+	return nil
+}
+
+// Dropped returns the number of streamed messages dropped since logs were
+// last sent plus the number of backlog log files deleted to keep within
+// the quota.
+func (l *Logger) Dropped() int {
+	var n int
+	if l.stream != nil {
+		n += l.stream.Dropped()
+	}
+	if l.backlog != nil {
+		n += l.backlog.Dropped()
+	}
+	return n
+}
+
+// Close closes the log file, if any. Streamed logs which have not been
+// sent are not sent (see Flush).
+func (l *Logger) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,176 @@
+/*
+NAME
+  logsend_test.go
+
+LICENSE
+  logsend is Copyright (C) 2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with logsend in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package logsend
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ausocean/client/pi/netsender"
+)
+
+// testLogger implements a netsender.Logger which discards logs.
+type testLogger struct{}
+
+func (testLogger) SetLevel(int8)                    {}
+func (testLogger) Log(int8, string, ...interface{}) {}
+
+// logServer is a test service which records the logs sent on T0.
+type logServer struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (s *logServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/poll" && r.URL.Query().Get("T0") != "" {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Type") == "application/gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = gz
+		}
+		b, _ := io.ReadAll(body)
+		s.mu.Lock()
+		s.logs = append(s.logs, string(b))
+		s.mu.Unlock()
+	}
+	io.WriteString(w, `{"rc":0}`)
+}
+
+// newSender returns a Sender for the service at url with T0 as an input.
+func newSender(t *testing.T, url string) *netsender.Sender {
+	conf := filepath.Join(t.TempDir(), "netsender.conf")
+	err := os.WriteFile(conf, []byte("ma 00:00:00:00:00:01\ndk 10000001\nip T0\nmp 1\nsh "+url+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("could not write config: %v", err)
+	}
+	ns, err := netsender.New(testLogger{}, nil, nil, nil, netsender.WithConfigFile(conf))
+	if err != nil {
+		t.Fatalf("unexpected error from netsender.New: %v", err)
+	}
+	return ns
+}
+
+// TestNew tests that invalid combinations of options are rejected.
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "file", opts: []Option{WithFile(filepath.Join(dir, "a.log"), 0, 0, 0)}},
+		{name: "stream", opts: []Option{WithStream()}},
+		{name: "backlog", opts: []Option{WithFile(filepath.Join(dir, "netsender.log"), 0, 0, 0), WithBacklog(0)}},
+		{name: "stream and backlog", opts: []Option{WithFile(filepath.Join(dir, "netsender.log"), 0, 0, 0), WithStream(), WithBacklog(0)}, wantErr: true},
+		{name: "backlog without file", opts: []Option{WithBacklog(0)}, wantErr: true},
+		{name: "backlog with other file", opts: []Option{WithFile(filepath.Join(dir, "a.log"), 0, 0, 0), WithBacklog(0)}, wantErr: true},
+		{name: "empty file", opts: []Option{WithFile("", 0, 0, 0)}, wantErr: true},
+	}
+	for _, test := range tests {
+		_, err := New(test.opts...)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error: %t", test.name, err, test.wantErr)
+		}
+	}
+}
+
+// TestStream tests that streamed logs are written to the log file and
+// sent by Send.
+func TestStream(t *testing.T) {
+	var svc logServer
+	srv := httptest.NewServer(&svc)
+	defer srv.Close()
+	ns := newSender(t, srv.URL)
+
+	path := filepath.Join(t.TempDir(), "client.log")
+	l, err := New(WithFile(path, 0, 0, 0), WithStream())
+	if err != nil {
+		t.Fatalf("unexpected error from New: %v", err)
+	}
+	defer l.Close()
+	io.WriteString(l, `{"level":"info","message":"hello"}`+"\n")
+
+	err = l.Send(ns)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if len(svc.logs) != 1 || !strings.Contains(svc.logs[0], "hello") {
+		t.Errorf("got logs sent %q, want hello", svc.logs)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(b), "hello") {
+		t.Errorf("got log file %q, error %v, want hello", b, err)
+	}
+}
+
+// TestBacklog tests that the backlog log file is rotated and sent by Send.
+func TestBacklog(t *testing.T) {
+	var svc logServer
+	srv := httptest.NewServer(&svc)
+	defer srv.Close()
+	ns := newSender(t, srv.URL)
+
+	dir := t.TempDir()
+	l, err := New(WithFile(filepath.Join(dir, "netsender.log"), 0, 0, 0), WithBacklog(0))
+	if err != nil {
+		t.Fatalf("unexpected error from New: %v", err)
+	}
+	defer l.Close()
+	io.WriteString(l, "hello\n")
+
+	// The log file is not rotated with a zero period, so nothing is sent.
+	err = l.Send(ns)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if len(svc.logs) != 0 {
+		t.Fatalf("got logs sent %q before rotation, want none", svc.logs)
+	}
+
+	err = l.Rotate()
+	if err != nil {
+		t.Fatalf("unexpected error from Rotate: %v", err)
+	}
+	err = l.Send(ns)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if len(svc.logs) != 1 || svc.logs[0] != "hello\n" {
+		t.Errorf("got logs sent %q, want hello", svc.logs)
+	}
+	backups, _ := filepath.Glob(filepath.Join(dir, "netsender-*"))
+	if len(backups) != 0 {
+		t.Errorf("got backups %v after sending, want none", backups)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+NAME
+  format.go
+
+DESCRIPTION
+  format.go provides the formatting of logs as JSON arrays of log
+  entries for sending.
+
+LICENSE
+  netlogger is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with revid in gpl.txt.  If not, see [GNU licenses](http://www.gnu.org/licenses).
+*/
+
+package netlogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Format is the format in which logs are sent (see WithFormat).
+type Format int
+
+// Log formats.
+//
+// By default, logs are sent as a JSON array of log entries, each of which
+// is a log message as written, i.e., a JSON object with the message's
+// original time and level, plus the boot ID of the device, e.g.,
+//
+//	[{"level":"info","time":"2026-01-02T03:04:05.000Z","message":"started","boot":"6f1e..."}]
+//
+// The boot ID distinguishes the logs of each boot of the device, which
+// is needed to order them correctly if the device clock is reset. Lines
+// which are not JSON objects are sent as entries with the line as the
+// message.
+//
+// The service must accept JSON arrays of log entries on T0. Services
+// which predate this format, and expect the concatenated messages as
+// written, require FormatRaw.
+const (
+	FormatJSON Format = iota // JSON array of log entries, with the boot ID.
+	FormatRaw                // Messages as written, concatenated.
+)
+
+// bootIDFile is the file containing the boot ID on Linux.
+const bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+// bootID returns the boot ID of the device, or an empty string if it is
+// not known.
+var bootID = sync.OnceValue(func() string {
+	b, err := os.ReadFile(bootIDFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+})
+
+// chunk is a JSON array of log entries, formatted from the first n bytes
+// of the logs. A chunk of only blank lines has no data.
+type chunk struct {
+	data []byte
+	n    int
+}
+
+// split formats logs in format f, in chunks of at most max bytes.
+func split(logs []byte, max int, f Format) []chunk {
+	if f == FormatRaw {
+		return splitRaw(logs, max)
+	}
+	return splitJSON(logs, max)
+}
+
+// splitJSON formats logs as JSON arrays of log entries of at most max
+// bytes, unless an entry is longer than max, in which case it is sent
+// alone. If max is zero, logs are not split.
+func splitJSON(logs []byte, max int) []chunk {
+	var chunks []chunk
+	var c chunk
+	for len(logs) != 0 {
+		line := logs
+		if i := bytes.IndexByte(logs, '\n'); i >= 0 {
+			line = logs[:i+1]
+		}
+		logs = logs[len(line):]
+		e := entry(line)
+		if e == nil {
+			c.n += len(line)
+			continue
+		}
+		if max != 0 && c.data != nil && len(c.data)+len(e)+2 > max {
+			c.data = append(c.data, ']')
+			chunks = append(chunks, c)
+			c = chunk{}
+		}
+		if c.data == nil {
+			c.data = append(c.data, '[')
+		} else {
+			c.data = append(c.data, ',')
+		}
+		c.data = append(c.data, e...)
+		c.n += len(line)
+	}
+	if c.data != nil {
+		c.data = append(c.data, ']')
+		chunks = append(chunks, c)
+	} else if c.n != 0 && len(chunks) != 0 {
+		chunks[len(chunks)-1].n += c.n // Trailing blank lines.
+	} else if c.n != 0 {
+		chunks = append(chunks, c) // Only blank lines, so nothing to send.
+	}
+	return chunks
+}
+
+// splitRaw splits logs as written into chunks of at most max bytes,
+// between messages, unless a message is longer than max, in which case
+// it is sent alone. If max is zero, logs are not split.
+func splitRaw(logs []byte, max int) []chunk {
+	var chunks []chunk
+	for len(logs) != 0 {
+		n := len(logs)
+		if max != 0 && n > max {
+			n = bytes.LastIndexByte(logs[:max], '\n') + 1
+			if n == 0 {
+				n = bytes.IndexByte(logs, '\n') + 1 // Message longer than max.
+			}
+			if n == 0 {
+				n = len(logs)
+			}
+		}
+		chunks = append(chunks, chunk{data: logs[:n], n: n})
+		logs = logs[n:]
+	}
+	return chunks
+}
+
+// entry returns the log entry for a line of logs, or nil if the line is
+// blank.
+func entry(line []byte) []byte {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil
+	}
+	boot, _ := json.Marshal(bootID())
+	if line[0] == '{' && json.Valid(line) {
+		e := make([]byte, 0, len(line)+len(boot)+8)
+		e = append(e, line[:len(line)-1]...)
+		if len(bytes.TrimSpace(line[1:len(line)-1])) != 0 {
+			e = append(e, ',')
+		}
+		e = append(e, `"boot":`...)
+		e = append(e, boot...)
+		return append(e, '}')
+	}
+	e, _ := json.Marshal(struct {
+		Message string `json:"message"`
+		Boot    string `json:"boot"`
+	}{string(line), bootID()})
+	return e
+}
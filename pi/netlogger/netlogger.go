@@ -28,57 +28,361 @@ LICENSE
 
 // Package netlogger provides a netlogger type which is used for sending log files
 // using netsender.
+//
+// Clients usually use netlogger via the logsend package, which also
+// writes logs to a local file.
 package netlogger
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ausocean/client/pi/netsender"
 	"github.com/ausocean/utils/sliceutils"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 )
 
+// DefaultMaxSize is the default maximum size in bytes of unsent logs.
+const DefaultMaxSize = 1 << 20
+
+// DefaultMaxPayload is the default maximum size in bytes of the logs sent
+// in each request.
+const DefaultMaxPayload = 256 << 10
+
+// LevelVar is the var which sets the minimum level of the messages sent,
+// e.g., "Warning", so that messages which are only needed locally do not
+// use cellular data. An empty value means all messages are sent.
+const LevelVar = "CloudLogLevel"
+
+// levels maps the zap level names in messages to levels.
+var levels = map[string]int8{
+	"debug":  netsender.DebugLevel,
+	"info":   netsender.InfoLevel,
+	"warn":   netsender.WarningLevel,
+	"error":  netsender.ErrorLevel,
+	"dpanic": netsender.ErrorLevel + 1,
+	"panic":  netsender.ErrorLevel + 2,
+	"fatal":  netsender.FatalLevel,
+}
+
 // Logger is used for sending log files using netsender. Logger implements io.Writer.
+// Logger is safe for concurrent use. Unsent logs are limited to a maximum
+// size, beyond which the oldest messages are dropped, e.g., while the
+// service cannot be reached. The number of messages dropped is reported
+// in a warning message when logs are next sent. Messages below the
+// Logger's level are not sent (see SetLevel). Logs which cannot be sent
+// are resent as is, with the same request ID, so that the service can
+// recognise logs it has already received.
 type Logger struct {
-	unsent bytes.Buffer
+	mu       sync.Mutex // Guards unsent, level, maxSize, inflight, snapshot and dropped.
+	unsent   bytes.Buffer
+	level    int8 // Minimum level of messages sent.
+	maxSize  int  // Maximum size of unsent logs, or 0 for no limit.
+	snapshot int  // Bytes of unsent logs being sent.
+	inflight int  // Bytes of unsent logs being sent which have not been sent or dropped.
+	dropped  int  // Messages dropped since logs were last sent.
+
+	sending    sync.Mutex         // Serializes sends, and guards the fields below.
+	spill      *lumberjack.Logger // Spill file, or nil.
+	failures   int                // Consecutive failed sends.
+	maxPayload int                // Maximum size of each send, or 0 for no limit.
+	format     Format             // Format in which logs are sent.
+	retry      *pending           // Chunk of logs whose send failed, or nil.
+}
+
+// pending is a chunk of logs whose send failed. It is resent as is, with
+// the request ID of the failed send, before any other logs, so that the
+// service can discard it if the failed send was in fact received (see
+// netsender.WithRequestID).
+type pending struct {
+	raw  []byte // Logs in the chunk, as written, for spilling.
+	data []byte // Chunk, formatted for sending.
+	id   string // Request ID of the failed send.
+}
+
+// Option is a functional option for New.
+type Option func(*Logger)
+
+// WithMaxSize returns an option that sets the maximum size in bytes of
+// unsent logs. Zero means no limit. The default is DefaultMaxSize.
+func WithMaxSize(n int) Option {
+	return func(l *Logger) {
+		l.maxSize = max(n, 0)
+	}
+}
+
+// WithMaxPayload returns an option that sets the maximum size in bytes
+// of the logs sent in each request. Larger amounts of logs are sent in
+// multiple requests, split between messages. A message which is larger
+// than the maximum is sent alone. Zero means no limit. The default is
+// DefaultMaxPayload.
+func WithMaxPayload(n int) Option {
+	return func(l *Logger) {
+		l.maxPayload = max(n, 0)
+	}
+}
+
+// WithFormat returns an option that sets the format in which logs are
+// sent. The default is FormatJSON, which requires a service which accepts
+// JSON arrays of log entries.
+func WithFormat(f Format) Option {
+	return func(l *Logger) {
+		l.format = f
+	}
+}
+
+// WithLevel returns an option that sets the minimum level of the
+// messages sent (see SetLevel).
+func WithLevel(level int8) Option {
+	return func(l *Logger) {
+		l.level = level
+	}
 }
 
 // New creates a Logger struct.
-func New() *Logger {
-	return &Logger{}
+func New(options ...Option) *Logger {
+	l := &Logger{level: netsender.DebugLevel, maxSize: DefaultMaxSize, maxPayload: DefaultMaxPayload}
+	for _, o := range options {
+		o(l)
+	}
+	return l
 }
 
 // Implements io.Writer.
-// Write stores log data to be sent in a buffer.
+// Write stores log data to be sent in a buffer, dropping the oldest
+// messages if the buffer exceeds the maximum size. Messages below the
+// Logger's level are discarded. Each write must contain whole messages.
 func (l *Logger) Write(p []byte) (n int, err error) {
-	return l.unsent.Write(p)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.level <= netsender.DebugLevel {
+		_, err = l.unsent.Write(p)
+	} else {
+		for rest := p; len(rest) != 0 && err == nil; {
+			msg := rest
+			if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+				msg = rest[:i+1]
+			}
+			rest = rest[len(msg):]
+			if level, ok := messageLevel(msg); ok && level < l.level {
+				continue
+			}
+			_, err = l.unsent.Write(msg)
+		}
+	}
+	if l.maxSize != 0 && l.unsent.Len() > l.maxSize {
+		l.evict(l.unsent.Len() - l.maxSize)
+	}
+	return len(p), err
 }
 
-// Send unsent logs as JSON text to a NetReceiver service when T0
-// is configured as an input, otherwise resets unsent logs.
+// messageLevel returns the level of a JSON log message, and true, or
+// false if it has no known level.
+func messageLevel(msg []byte) (int8, bool) {
+	const key = `"level":"`
+	i := bytes.Index(msg, []byte(key))
+	if i < 0 {
+		return 0, false
+	}
+	name := msg[i+len(key):]
+	j := bytes.IndexByte(name, '"')
+	if j < 0 {
+		return 0, false
+	}
+	level, ok := levels[string(name[:j])]
+	return level, ok
+}
+
+// SetLevel sets the minimum level of the messages sent. Messages written
+// at lower levels are discarded, although they may still be logged
+// elsewhere, e.g., to a file. By default all messages are sent.
+func (l *Logger) SetLevel(level int8) {
+	l.mu.Lock()
+	l.level = level
+	l.mu.Unlock()
+}
+
+// SetLevelVar sets the minimum level of the messages sent from the value
+// of the CloudLogLevel var, which is a log level name, e.g., "Warning"
+// (see netsender.ParseLogLevel), or empty for all messages. SetLevelVar
+// is a netsender.VarFunc, e.g.,
+//
+//	ns.OnVar(netlogger.LevelVar, nl.SetLevelVar)
+func (l *Logger) SetLevelVar(v string) error {
+	if v == "" {
+		l.SetLevel(netsender.DebugLevel)
+		return nil
+	}
+	level, err := netsender.ParseLogLevel(v)
+	if err != nil {
+		return err
+	}
+	l.SetLevel(level)
+	return nil
+}
+
+// evict drops at least n bytes of the oldest messages. l.mu must be held.
+func (l *Logger) evict(n int) {
+	b := l.unsent.Bytes()
+	if i := bytes.IndexByte(b[n-1:], '\n'); i >= 0 {
+		n += i // Drop whole messages.
+	} else {
+		n = len(b)
+	}
+	l.dropped += bytes.Count(b[:n], []byte{'\n'})
+	if n == len(b) && b[n-1] != '\n' {
+		l.dropped++ // Incomplete last message.
+	}
+	l.unsent.Next(n)
+	l.inflight = max(l.inflight-n, 0)
+}
+
+// Dropped returns the number of messages dropped since logs were last
+// sent.
+func (l *Logger) Dropped() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped
+}
+
+// Send unsent logs in the Logger's format, by default a JSON array of log
+// entries, each with its original time and level and the device's boot
+// ID (see Format), to a NetReceiver service when T0 is configured as an
+// input, otherwise resets unsent logs.
 func (l *Logger) Send(ns *netsender.Sender) error {
-	if l.unsent.Len() == 0 {
-		return nil // No logs to send.
+	_, err := l.send(ns, false)
+	return err
+}
+
+// Flush sends unsent logs, returning the number of bytes sent. Flush
+// satisfies netsender.FlushFunc, so that a Logger may be registered with
+// netsender.Sender.AddFlusher.
+func (l *Logger) Flush(ctx context.Context, ns *netsender.Sender) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return l.send(ns, true)
+}
+
+// send implements Send and Flush. If flush is true, unsent logs are
+// spilled if they cannot be sent (see WithSpillFile).
+func (l *Logger) send(ns *netsender.Sender, flush bool) (int, error) {
+	l.sending.Lock()
+	defer l.sending.Unlock()
+
+	// Logs written while sending, e.g., by netsender itself, are retained
+	// for the next send, so we copy the logs rather than holding the lock.
+	l.mu.Lock()
+	var report []byte
+	dropped := l.dropped
+	if dropped != 0 {
+		report = droppedMessage(dropped)
 	}
+	logs := append([]byte(nil), l.unsent.Bytes()...)
+	l.snapshot, l.inflight = len(logs), len(logs)
+	l.mu.Unlock()
 
 	ip := strings.Split(ns.Param("ip"), ",")
 	if !sliceutils.ContainsString(ip, "T0") {
-		l.unsent.Reset()
-		return nil // No pin to send them with.
+		l.retry = nil
+		l.discard(len(logs), dropped)
+		return 0, nil // No pin to send them with.
+	}
+
+	var sent int
+	if l.retry != nil {
+		err := sendLogs(ns, l.retry.data, l.retry.id)
+		if err != nil {
+			return 0, l.failed(err, flush)
+		}
+		sent = len(l.retry.data)
+		l.retry = nil
+	}
+	if len(report)+len(logs) == 0 {
+		drained, err := l.drain(ns) // No unsent logs, so send any spilled logs.
+		return sent + drained, err
 	}
 
-	logs := l.unsent.Bytes()
+	// Each chunk is discarded once it is sent, so that a failure does not
+	// cause chunks to be sent again. A chunk which cannot be sent is kept
+	// to be resent as is.
+	all := append(report, logs...)
+	var n int
+	for _, chunk := range split(all, l.maxPayload, l.format) {
+		var err error
+		id := netsender.NewRequestID()
+		if chunk.data != nil {
+			err = sendLogs(ns, chunk.data, id)
+		}
+		if err != nil {
+			l.retry = &pending{raw: append([]byte(nil), all[n:n+chunk.n]...), data: chunk.data, id: id}
+		} else {
+			sent += len(chunk.data)
+		}
+		n += chunk.n
+		l.discard(n-len(report), dropped)
+		if n >= len(report) {
+			dropped = 0 // Reported.
+		}
+		if err != nil {
+			return sent, l.failed(err, flush)
+		}
+	}
+	l.failures = 0
+	drained, err := l.drain(ns)
+	return sent + drained, err
+}
+
+// failed records a failed send, spilling the unsent logs if there have
+// been too many failures or if flush is true, and returns err, joined
+// with any spill error. l.sending must be held.
+func (l *Logger) failed(err error, flush bool) error {
+	l.failures++
+	if l.spill != nil && (flush || l.failures >= spillFailures) {
+		serr := l.spillUnsent()
+		if serr != nil {
+			err = errors.Join(err, serr)
+		}
+	}
+	return err
+}
+
+// sendLogs sends formatted logs on pin T0, with the given request ID.
+func sendLogs(ns *netsender.Sender, logs []byte, id string) error {
 	pin := netsender.Pin{
 		Name:     "T0",
 		Value:    len(logs),
 		Data:     logs,
 		MimeType: "application/json",
 	}
+	_, _, err := ns.Send(netsender.RequestPoll, []netsender.Pin{pin}, netsender.WithRequestID(id))
+	return err
+}
 
-	_, _, err := ns.Send(netsender.RequestPoll, []netsender.Pin{pin})
-	if err == nil {
-		l.unsent.Reset()
+// discard discards the unsent logs being sent up to offset off, less any
+// which have since been dropped, and the given number of reported drops
+// if off is not negative, i.e., the drops report has been sent.
+func (l *Logger) discard(off, dropped int) {
+	l.mu.Lock()
+	if off < 0 {
+		l.mu.Unlock()
+		return
 	}
+	n := min(max(off-(l.snapshot-l.inflight), 0), l.inflight)
+	l.unsent.Next(n)
+	l.inflight -= n
+	l.dropped = max(l.dropped-dropped, 0)
+	l.mu.Unlock()
+}
 
-	return err
+// droppedMessage returns a JSON warning message, in the format of the
+// other log messages, reporting the number of messages dropped.
+func droppedMessage(n int) []byte {
+	return []byte(fmt.Sprintf(`{"level":"warn","time":"%s","caller":"netlogger/netlogger.go","message":"dropped unsent logs","dropped":%d}`+"\n",
+		time.Now().Format("2006-01-02T15:04:05.000Z0700"), n))
 }
@@ -0,0 +1,490 @@
+/*
+NAME
+  netlogger_test.go
+
+LICENSE
+  netlogger is Copyright (C) 2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netlogger in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netlogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ausocean/client/pi/netsender"
+)
+
+// testLogger implements a netsender.Logger which discards logs.
+type testLogger struct{}
+
+func (testLogger) SetLevel(int8)                    {}
+func (testLogger) Log(int8, string, ...interface{}) {}
+
+// logRequest is a request with logs received by a logServer.
+type logRequest struct {
+	id   string // Request ID.
+	logs string // Logs, as sent.
+	ok   bool   // True if the request succeeded.
+}
+
+// logServer is a test service which records the logs sent on T0. Requests
+// with logs fail while fail is true, after the next ok requests.
+type logServer struct {
+	mu   sync.Mutex
+	fail bool
+	ok   int
+	reqs []logRequest
+}
+
+func (s *logServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/poll" && r.URL.Query().Get("T0") != "" {
+		b, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		fail := s.fail && s.ok == 0
+		if s.ok > 0 {
+			s.ok--
+		}
+		s.reqs = append(s.reqs, logRequest{id: r.Header.Get("X-Netsender-Request-Id"), logs: string(b), ok: !fail})
+		s.mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	io.WriteString(w, `{"rc":0}`)
+}
+
+// setFail sets whether requests with logs fail.
+func (s *logServer) setFail(fail bool) {
+	s.failAfter(0)
+	s.mu.Lock()
+	s.fail = fail
+	s.mu.Unlock()
+}
+
+// failAfter makes requests with logs fail after the next n requests.
+func (s *logServer) failAfter(n int) {
+	s.mu.Lock()
+	s.fail, s.ok = true, n
+	s.mu.Unlock()
+}
+
+// requests returns the requests received so far.
+func (s *logServer) requests() []logRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]logRequest(nil), s.reqs...)
+}
+
+// received returns the messages received by successful requests, in
+// the order received.
+func (s *logServer) received(t *testing.T) []string {
+	var msgs []string
+	for _, r := range s.requests() {
+		if r.ok {
+			msgs = append(msgs, messages(t, r.logs)...)
+		}
+	}
+	return msgs
+}
+
+// messages returns the messages of a JSON array of log entries.
+func messages(t *testing.T, logs string) []string {
+	var entries []struct {
+		Message string `json:"message"`
+	}
+	err := json.Unmarshal([]byte(logs), &entries)
+	if err != nil {
+		t.Fatalf("logs are not a JSON array of entries: %v: %q", err, logs)
+	}
+	var msgs []string
+	for _, e := range entries {
+		msgs = append(msgs, e.Message)
+	}
+	return msgs
+}
+
+// newSender returns a Sender for the service at url with T0 as an input.
+func newSender(t *testing.T, url string) *netsender.Sender {
+	conf := filepath.Join(t.TempDir(), "netsender.conf")
+	err := os.WriteFile(conf, []byte("ma 00:00:00:00:00:01\ndk 10000001\nip T0\nmp 1\nsh "+url+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("could not write config: %v", err)
+	}
+	ns, err := netsender.New(testLogger{}, nil, nil, nil, netsender.WithConfigFile(conf))
+	if err != nil {
+		t.Fatalf("unexpected error from netsender.New: %v", err)
+	}
+	return ns
+}
+
+// newService returns a logServer and a Sender which sends to it.
+func newService(t *testing.T) (*logServer, *netsender.Sender) {
+	svc := &logServer{}
+	srv := httptest.NewServer(svc)
+	t.Cleanup(srv.Close)
+	return svc, newSender(t, srv.URL)
+}
+
+// message returns a JSON log message with the given message text.
+func message(msg string) string {
+	return `{"level":"info","time":"2026-01-02T03:04:05.000Z","message":"` + msg + `"}` + "\n"
+}
+
+// write writes the messages m0, m1, ... m<n-1> to l.
+func write(l *Logger, n int) {
+	for i := 0; i < n; i++ {
+		io.WriteString(l, message(fmt.Sprintf("m%d", i)))
+	}
+}
+
+// TestMaxSize tests that the oldest messages are dropped when unsent
+// logs exceed the maximum size, and that the drops are reported.
+func TestMaxSize(t *testing.T) {
+	svc, ns := newService(t)
+	size := len(message("m0"))
+	l := New(WithMaxSize(3 * size))
+
+	write(l, 5)
+	if got := l.Dropped(); got != 2 {
+		t.Errorf("unexpected dropped messages: got %d, want 2", got)
+	}
+
+	err := l.Send(ns)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	reqs := svc.requests()
+	if len(reqs) != 1 {
+		t.Fatalf("unexpected requests: %+v", reqs)
+	}
+	var entries []struct {
+		Message string `json:"message"`
+		Dropped int    `json:"dropped"`
+	}
+	err = json.Unmarshal([]byte(reqs[0].logs), &entries)
+	if err != nil {
+		t.Fatalf("could not decode logs: %v", err)
+	}
+	if len(entries) != 4 || entries[0].Message != "dropped unsent logs" || entries[0].Dropped != 2 {
+		t.Fatalf("unexpected drops report: %+v", entries)
+	}
+	if got, want := svc.received(t)[1:], []string{"m2", "m3", "m4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected messages: got %v, want %v", got, want)
+	}
+	if got := l.Dropped(); got != 0 {
+		t.Errorf("dropped messages not reset after report: %d", got)
+	}
+
+	// The drops are reported once only.
+	write(l, 1)
+	err = l.Send(ns)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if got, want := svc.received(t)[4:], []string{"m0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected messages after report: got %v, want %v", got, want)
+	}
+}
+
+// TestResend tests that logs which fail to send are resent as is, with
+// the same request ID, and are not sent twice.
+func TestResend(t *testing.T) {
+	svc, ns := newService(t)
+	l := New()
+
+	write(l, 2)
+	svc.setFail(true)
+	err := l.Send(ns)
+	if err == nil {
+		t.Fatalf("expected error from Send")
+	}
+	io.WriteString(l, message("m2"))
+	svc.setFail(false)
+	err = l.Send(ns)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+
+	reqs := svc.requests()
+	if len(reqs) != 3 {
+		t.Fatalf("unexpected requests: %+v", reqs)
+	}
+	if reqs[1].id != reqs[0].id || reqs[1].logs != reqs[0].logs {
+		t.Errorf("failed logs not resent as is: got %+v, want %+v", reqs[1], reqs[0])
+	}
+	if reqs[2].id == reqs[0].id {
+		t.Errorf("new logs sent with the ID of the failed request")
+	}
+	if got, want := svc.received(t), []string{"m0", "m1", "m2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected messages: got %v, want %v", got, want)
+	}
+
+	// Nothing is left to send.
+	err = l.Send(ns)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if got := len(svc.requests()); got != 3 {
+		t.Errorf("unexpected requests after sending: got %d, want 3", got)
+	}
+}
+
+// TestSpill tests that unsent logs are spilled after repeated failures,
+// and sent from the spill file once sends succeed.
+func TestSpill(t *testing.T) {
+	svc, ns := newService(t)
+	path := filepath.Join(t.TempDir(), "spill.log")
+	l := New(WithSpillFile(path, 1, 3))
+
+	write(l, 2)
+	svc.setFail(true)
+	for i := 1; i <= spillFailures; i++ {
+		err := l.Send(ns)
+		if err == nil {
+			t.Fatalf("expected error from send %d", i)
+		}
+		_, err = os.Stat(path)
+		if spilled := err == nil; spilled != (i == spillFailures) {
+			t.Fatalf("unexpected spill after %d failures: %t", i, spilled)
+		}
+	}
+	got, err := os.ReadFile(path)
+	if want := message("m0") + message("m1"); string(got) != want {
+		t.Errorf("unexpected spill file: got %q, want %q, error %v", got, want, err)
+	}
+
+	svc.setFail(false)
+	err = l.Send(ns)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if got, want := svc.received(t), []string{"m0", "m1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected messages: got %v, want %v", got, want)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("spill file not removed once sent: %v", err)
+	}
+}
+
+// TestDrainOrder tests that spill files, including those rotated by
+// lumberjack, are sent oldest first.
+func TestDrainOrder(t *testing.T) {
+	svc, ns := newService(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "spill.log")
+	files := map[string]string{
+		"spill-2026-01-02T00-00-00.000.log": "b",
+		"spill-2026-01-01T00-00-00.000.log": "a",
+		"spill.log":                         "c",
+	}
+	for name, msg := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(message(msg)), 0644)
+		if err != nil {
+			t.Fatalf("could not write spill file: %v", err)
+		}
+	}
+	l := New(WithSpillFile(path, 1, 3))
+
+	for i := range files {
+		err := l.Send(ns)
+		if err != nil {
+			t.Fatalf("unexpected error from send %s: %v", i, err)
+		}
+	}
+	if got, want := svc.received(t), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected messages: got %v, want %v", got, want)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*")); len(left) != 0 {
+		t.Errorf("spill files not removed: %v", left)
+	}
+}
+
+// TestPartialDrain tests that a spill file is truncated to the logs after
+// a chunk which fails to send, and that the chunk is then resent.
+func TestPartialDrain(t *testing.T) {
+	svc, ns := newService(t)
+	path := filepath.Join(t.TempDir(), "spill.log")
+	var logs string
+	for i := 0; i < 4; i++ {
+		logs += message(fmt.Sprintf("m%d", i))
+	}
+	err := os.WriteFile(path, []byte(logs), 0644)
+	if err != nil {
+		t.Fatalf("could not write spill file: %v", err)
+	}
+	l := New(WithSpillFile(path, 1, 3), WithMaxPayload(1)) // A chunk per message.
+
+	svc.failAfter(1)
+	err = l.Send(ns)
+	if err == nil {
+		t.Fatalf("expected error from Send")
+	}
+	got, err := os.ReadFile(path)
+	if want := message("m2") + message("m3"); string(got) != want {
+		t.Errorf("unexpected spill file after partial drain: got %q, want %q, error %v", got, want, err)
+	}
+
+	svc.setFail(false)
+	for i := 0; i < 2; i++ {
+		err = l.Send(ns)
+		if err != nil {
+			t.Fatalf("unexpected error from Send: %v", err)
+		}
+	}
+	if got, want := svc.received(t), []string{"m0", "m1", "m2", "m3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected messages: got %v, want %v", got, want)
+	}
+	reqs := svc.requests()
+	if len(reqs) < 3 || reqs[2].id != reqs[1].id || reqs[2].logs != reqs[1].logs {
+		t.Errorf("failed chunk not resent as is: %+v", reqs)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("spill file not removed once sent: %v", err)
+	}
+}
+
+// TestSplit tests that logs are split into JSON arrays of at most the
+// maximum size, between messages, and that a message larger than the
+// maximum is sent alone.
+func TestSplit(t *testing.T) {
+	var logs string
+	for i := 0; i < 5; i++ {
+		logs += message(fmt.Sprintf("m%d", i))
+	}
+	big := message("big" + strings.Repeat("x", 200))
+	e := len(entry([]byte(message("m0"))))
+
+	tests := []struct {
+		name string
+		logs string
+		max  int
+		want [][]string
+	}{
+		{name: "unlimited", logs: logs, want: [][]string{{"m0", "m1", "m2", "m3", "m4"}}},
+		{name: "exact fit", logs: logs, max: 2*e + 3, want: [][]string{{"m0", "m1"}, {"m2", "m3"}, {"m4"}}},
+		{name: "one short", logs: logs, max: 2*e + 2, want: [][]string{{"m0"}, {"m1"}, {"m2"}, {"m3"}, {"m4"}}},
+		{name: "oversized", logs: message("m0") + big + message("m1"), max: 2*e + 3, want: [][]string{{"m0"}, {"big" + strings.Repeat("x", 200)}, {"m1"}}},
+		{name: "blank lines", logs: "\n" + message("m0") + "\n\n", max: 2*e + 3, want: [][]string{{"m0"}}},
+	}
+	for _, test := range tests {
+		chunks := split([]byte(test.logs), test.max, FormatJSON)
+		var got [][]string
+		var n int
+		for _, c := range chunks {
+			if test.max != 0 && len(c.data) > test.max && len(messages(t, string(c.data))) != 1 {
+				t.Errorf("%s: chunk of %d bytes exceeds maximum of %d: %q", test.name, len(c.data), test.max, c.data)
+			}
+			got = append(got, messages(t, string(c.data)))
+			n += c.n
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: unexpected chunks: got %v, want %v", test.name, got, test.want)
+		}
+		if n != len(test.logs) {
+			t.Errorf("%s: chunks cover %d bytes of logs, want %d", test.name, n, len(test.logs))
+		}
+	}
+}
+
+// TestResumeSend tests that, when a chunk fails to send, the chunks
+// already sent are not sent again and the rest are sent by the next send.
+func TestResumeSend(t *testing.T) {
+	svc, ns := newService(t)
+	l := New(WithMaxPayload(1)) // A chunk per message.
+
+	write(l, 4)
+	svc.failAfter(1)
+	err := l.Send(ns)
+	if err == nil {
+		t.Fatalf("expected error from Send")
+	}
+	if got, want := svc.received(t), []string{"m0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected messages before failure: got %v, want %v", got, want)
+	}
+
+	svc.setFail(false)
+	err = l.Send(ns)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if got, want := svc.received(t), []string{"m0", "m1", "m2", "m3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected messages: got %v, want %v", got, want)
+	}
+	reqs := svc.requests()
+	if len(reqs) != 5 || reqs[2].id != reqs[1].id {
+		t.Errorf("failed chunk not resent with its request ID: %+v", reqs)
+	}
+}
+
+// TestEntry tests that log lines are formatted as JSON log entries with
+// the boot ID.
+func TestEntry(t *testing.T) {
+	defer func(f func() string) { bootID = f }(bootID)
+	bootID = func() string { return "b1" }
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{line: `{"level":"info","message":"m0"}` + "\n", want: `{"level":"info","message":"m0","boot":"b1"}`},
+		{line: `{}`, want: `{"boot":"b1"}`},
+		{line: `{ }` + "\n", want: `{ "boot":"b1"}`},
+		{line: "plain text\n", want: `{"message":"plain text","boot":"b1"}`},
+		{line: `{"unterminated":` + "\n", want: `{"message":"{\"unterminated\":","boot":"b1"}`},
+		{line: `["not","an","object"]`, want: `{"message":"[\"not\",\"an\",\"object\"]","boot":"b1"}`},
+		{line: " \n", want: ""},
+	}
+	for _, test := range tests {
+		got := entry([]byte(test.line))
+		if string(got) != test.want {
+			t.Errorf("unexpected entry for %q: got %q, want %q", test.line, got, test.want)
+		}
+		if got != nil && !json.Valid(got) {
+			t.Errorf("entry for %q is not valid JSON: %q", test.line, got)
+		}
+	}
+}
+
+// TestFormatRaw tests that logs are sent as written with FormatRaw, for
+// services which do not accept JSON arrays of log entries.
+func TestFormatRaw(t *testing.T) {
+	svc, ns := newService(t)
+	l := New(WithFormat(FormatRaw), WithMaxPayload(2*len(message("m0"))))
+
+	write(l, 3)
+	err := l.Send(ns)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	var got []string
+	for _, r := range svc.requests() {
+		got = append(got, r.logs)
+	}
+	if want := []string{message("m0") + message("m1"), message("m2")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected logs sent: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+NAME
+  spill.go
+
+DESCRIPTION
+  spill.go provides spill files, which hold logs that could not be sent
+  until they can be.
+
+LICENSE
+  netlogger is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with revid in gpl.txt.  If not, see [GNU licenses](http://www.gnu.org/licenses).
+*/
+
+package netlogger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ausocean/client/pi/netsender"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// spillFailures is the number of consecutive failed sends after which
+// unsent logs are spilled.
+const spillFailures = 3
+
+// WithSpillFile returns an option that writes unsent logs to the file at
+// path when sends fail repeatedly, or when they cannot be flushed, so
+// that they survive a crash or reboot. Spilled logs are sent, oldest
+// first, once sends succeed again, including after a restart. The file
+// is rotated when it reaches maxSize megabytes, keeping at most
+// maxBackups rotated files, as for a lumberjack.Logger.
+func WithSpillFile(path string, maxSize, maxBackups int) Option {
+	return func(l *Logger) {
+		l.spill = &lumberjack.Logger{Filename: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	}
+}
+
+// spillUnsent writes the logs to be resent, if any, and the unsent logs
+// to the spill file, and discards them. Spilled logs are later sent with
+// new request IDs. l.sending must be held.
+func (l *Logger) spillUnsent() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var logs []byte
+	if l.retry != nil {
+		logs = append(logs, l.retry.raw...)
+	}
+	logs = append(logs, l.unsent.Bytes()...)
+	_, err := l.spill.Write(logs)
+	if err != nil {
+		return fmt.Errorf("could not spill logs: %w", err)
+	}
+	l.retry = nil
+	l.unsent.Reset()
+	l.snapshot, l.inflight = 0, 0
+	return nil
+}
+
+// drain sends the oldest spill file, if any, returning the number of
+// bytes sent. A file is sent in chunks of at most the maximum payload
+// size, and is removed once it is sent. If a chunk cannot be sent, it is
+// kept to be resent as is, and the file is truncated to the logs after
+// it. l.sending must be held.
+func (l *Logger) drain(ns *netsender.Sender) (int, error) {
+	if l.spill == nil {
+		return 0, nil
+	}
+	files, err := l.spillFiles()
+	if err != nil || len(files) == 0 {
+		return 0, err
+	}
+	name := files[0]
+	if name == l.spill.Filename {
+		err = l.spill.Close() // Reopened by the next spill.
+		if err != nil {
+			return 0, err
+		}
+	}
+	logs, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	var sent, n int
+	for _, chunk := range split(logs, l.maxPayload, l.format) {
+		id := netsender.NewRequestID()
+		if chunk.data != nil {
+			err = sendLogs(ns, chunk.data, id)
+		}
+		if err != nil {
+			l.retry = &pending{raw: logs[n : n+chunk.n], data: chunk.data, id: id}
+			return sent, errors.Join(err, os.WriteFile(name, logs[n+chunk.n:], 0644))
+		}
+		sent += len(chunk.data)
+		n += chunk.n
+	}
+	return sent, os.Remove(name)
+}
+
+// spillFiles returns the spill files, oldest first, i.e., the rotated
+// files in order of their timestamps, then the current file, if any.
+func (l *Logger) spillFiles() ([]string, error) {
+	name := l.spill.Filename
+	ext := filepath.Ext(name)
+	backups, err := filepath.Glob(strings.TrimSuffix(name, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(backups)
+	if _, err := os.Stat(name); err == nil {
+		backups = append(backups, name)
+	}
+	return backups, nil
+}
@@ -0,0 +1,286 @@
+/*
+NAME
+  bandwidth.go provides streaming bandwidth measurement for the download
+  and upload speed tests, which samples throughput over the transfer.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// bandwidthPin is the pin on which the speed test results, if any, are
+// reported as JSON, e.g.,
+//
+//	{"download":{"min":800000,"avg":950000,"max":1100000,"bytes":1250000,"secs":10.5},"upload":{...}}
+const bandwidthPin = "T2"
+
+// speedTestVar is the var which sets the interval between scheduled
+// speed tests, in seconds or as a Go duration, e.g., 6h. Zero, the
+// default, disables scheduled speed tests.
+const speedTestVar = "SpeedTestInterval"
+
+// speedTestHistory is the number of speed test results kept for
+// computing percentiles.
+const speedTestHistory = 48
+
+// Speed test percentile pins, which report the 50th and 10th percentiles
+// of the average speeds of recent speed tests, in bits per second. The
+// 10th percentile shows link degradation which the median may hide.
+const (
+	downloadP50Pin = "X4"
+	downloadP10Pin = "X5"
+	uploadP50Pin   = "X6"
+	uploadP10Pin   = "X7"
+)
+
+// bandwidthSampleInterval is the interval over which throughput samples
+// are measured.
+const bandwidthSampleInterval = 250 * time.Millisecond
+
+// Bandwidth holds the results of a speed test, with speeds in bits per
+// second. Min and Max are the lowest and highest throughput over any
+// sample interval, and Avg is the throughput over the whole transfer.
+type Bandwidth struct {
+	Min   int     `json:"min"`
+	Avg   int     `json:"avg"`
+	Max   int     `json:"max"`
+	Bytes int64   `json:"bytes"`
+	Secs  float64 `json:"secs"`
+}
+
+// WithSpeedTest returns an option that sets the number of bytes
+// transferred by each speed test and the maximum duration of each test,
+// which ends after that time even if fewer bytes have been transferred.
+// A duration of zero means no limit. The defaults are 1250000 bytes, i.e.,
+// 10 megabits, and no limit.
+func WithSpeedTest(size int, duration time.Duration) Option {
+	return func(s *Sender) error {
+		if size < 1 {
+			return errors.New("invalid speed test size")
+		}
+		if duration < 0 {
+			return errors.New("invalid speed test duration")
+		}
+		s.testSize = size
+		s.testDuration = duration
+		return nil
+	}
+}
+
+// speedTest returns the speed test size and duration.
+func (ns *Sender) speedTest() (int, time.Duration) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.testSize == 0 {
+		return downloadTestSize, ns.testDuration
+	}
+	return ns.testSize, ns.testDuration
+}
+
+// DownloadBandwidth returns the results of the most recent TestDownload,
+// and true, or false if it has not been run.
+func (ns *Sender) DownloadBandwidth() (Bandwidth, bool) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.downloadBW == nil {
+		return Bandwidth{}, false
+	}
+	return *ns.downloadBW, true
+}
+
+// UploadBandwidth returns the results of the most recent TestUpload,
+// and true, or false if it has not been run.
+func (ns *Sender) UploadBandwidth() (Bandwidth, bool) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.uploadBW == nil {
+		return Bandwidth{}, false
+	}
+	return *ns.uploadBW, true
+}
+
+// bandwidthJSON returns the speed test results as JSON, or nil if no
+// speed test has been run.
+func (ns *Sender) bandwidthJSON() []byte {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.downloadBW == nil && ns.uploadBW == nil {
+		return nil
+	}
+	b, _ := json.Marshal(struct {
+		Download *Bandwidth `json:"download,omitempty"`
+		Upload   *Bandwidth `json:"upload,omitempty"`
+	}{ns.downloadBW, ns.uploadBW})
+	return b
+}
+
+// meter implements an io.Reader which measures the throughput of reads
+// from r, sampled every interval. Once the deadline, if any, has passed,
+// reads return io.EOF.
+type meter struct {
+	r        io.Reader
+	interval time.Duration
+	deadline time.Time
+	start    time.Time
+	last     time.Time // Start of the current sample.
+	n        int64     // Bytes read.
+	lastN    int64     // Bytes read at the start of the current sample.
+	min, max float64   // Sample throughput in bits per second.
+	sampled  bool
+	expired  bool // True if the deadline ended the transfer.
+}
+
+// newMeter returns a meter for reads from r, with a deadline of duration
+// from now unless duration is zero.
+func newMeter(r io.Reader, duration time.Duration) *meter {
+	now := time.Now()
+	m := &meter{r: r, interval: bandwidthSampleInterval, start: now, last: now}
+	if duration != 0 {
+		m.deadline = now.Add(duration)
+	}
+	return m
+}
+
+// Read implements io.Reader.Read.
+func (m *meter) Read(p []byte) (int, error) {
+	if !m.deadline.IsZero() && !time.Now().Before(m.deadline) {
+		m.expired = true
+		return 0, io.EOF
+	}
+	n, err := m.r.Read(p)
+	m.n += int64(n)
+	now := time.Now()
+	if now.Sub(m.last) >= m.interval {
+		m.sample(now)
+	}
+	return n, err
+}
+
+// sample records the throughput since the start of the current sample.
+func (m *meter) sample(now time.Time) {
+	bps := float64(m.n-m.lastN) * 8 / now.Sub(m.last).Seconds()
+	if !m.sampled || bps < m.min {
+		m.min = bps
+	}
+	if !m.sampled || bps > m.max {
+		m.max = bps
+	}
+	m.sampled = true
+	m.last, m.lastN = now, m.n
+}
+
+// result returns the bandwidth of the transfer, which ended at end. If
+// the transfer was shorter than a sample interval, the minimum and
+// maximum are the average.
+func (m *meter) result(end time.Time) Bandwidth {
+	dur := end.Sub(m.start).Seconds()
+	avg := float64(m.n) * 8 / dur
+	if !m.sampled {
+		m.min, m.max = avg, avg
+	}
+	return Bandwidth{Min: int(m.min), Avg: int(avg), Max: int(m.max), Bytes: m.n, Secs: dur}
+}
+
+// setSpeedTestInterval sets the interval between scheduled speed tests
+// from the SpeedTestInterval var, if present.
+func (ns *Sender) setSpeedTestInterval(vars map[string]string) {
+	v, present := vars[speedTestVar]
+	if !present {
+		return
+	}
+	d, err := parseDuration(v)
+	if err != nil || d < 0 {
+		ns.logger.Log(WarningLevel, warnSpeedTestInterval, "value", v)
+		return
+	}
+	ns.mu.Lock()
+	ns.testInterval = d
+	ns.mu.Unlock()
+}
+
+// scheduledSpeedTest runs the download and upload speed tests if
+// scheduled speed tests are enabled and one is due.
+func (ns *Sender) scheduledSpeedTest(ctx context.Context) {
+	ns.mu.Lock()
+	due := ns.testInterval != 0 && (ns.lastTest.IsZero() || time.Since(ns.lastTest) >= ns.testInterval)
+	if due {
+		ns.lastTest = time.Now()
+	}
+	ns.mu.Unlock()
+	if !due {
+		return
+	}
+	err := ns.TestDownloadContext(ctx)
+	if err == nil {
+		err = ns.TestUploadContext(ctx)
+	}
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnSpeedTest, "error", err.Error())
+	}
+}
+
+// speedPercentile returns the value of a speed test percentile pin, or
+// -1 if there are no results.
+func (ns *Sender) speedPercentile(pin string) int {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	switch pin {
+	case downloadP50Pin:
+		return percentile(ns.downloadHist, 50)
+	case downloadP10Pin:
+		return percentile(ns.downloadHist, 10)
+	case uploadP50Pin:
+		return percentile(ns.uploadHist, 50)
+	case uploadP10Pin:
+		return percentile(ns.uploadHist, 10)
+	}
+	return -1
+}
+
+// appendHistory appends a speed to a speed test history, dropping the
+// oldest speed if the history is full.
+func appendHistory(hist []int, speed int) []int {
+	hist = append(hist, speed)
+	if len(hist) > speedTestHistory {
+		hist = hist[len(hist)-speedTestHistory:]
+	}
+	return hist
+}
+
+// percentile returns the pth nearest-rank percentile of vals, or -1 if
+// vals is empty.
+func percentile(vals []int, p int) int {
+	if len(vals) == 0 {
+		return -1
+	}
+	sorted := append([]int(nil), vals...)
+	sort.Ints(sorted)
+	i := (p*len(sorted) + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i]
+}
@@ -0,0 +1,190 @@
+/*
+NAME
+  capture.go provides a capture of recent service requests and replies,
+  which may be uploaded for remote debugging of protocol issues.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ausocean/utils/sliceutils"
+)
+
+// capturePin is the pin on which captured exchanges are uploaded as JSON.
+// T3 is not used, since it carries router statistics.
+const capturePin = "T4"
+
+// dumpHTTPVar is the var which requests an upload of the captured
+// exchanges whenever it changes to a true value, e.g., "true" or "1".
+const dumpHTTPVar = "DumpHTTP"
+
+// Device keys are redacted from captured requests and replies, and the
+// WiFi password is redacted from the wi param (see redact).
+var (
+	redactParam = regexp.MustCompile(`([?&](?:dk|pk)=)[^&]*`)
+	redactJSON  = regexp.MustCompile(`("(?:dk|pk)"\s*:\s*)("[^"]*"|[0-9]+)`)
+	wifiParam   = regexp.MustCompile(`([?&]wi=)([^&]*)`)
+	wifiJSON    = regexp.MustCompile(`("wi"\s*:\s*")([^"]*)(")`)
+)
+
+// redacted replaces device keys with this.
+const redacted = "REDACTED"
+
+// HTTPExchange is a captured service request and its reply or error.
+// Device keys and the WiFi password in the request and reply are
+// redacted.
+type HTTPExchange struct {
+	Time    time.Time     `json:"time"`
+	Host    string        `json:"host"`
+	Request string        `json:"request"`
+	Reply   string        `json:"reply,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	RTT     time.Duration `json:"rtt"`
+}
+
+// WithHTTPCapture returns an option that captures the last n service
+// requests and replies for remote debugging (see DumpHTTP). Zero, the
+// default, disables capture, and the capture pin is then read like any
+// other pin.
+func WithHTTPCapture(n int) Option {
+	return func(s *Sender) error {
+		if n < 0 {
+			return fmt.Errorf("invalid capture size: %d", n)
+		}
+		s.captureSize = n
+		return nil
+	}
+}
+
+// HTTPCapture returns the captured exchanges, oldest first.
+func (ns *Sender) HTTPCapture() []HTTPExchange {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return append([]HTTPExchange(nil), ns.capture...)
+}
+
+// captureExchange captures a request and its reply or error.
+func (ns *Sender) captureExchange(start time.Time, host, path, reply string, rtt time.Duration, err error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	n := ns.captureSize
+	if n == 0 {
+		return
+	}
+	x := HTTPExchange{
+		Time:    start,
+		Host:    host,
+		Request: redactRequest(path),
+		Reply:   redactReply(reply),
+		RTT:     rtt,
+	}
+	if err != nil {
+		x.Error = err.Error()
+	}
+	ns.capture = append(ns.capture, x)
+	if len(ns.capture) > n {
+		ns.capture = ns.capture[len(ns.capture)-n:]
+	}
+}
+
+// redactRequest returns the request path with device keys and the WiFi
+// password redacted.
+func redactRequest(path string) string {
+	path = redactParam.ReplaceAllString(path, "${1}"+redacted)
+	return wifiParam.ReplaceAllStringFunc(path, func(m string) string {
+		sub := wifiParam.FindStringSubmatch(m)
+		wi, err := url.QueryUnescape(sub[2])
+		if err != nil {
+			return sub[1] + redacted
+		}
+		return sub[1] + url.QueryEscape(Redact("wi", wi))
+	})
+}
+
+// redactReply returns the reply with device keys and the WiFi password
+// redacted.
+func redactReply(reply string) string {
+	reply = redactJSON.ReplaceAllString(reply, `${1}"`+redacted+`"`)
+	return wifiJSON.ReplaceAllStringFunc(reply, func(m string) string {
+		sub := wifiJSON.FindStringSubmatch(m)
+		return sub[1] + Redact("wi", sub[2]) + sub[3]
+	})
+}
+
+// DumpHTTP uploads the captured exchanges as JSON on pin T4, if T4 is
+// an input and capture is enabled (see WithHTTPCapture). The upload
+// itself is captured, so it is included in the next dump. Dumps are also
+// requested by the DumpHTTP var and the Debug response code.
+func (ns *Sender) DumpHTTP() error {
+	return ns.DumpHTTPContext(context.Background())
+}
+
+// DumpHTTPContext is like DumpHTTP, but the request is cancelled when
+// ctx is done.
+func (ns *Sender) DumpHTTPContext(ctx context.Context) error {
+	if !ns.capturing() || !sliceutils.ContainsString(strings.Split(ns.Param("ip"), ","), capturePin) {
+		return nil
+	}
+	capture := ns.HTTPCapture()
+	b, err := json.Marshal(capture)
+	if err != nil {
+		return err
+	}
+	ns.logger.Log(DebugLevel, debugDumpHTTP, "exchanges", len(capture))
+	pin := Pin{Name: capturePin, Value: len(b), Data: b, MimeType: "application/json"}
+	_, _, err = ns.SendContext(ctx, RequestPoll, []Pin{pin})
+	return err
+}
+
+// capturing returns true if exchanges are captured.
+func (ns *Sender) capturing() bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.captureSize > 0
+}
+
+// dumpHTTPOnVar dumps the captured exchanges if the DumpHTTP var has
+// changed to a true value, including when it is first received.
+func (ns *Sender) dumpHTTPOnVar(ctx context.Context, vars map[string]string) {
+	v, present := vars[dumpHTTPVar]
+	ns.mu.Lock()
+	prev := ns.dumpVar
+	ns.dumpVar = v
+	ns.mu.Unlock()
+	if !present || v == prev {
+		return
+	}
+	dump, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil || !dump {
+		return
+	}
+	err = ns.DumpHTTPContext(ctx)
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnDumpHTTP, "error", err.Error())
+	}
+}
@@ -0,0 +1,114 @@
+/*
+NAME
+  clientcert.go provides mutual TLS authentication of service requests
+  with a client certificate, for sites with managed PKI.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrCertExpired is returned, wrapped, by service requests when the
+// client certificate has expired or is not yet valid.
+var ErrCertExpired = errors.New("client certificate expired or not yet valid")
+
+// loadClientCert loads the client certificate and key from the given PEM
+// files and checks that the certificate is currently valid. If keyFile
+// is empty, the key is read from certFile.
+func loadClientCert(certFile, keyFile string) (*tls.Certificate, error) {
+	if keyFile == "" {
+		keyFile = certFile
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load client certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse client certificate: %w", err)
+	}
+	now := time.Now()
+	if now.After(leaf.NotAfter) || now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("%w: valid from %s to %s", ErrCertExpired, leaf.NotBefore, leaf.NotAfter)
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+// setClientCert configures service requests to present the client
+// certificate in certFile, with the key in keyFile, and to use HTTPS.
+// The certificate is reloaded for each TLS handshake, so that renewed
+// certificates are picked up without a restart, and handshakes fail,
+// i.e., requests fail closed, if the certificate cannot be loaded or has
+// expired. The transport must be either the default or one set by WithTLS.
+func (ns *Sender) setClientCert(certFile, keyFile string) error {
+	_, err := loadClientCert(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	var t *http.Transport
+	switch rt := ns.roundTripper.(type) {
+	case nil:
+		t = newTransport()
+	case *http.Transport:
+		t = rt.Clone()
+	default:
+		return errors.New("cannot apply client certificate to custom transport")
+	}
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return loadClientCert(certFile, keyFile)
+	}
+	ns.roundTripper = t
+	if !ns.tls {
+		ns.certTLS = true
+	}
+	ns.tls = true
+	return nil
+}
+
+// clearClientCert stops service requests from presenting a client
+// certificate (see setClientCert). Requests continue to use HTTPS only if
+// they did before the client certificate was set, e.g., by WithTLS.
+func (ns *Sender) clearClientCert() {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	t, ok := ns.roundTripper.(*http.Transport)
+	if !ok || t.TLSClientConfig == nil || t.TLSClientConfig.GetClientCertificate == nil {
+		return
+	}
+	t = t.Clone()
+	t.TLSClientConfig.GetClientCertificate = nil
+	ns.roundTripper = t
+	if ns.certTLS {
+		ns.tls, ns.certTLS = false, false
+	}
+}
@@ -0,0 +1,141 @@
+/*
+NAME
+  clock.go provides clock synchronization from service replies, for
+  devices without a real-time clock, which boot with a bogus time.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// clockSkewPin is the pin on which the clock skew, i.e., the local time
+// minus the service time, is reported in seconds, once known.
+const clockSkewPin = "X3"
+
+// dateResolution is the resolution of the HTTP Date header.
+const dateResolution = time.Second
+
+// serverDateKey is the context key for recording the HTTP Date header of
+// a service reply.
+type serverDateKey struct{}
+
+// setClock steps the system clock to t. It is a variable so that it may
+// be replaced in tests.
+var setClock = func(t time.Time) error {
+	return exec.Command("date", "-s", "@"+strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', 3, 64)).Run()
+}
+
+// WithClockStep returns an option that steps the system clock to the
+// service time when the clock skew exceeds threshold, e.g., after booting
+// without a real-time clock. This requires the privilege to set the clock.
+// Without this option, the skew is only applied to times returned by Now.
+func WithClockStep(threshold time.Duration) Option {
+	return func(s *Sender) error {
+		if threshold <= 0 {
+			return errors.New("clock step threshold must be positive")
+		}
+		s.clockStep = threshold
+		return nil
+	}
+}
+
+// Now returns the current time according to the service, i.e., the local
+// time corrected for the clock skew measured from service replies, or the
+// local time if no service reply has provided the time yet.
+func (ns *Sender) Now() time.Time {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return time.Now().Add(-ns.clockSkew)
+}
+
+// ClockSkew returns the local time minus the service time, and true, if
+// the skew has been measured, else false.
+func (ns *Sender) ClockSkew() (time.Duration, bool) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.clockSkew, ns.clockSynced
+}
+
+// syncClock measures the clock skew from the service time in a reply,
+// given the local time the request was sent and its round-trip time.
+// The service time is the reply's ts value, in Unix seconds, if any, else
+// the HTTP Date header, if any. The service time is assumed to correspond
+// to the midpoint of the request. If enabled by WithClockStep, the system
+// clock is stepped when the skew exceeds the threshold.
+func (ns *Sender) syncClock(dec *JSONDecoder, date time.Time, start time.Time, rtt time.Duration) {
+	var server time.Time
+	var res time.Duration
+	if ts, ok := dec.data["ts"].(float64); ok && ts > 0 {
+		sec, frac := math.Modf(ts)
+		server = time.Unix(int64(sec), int64(frac*1e9))
+	} else if !date.IsZero() {
+		// Date is truncated to the second, so assume the middle of it.
+		server = date.Add(dateResolution / 2)
+		res = dateResolution
+	} else {
+		return
+	}
+	skew := start.Add(rtt / 2).Sub(server)
+
+	ns.mu.Lock()
+	// Ignore changes within the resolution of the service time, to avoid jitter.
+	if ns.clockSynced && (skew-ns.clockSkew).Abs() <= res {
+		ns.mu.Unlock()
+		return
+	}
+	ns.clockSkew = skew
+	ns.clockSynced = true
+	step := ns.clockStep != 0 && skew.Abs() > ns.clockStep
+	ns.mu.Unlock()
+
+	ns.logger.Log(DebugLevel, debugClockSkew, "skew", skew.String())
+	if !step {
+		return
+	}
+	err := setClock(time.Now().Add(-skew))
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnClockStep, "error", err.Error())
+		return
+	}
+	ns.logger.Log(InfoLevel, infoClockStepped, "skew", skew.String())
+	ns.mu.Lock()
+	ns.clockSkew = 0
+	ns.mu.Unlock()
+}
+
+// recordDate records the HTTP Date header value of a reply in ctx, if
+// ctx was prepared for it by SendContext.
+func recordDate(ctx context.Context, date string) {
+	d, ok := ctx.Value(serverDateKey{}).(*time.Time)
+	if !ok || date == "" {
+		return
+	}
+	t, err := http.ParseTime(date)
+	if err == nil {
+		*d = t
+	}
+}
@@ -0,0 +1,138 @@
+/*
+NAME
+  close.go provides graceful shutdown of a Sender.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrClosed is returned by Run and Close once the Sender has been closed.
+var ErrClosed = errors.New("sender closed")
+
+// Close gracefully shuts down the Sender. It cancels outstanding service
+// requests, speed tests and watch requests, and causes subsequent calls
+// to Run to return ErrClosed. It then waits for any upgrade in progress,
+// which is not interrupted, flushes buffered data (see FlushAll), writes
+// the config file, disconnects from any MQTT broker and closes any metrics
+// listener. Requests made by Close, and Send calls after Close, are
+// bounded only by ctx.
+//
+// Clients should call Close on SIGTERM, e.g.,
+//
+//	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+//	defer stop()
+//	for ctx.Err() == nil {
+//		ns.RunContext(ctx)
+//		// Sleep for the monitor period or until ctx is done.
+//	}
+//	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+//	defer cancel()
+//	err := ns.Close(ctx)
+func (ns *Sender) Close(ctx context.Context) error {
+	ns.mu.Lock()
+	if ns.closed {
+		ns.mu.Unlock()
+		return ErrClosed
+	}
+	ns.closed = true
+	ns.mu.Unlock()
+	ns.notifySystemd(sdStopping)
+	ns.lifetime()
+	ns.stop()
+
+	var errs []error
+	upgraded := make(chan struct{})
+	go func() {
+		ns.upgrades.Wait()
+		close(upgraded)
+	}()
+	select {
+	case <-upgraded:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("upgrade in progress: %w", ctx.Err()))
+	}
+
+	err := ns.FlushAll(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	ns.mu.Lock()
+	if ns.config != nil && (ns.store != nil || ns.configFile != "") {
+		err = ns.writeConfig(ns.config)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not write config: %w", err))
+		}
+	}
+	mqtt := ns.mqtt
+	srv := ns.metricsServer
+	ns.mu.Unlock()
+	if mqtt != nil {
+		mqtt.mu.Lock()
+		mqtt.close()
+		mqtt.mu.Unlock()
+	}
+	if srv != nil {
+		err = srv.Shutdown(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not close metrics listener: %w", err))
+		}
+	}
+
+	ns.logger.Log(InfoLevel, infoClosed)
+	return errors.Join(errs...)
+}
+
+// isClosed returns true if Close has been called.
+func (ns *Sender) isClosed() bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.closed
+}
+
+// lifetime returns a context which is done when Close is called.
+func (ns *Sender) lifetime() context.Context {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.life == nil {
+		ns.life, ns.stop = context.WithCancel(context.Background())
+	}
+	return ns.life
+}
+
+// bindLifetime returns a copy of ctx which is also cancelled when Close
+// is called, unless Close has already been called, and a function to
+// release its resources.
+func (ns *Sender) bindLifetime(ctx context.Context) (context.Context, context.CancelFunc) {
+	life := ns.lifetime()
+	if life.Err() != nil {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(life, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
@@ -0,0 +1,85 @@
+/*
+NAME
+  conditional.go provides conditional vars requests, in which the service
+  replies without the vars if they have not changed since they were last
+  received, which reduces the bandwidth used on metered links.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"fmt"
+	"maps"
+)
+
+// notModifiedKey is the var present in the reply to a vars request when
+// the vars are unchanged. Its value is "1".
+const notModifiedKey = "nm"
+
+// varSumTagKey is the context key for var sum tags.
+type varSumTagKey struct{}
+
+// VarSumTag returns the var sum of the vars most recently received, as a
+// string, from the context passed to Transport.Request for a vars
+// request, or the empty string if there is none. The HTTP transport
+// sends it as an ETag in an If-None-Match header, and the service may
+// then reply 304 Not Modified, without a body, if the var sum is
+// unchanged. Custom transports may instead reply {"vs":"<tag>","nm":"1"}.
+func VarSumTag(ctx context.Context) string {
+	tag, _ := ctx.Value(varSumTagKey{}).(string)
+	return tag
+}
+
+// notModifiedReply returns the reply to a vars request for which the
+// vars with var sum tag are unchanged.
+func notModifiedReply(tag string) string {
+	return fmt.Sprintf(`{"vs":%q,%q:"1"}`, tag, notModifiedKey)
+}
+
+// withVarSumTag returns ctx with the var sum of the vars most recently
+// received, if any, so that the vars request is conditional. Requests
+// which sync the mode or error are not conditional, since the service
+// may change them in reply.
+func (ns *Sender) withVarSumTag(ctx context.Context) context.Context {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	tag := ns.lastVars["vs"]
+	if tag == "" || ns.sync {
+		return ctx
+	}
+	return context.WithValue(ctx, varSumTagKey{}, tag)
+}
+
+// unmodifiedVars returns a copy of the vars most recently received if
+// vars, the reply to a vars request, indicates that they are unchanged,
+// else vars.
+func (ns *Sender) unmodifiedVars(vars map[string]string) map[string]string {
+	if vars[notModifiedKey] != "1" {
+		return vars
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.lastVars == nil || ns.lastVars["vs"] != vars["vs"] {
+		delete(vars, notModifiedKey)
+		return vars
+	}
+	ns.logger.Log(DebugLevel, debugVarsNotModified, "vs", vars["vs"])
+	return maps.Clone(ns.lastVars)
+}
@@ -0,0 +1,296 @@
+/*
+NAME
+  config.go provides a typed representation of the config params and
+  their validation.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ausocean/utils/filemap"
+	"github.com/ausocean/utils/sliceutils"
+)
+
+// Config is a typed representation of the config params (see
+// configParams). Config params are stored and written as strings, for
+// compatibility with existing config files and the service, so Config is
+// obtained by parsing them with ParseConfig.
+type Config struct {
+	MAC            string            // ma: MAC address, e.g., 00:00:00:00:00:01.
+	DeviceKey      string            // dk: device key, which is numeric.
+	WiFi           string            // wi: WiFi SSID,password.
+	Inputs         []string          // ip: input pin names.
+	Outputs        []string          // op: output pin names.
+	MonitorPeriod  time.Duration     // mp: monitor period.
+	ActPeriod      time.Duration     // ap: act period, or 0 for none.
+	ClientType     string            // ct: client type.
+	ClientVersion  string            // cv: client version.
+	Hardware       string            // hw: hardware.
+	Services       map[string]string // sh: service hosts keyed by request type, with | separated failover hosts.
+	FloatDecimals  map[string]int    // fs: decimal places keyed by float pin name.
+	RequireSigning bool              // rs: true if requests are signed.
+	ClientCert     string            // cc: client certificate file path.
+	ClientKey      string            // ck: client key file path.
+	PreviousKey    string            // pk: previous device key, while a key rotation is unacknowledged.
+	Extra          map[string]string // Other params, e.g., added by hand.
+}
+
+// pinName matches valid pin names, i.e., a pin type letter followed by
+// a pin number, e.g., A0 or X10.
+var pinName = regexp.MustCompile(`^[A-Z][0-9]+$`)
+
+// ParseConfig parses and validates config params, returning an error
+// describing every invalid param, if any. The ma and dk params are
+// required. Other missing params take their zero value, except sh which
+// defaults to the default service.
+func ParseConfig(params map[string]string) (*Config, error) {
+	c := &Config{Extra: make(map[string]string)}
+	var errs []error
+	for _, name := range []string{"ma", "dk"} {
+		if _, ok := params[name]; !ok {
+			errs = append(errs, fmt.Errorf("required %s param is missing", name))
+		}
+	}
+	if _, ok := params["sh"]; !ok {
+		c.Services = map[string]string{"default": defaultService}
+	}
+	for name, val := range params {
+		err := c.parseParam(name, val)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s param %q: %w", name, val, err))
+		}
+	}
+	if c.ClientKey != "" && c.ClientCert == "" {
+		errs = append(errs, errors.New("ck param requires cc param"))
+	}
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+	return c, nil
+}
+
+// validateParam returns an error if val is not a valid value for the
+// named config param.
+func validateParam(name, val string) error {
+	var c Config
+	err := c.parseParam(name, val)
+	if err != nil {
+		return fmt.Errorf("invalid %s param %q: %w", name, val, err)
+	}
+	return nil
+}
+
+// parseParam parses the value of the named config param into c.
+func (c *Config) parseParam(name, val string) error {
+	var err error
+	switch name {
+	case "ma":
+		err = validateMAC(val, false)
+		c.MAC = val
+	case "dk":
+		_, err = strconv.ParseInt(val, 10, 64)
+		c.DeviceKey = val
+	case "wi":
+		c.WiFi = val
+	case "ip":
+		c.Inputs, err = parsePins(val)
+	case "op":
+		c.Outputs, err = parsePins(val)
+	case "mp":
+		c.MonitorPeriod, err = parsePeriod(val, 1)
+	case "ap":
+		c.ActPeriod, err = parsePeriod(val, 0)
+	case "ct":
+		c.ClientType = val
+	case "cv":
+		c.ClientVersion = val
+	case "hw":
+		c.Hardware = val
+	case "sh":
+		c.Services, err = parseServices(val)
+	case "fs":
+		c.FloatDecimals, err = parseDecimals(val)
+	case "rs":
+		if val != "" {
+			c.RequireSigning, err = strconv.ParseBool(val)
+		}
+	case "cc":
+		c.ClientCert = val
+	case "ck":
+		c.ClientKey = val
+	case "pk":
+		if val != "" {
+			_, err = strconv.ParseInt(val, 10, 64)
+		}
+		c.PreviousKey = val
+	default:
+		if c.Extra == nil {
+			c.Extra = make(map[string]string)
+		}
+		c.Extra[name] = val
+	}
+	return err
+}
+
+// Params returns the config params represented by c, in the form in which
+// they are written to config files.
+func (c *Config) Params() map[string]string {
+	params := map[string]string{
+		"ma": c.MAC,
+		"dk": c.DeviceKey,
+		"wi": c.WiFi,
+		"ip": strings.Join(c.Inputs, ","),
+		"op": strings.Join(c.Outputs, ","),
+		"mp": strconv.Itoa(int(c.MonitorPeriod / time.Second)),
+		"ap": strconv.Itoa(int(c.ActPeriod / time.Second)),
+		"ct": c.ClientType,
+		"cv": c.ClientVersion,
+		"hw": c.Hardware,
+		"cc": c.ClientCert,
+		"ck": c.ClientKey,
+		"pk": c.PreviousKey,
+	}
+	var sh []string
+	for _, k := range requestTypes {
+		if h, ok := c.Services[k]; ok {
+			sh = append(sh, k+"="+h)
+		}
+	}
+	params["sh"] = strings.Join(sh, ",")
+	var fs []string
+	for pin, d := range c.FloatDecimals {
+		fs = append(fs, pin+":"+strconv.Itoa(d))
+	}
+	sort.Strings(fs)
+	params["fs"] = strings.Join(fs, ",")
+	params["rs"] = ""
+	if c.RequireSigning {
+		params["rs"] = "true"
+	}
+	for k, v := range c.Extra {
+		params[k] = v
+	}
+	return params
+}
+
+// TypedConfig returns the current config params as a Config.
+func (ns *Sender) TypedConfig() (*Config, error) {
+	return ParseConfig(ns.EffectiveConfig())
+}
+
+// parsePins parses a CSV list of pin names, which must be valid and
+// unique.
+func parsePins(csv string) ([]string, error) {
+	var pins []string
+	for _, pin := range strings.Split(csv, ",") {
+		if pin == "" {
+			continue
+		}
+		if !pinName.MatchString(pin) {
+			return nil, errors.New("invalid pin name: " + pin)
+		}
+		if sliceutils.ContainsString(pins, pin) {
+			return nil, errors.New("duplicate pin: " + pin)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// parsePeriod parses a period in seconds, which must be at least min.
+func parsePeriod(val string, min int) (time.Duration, error) {
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, err
+	}
+	if n < min {
+		return 0, fmt.Errorf("less than %d", min)
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// parseServices parses a service host (sh) param (see configServices) and
+// checks that every host is a valid host, with optional port, or URL.
+func parseServices(sh string) (map[string]string, error) {
+	services, err := configServices(sh)
+	if err != nil {
+		return nil, err
+	}
+	for _, hosts := range services {
+		for _, host := range strings.Split(hosts, hostSeparator) {
+			err := validateHost(host)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return services, nil
+}
+
+// validateHost checks that host is a host name or address, with optional
+// port, or a URL with a host, e.g., mqtt://broker.example.com:1883.
+func validateHost(host string) error {
+	raw := host
+	if !strings.Contains(host, "://") {
+		raw = "//" + host
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" || strings.ContainsAny(u.Hostname(), " \t") {
+		return errors.New("invalid service host: " + host)
+	}
+	if !strings.Contains(host, "://") && (u.Path != "" || u.RawQuery != "" || u.User != nil) {
+		return errors.New("invalid service host: " + host)
+	}
+	if p := u.Port(); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return errors.New("invalid port in service host: " + host)
+		}
+	}
+	return nil
+}
+
+// parseDecimals parses a float pin scale (fs) param, i.e., CSV
+// pin:decimals pairs.
+func parseDecimals(fs string) (map[string]int, error) {
+	decimals := make(map[string]int)
+	for pin, val := range filemap.Split(fs, ",", ":") {
+		if pin == "" {
+			continue
+		}
+		if !pinName.MatchString(pin) {
+			return nil, errors.New("invalid pin name: " + pin)
+		}
+		d, err := strconv.Atoi(val)
+		if err != nil || d < 0 {
+			return nil, errors.New("invalid decimal places for pin " + pin + ": " + val)
+		}
+		decimals[pin] = d
+	}
+	return decimals, nil
+}
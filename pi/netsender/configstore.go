@@ -0,0 +1,344 @@
+/*
+NAME
+  configstore.go provides config storage in the legacy netsender.conf
+  format, JSON or YAML.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ausocean/utils/filemap"
+)
+
+// ConfigStore reads and writes config params.
+type ConfigStore interface {
+	// Read returns the stored config params. If there is no stored config,
+	// the error satisfies errors.Is(err, fs.ErrNotExist).
+	Read() (map[string]string, error)
+
+	// Write stores the config params, in the given order. If the stored
+	// config is unchanged, Write may return ErrUnchanged.
+	Write(config map[string]string, order []string) error
+}
+
+// NewConfigStore returns a ConfigStore for the config file at path, whose
+// format is chosen by its extension, i.e., JSON for .json, YAML for .yaml
+// or .yml, and otherwise the legacy netsender.conf format.
+func NewConfigStore(path string) ConfigStore {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return NewJSONConfigStore(path)
+	case ".yaml", ".yml":
+		return NewYAMLConfigStore(path)
+	default:
+		return NewLegacyConfigStore(path)
+	}
+}
+
+// NewLegacyConfigStore returns a ConfigStore for a config file in the
+// legacy netsender.conf format, i.e., one "name value" param per line.
+func NewLegacyConfigStore(path string) ConfigStore {
+	return &fileStore{path: path, decode: decodeLegacy, encode: encodeLegacy}
+}
+
+// NewJSONConfigStore returns a ConfigStore for a config file containing
+// a JSON object of params, e.g., {"ma": "00:00:00:00:00:01", "mp": 60}.
+// Number and boolean values are read as their JSON text.
+func NewJSONConfigStore(path string) ConfigStore {
+	return &fileStore{path: path, decode: decodeJSON, encode: encodeJSON}
+}
+
+// NewYAMLConfigStore returns a ConfigStore for a config file containing
+// a YAML mapping of params, e.g., "mp: 60". Only flat mappings of scalars
+// are supported. When the file is written, params are updated in place
+// and comment lines are preserved.
+func NewYAMLConfigStore(path string) ConfigStore {
+	return &fileStore{path: path, decode: decodeYAML, encode: encodeYAML}
+}
+
+// WithConfigStore returns an option that sets the store used to read and
+// write config params, in place of the config file (see WithConfigFile).
+func WithConfigStore(cs ConfigStore) Option {
+	return func(s *Sender) error {
+		if cs == nil {
+			return errors.New("nil config store")
+		}
+		s.store = cs
+		return nil
+	}
+}
+
+// configStore returns the config store, which is the store set by
+// WithConfigStore, if any, else a store for the config file.
+func (s *Sender) configStore() ConfigStore {
+	if s.store != nil {
+		return s.store
+	}
+	return NewConfigStore(s.configFile)
+}
+
+// fileStore implements a ConfigStore backed by a file.
+type fileStore struct {
+	path   string
+	decode func([]byte) (map[string]string, error)
+	encode func(prev []byte, config map[string]string, order []string) ([]byte, error)
+}
+
+// Read implements ConfigStore.Read.
+func (f *fileStore) Read() (map[string]string, error) {
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := f.decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", f.path, err)
+	}
+	return config, nil
+}
+
+// Write implements ConfigStore.Write. The file is not rewritten if its
+// content would be unchanged, which reduces wear on SD cards. Otherwise,
+// it is replaced atomically, so that a power failure cannot leave a
+// partially written config, e.g., during a key rotation.
+func (f *fileStore) Write(config map[string]string, order []string) error {
+	prev, err := os.ReadFile(f.path)
+	if err != nil {
+		prev = nil
+	}
+	b, err := f.encode(prev, config, order)
+	if err != nil {
+		return err
+	}
+	if prev != nil && bytes.Equal(prev, b) {
+		return ErrUnchanged
+	}
+
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(f.path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), "."+filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// ErrUnchanged is returned by a ConfigStore's Write method when the
+// stored config is unchanged, in which case nothing was written.
+var ErrUnchanged = errors.New("config unchanged")
+
+// decodeLegacy decodes the legacy netsender.conf format.
+func decodeLegacy(b []byte) (map[string]string, error) {
+	return filemap.Split(string(b), "\n", " "), nil
+}
+
+// encodeLegacy encodes the legacy netsender.conf format.
+func encodeLegacy(prev []byte, config map[string]string, order []string) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, kv := range filemap.Sort(config, order) {
+		buf.WriteString(kv.Key + " " + kv.Value + "\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeJSON decodes a JSON object of params.
+func decodeJSON(b []byte) (map[string]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var obj map[string]interface{}
+	err := dec.Decode(&obj)
+	if err != nil {
+		return nil, err
+	}
+	config := make(map[string]string, len(obj))
+	for k, v := range obj {
+		switch v := v.(type) {
+		case string:
+			config[k] = v
+		case json.Number:
+			config[k] = v.String()
+		case bool:
+			config[k] = strconv.FormatBool(v)
+		case nil:
+			config[k] = ""
+		default:
+			return nil, fmt.Errorf("param %s is not a scalar", k)
+		}
+	}
+	return config, nil
+}
+
+// encodeJSON encodes a JSON object of params, in order.
+func encodeJSON(prev []byte, config map[string]string, order []string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, kv := range filemap.Sort(config, order) {
+		if i != 0 {
+			buf.WriteString(",")
+		}
+		k, _ := json.Marshal(kv.Key)
+		v, _ := json.Marshal(kv.Value)
+		buf.WriteString("\n  " + string(k) + ": " + string(v))
+	}
+	buf.WriteString("\n}\n")
+	return buf.Bytes(), nil
+}
+
+// yamlLine splits a line of a flat YAML mapping into its key and value,
+// returning false for blank lines, comments and document markers.
+func yamlLine(line string) (key, val string, ok bool, err error) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || trimmed[0] == '#' || trimmed == "---" || trimmed == "..." {
+		return "", "", false, nil
+	}
+	if line[0] == ' ' || line[0] == '\t' || trimmed[0] == '-' {
+		return "", "", false, fmt.Errorf("unsupported YAML, only flat mappings are supported: %q", line)
+	}
+	i := strings.Index(line, ":")
+	if i < 0 || (i+1 < len(line) && line[i+1] != ' ' && line[i+1] != '\t') {
+		return "", "", false, fmt.Errorf("expected key: value, got %q", line)
+	}
+	key = strings.TrimSpace(line[:i])
+	val, err = yamlValue(strings.TrimSpace(line[i+1:]))
+	if err != nil {
+		return "", "", false, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return key, val, true, nil
+}
+
+// yamlValue decodes a YAML scalar, which may be quoted or followed by a
+// comment.
+func yamlValue(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := 1
+		for ; end < len(s); end++ {
+			if s[end] == '\\' {
+				end++
+			} else if s[end] == '"' {
+				break
+			}
+		}
+		if end >= len(s) {
+			return "", errors.New("unterminated string")
+		}
+		return strconv.Unquote(s[:end+1])
+	case strings.HasPrefix(s, "'"):
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				b.WriteByte(s[i])
+				continue
+			}
+			if i+1 < len(s) && s[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+				continue
+			}
+			return b.String(), nil
+		}
+		return "", errors.New("unterminated string")
+	}
+	if s == "~" || s == "null" {
+		return "", nil
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// yamlQuote returns val as a YAML scalar, quoted if necessary.
+func yamlQuote(val string) string {
+	if val == "" || val == "~" || val == "null" || strings.TrimSpace(val) != val ||
+		strings.ContainsAny(val[:1], "-?:,[]{}#&*!|>'\"%@`") ||
+		strings.Contains(val, ":") || strings.Contains(val, " #") ||
+		strings.ContainsAny(val, "\n\t\\") {
+		return strconv.Quote(val)
+	}
+	return val
+}
+
+// decodeYAML decodes a flat YAML mapping of params.
+func decodeYAML(b []byte) (map[string]string, error) {
+	config := make(map[string]string)
+	for _, line := range strings.Split(string(b), "\n") {
+		key, val, ok, err := yamlLine(strings.TrimRight(line, "\r"))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			config[key] = val
+		}
+	}
+	return config, nil
+}
+
+// encodeYAML encodes a flat YAML mapping of params. Params present in the
+// previous file content are updated in place, if changed, preserving
+// comments and order, and others are appended in order.
+func encodeYAML(prev []byte, config map[string]string, order []string) ([]byte, error) {
+	var buf bytes.Buffer
+	written := make(map[string]bool)
+	if len(prev) != 0 {
+		for _, line := range strings.SplitAfter(strings.TrimSuffix(string(prev), "\n"), "\n") {
+			key, old, ok, err := yamlLine(strings.TrimRight(line, "\r\n"))
+			val, present := config[key]
+			if ok && present {
+				written[key] = true
+			}
+			if err != nil || !ok || !present || val == old {
+				buf.WriteString(strings.TrimSuffix(line, "\n") + "\n")
+				continue
+			}
+			buf.WriteString(key + ": " + yamlQuote(val) + "\n")
+		}
+	}
+	for _, kv := range filemap.Sort(config, order) {
+		if !written[kv.Key] {
+			buf.WriteString(kv.Key + ": " + yamlQuote(kv.Value) + "\n")
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,144 @@
+/*
+NAME
+  failover.go provides failover between multiple service hosts for a
+  request type, so that a device keeps reporting when its primary service
+  host is down.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// hostSeparator separates failover hosts in the sh param.
+const hostSeparator = "|"
+
+// Failover health check timing.
+const (
+	minHostBackoff = 30 * time.Second // Time before a down host is first health checked.
+	maxHostBackoff = 10 * time.Minute // Maximum time between health checks of a down host.
+)
+
+// hostState records the health of a service host which is down.
+type hostState struct {
+	failures int       // Consecutive failures.
+	checkAt  time.Time // Time of the next health check.
+}
+
+// pickHost returns the first host in the |-separated list of hosts which
+// is not down, else the first host. ns.mu must be held.
+func (ns *Sender) pickHost(hosts string) string {
+	if !strings.Contains(hosts, hostSeparator) {
+		return hosts
+	}
+	list := strings.Split(hosts, hostSeparator)
+	for _, host := range list {
+		if _, down := ns.downHosts[host]; !down {
+			return host
+		}
+	}
+	return list[0]
+}
+
+// markHost records the outcome of a request to host. A host is marked
+// down when a request fails without a service error, so that requests
+// fail over to the next host in its list, and is marked up again by a
+// successful request or health check. Only hosts which have failover
+// hosts are tracked.
+func (ns *Sender) markHost(host string, err error) {
+	ns.mu.Lock()
+	if !ns.hasFailover(host) {
+		ns.mu.Unlock()
+		return
+	}
+	var se *ServerError
+	if err == nil || errors.As(err, &se) {
+		_, down := ns.downHosts[host]
+		delete(ns.downHosts, host)
+		ns.mu.Unlock()
+		if down {
+			ns.logger.Log(InfoLevel, infoHostUp, "host", host)
+		}
+		return
+	}
+	if ns.downHosts == nil {
+		ns.downHosts = make(map[string]*hostState)
+	}
+	hs, down := ns.downHosts[host]
+	if !down {
+		hs = &hostState{}
+		ns.downHosts[host] = hs
+	}
+	hs.failures++
+	backoff := maxHostBackoff
+	if hs.failures < 6 {
+		backoff = min(minHostBackoff<<(hs.failures-1), maxHostBackoff)
+	}
+	hs.checkAt = time.Now().Add(backoff)
+	ns.mu.Unlock()
+	if !down {
+		ns.logger.Log(WarningLevel, warnHostDown, "host", host, "error", err.Error())
+	}
+}
+
+// hasFailover returns true if host is in a list of failover hosts in the
+// sh param. ns.mu must be held.
+func (ns *Sender) hasFailover(host string) bool {
+	for _, hosts := range ns.services {
+		if !strings.Contains(hosts, hostSeparator) {
+			continue
+		}
+		for _, h := range strings.Split(hosts, hostSeparator) {
+			if h == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkHosts health checks down hosts which are due for a check, by
+// pinging them, so that requests fail back to a preferred host once it
+// is up again. MQTT brokers are instead checked by the next request.
+func (ns *Sender) checkHosts(ctx context.Context) {
+	ns.mu.Lock()
+	var due []string
+	for host, hs := range ns.downHosts {
+		if !time.Now().Before(hs.checkAt) {
+			due = append(due, host)
+		}
+	}
+	ns.mu.Unlock()
+	for _, host := range due {
+		if strings.HasPrefix(host, mqttScheme) {
+			// Brokers cannot be pinged, so let the next request check.
+			ns.markHost(host, nil)
+			continue
+		}
+		_, err := ns.ping(ctx, host)
+		if ctx.Err() != nil {
+			return
+		}
+		ns.markHost(host, err)
+	}
+}
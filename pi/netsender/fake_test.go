@@ -0,0 +1,161 @@
+/*
+NAME
+  fake_test.go provides an offline fake of the NetReceiver service for tests.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeService is an offline fake of the NetReceiver service, which
+// implements the requests made by a Sender, so that tests do not depend
+// on the network or a live service.
+type fakeService struct {
+	mu       sync.Mutex
+	mode     string            // Device mode, synced by the md param.
+	error    string            // Device error, synced by the er param.
+	vars     map[string]string // Other vars.
+	varSum   int               // Var sum returned in replies.
+	config   map[string]string // Config params returned by config requests.
+	rc       int               // Response code returned by poll and config requests.
+	pins     map[string]string // Pin params of the last poll.
+	uploaded int64             // Bytes received by upload speed tests.
+	delay    time.Duration     // Delay before replying.
+}
+
+// newFakeService returns a fakeService, which is used as the handler of
+// newTestSender, e.g., newTestSender(t, fakeConfig(), fs.ServeHTTP).
+//
+// NB: netspoofer.Handler cannot be used instead, since netspoofer imports
+// netsender.
+func newFakeService() *fakeService {
+	return &fakeService{
+		mode:   "Normal",
+		vars:   map[string]string{},
+		config: map[string]string{},
+	}
+}
+
+// fakeConfig returns the config of a Sender using the fake service.
+func fakeConfig() map[string]string {
+	return map[string]string{"ma": "00:00:00:00:00:01", "dk": "10000001", "ip": "X10", "mp": "1"}
+}
+
+// ServeHTTP implements http.Handler.
+func (fs *fakeService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	delay := fs.delay
+	fs.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, downloadTestPath):
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, downloadTestPath))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write(make([]byte, n))
+		return
+	case strings.HasPrefix(r.URL.Path, uploadTestPath):
+		n, _ := io.Copy(io.Discard, r.Body)
+		fs.mu.Lock()
+		fs.uploaded += n
+		fs.mu.Unlock()
+		return
+	}
+
+	q := r.URL.Query()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if q.Has("md") {
+		fs.mode = q.Get("md")
+	}
+	if q.Has("er") {
+		fs.error = q.Get("er")
+	}
+	reply := map[string]interface{}{}
+	switch r.URL.Path {
+	case "/vars":
+		for k, v := range fs.vars {
+			reply[k] = v
+		}
+		reply["mode"] = fs.mode
+		reply["error"] = fs.error
+		reply["vs"] = strconv.Itoa(fs.varSum)
+	case "/config":
+		for k, v := range fs.config {
+			reply[k] = v
+			if n, err := strconv.Atoi(v); err == nil && slices.Contains(configNumbers, k) {
+				reply[k] = n
+			}
+		}
+		reply["rc"] = fs.rc
+		reply["vs"] = fs.varSum
+	case "/poll", "/act":
+		fs.pins = map[string]string{}
+		for k := range q {
+			if len(k) >= 2 && strings.ContainsRune("ADTX", rune(k[0])) && !strings.Contains(k, ".") {
+				fs.pins[k] = q.Get(k)
+			}
+		}
+		io.Copy(io.Discard, r.Body)
+		reply["rc"] = fs.rc
+		reply["vs"] = fs.varSum
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	// Replies must not end with a newline, since the Sender reads the last line.
+	b, _ := json.Marshal(reply)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// setVars sets the vars other than the mode and error, and increments the
+// var sum.
+func (fs *fakeService) setVars(vars map[string]string) {
+	fs.mu.Lock()
+	fs.vars = maps.Clone(vars)
+	fs.varSum++
+	fs.mu.Unlock()
+}
+
+// lastPins returns the pin params of the last poll.
+func (fs *fakeService) lastPins() map[string]string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return maps.Clone(fs.pins)
+}
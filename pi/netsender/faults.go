@@ -0,0 +1,113 @@
+/*
+NAME
+  faults.go provides in-process network fault injection for testing
+  netsender clients.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultConfig describes network faults to inject into service requests.
+// It is intended for testing the resilience of client loops without
+// external tooling and must not be used in production.
+type FaultConfig struct {
+	Delay        time.Duration // Delay added to every request.
+	DropRate     float64       // Fraction of requests, in [0,1], which fail with a network error.
+	Status       int           // HTTP status returned for every request instead of forwarding it, if non-zero.
+	ServiceError string        // Service error code (er) returned for every request instead of forwarding it, if non-empty.
+	Seed         int64         // Seed for deciding which requests to drop, so that faults are reproducible.
+}
+
+// errInjectedDrop is returned for requests dropped by fault injection.
+var errInjectedDrop = errors.New("request dropped by fault injection")
+
+// WithFaultInjection returns an option that injects the faults described
+// by fc into all service requests. It is intended for testing only.
+func WithFaultInjection(fc FaultConfig) Option {
+	return func(s *Sender) error {
+		if fc.DropRate < 0 || fc.DropRate > 1 {
+			return fmt.Errorf("invalid drop rate: %v", fc.DropRate)
+		}
+		next := s.roundTripper
+		if next == nil {
+			next = sharedTransport()
+		}
+		s.roundTripper = &faultTransport{fc: fc, next: next, rand: rand.New(rand.NewSource(fc.Seed))}
+		return nil
+	}
+}
+
+// faultTransport implements an http.RoundTripper which injects faults.
+type faultTransport struct {
+	fc   FaultConfig
+	next http.RoundTripper
+	mu   sync.Mutex // Protects rand.
+	rand *rand.Rand
+}
+
+// RoundTrip implements http.RoundTripper.
+func (ft *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ft.fc.Delay > 0 {
+		select {
+		case <-time.After(ft.fc.Delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	ft.mu.Lock()
+	drop := ft.rand.Float64() < ft.fc.DropRate
+	ft.mu.Unlock()
+	if drop {
+		return nil, errInjectedDrop
+	}
+
+	switch {
+	case ft.fc.Status != 0:
+		return faultResponse(req, ft.fc.Status, http.StatusText(ft.fc.Status)), nil
+	case ft.fc.ServiceError != "":
+		return faultResponse(req, http.StatusOK, `{"er":"`+ft.fc.ServiceError+`"}`), nil
+	}
+	return ft.next.RoundTrip(req)
+}
+
+// faultResponse returns an HTTP response with the given status and body.
+func faultResponse(req *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,80 @@
+/*
+NAME
+  flush.go provides on demand flushing of data buffered by netsender
+  clients, e.g., before shutdown.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// FlushFunc sends all data buffered by a client component using the
+// given Sender, returning the amount of data sent, in units defined by
+// the component, e.g., bytes of logs. A FlushFunc should return early
+// if the context is cancelled.
+type FlushFunc func(ctx context.Context, ns *Sender) (int, error)
+
+// flusher is a named FlushFunc.
+type flusher struct {
+	name  string
+	flush FlushFunc
+}
+
+// AddFlusher registers a FlushFunc to be called by FlushAll. Flushers
+// are called in the order in which they were added. The name is used
+// for logging.
+func (ns *Sender) AddFlusher(name string, f FlushFunc) {
+	ns.mu.Lock()
+	ns.flushers = append(ns.flushers, flusher{name: name, flush: f})
+	ns.mu.Unlock()
+}
+
+// FlushAll sends all buffered data immediately, regardless of the
+// normal send cadence, by calling each registered FlushFunc in turn.
+// It returns when all flushers have been called or the context is
+// cancelled. Errors from individual flushers do not prevent others
+// from being called and are joined in the returned error.
+// FlushAll is safe to call concurrently with Run and Send, and
+// concurrent calls to FlushAll are serialized.
+func (ns *Sender) FlushAll(ctx context.Context) error {
+	ns.flushing.Lock()
+	defer ns.flushing.Unlock()
+
+	ns.mu.Lock()
+	flushers := append([]flusher(nil), ns.flushers...)
+	ns.mu.Unlock()
+
+	var errs []error
+	for _, f := range flushers {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		n, err := f.flush(ctx, ns)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not flush %s: %w", f.name, err))
+		}
+		ns.logger.Log(InfoLevel, infoFlushed, "name", f.name, "amount", n)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,161 @@
+/*
+NAME
+  levels.go provides per-subsystem log levels, set by vars and applied by
+  named Loggers.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Logging vars.
+const (
+	loggingVar       = "logging"  // Log level of all subsystems.
+	loggingVarPrefix = "logging." // Prefix of the log level var of a subsystem, e.g., logging.alignment.
+)
+
+// senderSubsystem is the subsystem name of the Sender's own log messages.
+const senderSubsystem = "netsender"
+
+// subsystemLevels holds the log levels set by the logging.<subsystem>
+// vars. It has its own mutex, rather than using the Sender's, since it is
+// used for every log message.
+type subsystemLevels struct {
+	mu    sync.Mutex
+	named map[string]int8 // Levels set by logging.<subsystem> vars.
+}
+
+// level returns the log level of the named subsystem, and true, or false
+// if it has no level of its own and so follows the client's Logger.
+func (sl *subsystemLevels) level(name string) (int8, bool) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	l, ok := sl.named[name]
+	return l, ok
+}
+
+// namedLogger is a Logger for a subsystem, which logs messages to the
+// client's Logger if they are at or above the subsystem's level.
+type namedLogger struct {
+	ns   *Sender
+	name string
+}
+
+// Logger returns a Logger for the named subsystem, e.g., "alignment",
+// which logs to the Logger passed to New, with the subsystem name as the
+// "logger" param. Its messages are filtered by the level set by the
+// logging.<name> var, if any, e.g., logging.netsender=Warning, and are
+// then logged by the client's Logger at its own level, which is set by
+// the logging var. Subsystems without a level of their own follow the
+// client's Logger.
+//
+// Since the client's Logger still filters every message, a subsystem can
+// only be made quieter than it. To debug one subsystem without Debug
+// messages from every other, set logging=Debug and raise the levels of
+// the others, e.g., logging.netsender=Info.
+func (ns *Sender) Logger(name string) Logger {
+	return &namedLogger{ns: ns, name: name}
+}
+
+// SetLevel implements Logger.SetLevel. It sets the level of the
+// subsystem until the vars are next received.
+func (l *namedLogger) SetLevel(level int8) {
+	sl := &l.ns.levels
+	sl.mu.Lock()
+	if sl.named == nil {
+		sl.named = make(map[string]int8)
+	}
+	sl.named[l.name] = level
+	sl.mu.Unlock()
+}
+
+// Log implements Logger.Log.
+func (l *namedLogger) Log(level int8, message string, params ...interface{}) {
+	if min, ok := l.ns.levels.level(l.name); ok && level < min {
+		return
+	}
+	params = append(params[:len(params):len(params)], "logger", l.name)
+	l.ns.base().Log(level, message, params...)
+}
+
+// base returns the Logger passed to New, or the Sender's Logger if the
+// Sender was not initialized by New.
+func (ns *Sender) base() Logger {
+	if ns.baseLogger == nil {
+		return ns.logger
+	}
+	return ns.baseLogger
+}
+
+// setLogLevels sets the level of the client's Logger from the logging
+// var, and the subsystem levels from the logging.<subsystem> vars, if
+// present. Subsystems whose vars are no longer present revert to
+// following the client's Logger.
+func (ns *Sender) setLogLevels(vars map[string]string) {
+	// Levels are parsed before locking, since logging locks sl.mu.
+	def, defOK := int8(0), false
+	logging, present := vars[loggingVar]
+	if present {
+		level, err := ParseLogLevel(logging)
+		if err != nil {
+			ns.logger.Log(WarningLevel, warnSetLogLevel, "LogLevel", logging, "valid", strings.Join(LogLevels(), ","))
+		} else {
+			def, defOK = level, true
+		}
+	}
+
+	var keys, names []string
+	for k := range vars {
+		if strings.HasPrefix(k, loggingVarPrefix) && len(k) > len(loggingVarPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var named map[string]int8
+	for _, k := range keys {
+		level, err := ParseLogLevel(vars[k])
+		if err != nil {
+			ns.logger.Log(WarningLevel, warnSetLogLevel, "LogLevel", vars[k], "var", k, "valid", strings.Join(LogLevels(), ","))
+			continue
+		}
+		if named == nil {
+			named = make(map[string]int8)
+		}
+		named[k[len(loggingVarPrefix):]] = level
+		names = append(names, k[len(loggingVarPrefix):])
+	}
+
+	sl := &ns.levels
+	sl.mu.Lock()
+	if !defOK && len(named) == 0 && len(sl.named) == 0 {
+		sl.mu.Unlock()
+		return
+	}
+	sl.named = named
+	sl.mu.Unlock()
+
+	if defOK {
+		ns.base().SetLevel(def)
+	}
+	ns.logger.Log(DebugLevel, debugSetLogLevel, "LogLevel", logging, "subsystems", strings.Join(names, ","))
+}
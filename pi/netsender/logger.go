@@ -0,0 +1,103 @@
+/*
+NAME
+  logger.go provides simple implementations of the netsender Logger
+  interface.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// NopLogger implements a Logger that discards all log entries.
+// It is used when a client does not supply a Logger.
+type NopLogger struct{}
+
+// SetLevel implements Logger.SetLevel.
+func (NopLogger) SetLevel(int8) {}
+
+// Log implements Logger.Log.
+func (NopLogger) Log(level int8, message string, params ...interface{}) {}
+
+// StdLogger implements a Logger that writes log entries to standard
+// output, one per line, in the form "Level: message key:value ...".
+// The zero value logs entries at or above InfoLevel.
+type StdLogger struct {
+	mu    sync.Mutex
+	level int8
+	w     io.Writer
+}
+
+// NewStdLogger returns a new StdLogger which logs entries at or above the given level.
+func NewStdLogger(level int8) *StdLogger {
+	return &StdLogger{level: level, w: os.Stdout}
+}
+
+// SetLevel implements Logger.SetLevel.
+func (l *StdLogger) SetLevel(level int8) {
+	l.mu.Lock()
+	l.level = level
+	l.mu.Unlock()
+}
+
+// Log implements Logger.Log. Params are key/value pairs.
+func (l *StdLogger) Log(level int8, message string, params ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(levelName(level) + ": " + message)
+	for i := 0; i < len(params); i += 2 {
+		fmt.Fprintf(&b, " %v", params[i])
+		if i+1 < len(params) {
+			fmt.Fprintf(&b, ":%v", params[i+1])
+		}
+	}
+	b.WriteByte('\n')
+	w := l.w
+	if w == nil {
+		w = os.Stdout
+	}
+	io.WriteString(w, b.String())
+}
+
+// levelName returns the name of a log level.
+func levelName(level int8) string {
+	switch level {
+	case DebugLevel:
+		return "Debug"
+	case InfoLevel:
+		return "Info"
+	case WarningLevel:
+		return "Warning"
+	case ErrorLevel:
+		return "Error"
+	case FatalLevel:
+		return "Fatal"
+	default:
+		return fmt.Sprintf("Level(%d)", level)
+	}
+}
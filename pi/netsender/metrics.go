@@ -0,0 +1,277 @@
+/*
+NAME
+  metrics.go provides internal health metrics, reported on software-defined
+  pins and optionally served in the Prometheus text format.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Health metric pins, which report the metrics of the Sender when
+// included in the inputs.
+const (
+	requestsPin   = "X90" // Number of service requests.
+	failuresPin   = "X91" // Number of failed service requests.
+	retriesPin    = "X92" // Number of retried service requests.
+	bytesSentPin  = "X93" // Approximate number of bytes sent, in kilobytes.
+	latencyP50Pin = "X94" // Median request latency in seconds.
+	latencyP95Pin = "X95" // 95th percentile request latency in seconds.
+	varSumAgePin  = "X96" // Seconds since a var sum was last received.
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram buckets, besides the final +Inf bucket.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metricsPath is the path on which WithMetricsListener serves metrics.
+const metricsPath = "/metrics"
+
+// metrics holds the health metrics of a Sender, guarded by the Sender's mu.
+type metrics struct {
+	requests   int64     // Service requests made.
+	failures   int64     // Service requests which failed, including service errors.
+	retries    int64     // Service requests which were retries (see RequestID).
+	bytesSent  int64     // Approximate bytes sent.
+	latency    []int64   // Request latency histogram counts, per latencyBuckets, plus +Inf.
+	latencySum float64   // Sum of request latencies in seconds.
+	latencyMax float64   // Maximum request latency in seconds.
+	varSumAt   time.Time // Time a var sum was last received, or zero.
+}
+
+// Metrics is a snapshot of the health metrics of a Sender.
+type Metrics struct {
+	Requests   int64         // Service requests made since the Sender was initialized.
+	Failures   int64         // Service requests which failed, including service errors.
+	Retries    int64         // Service requests which were retries of failed requests.
+	BytesSent  int64         // Approximate bytes sent in service requests.
+	LatencyP50 time.Duration // Estimated median request latency.
+	LatencyP95 time.Duration // Estimated 95th percentile request latency.
+	VarSumAge  time.Duration // Time since a var sum was last received, or -1 if never.
+}
+
+// Metrics returns a snapshot of the health metrics of the Sender.
+// Latency percentiles are estimated from a histogram, so are the upper
+// bound of the bucket containing the percentile, or the maximum latency
+// observed if that is lower.
+func (ns *Sender) Metrics() Metrics {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	m := &ns.metrics
+	snap := Metrics{
+		Requests:   m.requests,
+		Failures:   m.failures,
+		Retries:    m.retries,
+		BytesSent:  m.bytesSent,
+		LatencyP50: seconds(m.latencyPercentile(50)),
+		LatencyP95: seconds(m.latencyPercentile(95)),
+		VarSumAge:  -1,
+	}
+	if !m.varSumAt.IsZero() {
+		snap.VarSumAge = time.Since(m.varSumAt)
+	}
+	return snap
+}
+
+// recordRequest records the outcome of a service request.
+// ns.mu must be held.
+func (m *metrics) recordRequest(err error) {
+	m.requests++
+	if err != nil {
+		m.failures++
+	}
+}
+
+// recordLatency records the latency and size of a service request.
+func (ns *Sender) recordLatency(rtt time.Duration, size int) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	m := &ns.metrics
+	if m.latency == nil {
+		m.latency = make([]int64, len(latencyBuckets)+1)
+	}
+	s := rtt.Seconds()
+	i := 0
+	for i < len(latencyBuckets) && s > latencyBuckets[i] {
+		i++
+	}
+	m.latency[i]++
+	m.latencySum += s
+	if s > m.latencyMax {
+		m.latencyMax = s
+	}
+	m.bytesSent += int64(size)
+}
+
+// latencyPercentile returns the estimated pth percentile request latency
+// in seconds, or 0 if no requests have been made.
+func (m *metrics) latencyPercentile(p int) float64 {
+	var n int64
+	for _, c := range m.latency {
+		n += c
+	}
+	if n == 0 {
+		return 0
+	}
+	rank := (n*int64(p) + 99) / 100
+	var cum int64
+	for i, c := range m.latency {
+		cum += c
+		if cum >= rank && i < len(latencyBuckets) {
+			return min(latencyBuckets[i], m.latencyMax)
+		}
+	}
+	return m.latencyMax
+}
+
+// requestSize returns the approximate size in bytes of a service request
+// with the given path and pins.
+func requestSize(path string, pins []Pin) int {
+	n := len(path)
+	for _, pin := range pins {
+		if pin.MimeType != "" {
+			n += dataLen(pin)
+		}
+	}
+	return n
+}
+
+// seconds converts seconds to a duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// metricPin sets the value of a health metric pin.
+func (ns *Sender) metricPin(pin *Pin) {
+	m := ns.Metrics()
+	switch pin.Name {
+	case requestsPin:
+		pin.Value = int(m.Requests)
+	case failuresPin:
+		pin.Value = int(m.Failures)
+	case retriesPin:
+		pin.Value = int(m.Retries)
+	case bytesSentPin:
+		pin.Value = int(m.BytesSent / 1000)
+	case latencyP50Pin:
+		pin.SetFloat(m.LatencyP50.Seconds())
+	case latencyP95Pin:
+		pin.SetFloat(m.LatencyP95.Seconds())
+	case varSumAgePin:
+		pin.Value = -1
+		if m.VarSumAge >= 0 {
+			pin.Value = int(m.VarSumAge.Seconds())
+		}
+	}
+}
+
+// MetricsHandler returns an HTTP handler which serves the health metrics
+// of the Sender in the Prometheus text exposition format, e.g., for
+// clients that already run an HTTP server. See also WithMetricsListener.
+func (ns *Sender) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		ns.writeMetrics(w)
+	})
+}
+
+// writeMetrics writes the health metrics in the Prometheus text format.
+func (ns *Sender) writeMetrics(w io.Writer) {
+	ns.mu.Lock()
+	m := ns.metrics
+	m.latency = append([]int64(nil), m.latency...)
+	stats := make(map[int]Stats, len(ns.stats))
+	for k, v := range ns.stats {
+		stats[k] = v
+	}
+	ns.mu.Unlock()
+
+	counter := func(name, help string, val int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, val)
+	}
+	counter("netsender_requests_total", "Service requests made.", m.requests)
+	counter("netsender_request_failures_total", "Service requests which failed.", m.failures)
+	counter("netsender_request_retries_total", "Service requests which retried a failed request.", m.retries)
+	counter("netsender_sent_bytes_total", "Approximate bytes sent in service requests.", m.bytesSent)
+
+	fmt.Fprint(w, "# HELP netsender_request_outcomes_total Service request outcomes by request type.\n# TYPE netsender_request_outcomes_total counter\n")
+	for rt, name := range requestTypes {
+		st, ok := stats[rt]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "netsender_request_outcomes_total{type=%q,outcome=\"success\"} %d\n", name, st.Success)
+		fmt.Fprintf(w, "netsender_request_outcomes_total{type=%q,outcome=\"failure\"} %d\n", name, st.Failure)
+	}
+
+	fmt.Fprint(w, "# HELP netsender_request_duration_seconds Service request latency.\n# TYPE netsender_request_duration_seconds histogram\n")
+	var cum int64
+	for i, c := range m.latency {
+		cum += c
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "netsender_request_duration_seconds_bucket{le=%q} %d\n", le, cum)
+	}
+	if m.latency == nil {
+		fmt.Fprint(w, "netsender_request_duration_seconds_bucket{le=\"+Inf\"} 0\n")
+	}
+	fmt.Fprintf(w, "netsender_request_duration_seconds_sum %g\n", m.latencySum)
+	fmt.Fprintf(w, "netsender_request_duration_seconds_count %d\n", cum)
+
+	if !m.varSumAt.IsZero() {
+		fmt.Fprint(w, "# HELP netsender_varsum_age_seconds Time since a var sum was last received.\n# TYPE netsender_varsum_age_seconds gauge\n")
+		fmt.Fprintf(w, "netsender_varsum_age_seconds %g\n", time.Since(m.varSumAt).Seconds())
+	}
+}
+
+// WithMetricsListener returns an option that serves the health metrics of
+// the Sender on addr, e.g., ":9100", at /metrics, so that they can be
+// scraped on the local network. The listener is closed by Close.
+func WithMetricsListener(addr string) Option {
+	return func(s *Sender) error {
+		if s.metricsServer != nil {
+			return errors.New("metrics listener already set")
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("could not listen for metrics: %w", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle(metricsPath, s.MetricsHandler())
+		srv := &http.Server{Handler: mux, ReadHeaderTimeout: Timeout}
+		s.metricsServer = srv
+		go func() {
+			err := srv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.logger.Log(WarningLevel, warnMetricsServe, "error", err.Error())
+			}
+		}()
+		return nil
+	}
+}
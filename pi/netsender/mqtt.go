@@ -0,0 +1,479 @@
+/*
+NAME
+  mqtt.go provides an MQTT transport for netsender service requests, for
+  use on constrained links where repeated HTTP requests are costly.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mqttScheme is the service host scheme which selects the MQTT transport,
+// e.g., sh default=mqtt://broker.example.com:1883.
+const mqttScheme = "mqtt://"
+
+// mqttTopicPrefix is the prefix of all netsender MQTT topics.
+//
+// A request of type T from the device with MAC address M is published to
+// netsender/M/T/C, where C is a correlation ID unique to the connection,
+// with a payload of the request path, a newline, and any binary pin data.
+// The service publishes its JSON reply to netsender/M/reply/C, and replies
+// with any other correlation ID, such as those of requests which timed
+// out, are ignored.
+//
+// Whenever the device's vars change, the service also publishes the new
+// var sum to netsender/M/vars, as {"vs":"<var sum>"}, whereupon the device
+// fetches its vars without waiting for its next request. This requires
+// the broker connection, which is kept alive between requests, to have
+// been established by an earlier request.
+const mqttTopicPrefix = "netsender/"
+
+// mqttKeepAlive is the MQTT keep alive interval. A PINGREQ is sent every
+// half interval, and the connection is closed if nothing is received from
+// the broker for one and a half intervals.
+const mqttKeepAlive = 60 * time.Second
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// MQTT transport errors.
+var (
+	errMQTTRefused = errors.New("mqtt connection refused")
+	errMQTTSigning = errors.New("mqtt requests cannot be signed, as required by rs")
+	errMQTTClosed  = errors.New("mqtt connection closed")
+	errMQTTTimeout = errors.New("timed out waiting for mqtt reply")
+)
+
+// mqttTransport implements a Transport which publishes requests to an MQTT
+// broker and waits for the correlated reply on the device's reply topic.
+// The broker connection is kept open between requests, with keep alives,
+// and re-established by the next request after an error. Only QoS 0 is
+// used, so a lost request is reported as a timeout. Since requests cannot
+// be signed, they are refused when the rs param requires signing, rather
+// than being sent without the device key.
+type mqttTransport struct {
+	ns        *Sender       // Sender whose rs param is checked and whose vars are fetched on change.
+	keepAlive time.Duration // Keep alive interval, or 0 for mqttKeepAlive.
+	fetching  atomic.Bool   // True while fetching vars after a var sum change.
+
+	mu      sync.Mutex                // Guards the following and serializes writes.
+	broker  string                    // Address of the current connection.
+	device  string                    // Topic prefix of the device of the current connection.
+	conn    net.Conn                  // Current connection, or nil.
+	done    chan struct{}             // Closed when the current connection is closed.
+	nextID  uint64                    // Next correlation ID.
+	pending map[string]chan mqttReply // Reply receivers of requests in flight, by correlation ID.
+}
+
+// mqttReply is the reply to a request, or the error which prevented it.
+type mqttReply struct {
+	reply string
+	err   error
+}
+
+// Request implements Transport.Request.
+func (t *mqttTransport) Request(ctx context.Context, host, path string, pins []Pin) (string, error) {
+	if t.ns != nil && t.ns.signing() {
+		return "", errMQTTSigning
+	}
+	broker := strings.TrimPrefix(host, mqttScheme)
+	u, err := url.Parse(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid request path: %w", err)
+	}
+	ma := u.Query().Get("ma")
+	if ma == "" {
+		return "", errors.New("mqtt request requires ma param")
+	}
+	device := mqttTopicPrefix + ma + "/"
+
+	var payload bytes.Buffer
+	payload.WriteString(path + "\n")
+	for _, pin := range pins {
+		switch {
+		case pin.MimeType == "":
+		case pin.DataReader != nil:
+			_, err := io.CopyN(&payload, pin.DataReader, int64(pin.Value))
+			if err != nil {
+				return "", fmt.Errorf("could not read pin %s data: %w", pin.Name, err)
+			}
+		case len(pin.Data) != 0:
+			payload.Write(pin.Data)
+		}
+	}
+
+	id, ch, err := t.publish(ctx, broker, device, strings.TrimPrefix(u.Path, "/"), payload.Bytes())
+	if err != nil {
+		return "", err
+	}
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.reply, r.err
+	case <-ctx.Done():
+		t.forget(id)
+		return "", ctx.Err()
+	case <-timer.C:
+		t.forget(id)
+		return "", errMQTTTimeout
+	}
+}
+
+// publish publishes a request, connecting to the broker if necessary, and
+// returns its correlation ID and the channel on which its reply is sent.
+// The connection is established without holding t.mu, so that a slow
+// broker does not block other requests or the dispatch of their replies.
+func (t *mqttTransport) publish(ctx context.Context, broker, device, requestType string, payload []byte) (string, chan mqttReply, error) {
+	t.mu.Lock()
+	connected := t.connected(broker, device)
+	t.mu.Unlock()
+	if !connected {
+		conn, r, err := t.connect(ctx, broker, device)
+		if err != nil {
+			return "", nil, err
+		}
+		t.mu.Lock()
+		if t.connected(broker, device) {
+			// Another request connected first, so this connection is discarded.
+			writeMQTTPacket(conn, mqttDisconnect<<4, nil)
+			conn.Close()
+		} else {
+			t.close()
+			t.start(conn, r, broker, device)
+		}
+		t.mu.Unlock()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.connected(broker, device) {
+		return "", nil, errMQTTClosed
+	}
+	t.nextID++
+	id := strconv.FormatUint(t.nextID, 10)
+	ch := make(chan mqttReply, 1)
+	t.pending[id] = ch
+	err := t.write(mqttPublish<<4, mqttPublishBody(device+requestType+"/"+id, payload))
+	if err != nil {
+		t.close()
+		return "", nil, fmt.Errorf("could not publish request: %w", err)
+	}
+	return id, ch, nil
+}
+
+// forget stops waiting for the reply to the request with correlation ID id.
+func (t *mqttTransport) forget(id string) {
+	t.mu.Lock()
+	delete(t.pending, id)
+	t.mu.Unlock()
+}
+
+// connected returns true if there is a connection to the broker for the
+// device. t.mu must be held.
+func (t *mqttTransport) connected(broker, device string) bool {
+	return t.conn != nil && t.broker == broker && t.device == device
+}
+
+// connect connects to the broker and subscribes to the device's reply and
+// vars topics, returning the connection and its reader. The connection is
+// abandoned if ctx is done first.
+func (t *mqttTransport) connect(ctx context.Context, broker, device string) (net.Conn, *bufio.Reader, error) {
+	conn, err := (&net.Dialer{Timeout: Timeout}).DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not connect to mqtt broker: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	err = t.handshake(conn, r, device)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, r, nil
+}
+
+// handshake sends CONNECT and SUBSCRIBE packets on a new connection to the
+// broker, and reads their acknowledgements.
+func (t *mqttTransport) handshake(conn net.Conn, r *bufio.Reader, device string) error {
+	conn.SetDeadline(time.Now().Add(Timeout))
+
+	// CONNECT with a clean session.
+	var b bytes.Buffer
+	writeMQTTString(&b, "MQTT")
+	b.Write([]byte{4, 0x02})
+	binary.Write(&b, binary.BigEndian, uint16(t.keepAliveInterval()/time.Second))
+	writeMQTTString(&b, strings.TrimSuffix(strings.ReplaceAll(device, "/", "-"), "-"))
+	err := writeMQTTPacket(conn, mqttConnect<<4, b.Bytes())
+	if err != nil {
+		return fmt.Errorf("could not send mqtt connect: %w", err)
+	}
+	typ, body, err := readMQTTPacket(r)
+	if err != nil {
+		return fmt.Errorf("could not read mqtt connack: %w", err)
+	}
+	if typ>>4 != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("unexpected mqtt packet type: %d", typ>>4)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("%w: return code %d", errMQTTRefused, body[1])
+	}
+
+	// SUBSCRIBE to the reply and vars topics at QoS 0, with packet identifier 1.
+	b.Reset()
+	b.Write([]byte{0, 1})
+	for _, topic := range []string{device + "reply/+", device + "vars"} {
+		writeMQTTString(&b, topic)
+		b.WriteByte(0)
+	}
+	err = writeMQTTPacket(conn, mqttSubscribe<<4|0x02, b.Bytes())
+	if err != nil {
+		return fmt.Errorf("could not send mqtt subscribe: %w", err)
+	}
+	typ, body, err = readMQTTPacket(r)
+	if err != nil {
+		return fmt.Errorf("could not read mqtt suback: %w", err)
+	}
+	if typ>>4 != mqttSuback || len(body) != 4 || body[2] == 0x80 || body[3] == 0x80 {
+		return errors.New("mqtt subscribe failed")
+	}
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+// start makes conn the current connection, and starts receiving from it
+// and keeping it alive. t.mu must be held.
+func (t *mqttTransport) start(conn net.Conn, r *bufio.Reader, broker, device string) {
+	keepAlive := t.keepAliveInterval()
+	t.conn, t.broker, t.device = conn, broker, device
+	t.done = make(chan struct{})
+	t.pending = make(map[string]chan mqttReply)
+	go t.receive(conn, r, device, keepAlive)
+	go t.ping(conn, t.done, keepAlive)
+}
+
+// keepAliveInterval returns the keep alive interval.
+func (t *mqttTransport) keepAliveInterval() time.Duration {
+	if t.keepAlive <= 0 {
+		return mqttKeepAlive
+	}
+	return t.keepAlive
+}
+
+// receive receives packets from the broker on conn until it is closed,
+// passing replies to the requests awaiting them and handling var sum
+// notifications.
+func (t *mqttTransport) receive(conn net.Conn, r *bufio.Reader, device string, keepAlive time.Duration) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		typ, body, err := readMQTTPacket(r)
+		if err != nil {
+			t.mu.Lock()
+			if t.conn == conn {
+				t.close()
+			}
+			t.mu.Unlock()
+			return
+		}
+		if typ>>4 != mqttPublish || typ&0x06 != 0 {
+			continue // Only QoS 0 publishes are expected, besides PINGRESP.
+		}
+		topic, msg, err := parseMQTTPublish(body)
+		if err != nil {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(topic, device+"reply/"):
+			id := strings.TrimPrefix(topic, device+"reply/")
+			t.mu.Lock()
+			ch := t.pending[id]
+			delete(t.pending, id)
+			t.mu.Unlock()
+			if ch != nil {
+				ch <- mqttReply{reply: string(msg)}
+			}
+		case topic == device+"vars":
+			if t.ns != nil && t.ns.varSumChanged(string(msg)) && t.fetching.CompareAndSwap(false, true) {
+				go func() {
+					defer t.fetching.Store(false)
+					_, err := t.ns.VarsContext(t.ns.lifetime())
+					if err != nil {
+						t.ns.logger.Log(WarningLevel, warnVarsError, "error", err.Error())
+					}
+				}()
+			}
+		}
+	}
+}
+
+// ping sends a PINGREQ on conn every half keep alive interval until done
+// is closed.
+func (t *mqttTransport) ping(conn net.Conn, done chan struct{}, keepAlive time.Duration) {
+	tick := time.NewTicker(keepAlive / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+		t.mu.Lock()
+		if t.conn == conn && t.write(mqttPingreq<<4, nil) != nil {
+			t.close()
+		}
+		t.mu.Unlock()
+	}
+}
+
+// write writes a packet to the current connection. t.mu must be held.
+func (t *mqttTransport) write(header byte, body []byte) error {
+	t.conn.SetWriteDeadline(time.Now().Add(Timeout))
+	return writeMQTTPacket(t.conn, header, body)
+}
+
+// close disconnects from the broker, if connected, failing any requests
+// in flight. t.mu must be held.
+func (t *mqttTransport) close() {
+	if t.conn == nil {
+		return
+	}
+	t.write(mqttDisconnect<<4, nil)
+	t.conn.Close()
+	if t.done != nil {
+		close(t.done)
+	}
+	for id, ch := range t.pending {
+		ch <- mqttReply{err: errMQTTClosed}
+		delete(t.pending, id)
+	}
+	t.conn, t.done, t.broker, t.device = nil, nil, "", ""
+}
+
+// varSumChanged returns true if the var sum published on the device's
+// vars topic differs from the current var sum.
+func (ns *Sender) varSumChanged(msg string) bool {
+	n, err := parseVarSum(msg)
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnVarsError, "error", err.Error())
+		return false
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return n != ns.varSum
+}
+
+// mqttPublishBody returns the body of a QoS 0 PUBLISH packet.
+func mqttPublishBody(topic string, payload []byte) []byte {
+	var b bytes.Buffer
+	writeMQTTString(&b, topic)
+	b.Write(payload)
+	return b.Bytes()
+}
+
+// parseMQTTPublish returns the topic and payload of a QoS 0 PUBLISH packet body.
+func parseMQTTPublish(body []byte) (string, []byte, error) {
+	if len(body) < 2 {
+		return "", nil, errors.New("short mqtt publish")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return "", nil, errors.New("short mqtt publish topic")
+	}
+	return string(body[2 : 2+n]), body[2+n:], nil
+}
+
+// writeMQTTString writes a length-prefixed MQTT string.
+func writeMQTTString(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
+
+// writeMQTTPacket writes an MQTT packet with the given first header byte
+// and body.
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	pkt := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		pkt = append(pkt, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(pkt, body...))
+	return err
+}
+
+// readMQTTPacket reads an MQTT packet, returning its first header byte and
+// its body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var n, shift int
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+		if shift > 21 {
+			return 0, nil, errors.New("invalid mqtt remaining length")
+		}
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
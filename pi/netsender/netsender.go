@@ -31,16 +31,28 @@ package netsender
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"maps"
+	"math"
 	"math/rand"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -90,6 +102,15 @@ const (
 	uploadTestPin    = "X2"
 )
 
+// actIdleWait is the time RunActs waits before rechecking a zero act period.
+const actIdleWait = 10 * time.Second
+
+// pingPath is the path requested by Ping.
+const pingPath = "/ping"
+
+// buildVersionPin is the pin on which the build version, if any, is reported.
+const buildVersionPin = "T5"
+
 // Logger is the interface NetSender expects clients to use for logging.
 type Logger interface {
 	// SetLevel sets the level of the Logger. Calls to Log with a
@@ -120,6 +141,7 @@ const (
 // NetSender log messages.
 const (
 	errorConfigWrite      = "error writing config"
+	errorRestart          = "could not re-execute after self-update"
 	warnPinRead           = "error reading pin"
 	warnPinWrite          = "error writing pin"
 	warnHttpError         = "http error"
@@ -130,6 +152,42 @@ const (
 	warnUpgraderNotFound  = "upgrader not found"
 	warnUpgraderError     = "error executing upgrader"
 	warnUpgradeFailed     = "upgrade failed"
+	warnPeriodClamped     = "period out of range, clamped"
+	warnVarsError         = "error getting vars"
+	warnMtsGap            = "mts chunk send failed, leaving sequence gap"
+	warnPinDecode         = "cannot decode pin value, not writing pin"
+	warnQuietHours        = "invalid quiet hours"
+	warnQueueWrite        = "could not queue poll"
+	warnQueueDecode       = "could not decode queued poll, discarding"
+	warnQueueDrain        = "could not send queued polls"
+	warnWatchVars         = "watch request failed"
+	warnVarFunc           = "var callback failed"
+	warnHostDown          = "service host down, failing over"
+	warnClockStep         = "could not step clock"
+	warnSpeedTest         = "scheduled speed test failed"
+	warnActError          = "act request failed"
+	warnSpeedTestInterval = "invalid speed test interval"
+	warnUploadRate        = "invalid upload rate"
+	warnDumpHTTP          = "could not dump captured requests"
+	warnSystemdNotify     = "could not notify systemd"
+	warnMetricsServe      = "metrics listener failed"
+	warnConfigReload      = "could not reload config"
+	warnConfigParam       = "invalid config param from service, ignoring"
+	warnConfigFileParam   = "invalid config file param"
+	warnKeyRejected       = "new device key rejected, restored previous key"
+	warnKeyUnacked        = "could not acknowledge new device key, restored previous key"
+	warnKeyRotation       = "device key rotation incomplete"
+	warnWiFi              = "could not apply WiFi config"
+	warnUpgradeVerify     = "upgrade verification failed, not installing"
+	warnUpgradeState      = "could not update upgrade state"
+	warnNoRollback        = "previous version unknown, upgrade cannot be rolled back"
+	warnRollingBack       = "upgrade failed health check, rolling back"
+	warnRolledBack        = "upgrade rolled back"
+	warnFlushError        = "could not flush buffered data"
+	warnKeepPrevious      = "could not keep previous executable"
+	warnUpgradeStage      = "could not report upgrade stage"
+	warnVarsCache         = "could not cache vars"
+	warnStaleVars         = "could not get vars, using cached vars"
 	infoConfig            = "received config"
 	infoConfigParams      = "config params"
 	infoConfigParamChange = "config param changed"
@@ -145,44 +203,175 @@ const (
 	infoUpdateRequired    = "update required"
 	infoUpgrading         = "upgrade in progress"
 	infoUpgraded          = "completed upgrade"
+	infoModeChange        = "mode changed"
+	infoQueueDrained      = "sent queued polls"
+	infoFlushed           = "flushed buffered data"
+	infoHostUp            = "service host up"
+	infoClockStepped      = "stepped clock"
+	infoClosed            = "closed"
+	infoConfigWrite       = "wrote config"
+	infoConfigReloaded    = "reloaded config"
+	infoProvisioned       = "provisioned device key"
+	infoKeyRotating       = "rotating device key"
+	infoKeyRotated        = "rotated device key"
+	infoWiFiApplied       = "applied WiFi config"
+	infoUpgradeHealthy    = "upgrade passed health check"
+	infoRestarting        = "re-executing after self-update"
+	infoUpgradeStage      = "upgrade stage"
 	debugRunning          = "running"
 	debugSendStackTrace   = "sending stack trace"
 	debugSleeping         = "sleeping"
 	debugHttpRequest      = "http request"
 	debugHttpReply        = "http reply"
 	debugVarsumChanged    = "varsum changed"
-	debugConfigWrite      = "wrote config"
+	debugConfigUnchanged  = "config unchanged, not writing"
 	debugSetLogLevel      = "set log level"
+	debugQuietHours       = "quiet hours, suppressing poll"
+	debugQueuedPoll       = "queued poll"
+	debugClockSkew        = "clock skew"
+	debugVarsNotModified  = "vars not modified"
+	debugDumpHTTP         = "dumping captured requests"
 )
 
 // NetSender modes and errors.
 const (
-	modeCompleted = "Completed"
-	errorUpgrade  = "upgradeError"
+	modeCompleted      = "Completed"
+	errorUpgrade       = "upgradeError"
+	errorUpgradeVerify = "upgradeVerifyError"
 )
 
 var errNoKey = errors.New("key not found in JSON")
 
+// ErrRedirect is returned when the service redirects a request in a way
+// that would change its method, such as a 301 or 302 redirect of a POST,
+// which would drop its payload. The service host should be updated to
+// the redirected location.
+var ErrRedirect = errors.New("redirect would change request method")
+
+// errReadTimeout is returned by readPin when a pin read times out.
+var errReadTimeout = errors.New("pin read timed out")
+
+// ErrNotConfigured is returned by Run when the client has never been
+// successfully configured, e.g., a new device that cannot yet reach
+// the service or whose device key has not been provisioned.
+var ErrNotConfigured = errors.New("never configured")
+
 // Sender represents state for a NetSender client.
 type Sender struct {
-	logger     Logger            // Our logger.
-	mu         sync.Mutex        // Protects our state.
-	configFile string            // Path to config file.
-	config     map[string]string // Our latest configuration.
-	services   map[string]string // Services we use.
-	configured bool              // True if we're configured, false otherwse.
-	varSum     int               // Most recent var sum received from the service.
-	mode       string            // Client mode.
-	error      string            // Client error string, if any.
-	sync       bool              // True if we need to sync client mode or error with the service, false otherwise.
-	init       PinInit           // Pin initialization function, or nil.
-	read       PinReadWrite      // Pin read function, or nil.
-	write      PinReadWrite      // Pin write function, or nil.
-	configPins []Pin             // Pins sent in the config request.
-	upgrader   string            // Upgrader command.
-	upgrading  bool              // True if upgrading, false otherwise.
-	upload     int               // Measured upload speed in bits per second (in test mode).
-	download   int               // Measured download speed in bits per second (in test mode).
+	logger         Logger                   // Our logger, for the netsender subsystem.
+	baseLogger     Logger                   // Logger passed to New.
+	levels         subsystemLevels          // Subsystem log levels.
+	audit          Logger                   // Audit logger for security-relevant events, or nil.
+	mu             sync.Mutex               // Protects our state.
+	sendMu         sync.Mutex               // Serializes the application of SendOptions.
+	sendOpts       *sendOptions             // Options of the Send call whose SendOptions are being applied.
+	configFile     string                   // Path to config file.
+	store          ConfigStore              // Config store, or nil to choose one by the config file extension.
+	config         map[string]string        // Our latest configuration.
+	services       map[string]string        // Services we use.
+	configured     bool                     // True if we're configured, false otherwse.
+	everConfig     bool                     // True if we've ever been configured, false otherwise.
+	varSum         int                      // Most recent var sum received from the service.
+	mode           string                   // Client mode.
+	error          string                   // Client error string, if any.
+	sync           bool                     // True if we need to sync client mode or error with the service, false otherwise.
+	cleared        bool                     // True if the error has been cleared but not yet synced, false otherwise.
+	init           PinInit                  // Pin initialization function, or nil.
+	read           PinReadWrite             // Pin read function, or nil.
+	write          PinReadWrite             // Pin write function, or nil.
+	configPins     []Pin                    // Pins sent in the config request.
+	varTypes       map[string]string        // Var types sent in the config request.
+	pinMeta        map[string]PinMeta       // Pin metadata sent in the config request.
+	inputs         pinCache                 // Cached input pins.
+	outputs        pinCache                 // Cached output pins.
+	upgrader       string                   // Upgrader command.
+	upgrading      bool                     // True if upgrading, false otherwise.
+	upgradeHandler func(bool, error)        // Called when an upgrade finishes, or nil.
+	build          string                   // Build version of the running client, if any.
+	maxPeriod      int                      // Maximum monitor or act period in seconds, or 0 for the default.
+	checkMAC       bool                     // True if the ma param must be a valid MAC address.
+	strictMAC      bool                     // True if the ma param must also match a local interface.
+	order          []string                 // Config param write order, or nil for configParams order.
+	required       []string                 // Config params which must be present in the config file, besides ma and dk.
+	envParams      []string                 // Config params set by environment variables, which are not written.
+	envShadowed    map[string]string        // Config file values of envParams, if any, which are written in their place.
+	readTimeout    time.Duration            // Pin read timeout, or 0 for no timeout.
+	pinTimeouts    map[string]time.Duration // Pin read timeouts by pin name, overriding readTimeout.
+	concurrent     bool                     // True if input pins are read concurrently.
+	maxReply       int64                    // Maximum response body size in bytes, or 0 for the default.
+	roundTripper   http.RoundTripper        // HTTP transport for service requests, or nil for the default transport.
+	client         *http.Client             // HTTP client set by WithHTTPClient, or nil.
+	failed         map[string]time.Time     // Times of recent failed requests, keyed by ID.
+	downHosts      map[string]*hostState    // Service hosts which are down, keyed by host.
+	clockSkew      time.Duration            // Local time minus service time.
+	clockSynced    bool                     // True once clockSkew has been measured.
+	clockStep      time.Duration            // Skew beyond which the system clock is stepped, or 0 for never.
+	transport      Transport                // Service request transport, or nil for HTTP.
+	mqtt           *mqttTransport           // MQTT transport for mqtt:// service hosts, created on first use.
+	tls            bool                     // True if service requests use HTTPS, false for HTTP.
+	certTLS        bool                     // True if HTTPS is used only because of the client certificate.
+	quiet          QuietHours               // Quiet hours schedule.
+	quietDefault   QuietHours               // Quiet hours schedule when there is no quiet hours var.
+	heartbeat      time.Duration            // Period between polls during quiet hours, or 0 for the default.
+	lastBeat       time.Time                // Time of the most recent poll during quiet hours.
+	strictOutputs  bool                     // True if Run fails when an output pin value cannot be decoded, false to skip the pin.
+	varCh          chan map[string]string   // Var change notifications, or nil if not requested.
+	notified       bool                     // True if vars have been sent on varCh, false otherwise.
+	notifySum      int                      // Var sum of the vars most recently sent on varCh.
+	seq            map[string]int           // Next MTS sequence number per stream.
+	acked          map[string]int           // Last acknowledged MTS sequence number per stream.
+	stats          map[int]Stats            // Request outcome counters per request type.
+	flushers       []flusher                // Flush callbacks, in registration order.
+	varFuncs       map[string][]VarFunc     // Var change callbacks by var name.
+	varVals        map[string]string        // Var values most recently dispatched to callbacks.
+	varSnapshot    map[string]string        // Vars most recently returned by VarsChanged.
+	lastVars       map[string]string        // Vars most recently received, for conditional vars requests.
+	pinValues      map[string]Pin           // Pins most recently sent or written, by name.
+	queue          *queue                   // Offline poll queue, or nil if not queueing.
+	flushing       sync.Mutex               // Serializes FlushAll calls.
+	upload         int                      // Measured upload speed in bits per second (in test mode).
+	download       int                      // Measured download speed in bits per second (in test mode).
+	downloadBW     *Bandwidth               // Download speed test results, or nil if not yet measured.
+	uploadBW       *Bandwidth               // Upload speed test results, or nil if not yet measured.
+	testSize       int                      // Speed test size in bytes, or 0 for the default.
+	testDuration   time.Duration            // Maximum speed test duration, or 0 for no limit.
+	testInterval   time.Duration            // Interval between scheduled speed tests, or 0 for none.
+	pacer          pacer                    // Paces request payloads (see WithUploadRate).
+	capture        []HTTPExchange           // Recent service requests, oldest first.
+	captureSize    int                      // Number of requests captured.
+	dumpVar        string                   // Last value of the DumpHTTP var.
+	sdNotify       bool                     // True if systemd is notified (see WithSystemdNotify).
+	sdReady        bool                     // True once systemd has been notified that we are ready.
+	lastTest       time.Time                // Time of the last scheduled speed test.
+	downloadHist   []int                    // Recent download speeds, oldest first.
+	uploadHist     []int                    // Recent upload speeds, oldest first.
+	closed         bool                     // True once Close has been called.
+	life           context.Context          // Done when Close is called.
+	stop           context.CancelFunc       // Cancels life.
+	upgrades       sync.WaitGroup           // Upgrades in progress.
+	writing        sync.Mutex               // Serializes output pin writes.
+	actors         int                      // Number of RunActs calls in progress.
+	metrics        metrics                  // Health metrics.
+	metricsServer  *http.Server             // Metrics HTTP server, or nil.
+	provision      bool                     // True if the device key may be obtained by registering with the service.
+	enrollToken    string                   // Enrollment token sent when registering, if any.
+	keyAcks        int                      // Failed acknowledgements of the new device key, if any.
+	wifi           WiFiConfigurator         // Applies the wi param to the OS, or nil.
+	wifiApplied    string                   // Value of the wi param last applied.
+	upgradeKey     ed25519.PublicKey        // Key which signs upgrade manifests, or nil to not verify upgrades.
+	upgradeDir     string                   // Directory to which verified upgrade artifacts are downloaded.
+	selfUpdate     bool                     // True if upgrades replace the executable rather than calling the upgrader.
+	restartPath    string                   // Executable to re-execute once an upgrade completes, or empty.
+	upgradeStage   UpgradeStage             // Stage of the upgrade in progress, if any.
+	upgradeStageAt time.Time                // Time the upgrade stage began.
+	varsCache      ConfigStore              // Cache of the most recently received vars, or nil.
+	rollbackFile   string                   // Upgrade rollback state file, or empty if rollback is disabled.
+	rollbackWindow time.Duration            // Time allowed for an upgraded client to pass its health check.
+	installedCV    string                   // Value of the cv param when initialized.
+	healthDeadline time.Time                // Deadline of the upgrade health check, or zero if none.
+	healthChecked  time.Time                // Time of the last check of the service during the health check.
+	healthConfig   bool                     // True once a config request succeeds during the health check.
+	healthPoll     bool                     // True once a poll or act request succeeds during the health check.
 }
 
 // PinInit defines a pin initialization function, which takes a Pin and arbitrary intialization data.
@@ -201,12 +390,16 @@ const (
 	version         = 172
 	defaultService  = "data.cloudblue.org"
 	monPeriod       = 60
+	maxPeriod       = 86400 // Default maximum monitor or act period (one day).
 	rebooter        = "syncreboot"
 	defaultLogLevel = WarningLevel
 	stackTraceSize  = 1 << 16
+	maxRedirects    = 10
+	defaultMaxReply = 4 << 20 // Default maximum response body size in bytes.
 )
 
-// ServerError represents service error codes.
+// ServerError represents service error codes. Known codes may be tested
+// for with errors.Is, e.g., errors.Is(err, ErrInvalidDeviceKey).
 type ServerError struct {
 	er string
 }
@@ -215,14 +408,57 @@ func (e *ServerError) Error() string {
 	return e.er
 }
 
-const (
-	defaultConfigFile = "/etc/netsender.conf" // Default config file. Customize with WithConfigFile.
-	defaultUpgrader   = "pkg-upgrade.sh"      // Default upgrade script. Customize with WithUpgrader
+// Code returns the service error code.
+func (e *ServerError) Code() string {
+	return e.er
+}
+
+// Is returns true if target is a ServerError with the same code.
+func (e *ServerError) Is(target error) bool {
+	t, ok := target.(*ServerError)
+	return ok && t.er == e.er
+}
+
+// Known service error codes. Errors for invalid requests, such as a bad
+// device key or value, will recur if the request is retried unchanged,
+// whereas ErrReadError and ErrMarshalingError are transient failures of
+// the service.
+var (
+	ErrInvalidDeviceKey   = &ServerError{er: "InvalidDeviceKey"}   // The device key (dk) is wrong for the MAC address.
+	ErrInvalidValue       = &ServerError{er: "InvalidValue"}       // A pin value is missing or invalid.
+	ErrPinNotFound        = &ServerError{er: "PinNotFound"}        // A pin is not one of the device's inputs.
+	ErrInvalidPayloadSize = &ServerError{er: "InvalidPayloadSize"} // The request body is missing or its size does not match the pin value.
+	ErrReadError          = &ServerError{er: "ReadError"}          // The service could not read the request.
+	ErrMarshalingError    = &ServerError{er: "MarshalingError"}    // The service could not encode the reply.
 )
 
+const defaultUpgrader = "pkg-upgrade.sh" // Default upgrade script. Customize with WithUpgrader
+
+// DefaultConfigFile is the default config file. Customize per client
+// with WithConfigFile, or per build with:
+//
+//	go build -ldflags "-X github.com/ausocean/client/pi/netsender.DefaultConfigFile=/path/to/netsender.conf"
+var DefaultConfigFile = "/etc/netsender.conf"
+
 // Timeout is the timeout used for network calls.
 var Timeout = 20 * time.Second
 
+// Default HTTP transport settings, which may be tuned, e.g., for high
+// latency satellite or cellular links, before the first service request.
+var (
+	DialTimeout         = 30 * time.Second // Timeout for establishing TCP connections.
+	TLSHandshakeTimeout = 10 * time.Second // Timeout for TLS handshakes.
+	KeepAlive           = 30 * time.Second // TCP keep-alive period.
+	IdleConnTimeout     = 90 * time.Second // Time an idle connection is kept for reuse.
+)
+
+// defaultTransport is the HTTP transport shared by all senders without
+// a custom transport, so that connections are reused between requests.
+var (
+	defaultTransport     *http.Transport
+	defaultTransportOnce sync.Once
+)
+
 // rebootTime is the time we rebooted, which we use to calculate
 // uptime. If we are not networked at the time it will be a fake time
 // since the Pi does not have a real-time clock, but since we only
@@ -240,13 +476,22 @@ var rebootTime = time.Now()
 // ct: client type
 // cv: client version
 // hw: hardware
-// sh: service host
+// sh: service host, or hosts per request type, with | separated failover hosts
+// rs: require request signing, if true (see headerSignature)
+// fs: float pin scale hints, as CSV pin:decimals pairs, e.g., X10:2,X11:3
+// cc: client certificate PEM file path, for mutual TLS
+// ck: client key PEM file path, if not in the cc file
+// pk: previous device key, while a key rotation is unacknowledged (see rotateKey)
 // configParams specifies accepted parameters and the order in which they are written to ConfigFile.
 // configNumbers specifies configuration parameters which have numeric values.
 // requestTypes specifies service request types.
+// localParams specifies configuration parameters which are never updated by the service.
 // NB: hw and sh are client-side config params (i.e., not stored by the service).
+// rs, cc and ck are local so that security settings cannot be changed remotely,
+// and pk is local since it is only set by key rotation.
 var (
-	configParams  = []string{"ma", "dk", "wi", "ip", "op", "mp", "ap", "ct", "cv", "hw", "sh"}
+	configParams  = []string{"ma", "dk", "wi", "ip", "op", "mp", "ap", "ct", "cv", "hw", "sh", "fs", "rs", "cc", "ck", "pk"}
+	localParams   = []string{"rs", "cc", "ck", "pk"}
 	configNumbers = []string{"dk", "mp", "ap"}
 	requestTypes  = []string{"default", "config", "poll", "act", "vars", "mts"}
 )
@@ -260,9 +505,14 @@ func New(logger Logger, init PinInit, read, write PinReadWrite, options ...Optio
 
 // Init initializes the NetSender client by reading cached configuration data
 // and initializing data that is sent with config requests.
+// A nil logger disables logging.
 func (ns *Sender) Init(logger Logger, init PinInit, read, write PinReadWrite, options ...Option) error {
-	ns.logger = logger
-	ns.configFile = defaultConfigFile
+	if logger == nil {
+		logger = NopLogger{}
+	}
+	ns.baseLogger = logger
+	ns.logger = ns.Logger(senderSubsystem)
+	ns.configFile = DefaultConfigFile
 	ns.upgrader = defaultUpgrader
 	// Set download upload speeds to -1 to indicate they have not been deduced yet.
 	ns.upload, ns.download = -1, -1
@@ -292,31 +542,45 @@ func (ns *Sender) Init(logger Logger, init PinInit, read, write PinReadWrite, op
 		return err
 	}
 
+	if config["cc"] != "" {
+		err = ns.setClientCert(config["cc"], config["ck"])
+		if err != nil {
+			return err
+		}
+	}
+
 	ns.mu.Lock()
 	ns.config = config
 	ns.services = services
+	ns.wifiApplied = config["wi"]
+	ns.mu.Unlock()
+	ns.startHealthCheck()
+
+	// Log the effective config once all options and defaults are applied.
 	var params []interface{}
-	for _, name := range configParams {
-		params = append(params, name, ns.config[name])
+	for _, kv := range filemap.Sort(ns.EffectiveConfig(), configParams) {
+		params = append(params, kv.Key, Redact(kv.Key, kv.Value))
 	}
 	ns.logger.Log(InfoLevel, infoConfigParams, params...)
-	ns.mu.Unlock()
 
 	return nil
 }
 
 // initPins initializes all pins, if any
 func (ns *Sender) initPins() error {
-	if ns.init == nil {
+	ns.mu.Lock()
+	init := ns.init
+	ns.mu.Unlock()
+	if init == nil {
 		return nil
 	}
 	for _, pin := range MakePins(ns.Param("ip"), "") {
-		if err := ns.init(&pin, PinIn); err != nil {
+		if err := init(&pin, PinIn); err != nil {
 			return err
 		}
 	}
 	for _, pin := range MakePins(ns.Param("op"), "") {
-		if err := ns.init(&pin, PinOut); err != nil {
+		if err := init(&pin, PinOut); err != nil {
 			return err
 		}
 	}
@@ -326,74 +590,146 @@ func (ns *Sender) initPins() error {
 // Run sends requests to the service and handles responses.
 // Clients are responsible for calling Run regularly.
 // Clients are responsible for handling variable changes separately.
+// Run is equivalent to RunContext with a background context.
 func (ns *Sender) Run() error {
+	return ns.RunContext(context.Background())
+}
+
+// RunContext is like Run, but service requests, including any resulting
+// config requests and speed tests, are cancelled when ctx is done.
+// Pin reads are not cancelled; see WithReadTimeout.
+func (ns *Sender) RunContext(ctx context.Context) error {
+	if ns.isClosed() {
+		return ErrClosed
+	}
 	ns.logger.Log(DebugLevel, debugRunning)
+	ns.notifySystemd(sdWatchdog)
+	ctx, cancel := ns.bindLifetime(ctx)
+	defer cancel()
+	if ns.needsProvisioning() {
+		err := ns.register(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if ns.keyPending() {
+		err := ns.ackKey(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	ns.checkHealth(ctx)
+	ns.checkHosts(ctx)
+	ns.scheduledSpeedTest(ctx)
 
 	rc := ResponseNone
 	var err error
 	var sent bool
 	var reply string
 
+	// Snapshot the pin callbacks, which may be swapped concurrently,
+	// and the net speeds, which may be updated concurrently.
+	ns.mu.Lock()
+	read, write := ns.read, ns.write
+	download, upload := ns.download, ns.upload
+	readTimeout, pinTimeouts, concurrent := ns.readTimeout, ns.pinTimeouts, ns.concurrent
+	strictOutputs, capturing := ns.strictOutputs, ns.captureSize > 0
+	ns.mu.Unlock()
+
 	ip := ns.Param("ip")
 	op := ns.Param("op")
-	outputs := MakePins(op, "")
+	if (ip != "" || op != "") && ns.suppressPoll() {
+		ns.logger.Log(DebugLevel, debugQuietHours)
+		return nil
+	}
+	ns.mu.Lock()
+	outputs := ns.outputs.get(op)
+	ns.mu.Unlock()
 	if ip != "" {
-		inputs := MakePins(ip, "")
-		if ns.read != nil {
+		ns.mu.Lock()
+		inputs := ns.inputs.get(ip)
+		ns.mu.Unlock()
+		if read != nil {
+			var reads []int
 			for i := range inputs {
 				// If download and upload speed pins are specified, set.
 				// NB: ns.download and ns.upload are set to -1 in ns.Init,
 				// i.e. this will indicate speeds have not yet been calculated.
 				switch inputs[i].Name {
 				case downloadTestPin:
-					inputs[i].Value = ns.download
+					inputs[i].Value = download
 				case uploadTestPin:
-					inputs[i].Value = ns.upload
+					inputs[i].Value = upload
+				case downloadP50Pin, downloadP10Pin, uploadP50Pin, uploadP10Pin:
+					inputs[i].Value = ns.speedPercentile(inputs[i].Name)
+					continue
+				case bandwidthPin:
+					if b := ns.bandwidthJSON(); b != nil {
+						inputs[i].Data = b
+						inputs[i].Value = len(b)
+						inputs[i].MimeType = "application/json"
+					}
+					continue
+				case capturePin:
+					if capturing {
+						continue // Sent only by DumpHTTP.
+					}
+				case requestsPin, failuresPin, retriesPin, bytesSentPin, latencyP50Pin, latencyP95Pin, varSumAgePin:
+					ns.metricPin(&inputs[i])
+					continue
+				case upgradeStagePin, upgradeStageAgePin:
+					ns.upgradePin(&inputs[i])
+					continue
+				case clockSkewPin:
+					if skew, ok := ns.ClockSkew(); ok {
+						inputs[i].SetFloat(skew.Seconds())
+					}
+					continue
+				case buildVersionPin:
+					if ns.build != "" {
+						// The build version is sent as a URL param, so no MIME type.
+						inputs[i].Data = []byte(url.QueryEscape(ns.build))
+						inputs[i].Value = len(inputs[i].Data)
+						continue
+					}
 				}
 
-				err := ns.read(&inputs[i])
-				if err != nil {
-					ns.logger.Log(WarningLevel, warnPinRead, "error", err.Error(), "pin", inputs[i].Name)
-				}
+				reads = append(reads, i)
 			}
+			ns.readPins(read, inputs, reads, readTimeout, pinTimeouts, concurrent)
 		}
 
-		reply, rc, err = ns.Send(RequestPoll, inputs)
+		id := NewRequestID()
+		reply, rc, err = ns.SendContext(ctx, RequestPoll, inputs, WithRequestID(id))
 		if err != nil {
+			ns.enqueuePoll(id, inputs, err)
 			return err
 		}
 		sent = true
+		ns.recordPins(inputs...)
+		ns.reportHealth(healthPoll)
+		ns.drainQueue(ctx)
 
-	} else if op != "" {
-		reply, rc, err = ns.Send(RequestAct, outputs)
+	} else if op != "" && !ns.acting() {
+		reply, rc, err = ns.SendContext(ctx, RequestAct, outputs)
 		if err != nil {
 			return err
 		}
 		sent = true
+		ns.reportHealth(healthPoll)
 	}
 	if sent && op != "" {
-		dec, err := NewJSONDecoder(reply)
+		err = ns.writeOutputs(reply, outputs, write, strictOutputs)
 		if err != nil {
-			return fmt.Errorf("JSON decoding error: %w", err)
-		}
-		if ns.write != nil {
-			for _, pin := range outputs {
-				v, err := dec.Int(pin.Name)
-				if err != nil {
-					return fmt.Errorf("cannot decode pin value: %w", err)
-				}
-				pin.Value = v
-				ns.logger.Log(DebugLevel, fmt.Sprintf("writing value %d to pin %s", v, pin.Name))
-				err = ns.write(&pin)
-				if err != nil {
-					ns.logger.Log(WarningLevel, warnPinWrite, "error", err.Error(), "pin", pin.Name)
-				}
-			}
+			return err
 		}
 	}
 	if !sent {
-		rc, err = ns.Config()
+		rc, err = ns.ConfigContext(ctx)
 		if err != nil {
+			if !ns.EverConfigured() {
+				return fmt.Errorf("%w: %w", ErrNotConfigured, err)
+			}
 			return err
 		}
 	}
@@ -402,16 +738,19 @@ func (ns *Sender) Run() error {
 	switch rc {
 	case ResponseUpdate:
 		ns.logger.Log(InfoLevel, infoUpdateRequest)
-		_, err = ns.Config()
+		_, err = ns.ConfigContext(ctx)
 		return err
 
 	case ResponseReboot:
 		ns.logger.Log(InfoLevel, infoRebootRequest)
+		if !ns.EverConfigured() {
+			return ErrNotConfigured
+		}
 		if !ns.IsConfigured() {
 			ns.logger.Log(InfoLevel, infoUpdateRequired)
 			return nil
 		}
-		ns.logger.Log(InfoLevel, infoRebooting)
+		ns.auditLog(InfoLevel, infoRebooting)
 		err := exec.Command(rebooter).Run()
 		if err != nil {
 			ns.logger.Log(WarningLevel, warnRebootError)
@@ -419,10 +758,10 @@ func (ns *Sender) Run() error {
 		}
 
 	case ResponseShutdown:
-		ns.logger.Log(InfoLevel, infoShutdownRequest)
+		ns.auditLog(InfoLevel, infoShutdownRequest)
 		if !ns.IsConfigured() {
 			ns.logger.Log(DebugLevel, "need to config for shutdown request")
-			_, err := ns.Config()
+			_, err := ns.ConfigContext(ctx)
 			if err != nil {
 				return fmt.Errorf("could not perform config request for shutdown request: %w", err)
 			}
@@ -434,6 +773,9 @@ func (ns *Sender) Run() error {
 
 	case ResponseDebug:
 		ns.logger.Log(InfoLevel, infoDebugRequest)
+		if !ns.EverConfigured() {
+			return ErrNotConfigured
+		}
 		if !ns.IsConfigured() {
 			ns.logger.Log(InfoLevel, infoUpdateRequired)
 			return nil
@@ -451,16 +793,20 @@ func (ns *Sender) Run() error {
 		}
 
 		// Perform the upgrade concurrently.
-		go ns.Upgrade()
+		ns.upgrades.Add(1)
+		go func() {
+			defer ns.upgrades.Done()
+			ns.Upgrade()
+		}()
 
 	case ResponseTest:
 		ns.logger.Log(InfoLevel, infoTestRequest)
-		err := ns.TestDownload()
+		err := ns.TestDownloadContext(ctx)
 		if err != nil {
 			return fmt.Errorf("could not test download speed: %w", err)
 		}
 
-		err = ns.TestUpload()
+		err = ns.TestUploadContext(ctx)
 		if err != nil {
 			return fmt.Errorf("could not test upload speed: %w", err)
 		}
@@ -468,37 +814,257 @@ func (ns *Sender) Run() error {
 	return nil
 }
 
+// writeOutputs writes the output pin values in a poll or act reply using
+// the given write function, if any. Writes are serialized, since Run and
+// RunActs may write outputs concurrently.
+func (ns *Sender) writeOutputs(reply string, outputs []Pin, write PinReadWrite, strict bool) error {
+	dec, err := NewJSONDecoder(reply)
+	if err != nil {
+		return fmt.Errorf("JSON decoding error: %w", err)
+	}
+	if write == nil {
+		return nil
+	}
+	ns.writing.Lock()
+	defer ns.writing.Unlock()
+	for _, pin := range outputs {
+		v, err := dec.Int(pin.Name)
+		if err != nil {
+			if strict {
+				return fmt.Errorf("cannot decode pin value: %w", err)
+			}
+			ns.logger.Log(WarningLevel, warnPinDecode, "error", err.Error(), "pin", pin.Name)
+			continue
+		}
+		pin.Value = v
+		ns.logger.Log(DebugLevel, fmt.Sprintf("writing value %d to pin %s", v, pin.Name))
+		err = write(&pin)
+		if err != nil {
+			ns.logger.Log(WarningLevel, warnPinWrite, "error", err.Error(), "pin", pin.Name)
+			continue
+		}
+		ns.recordPins(pin)
+	}
+	return nil
+}
+
+// PinValues returns the input pins most recently sent by Run and the
+// output pins most recently written by Run or RunActs, sorted by name.
+// Pins with no data, e.g., failed reads, are not recorded. Payload data
+// is omitted, but Value is the length of any data.
+func (ns *Sender) PinValues() []Pin {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	pins := make([]Pin, 0, len(ns.pinValues))
+	for _, pin := range ns.pinValues {
+		pins = append(pins, pin)
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Name < pins[j].Name })
+	return pins
+}
+
+// recordPins records the values of pins for PinValues.
+func (ns *Sender) recordPins(pins ...Pin) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.pinValues == nil {
+		ns.pinValues = make(map[string]Pin)
+	}
+	for _, pin := range pins {
+		if !hasValidData(pin) {
+			continue
+		}
+		pin.Data, pin.DataReader = nil, nil
+		ns.pinValues[pin.Name] = pin
+	}
+}
+
+// ActContext sends an act request with the output pins, if any, and
+// writes the output pin values in the reply. Unlike Run, it does not
+// read input pins or handle response codes, which are left to the next
+// Run. It is cancelled when ctx is done.
+func (ns *Sender) ActContext(ctx context.Context) error {
+	op := ns.Param("op")
+	if op == "" {
+		return nil
+	}
+	ns.mu.Lock()
+	outputs := ns.outputs.get(op)
+	write, strict := ns.write, ns.strictOutputs
+	ns.mu.Unlock()
+	reply, _, err := ns.SendContext(ctx, RequestAct, outputs)
+	if err != nil {
+		return err
+	}
+	return ns.writeOutputs(reply, outputs, write, strict)
+}
+
+// ActPeriod returns the act period (ap), or zero if it is not set, in
+// which case outputs are only written by Run.
+func (ns *Sender) ActPeriod() time.Duration {
+	ap, err := strconv.Atoi(ns.Param("ap"))
+	if err != nil || ap <= 0 {
+		return 0
+	}
+	return time.Duration(ap) * time.Second
+}
+
+// RunActs sends act requests and writes output pins once per act period
+// (ap) until ctx is done or the Sender is closed, and then returns the
+// context error. It is intended to be called in its own goroutine
+// alongside the usual Run loop, so that actuators respond more promptly
+// than once per monitor period. While the act period is zero, RunActs
+// waits for it to be set by a config update. While RunActs is acting, Run
+// does not send act requests itself, but still writes outputs from polls.
+func (ns *Sender) RunActs(ctx context.Context) error {
+	ctx, cancel := ns.bindLifetime(ctx)
+	defer cancel()
+	ns.mu.Lock()
+	ns.actors++
+	ns.mu.Unlock()
+	defer func() {
+		ns.mu.Lock()
+		ns.actors--
+		ns.mu.Unlock()
+	}()
+	for ctx.Err() == nil {
+		ap := ns.ActPeriod()
+		if ap == 0 {
+			sleepContext(ctx, actIdleWait)
+			continue
+		}
+		start := time.Now()
+		err := ns.ActContext(ctx)
+		if err != nil && ctx.Err() == nil {
+			ns.logger.Log(WarningLevel, warnActError, "error", err.Error())
+		}
+		sleepContext(ctx, ap-time.Since(start))
+	}
+	return ctx.Err()
+}
+
+// acting returns true if RunActs is running with a non-zero act period,
+// in which case Run need not send act requests.
+func (ns *Sender) acting() bool {
+	ns.mu.Lock()
+	actors := ns.actors
+	ns.mu.Unlock()
+	return actors > 0 && ns.ActPeriod() > 0
+}
+
+// readPins reads the inputs with the given indices using the given read
+// function, concurrently if requested (see WithConcurrentReads). Each read
+// times out after the pin's timeout, if any, else the default timeout (see
+// WithPinReadTimeouts). Read errors are logged.
+func (ns *Sender) readPins(read PinReadWrite, inputs []Pin, indices []int, timeout time.Duration, pinTimeouts map[string]time.Duration, concurrent bool) {
+	readOne := func(i int) {
+		t, ok := pinTimeouts[inputs[i].Name]
+		if !ok {
+			t = timeout
+		}
+		err := readPin(read, &inputs[i], t)
+		if err != nil {
+			ns.logger.Log(WarningLevel, warnPinRead, "error", err.Error(), "pin", inputs[i].Name)
+		}
+	}
+	if !concurrent {
+		for _, i := range indices {
+			readOne(i)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for _, i := range indices {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			readOne(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// readPin reads a pin using the given read function. If timeout is
+// non-zero and the read does not complete in time, the pin is reported
+// as having no data and errReadTimeout is returned. The hung read is
+// abandoned, but it reads into a copy of the pin so it cannot later
+// modify the pin.
+func readPin(read PinReadWrite, pin *Pin, timeout time.Duration) error {
+	if timeout == 0 {
+		return read(pin)
+	}
+	type result struct {
+		pin Pin
+		err error
+	}
+	ch := make(chan result, 1)
+	p := *pin
+	go func() {
+		err := read(&p)
+		ch <- result{p, err}
+	}()
+	select {
+	case res := <-ch:
+		*pin = res.pin
+		return res.err
+	case <-time.After(timeout):
+		pin.Value = -1
+		pin.Data = nil
+		pin.DataReader = nil
+		pin.Omit = true
+		return errReadTimeout
+	}
+}
+
 // TestDownload estimates net download speed by downloading a file using the
 // /api/test/download/ request and timing how long it takes. The calculated
 // speed is stored in ns.download, from which we can set the X0 pin if specified in
 // the netsender config.
 func (ns *Sender) TestDownload() error {
+	return ns.TestDownloadContext(context.Background())
+}
+
+// TestDownloadContext is like TestDownload, but the test is cancelled
+// when ctx is done.
+func (ns *Sender) TestDownloadContext(ctx context.Context) error {
+	ctx, cancel := ns.bindLifetime(ctx)
+	defer cancel()
 	ns.logger.Log(InfoLevel, "testing download")
-	url := "http://" + ns.services["default"] + downloadTestPath + strconv.Itoa(downloadTestSize)
+	size, duration := ns.speedTest()
+	url := ns.serviceURL(ns.serviceHost("default")) + downloadTestPath + strconv.Itoa(size)
 
-	// Download test data and time how long it takes.
-	now := time.Now()
-	resp, err := http.Get(url)
+	// Download test data, measuring throughput as it arrives.
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("could not create download speed test request: %w", err)
+	}
+	client := ns.httpClient()
+	client.Timeout = 0
+	m := newMeter(nil, duration)
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("could not do download speed test request: %w", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
 		return fmt.Errorf("download test request response status is %d and not 200 OK", resp.StatusCode)
 	}
-	body, err := io.ReadAll(resp.Body)
-	resp.Body.Close()
+	m.r = io.LimitReader(resp.Body, int64(size)+1)
+	_, err = io.Copy(io.Discard, m)
 	if err != nil {
 		return fmt.Errorf("download test failed to read body: %v", err)
 	}
-	if len(body) != downloadTestSize {
-		return fmt.Errorf("download test expected %d bytes, got %d bytes", downloadTestSize, len(body))
+	if !m.expired && m.n != int64(size) {
+		return fmt.Errorf("download test expected %d bytes, got %d bytes", size, m.n)
 	}
-	dur := time.Now().Sub(now).Seconds()
+	bw := m.result(time.Now())
 
-	// Calculate download speed in bits/s.
-	ns.download = int((downloadTestSize * 8) / dur)
-	ns.logger.Log(InfoLevel, "determined download speed", "speed(bits/s)", ns.download)
+	ns.mu.Lock()
+	ns.download = bw.Avg
+	ns.downloadBW = &bw
+	ns.downloadHist = appendHistory(ns.downloadHist, bw.Avg)
+	ns.mu.Unlock()
+	ns.logger.Log(InfoLevel, "determined download speed", "speed(bits/s)", bw.Avg, "min", bw.Min, "max", bw.Max)
 	return nil
 }
 
@@ -507,40 +1073,156 @@ func (ns *Sender) TestDownload() error {
 // long it takes. The calculated speed is stored in ns.upload, from
 // which we can set the X1 pin if specified in the netsender config.
 func (ns *Sender) TestUpload() error {
+	return ns.TestUploadContext(context.Background())
+}
+
+// TestUploadContext is like TestUpload, but the test is cancelled when
+// ctx is done. If the speed test duration is limited (see WithSpeedTest)
+// the data is sent with chunked encoding, so that it may be cut short.
+func (ns *Sender) TestUploadContext(ctx context.Context) error {
+	ctx, cancel := ns.bindLifetime(ctx)
+	defer cancel()
 	ns.logger.Log(InfoLevel, "testing upload")
-	url := "http://" + ns.services["default"] + uploadTestPath + strconv.Itoa(uploadTestSize)
+	size, duration := ns.speedTest()
+	url := ns.serviceURL(ns.serviceHost("default")) + uploadTestPath + strconv.Itoa(size)
 
 	// Create upload data.
 	rand.Seed(uploadRandSeed)
-	body := make([]byte, uploadTestSize)
+	body := make([]byte, size)
 	rand.Read(body)
 
-	// Upload test data and time how long it takes.
-	now := time.Now()
-	resp, err := http.Post(url, "application/octet-stream", bytes.NewBuffer(body))
+	// Upload test data, measuring throughput as it is sent.
+	m := newMeter(bytes.NewReader(body), duration)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, m)
+	if err != nil {
+		return fmt.Errorf("could not create upload speed test request: %w", err)
+	}
+	if duration == 0 {
+		req.ContentLength = int64(size)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	client := ns.httpClient()
+	client.Timeout = 0
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("could not upload test data: %w", err)
 	}
-	dur := time.Now().Sub(now).Seconds()
+	bw := m.result(time.Now())
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("upload test request response status is %d and not 200 OK", resp.StatusCode)
 	}
 
-	// Calculate upload speed in bits/s.
-	ns.upload = int((uploadTestSize * 8) / dur)
+	ns.mu.Lock()
+	ns.upload = bw.Avg
+	ns.uploadBW = &bw
+	ns.uploadHist = appendHistory(ns.uploadHist, bw.Avg)
+	ns.mu.Unlock()
 
-	ns.logger.Log(InfoLevel, "determined upload speed", "speed(bits/s)", ns.upload)
+	ns.logger.Log(InfoLevel, "determined upload speed", "speed(bits/s)", bw.Avg, "min", bw.Min, "max", bw.Max)
 	return nil
 }
 
+// DownloadSpeed returns the download speed in bits per second measured
+// by the most recent TestDownload, or -1 if not yet measured.
+func (ns *Sender) DownloadSpeed() int {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.download
+}
+
+// UploadSpeed returns the upload speed in bits per second measured by
+// the most recent TestUpload, or -1 if not yet measured.
+func (ns *Sender) UploadSpeed() int {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.upload
+}
+
+// SendOption is an option for a Send call. An option may change the
+// Sender, such as WithMtsAddress, or only the request being sent, such
+// as WithHost.
 type SendOption func(ns *Sender) error
 
+// sendOptions holds options which apply only to a single Send call.
+type sendOptions struct {
+	host   string // Service host, or empty to use the host for the request type.
+	params string // Extra URL params, each prefixed by &.
+	id     string // Request ID, or empty for a new ID.
+}
+
+// applySendOptions applies opts to the Sender, returning the options which
+// apply only to this call. Options are applied one call at a time, since
+// per-call options are set via ns.sendOpts.
+func (ns *Sender) applySendOptions(opts []SendOption) (*sendOptions, error) {
+	so := &sendOptions{}
+	ns.sendMu.Lock()
+	defer ns.sendMu.Unlock()
+	ns.sendOpts = so
+	defer func() { ns.sendOpts = nil }()
+	for i, opt := range opts {
+		err := opt(ns)
+		if err != nil {
+			return nil, fmt.Errorf("could not apply option no. %d: %v", i, err)
+		}
+	}
+	return so, nil
+}
+
+// callOption returns a SendOption which applies only to the Send call to
+// which it is passed, by calling f with the call's options.
+func callOption(f func(so *sendOptions) error) SendOption {
+	return func(ns *Sender) error {
+		if ns.sendOpts == nil {
+			return errors.New("option applies only to a Send call")
+		}
+		return f(ns.sendOpts)
+	}
+}
+
+// WithHost sets the HTTP address for a single Send call to addr,
+// without changing the Sender's services.
+func WithHost(addr string) SendOption {
+	return callOption(func(so *sendOptions) error {
+		if addr == "" {
+			return errors.New("empty host")
+		}
+		so.host = addr
+		return nil
+	})
+}
+
+// withParams adds the URL params p, each prefixed by &, to a single
+// Send call.
+func withParams(p string) SendOption {
+	return callOption(func(so *sendOptions) error {
+		so.params += p
+		return nil
+	})
+}
+
+// WithUploadID adds an ID for the data of the named pin to a single Send
+// call, sent as the <pin>.id param, e.g., T0.id, so that the service can
+// detect data which is uploaded more than once. The ID should be stable
+// for the same data, e.g., a content hash, and consist of URL-safe
+// characters.
+func WithUploadID(pin, id string) SendOption {
+	return callOption(func(so *sendOptions) error {
+		if pin == "" || id == "" {
+			return errors.New("empty upload pin or ID")
+		}
+		so.params += "&" + pin + ".id=" + id
+		return nil
+	})
+}
+
 // WithMtsAddress sets the HTTP address for the mts type to addr.
 func WithMtsAddress(addr string) SendOption {
 	return func(ns *Sender) error {
+		ns.mu.Lock()
 		ns.services["mts"] = addr
+		ns.mu.Unlock()
 		return nil
 	}
 }
@@ -560,11 +1242,17 @@ func WithRecvAddress(addr string) SendOption {
 // See http://netreceiver.appspot.com/help#protocol for a description
 // of the service requests.
 func (ns *Sender) Send(requestType int, pins []Pin, opts ...SendOption) (reply string, rc int, err error) {
-	for i, opt := range opts {
-		err := opt(ns)
-		if err != nil {
-			return "", 0, fmt.Errorf("could not apply option no. %d: %v", i, err)
-		}
+	return ns.SendContext(context.Background(), requestType, pins, opts...)
+}
+
+// SendContext is like Send, but the request is cancelled when ctx is done.
+// The global Timeout still applies.
+func (ns *Sender) SendContext(ctx context.Context, requestType int, pins []Pin, opts ...SendOption) (reply string, rc int, err error) {
+	ctx, cancel := ns.bindLifetime(ctx)
+	defer cancel()
+	so, err := ns.applySendOptions(opts)
+	if err != nil {
+		return "", 0, err
 	}
 	var path string
 	var uptime = int(time.Since(rebootTime).Seconds())
@@ -572,43 +1260,80 @@ func (ns *Sender) Send(requestType int, pins []Pin, opts ...SendOption) (reply s
 
 	switch requestType {
 	case RequestPoll, RequestMts, RequestAct, RequestConfig, RequestVars:
-		path = fmt.Sprintf("/%s?vn=%d&ma=%s&dk=%s&ut=%d", requestTypes[requestType], version, ns.Param("ma"), ns.Param("dk"), uptime)
+		path = fmt.Sprintf("/%s?vn=%d&ma=%s%s&ut=%d%s", requestTypes[requestType], version, ns.Param("ma"), ns.keyParam(), uptime, so.params)
 
 	default:
 		return reply, rc, errors.New("Invalid request type: " + strconv.Itoa(requestType))
 	}
+	defer func() { ns.countRequest(requestType, err) }()
 
 	ns.mu.Lock()
 	if ns.sync {
 		// Sync the mode and (optionally) error with the service.
 		path += "&md=" + ns.mode
-		if ns.error != "" {
+		if ns.error != "" || ns.cleared {
 			path += "&er=" + ns.error
 		}
 	}
 	ns.mu.Unlock()
 
+	// Sequence MTS chunks per stream (pin), so the service can detect
+	// gaps and reordering. A failed send leaves a gap in the sequence.
+	var seqs map[string]int
+	if requestType == RequestMts {
+		seqs = make(map[string]int)
+		defer func() { ns.ackSeqs(seqs, err) }()
+	}
+
 	// Append pin parameters to URL path.
+	scales := ns.Param("fs")
 	for _, pin := range pins {
 		if !hasValidData(pin) {
 			continue
 		}
+		if seqs != nil {
+			seqs[pin.Name] = ns.nextSeq(pin.Name)
+			path += "&" + pin.Name + ".sq=" + strconv.Itoa(seqs[pin.Name])
+		}
 		path += "&" + pin.Name + "="
-		if pin.MimeType != "" || len(pin.Data) == 0 {
+		switch {
+		case pin.IsFloat:
+			path += strconv.FormatFloat(pin.Float, 'f', floatDecimals(scales, pin.Name), 64)
+		case pin.MimeType != "" || len(pin.Data) == 0:
 			path += strconv.Itoa(pin.Value)
-		} else {
+		default:
 			path += string(pin.Data)
 		}
+		if !pin.Timestamp.IsZero() {
+			path += "&" + pin.Name + ".ts=" + strconv.FormatInt(pin.Timestamp.Unix(), 10)
+		}
 	}
 
-	// Look up the service host to use for this requestType, else use the default host.
-	host := ns.services[requestTypes[requestType]]
+	host := so.host
 	if host == "" {
-		host = ns.services["default"]
+		host = ns.serviceHost(requestTypes[requestType])
+	}
+
+	id := so.id
+	if hasDataReader(pins) {
+		id = "" // The data read cannot be known to be that of an earlier request.
 	}
+	id = ns.requestID(id)
+	defer func() { ns.ackRequest(id, err) }()
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+
+	var date time.Time
+	ctx = context.WithValue(ctx, serverDateKey{}, &date)
 
-	ns.logger.Log(DebugLevel, debugHttpRequest, "host", host, "request", path)
-	reply, err = httpRequest(host, path, pins)
+	ns.logger.Log(DebugLevel, debugHttpRequest, "host", host, "request", path, "id", id)
+	start := time.Now()
+	reply, err = ns.requestTransport(host).Request(ctx, host, path, pins)
+	rtt := time.Since(start)
+	ns.captureExchange(start, host, path, reply, rtt, err)
+	ns.recordLatency(rtt, requestSize(path, pins))
+	if so.host == "" {
+		ns.markHost(host, err)
+	}
 	if err != nil {
 		ns.logger.Log(WarningLevel, warnHttpError, "error", err.Error())
 		return reply, rc, err
@@ -622,9 +1347,10 @@ func (ns *Sender) Send(requestType int, pins []Pin, opts ...SendOption) (reply s
 	if err != nil {
 		return reply, rc, fmt.Errorf("error decoding reply: %v, error: %w", reply, err)
 	}
+	ns.syncClock(dec, date, start, rtt)
 	er, err := dec.String("er")
 	if err == nil {
-		ns.logger.Log(WarningLevel, warnHttpResponse, "er", er)
+		ns.auditLog(WarningLevel, warnHttpResponse, "er", er)
 		return reply, rc, &ServerError{er: er}
 	}
 	rc, err = dec.Int("rc")
@@ -659,91 +1385,388 @@ func (ns *Sender) Send(requestType int, pins []Pin, opts ...SendOption) (reply s
 		}
 	}
 	ns.mu.Lock()
-	if vs != ns.varSum {
+	ns.metrics.varSumAt = time.Now()
+	changed := vs != ns.varSum
+	if changed {
 		ns.logger.Log(DebugLevel, debugVarsumChanged)
 	}
 	ns.varSum = vs
+	notify := changed && (ns.varCh != nil || len(ns.varFuncs) != 0) && requestType != RequestVars
 	ns.mu.Unlock()
 
-	return reply, rc, nil
-}
+	// Fetch the changed vars, which notifies any VarChanges receiver
+	// and calls any var callbacks.
+	if notify {
+		_, err = ns.VarsContext(ctx)
+		if err != nil {
+			ns.logger.Log(WarningLevel, warnVarsError, "error", err.Error())
+		}
+	}
 
-// hasValidData checks a pin for data to be sent.
-func hasValidData(p Pin) bool {
-	return p.Value != -1 && (p.MimeType == "" || len(p.Data) != 0)
+	return reply, rc, nil
 }
 
-// localAddr returns the preferred local IP address as a string.
-func localAddr() string {
-	if conn, err := net.Dial("udp", "8.8.8.8:80"); err == nil {
-		// NB: dialing a UDP connection does not actually create a connection
-		defer conn.Close()
-		str := conn.LocalAddr().String()
-		if port := strings.Index(str, ":"); port > 0 {
-			return str[:port] // strip port number
-		}
-		return str
-	}
-	return ""
+// SendBatch sends multiple samples of input pins in a single poll
+// request, which is more efficient than a poll per sample, e.g., when
+// sampling faster than the monitor period or sending buffered readings.
+// Each sample is a set of pins read at the same time and every pin must
+// have a Timestamp, which the service uses instead of the arrival time.
+// A pin may appear in more than one sample, in which case its values are
+// sent in order, each followed by its timestamp. Pins with a MimeType
+// cannot be batched and must be sent individually with Send.
+func (ns *Sender) SendBatch(samples [][]Pin, opts ...SendOption) (reply string, rc int, err error) {
+	return ns.SendBatchContext(context.Background(), samples, opts...)
 }
 
-// httpRequest invokes an HTTP request.
-// GET is used when pins contain no payload data, POST otherwise.
-func httpRequest(address, path string, pins []Pin) (string, error) {
-	method := "GET"
-	var ior io.Reader
-	var pr *PayloadReader
-	var sz int
-	var mt string
-	if pins != nil {
-		var sendPins []Pin
-		for _, pin := range pins {
-			if len(pin.Data) == 0 || pin.MimeType == "" {
-				continue
-			}
-			if len(pin.Data) != pin.Value {
-				return "", errors.New("Pin Data length does not match Value")
+// SendBatchContext is like SendBatch, but the request is cancelled when
+// ctx is done.
+func (ns *Sender) SendBatchContext(ctx context.Context, samples [][]Pin, opts ...SendOption) (reply string, rc int, err error) {
+	var pins []Pin
+	for _, sample := range samples {
+		for _, pin := range sample {
+			if pin.Timestamp.IsZero() {
+				return "", ResponseNone, errors.New("batched pin has no timestamp: " + pin.Name)
 			}
-			sz += pin.Value
-			sendPins = append(sendPins, pin)
-			mt = pin.MimeType
-			if method == "GET" {
-				method = "POST"
+			if pin.MimeType != "" {
+				return "", ResponseNone, errors.New("batched pin has MIME type: " + pin.Name)
 			}
+			pins = append(pins, pin)
 		}
-		pr = NewPayloadReader(sendPins)
-		ior = pr
 	}
+	return ns.SendContext(ctx, RequestPoll, pins, opts...)
+}
+
+// Ping checks that the default service host is reachable and returns
+// the round-trip time of a minimal request. Any HTTP response, including
+// an error status, counts as reachable. Unlike a poll, Ping does not
+// touch the var sum, mode or config.
+func (ns *Sender) Ping(ctx context.Context) (time.Duration, error) {
+	return ns.ping(ctx, ns.serviceHost("default"))
+}
 
-	req, err := http.NewRequest(method, "http://"+address+path, ior)
+// ping implements Ping for the given service host.
+func (ns *Sender) ping(ctx context.Context, host string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ns.serviceURL(host)+pingPath, nil)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
-	if pr != nil {
-		req.ContentLength = int64(pr.Len())
-		snapshot := *pr
-		req.GetBody = func() (io.ReadCloser, error) {
-			r := snapshot
-			return ioutil.NopCloser(&r), nil
-		}
+	client := ns.httpClient()
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("could not ping service: %w", err)
 	}
-	if method == "POST" {
-		req.Header.Set("Content-Length", strconv.Itoa(sz))
+	latency := time.Since(start)
+	resp.Body.Close()
+	return latency, nil
+}
+
+// Services returns a copy of the services map, in which keys are
+// request types, or "default", and values are the corresponding
+// service hosts.
+func (ns *Sender) Services() map[string]string {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	services := make(map[string]string, len(ns.services))
+	for k, v := range ns.services {
+		services[k] = v
+	}
+	return services
+}
+
+// serviceHost returns the service host to use for the given request
+// type, else the default host. If there are multiple hosts, the first
+// which is not down is used (see pickHost).
+func (ns *Sender) serviceHost(requestType string) string {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	hosts := ns.services[requestType]
+	if hosts == "" {
+		hosts = ns.services["default"]
+	}
+	return ns.pickHost(hosts)
+}
+
+// nextSeq returns the next MTS sequence number for the given stream.
+func (ns *Sender) nextSeq(stream string) int {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.seq == nil {
+		ns.seq = make(map[string]int)
+	}
+	n := ns.seq[stream]
+	ns.seq[stream] = n + 1
+	return n
+}
+
+// ackSeqs records the given MTS sequence numbers as acknowledged if err
+// is nil, otherwise logs the resulting gaps.
+func (ns *Sender) ackSeqs(seqs map[string]int, err error) {
+	if err != nil {
+		for stream, n := range seqs {
+			ns.logger.Log(WarningLevel, warnMtsGap, "stream", stream, "seq", n, "error", err.Error())
+		}
+		return
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.acked == nil {
+		ns.acked = make(map[string]int)
+	}
+	for stream, n := range seqs {
+		if prev, ok := ns.acked[stream]; !ok || n > prev {
+			ns.acked[stream] = n
+		}
+	}
+}
+
+// Stats holds request outcome counters.
+type Stats struct {
+	Success int // Number of successful requests.
+	Failure int // Number of failed requests, including service errors.
+}
+
+// countRequest updates the request outcome counters for the given request type.
+func (ns *Sender) countRequest(requestType int, err error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.stats == nil {
+		ns.stats = make(map[int]Stats)
+	}
+	ns.metrics.recordRequest(err)
+	st := ns.stats[requestType]
+	if err != nil {
+		st.Failure++
+	} else {
+		st.Success++
+	}
+	ns.stats[requestType] = st
+}
+
+// RequestStats returns the request outcome counters keyed by request
+// type, e.g., RequestPoll, for requests made since the Sender was
+// initialized. This allows, for example, failing MTS requests to be
+// distinguished from successful polls.
+func (ns *Sender) RequestStats() map[int]Stats {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	stats := make(map[int]Stats, len(ns.stats))
+	for k, v := range ns.stats {
+		stats[k] = v
+	}
+	return stats
+}
+
+// LastAckedSeq returns the sequence number of the most recent MTS chunk
+// for the given stream (pin name) that was acknowledged by the service,
+// or false if none has been acknowledged.
+func (ns *Sender) LastAckedSeq(stream string) (int, bool) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	n, ok := ns.acked[stream]
+	return n, ok
+}
+
+// hasValidData checks a pin for data to be sent.
+// Float pins are valid unless NaN or infinite. Pins with Omit set are
+// never valid.
+func hasValidData(p Pin) bool {
+	if p.Omit {
+		return false
+	}
+	if p.IsFloat {
+		return !math.IsNaN(p.Float) && !math.IsInf(p.Float, 0)
+	}
+	return (p.Valid || p.Value != -1) && (p.MimeType == "" || len(p.Data) != 0 || p.DataReader != nil)
+}
+
+// localAddr returns the preferred local IP address as a string.
+func localAddr() string {
+	if conn, err := net.Dial("udp", "8.8.8.8:80"); err == nil {
+		// NB: dialing a UDP connection does not actually create a connection
+		defer conn.Close()
+		str := conn.LocalAddr().String()
+		if port := strings.Index(str, ":"); port > 0 {
+			return str[:port] // strip port number
+		}
+		return str
+	}
+	return ""
+}
+
+// Transport sends service requests on behalf of a Sender, allowing the
+// wire protocol to be replaced, e.g., by MQTT or a test double. The
+// default transport uses HTTP. See WithTransport.
+type Transport interface {
+	// Request sends a request to the service at host and returns the
+	// service's reply, which is normally JSON. The path includes the
+	// request type and query parameters, e.g., "/poll?vn=1&ma=...".
+	// The payload data of pins with a MimeType should accompany the
+	// request.
+	// The request should be cancelled when ctx is done.
+	Request(ctx context.Context, host, path string, pins []Pin) (string, error)
+}
+
+// TransportFunc is an adapter to allow the use of ordinary functions as
+// Transports.
+type TransportFunc func(ctx context.Context, host, path string, pins []Pin) (string, error)
+
+// Request implements Transport.Request by calling f.
+func (f TransportFunc) Request(ctx context.Context, host, path string, pins []Pin) (string, error) {
+	return f(ctx, host, path, pins)
+}
+
+// httpTransport implements the default HTTP Transport, which respects
+// the HTTP related options of its Sender.
+type httpTransport struct {
+	ns *Sender
+}
+
+// Request implements Transport.Request.
+func (t httpTransport) Request(ctx context.Context, host, path string, pins []Pin) (string, error) {
+	t.ns.mu.Lock()
+	maxReply := t.ns.maxReply
+	t.ns.mu.Unlock()
+	return httpRequest(ctx, t.ns.httpClient(), t.ns.serviceURL(host), path, pins, maxReply, t.ns.signingKey(), &t.ns.pacer)
+}
+
+// requestTransport returns the Transport used for service requests to
+// host. Unless WithTransport was applied, this is MQTT for service hosts
+// with an mqtt:// scheme, e.g., default=mqtt://broker.example.com:1883,
+// and HTTP otherwise.
+func (ns *Sender) requestTransport(host string) Transport {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	switch {
+	case ns.transport != nil:
+		return ns.transport
+	case strings.HasPrefix(host, mqttScheme):
+		if ns.mqtt == nil {
+			ns.mqtt = &mqttTransport{ns: ns}
+		}
+		return ns.mqtt
+	default:
+		return httpTransport{ns: ns}
+	}
+}
+
+// httpRequest invokes an HTTP request for path relative to the base URL.
+// GET is used when pins contain no payload data, POST otherwise.
+// Payload data with a single MIME type is concatenated into the body,
+// whereas payload data with differing MIME types is sent as a
+// multipart/mixed body with a part per pin (see multipartBody).
+// An error is returned if the response body exceeds maxReply bytes,
+// or defaultMaxReply bytes if maxReply is zero. The body, if any, is
+// paced by p, unless p is nil.
+func httpRequest(ctx context.Context, client *http.Client, base, path string, pins []Pin, maxReply int64, key string, p *pacer) (string, error) {
+	method := "GET"
+	var ior io.Reader
+	var pr *PayloadReader
+	var mp []byte
+	var sz int
+	var mt string
+	if pins != nil {
+		var sendPins []Pin
+		for _, pin := range pins {
+			if pin.MimeType == "" || (len(pin.Data) == 0 && pin.DataReader == nil) {
+				continue
+			}
+			if pin.DataReader == nil && len(pin.Data) != pin.Value {
+				return "", errors.New("Pin Data length does not match Value")
+			}
+			sz += pin.Value
+			sendPins = append(sendPins, pin)
+			if mt != "" && mt != pin.MimeType {
+				mp = []byte{} // Mixed MIME types.
+			}
+			mt = pin.MimeType
+			if method == "GET" {
+				method = "POST"
+			}
+		}
+		if mp != nil {
+			var err error
+			mp, mt, err = multipartBody(sendPins)
+			if err != nil {
+				return "", err
+			}
+			sz = len(mp)
+			ior = bytes.NewReader(mp)
+		} else {
+			pr = NewPayloadReader(sendPins)
+			ior = pr
+		}
+	}
+
+	if ior != nil {
+		ior = pace(ctx, ior, p)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base+path, ior)
+	if err != nil {
+		return "", err
+	}
+	if pr != nil {
+		req.ContentLength = int64(pr.Len())
+		req.GetBody = func() (io.ReadCloser, error) {
+			r := *pr
+			_, err := r.Seek(0, io.SeekStart)
+			return ioutil.NopCloser(pace(ctx, &r, p)), err
+		}
+	}
+	if mp != nil {
+		req.ContentLength = int64(len(mp))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(pace(ctx, bytes.NewReader(mp), p)), nil
+		}
+	}
+	if method == "POST" {
+		req.Header.Set("Content-Length", strconv.Itoa(sz))
 		req.Header.Set("Content-Type", mt)
 	}
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(headerRequestID, id)
+	}
+	tag := VarSumTag(ctx)
+	if tag != "" {
+		req.Header.Set("If-None-Match", `"`+tag+`"`)
+	}
+	if key != "" {
+		h := sha256.New()
+		if mp != nil {
+			h.Write(mp)
+		} else if pr != nil {
+			_, err = pr.WriteTo(h)
+			if err == nil {
+				_, err = pr.Seek(0, io.SeekStart)
+			}
+			if err != nil {
+				return "", fmt.Errorf("could not sign payload: %w", err)
+			}
+		}
+		signRequest(req, key, h.Sum(nil))
+	}
 
-	client := &http.Client{Timeout: Timeout, Transport: http.DefaultTransport}
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
+	recordDate(ctx, resp.Header.Get("Date"))
+	if resp.StatusCode == http.StatusNotModified && tag != "" {
+		return notModifiedReply(tag), nil
+	}
 
 	// Return the last line of the response, unless we encounter an error.
-	body, err := ioutil.ReadAll(resp.Body)
+	if maxReply == 0 {
+		maxReply = defaultMaxReply
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxReply+1))
 	if err != nil {
 		return "", err
 	}
+	if int64(len(body)) > maxReply {
+		return "", fmt.Errorf("response exceeds %d bytes", maxReply)
+	}
 	bodyLines := strings.Split(string(body), "\n")
 
 	if resp.Status == "200 OK" {
@@ -753,17 +1776,132 @@ func httpRequest(address, path string, pins []Pin) (string, error) {
 	}
 }
 
+// multipartBody returns a multipart/mixed body, and its content type,
+// with a part for the payload data of each pin. Each part has the pin's
+// MIME type and a Content-Disposition naming the pin, e.g.,
+// inline; name="B0".
+func multipartBody(pins []Pin) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, pin := range pins {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Type", pin.MimeType)
+		h.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"name": pin.Name}))
+		part, err := w.CreatePart(h)
+		if err != nil {
+			return nil, "", err
+		}
+		if pin.DataReader != nil {
+			_, err = io.CopyN(part, pin.DataReader, int64(pin.Value))
+		} else {
+			_, err = part.Write(pin.Data)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": w.Boundary()}), nil
+}
+
+// serviceURL returns the base URL for the given service host. A host
+// which includes a scheme, e.g., https://data.cloudblue.org, is used
+// as is, otherwise the scheme is https if WithTLS was applied and http
+// otherwise.
+func (ns *Sender) serviceURL(host string) string {
+	if strings.Contains(host, "://") {
+		return host
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.tls {
+		return "https://" + host
+	}
+	return "http://" + host
+}
+
+// httpClient returns the HTTP client used for service requests, which
+// is a copy of the client set by WithHTTPClient, if any. Unless set by
+// the client, the timeout is Timeout and redirects are checked with
+// checkRedirect.
+func (ns *Sender) httpClient() *http.Client {
+	ns.mu.Lock()
+	t := ns.roundTripper
+	var c http.Client
+	if ns.client != nil {
+		c = *ns.client
+	}
+	ns.mu.Unlock()
+	if t == nil {
+		t = sharedTransport()
+	}
+	c.Transport = t
+	if c.Timeout == 0 {
+		c.Timeout = Timeout
+	}
+	if c.CheckRedirect == nil {
+		c.CheckRedirect = checkRedirect
+	}
+	return &c
+}
+
+// sharedTransport returns the default HTTP transport, creating it on
+// first use.
+func sharedTransport() *http.Transport {
+	defaultTransportOnce.Do(func() { defaultTransport = newTransport() })
+	return defaultTransport
+}
+
+// newTransport returns an HTTP transport which honours the HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables, keeps connections
+// alive for reuse, and uses the default transport settings.
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: DialTimeout, KeepAlive: KeepAlive}).DialContext,
+		TLSHandshakeTimeout:   TLSHandshakeTimeout,
+		IdleConnTimeout:       IdleConnTimeout,
+		MaxIdleConns:          10,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+}
+
+// checkRedirect follows redirects which preserve the request method,
+// i.e., 307 and 308 redirects, or any redirect of a GET. In the former
+// case the payload is re-supplied by the request's GetBody. Redirects
+// which would change the method, and so silently drop a payload, are
+// refused with ErrRedirect.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	orig := via[0]
+	if req.Method != orig.Method {
+		return fmt.Errorf("%w: %s %s to %s %s", ErrRedirect, orig.Method, orig.URL.Host, req.Method, req.URL.Host)
+	}
+	return nil
+}
+
 // Config requests configuration information from the service via a /config request.
 // A config request can result in a new request from the service, which is returned as rc.
 // Config parameters that have changed are updated.
 // Missing or invalid config parameters are silently ignored.
 func (ns *Sender) Config() (rc int, err error) {
+	return ns.ConfigContext(context.Background())
+}
+
+// ConfigContext is like Config, but the request is cancelled when ctx is done.
+func (ns *Sender) ConfigContext(ctx context.Context) (rc int, err error) {
 	ns.mu.Lock()
 	ns.configured = false
 	ns.mu.Unlock()
 
 	var reply string
-	if reply, rc, err = ns.Send(RequestConfig, ns.configPins); err != nil {
+	if reply, rc, err = ns.SendContext(ctx, RequestConfig, ns.configPins); err != nil {
 		return rc, err
 	}
 
@@ -774,6 +1912,7 @@ func (ns *Sender) Config() (rc int, err error) {
 	}
 
 	changed := false
+	var newKey string
 	ns.mu.Lock()
 	for _, name := range configParams {
 		var num int
@@ -788,44 +1927,75 @@ func (ns *Sender) Config() (rc int, err error) {
 		if err != nil {
 			continue
 		}
+		if sliceutils.ContainsString(localParams, name) {
+			continue
+		}
+		if name == "mp" || name == "ap" {
+			val = ns.clampPeriod(name, val)
+		}
+		if err := validateParam(name, val); err != nil {
+			ns.logger.Log(WarningLevel, warnConfigParam, "error", err.Error())
+			continue
+		}
+		if name == "dk" {
+			// A new device key must be acknowledged (see rotateKey).
+			if val != ns.config["dk"] && val != ns.config["pk"] {
+				newKey = val
+			}
+			continue
+		}
 		if val != ns.config[name] {
 			ns.config[name] = val
-			ns.logger.Log(InfoLevel, infoConfigParamChange, "name", name, "value", val)
+			ns.auditLog(InfoLevel, infoConfigParamChange, "name", name, "value", Redact(name, val))
 			changed = true
 		}
 	}
 	ns.configured = true
+	ns.everConfig = true
 	ns.mu.Unlock()
+	ns.reportHealth(healthConfig)
+	ns.notifySystemd(sdReady)
 
 	if changed {
 		ns.mu.Lock()
 		err := ns.writeConfig(ns.config)
-		if err == nil {
-			ns.logger.Log(DebugLevel, debugConfigWrite)
-		} else {
+		if err != nil {
 			ns.logger.Log(ErrorLevel, errorConfigWrite, "error", err.Error())
 		}
 		ns.mu.Unlock()
 		ns.initPins()
+		ns.applyWiFi()
+	}
+	if newKey != "" {
+		err := ns.rotateKey(ctx, newKey)
+		if err != nil {
+			ns.logger.Log(WarningLevel, warnKeyRotation, "error", err.Error())
+		}
 	}
 	return rc, nil
 }
 
 // Debug logs a stack trace. If T0 (log text) is present as an input,
 // the stack trace is sent to the service, followed by a config
-// request.
+// request. If T4 is present as an input and capture is enabled, the
+// captured service requests are also sent (see DumpHTTP).
 func (ns *Sender) Debug() error {
 	buf := make([]byte, stackTraceSize)
 	size := runtime.Stack(buf, true)
 	ns.logger.Log(InfoLevel, infoStackTrace, "stack", string(buf[:size]))
 
+	err := ns.DumpHTTP()
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnDumpHTTP, "error", err.Error())
+	}
+
 	if !strings.Contains(ns.Param("ip"), "T0") {
 		return nil
 	}
 
 	ns.logger.Log(DebugLevel, debugSendStackTrace)
 	pin := Pin{Name: "T0", Value: size, Data: buf[:size], MimeType: "text/plain"}
-	_, _, err := ns.Send(RequestPoll, []Pin{pin})
+	_, _, err = ns.Send(RequestPoll, []Pin{pin})
 	if err != nil {
 		return err
 	}
@@ -833,6 +2003,30 @@ func (ns *Sender) Debug() error {
 	return err
 }
 
+// SetInitFunc sets the pin initialization function, which may be nil.
+// The new function is used the next time pins are initialized.
+func (ns *Sender) SetInitFunc(init PinInit) {
+	ns.mu.Lock()
+	ns.init = init
+	ns.mu.Unlock()
+}
+
+// SetReadFunc sets the pin read function, which may be nil.
+// It is safe to call during Run, which uses the function in effect at its start.
+func (ns *Sender) SetReadFunc(read PinReadWrite) {
+	ns.mu.Lock()
+	ns.read = read
+	ns.mu.Unlock()
+}
+
+// SetWriteFunc sets the pin write function, which may be nil.
+// It is safe to call during Run, which uses the function in effect at its start.
+func (ns *Sender) SetWriteFunc(write PinReadWrite) {
+	ns.mu.Lock()
+	ns.write = write
+	ns.mu.Unlock()
+}
+
 // IsConfigured returns true if (1) NetSender has been configured the first time or
 // (2) configured since the most recent update request.
 func (ns *Sender) IsConfigured() bool {
@@ -841,6 +2035,15 @@ func (ns *Sender) IsConfigured() bool {
 	return ns.configured
 }
 
+// EverConfigured returns true if NetSender has been successfully
+// configured at least once, regardless of subsequent update requests.
+// A client that has never been configured may need provisioning.
+func (ns *Sender) EverConfigured() bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.everConfig
+}
+
 // IsUpgrading returns true if an upgrade is is progress.
 func (ns *Sender) IsUpgrading() bool {
 	ns.mu.Lock()
@@ -855,6 +2058,18 @@ func (ns *Sender) Param(param string) string {
 	return ns.config[param]
 }
 
+// EffectiveConfig returns a copy of the config in effect, i.e., the
+// config file contents with defaults and server updates applied.
+func (ns *Sender) EffectiveConfig() map[string]string {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	config := make(map[string]string, len(ns.config))
+	for k, v := range ns.config {
+		config[k] = v
+	}
+	return config
+}
+
 // VarSum gets the currently cached var sum, i.e., the last var sum received from the service.
 // The var sum is a 32-bit CRC-style checksum of the current the service variables and their values.
 func (ns *Sender) VarSum() int {
@@ -869,15 +2084,25 @@ func (ns *Sender) VarSum() int {
 //
 //	id: the ID assigned to this device by the service (always present).
 //	mode: device-specific operating mode of this device, defaults to "Normal".
-//	logging: the log level, one of "Error", "Warn", "Info", or "Debug"
+//	logging: the log level, one of LogLevels, i.e., "Fatal", "Error", "Warning", "Info", or "Debug"
+//	quietHours: the quiet hours schedule (see ParseQuietHours)
 //	vs: the var sum (in _string_ form)
+//
+// Vars requests are conditional, i.e., the service need not resend vars
+// which are unchanged (see VarSumTag). If the service cannot be reached,
+// the cached vars may be returned instead (see WithVarsCache).
 func (ns *Sender) Vars() (map[string]string, error) {
+	return ns.VarsContext(context.Background())
+}
+
+// VarsContext is like Vars, but the request is cancelled when ctx is done.
+func (ns *Sender) VarsContext(ctx context.Context) (map[string]string, error) {
 	var reply string
 	var err error
 	var vars map[string]string
 
-	if reply, _, err = ns.Send(RequestVars, nil); err != nil {
-		return vars, err
+	if reply, _, err = ns.SendContext(ns.withVarSumTag(ctx), RequestVars, nil); err != nil {
+		return ns.staleVars(err)
 	}
 	ns.logger.Log(InfoLevel, infoReceivedVars, "vars", reply)
 
@@ -888,8 +2113,9 @@ func (ns *Sender) Vars() (map[string]string, error) {
 
 	er, present := vars["er"]
 	if present {
-		return vars, errors.New(er)
+		return vars, &ServerError{er: er}
 	}
+	vars = ns.unmodifiedVars(vars)
 
 	id, present := vars["id"]
 	if present {
@@ -902,8 +2128,8 @@ func (ns *Sender) Vars() (map[string]string, error) {
 	}
 
 	// Check for special vars.
-	_, present = vars["mode"]
-	if !present {
+	_, hasMode := vars["mode"]
+	if !hasMode {
 		vars["mode"] = "Normal"
 	}
 	_, present = vars["error"]
@@ -913,35 +2139,109 @@ func (ns *Sender) Vars() (map[string]string, error) {
 
 	// Save the mode and error.
 	ns.mu.Lock()
+	prevMode := ns.mode
 	if ns.mode == vars["mode"] && ns.error == vars["error"] {
 		ns.sync = false // client is in sync
+		ns.cleared = false
 	} else {
 		ns.mode = vars["mode"]
 		ns.error = vars["error"]
 	}
+	ns.lastVars = maps.Clone(vars)
+	ns.notifyVars(vars)
 	ns.mu.Unlock()
+	ns.setQuietHours(vars)
+	ns.setSpeedTestInterval(vars)
+	ns.setUploadRate(vars)
+	// The mode is not audited when it is first learned, or when it is
+	// only defaulted because the service did not send it.
+	if hasMode && prevMode != "" && prevMode != vars["mode"] {
+		ns.auditLog(InfoLevel, infoModeChange, "from", prevMode, "to", vars["mode"])
+	}
 
-	logging, present := vars["logging"]
-	if present {
-		switch logging {
-		case "Fatal":
-			ns.logger.SetLevel(FatalLevel)
-		case "Error":
-			ns.logger.SetLevel(ErrorLevel)
-		case "Warning":
-			ns.logger.SetLevel(WarningLevel)
-		case "Info":
-			ns.logger.SetLevel(InfoLevel)
-		case "Debug":
-			ns.logger.SetLevel(DebugLevel)
-		default:
-			ns.logger.Log(WarningLevel, warnSetLogLevel, "LogLevel", logging)
-			return vars, nil
+	ns.setLogLevels(vars)
+
+	ns.cacheVars(vars)
+	ns.dispatchVars(vars)
+	ns.dumpHTTPOnVar(ctx, vars)
+	return vars, nil
+}
+
+// logLevels maps the values of the logging var to log levels.
+var logLevels = []struct {
+	name  string
+	level int8
+}{
+	{"Fatal", FatalLevel},
+	{"Error", ErrorLevel},
+	{"Warning", WarningLevel},
+	{"Info", InfoLevel},
+	{"Debug", DebugLevel},
+}
+
+// LogLevels returns the valid values of the logging var, from least
+// to most verbose.
+func LogLevels() []string {
+	names := make([]string, len(logLevels))
+	for i, l := range logLevels {
+		names[i] = l.name
+	}
+	return names
+}
+
+// ParseLogLevel returns the log level for a value of the logging var,
+// or an error if the value is not one of LogLevels.
+func ParseLogLevel(s string) (int8, error) {
+	for _, l := range logLevels {
+		if l.name == s {
+			return l.level, nil
 		}
-		ns.logger.Log(DebugLevel, debugSetLogLevel, "LogLevel", logging)
 	}
+	return 0, errors.New("invalid log level: " + s)
+}
 
-	return vars, nil
+// VarChanges returns a channel on which a copy of the vars is sent
+// whenever the var sum changes. Changes detected by Send, e.g., during
+// Run, cause the vars to be fetched. The channel holds only the most
+// recent vars, so a slow receiver misses intermediate changes rather
+// than blocking the Sender. The channel is intended for a single
+// receiver and is never closed.
+func (ns *Sender) VarChanges() <-chan map[string]string {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.varCh == nil {
+		ns.varCh = make(chan map[string]string, 1)
+	}
+	return ns.varCh
+}
+
+// notifyVars sends a copy of vars on the var change channel, if any,
+// if the var sum has changed since the last notification, replacing
+// any unreceived vars. It must be called with ns.mu held.
+func (ns *Sender) notifyVars(vars map[string]string) {
+	if ns.varCh == nil || (ns.notified && ns.notifySum == ns.varSum) {
+		return
+	}
+	cp := make(map[string]string, len(vars))
+	for k, v := range vars {
+		cp[k] = v
+	}
+	select {
+	case <-ns.varCh:
+	default:
+	}
+	ns.varCh <- cp
+	ns.notified = true
+	ns.notifySum = ns.varSum
+}
+
+// InSync returns true if the client mode and error have been
+// acknowledged by the service, i.e., a Vars request has returned the
+// mode and error most recently set by the client.
+func (ns *Sender) InSync() bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return !ns.sync
 }
 
 // Mode gets the client mode value.
@@ -955,13 +2255,16 @@ func (ns *Sender) Mode() string {
 // SetMode sets the client mode, resets the client's varsum and forces a sync.
 func (ns *Sender) SetMode(mode string) {
 	ns.mu.Lock()
-	defer ns.mu.Unlock()
-	if mode == ns.mode {
+	prev := ns.mode
+	if mode == prev {
+		ns.mu.Unlock()
 		return
 	}
 	ns.mode = mode
 	ns.sync = true
 	ns.varSum = -1
+	ns.mu.Unlock()
+	ns.auditLog(InfoLevel, infoModeChange, "from", prev, "to", mode)
 }
 
 // Error gets the client error value.
@@ -981,17 +2284,31 @@ func (ns *Sender) SetError(error string) {
 	}
 	ns.error = error
 	ns.sync = true
+	ns.cleared = error == ""
 	ns.varSum = -1
 }
 
+// ClearError clears the client error, e.g., once the condition that
+// caused it has resolved, and syncs the cleared error with the service.
+// If there is no error, ClearError does nothing.
+func (ns *Sender) ClearError() {
+	ns.SetError("")
+}
+
 // Upgrade performs an upgrade of the device software for the
 // configured client type (ct) and client version (cv). Sets the mode
 // to modeCompleted upon completion, successful or otherwise. Sets the
-// error to errorUpgrade if the upgrade fails.
+// error to errorUpgrade if the upgrade fails, or errorUpgradeVerify if
+// the upgrade fails verification (see WithUpgradeVerification), and
+// clears either error if it succeeds. Finally, calls the upgrade
+// handler, if any, and, after a self-update, re-executes the client (see
+// WithSelfUpdate). The stage of the upgrade is reported throughout (see
+// UpgradeProgress).
 func (ns *Sender) Upgrade() {
 	ct := strings.ToLower(ns.Param("ct"))
 	if ct == "" {
 		ns.logger.Log(WarningLevel, warnMissingDeviceType)
+		ns.upgraded(errors.New(warnMissingDeviceType))
 		return
 	}
 	cv := strings.ToLower(ns.Param("cv"))
@@ -1003,39 +2320,184 @@ func (ns *Sender) Upgrade() {
 	ns.upgrading = true
 	ns.mu.Unlock()
 
-	ns.logger.Log(InfoLevel, "upgrading", "upgrader", ns.upgrader, "ct", ct, "cv", cv)
-	cmd := exec.Command(ns.upgrader, ct, cv)
-	err := cmd.Run()
+	ns.auditLog(InfoLevel, "upgrading", "upgrader", ns.upgrader, "ct", ct, "cv", cv)
+	ns.prepareRollback(ct, cv)
+	err := ns.install(ct, cv)
+	ns.upgradeInstalled(err)
 
 	ns.mu.Lock()
 	ns.upgrading = false
 	ns.mu.Unlock()
 
-	if err != nil {
-		ns.logger.Log(WarningLevel, warnUpgraderError, "upgrader", ns.upgrader, "ct", ct, "cv", cv)
+	switch {
+	case errors.Is(err, ErrUpgradeVerify):
+		ns.auditLog(WarningLevel, warnUpgradeVerify, "ct", ct, "cv", cv, "error", err.Error())
+		ns.SetError(errorUpgradeVerify)
+	case err != nil:
+		ns.auditLog(WarningLevel, warnUpgraderError, "upgrader", ns.upgrader, "ct", ct, "cv", cv, "error", err.Error())
 		ns.SetError(errorUpgrade)
-	} else {
-		ns.logger.Log(InfoLevel, infoUpgraded, "upgrader", ns.upgrader, "ct", ct, "cv", cv)
+	default:
+		ns.auditLog(InfoLevel, infoUpgraded, "upgrader", ns.upgrader, "ct", ct, "cv", cv)
+		// Clear any error from a previous upgrade, but not errors set by
+		// the application or reported by a rollback.
+		if e := ns.Error(); e == errorUpgrade || e == errorUpgradeVerify {
+			ns.ClearError()
+		}
 	}
 
 	ns.SetMode(modeCompleted)
 	ns.Config()
+	ns.upgraded(err)
+	ns.restart()
+	ns.setUpgradeStage(UpgradeIdle)
+}
+
+// install installs version cv of client type ct with the upgrader, after
+// fetching and verifying it if required (see WithUpgradeVerification), or
+// by replacing the executable (see WithSelfUpdate).
+func (ns *Sender) install(ct, cv string) error {
+	ns.mu.Lock()
+	key, dir := ns.upgradeKey, ns.upgradeDir
+	ns.mu.Unlock()
+	if ns.selfUpdate {
+		ctx, cancel := context.WithTimeout(context.Background(), upgradeFetchTimeout)
+		staging, err := ns.fetchUpgrade(ctx, key, dir, ct, cv)
+		cancel()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(dir) // The staging directory is ours, so remove it if empty.
+		ns.setUpgradeStage(UpgradeInstalling)
+		return ns.installBinary(ct, staging)
+	}
+	cmd := exec.Command(ns.upgrader, ct, cv)
+	if key != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), upgradeFetchTimeout)
+		staging, err := ns.fetchUpgrade(ctx, key, dir, ct, cv)
+		cancel()
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(staging)
+		cmd.Env = append(os.Environ(), upgradeDirEnv+"="+staging)
+	}
+	ns.setUpgradeStage(UpgradeInstalling)
+	return cmd.Run()
+}
+
+// upgraded calls the upgrade handler, if any, with the result of an upgrade.
+// NB: The handler is called without holding the mutex, so it may call Sender methods.
+func (ns *Sender) upgraded(err error) {
+	ns.mu.Lock()
+	h := ns.upgradeHandler
+	ns.mu.Unlock()
+	if h != nil {
+		h(err == nil, err)
+	}
+}
+
+// auditLog logs a security-relevant event to the logger and, if
+// present, to the audit logger. Audited events are config param
+// changes, reboots, shutdowns, upgrades, service rejections (such as
+// an invalid device key) and mode changes.
+func (ns *Sender) auditLog(level int8, message string, params ...interface{}) {
+	ns.logger.Log(level, message, params...)
+	if ns.audit != nil {
+		ns.audit.Log(level, message, params...)
+	}
 }
 
-// writeConfig writes configuration info to configFile in configParams order.
+// writeConfig writes configuration info to the config store in canonical
+// order (see configOrder). Config files are not rewritten if their content
+// would be unchanged, which reduces wear on SD cards. Params set by
+// environment variables are not written, so the config file keeps its
+// own values for them, if any. s.mu must be held.
 func (s *Sender) writeConfig(config map[string]string) error {
-	s.logger.Log(InfoLevel, "writing config", "config", config)
-	return filemap.WriteTo(s.configFile, "\n", " ", config, configParams)
+	if len(s.envParams) != 0 {
+		file := make(map[string]string, len(config))
+		for k, v := range config {
+			file[k] = v
+		}
+		for _, k := range s.envParams {
+			delete(file, k)
+			if v, ok := s.envShadowed[k]; ok {
+				file[k] = v
+			}
+		}
+		config = file
+	}
+	err := s.configStore().Write(config, s.configOrder(config))
+	switch {
+	case errors.Is(err, ErrUnchanged):
+		s.logger.Log(DebugLevel, debugConfigUnchanged)
+		return nil
+	case err != nil:
+		return err
+	}
+	s.logger.Log(InfoLevel, infoConfigWrite, "config", config)
+	return nil
+}
+
+// configOrder returns the order in which config params are written.
+// Params in the write order, which is configParams unless set by
+// WithConfigOrder, come first, followed by any other params, such as
+// those added by hand, in string sort order. The order therefore does
+// not depend on the order of params in the file which was read.
+func (s *Sender) configOrder(config map[string]string) []string {
+	order := s.order
+	if order == nil {
+		order = configParams
+	}
+	var extra []string
+	for k := range config {
+		if !sliceutils.ContainsString(order, k) {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(extra)
+	return append(append([]string(nil), order...), extra...)
 }
 
-// readConfig reads configuration info from configFile and returns it as a map of parameter name/value pairs.
-// An error is returned if required configuration parameters (ma or dk) are missing.
+// readConfig reads configuration info from the config store (see
+// WithConfigStore) and returns it as a map of parameter name/value pairs.
+// Params set by environment variables (see envConfig) take precedence
+// over those in the config file, which in turn take precedence over
+// built-in defaults. The config file may be absent if the environment
+// supplies at least one param. Params set by environment variables are
+// never written to the config file (see writeConfig).
+// An error is returned if required configuration parameters (ma or dk, and
+// any set by WithStrictConfig) are missing, if a numeric param is not a
+// number, or if ma is invalid and WithMACValidation was applied.
 // Default values are supplied for other parameters that are missing.
+// Other malformed params (see ParseConfig) are logged and replaced by
+// their default, if any, or else kept as is, so that config files which
+// were accepted by earlier versions are still accepted.
 func (s *Sender) readConfig() (map[string]string, error) {
-	config, err := filemap.ReadFrom(s.configFile, "\n", " ")
-	if err != nil {
+	env := envConfig()
+	config, err := s.configStore().Read()
+	switch {
+	case err == nil:
+	case errors.Is(err, fs.ErrNotExist) && len(env) != 0:
+		config = make(map[string]string)
+	default:
 		return nil, err
 	}
+	var envParams []string
+	shadowed := make(map[string]string)
+	for k, v := range env {
+		if fv, ok := config[k]; ok {
+			shadowed[k] = fv
+		}
+		config[k] = v
+		envParams = append(envParams, k)
+	}
+	sort.Strings(envParams)
+
+	for _, name := range s.required {
+		if _, present := config[name]; !present {
+			return nil, errors.New("Required " + name + " param is missing")
+		}
+	}
 
 	for _, name := range configParams {
 		val, present := config[name]
@@ -1044,32 +2506,146 @@ func (s *Sender) readConfig() (map[string]string, error) {
 			case "ma":
 				return nil, errors.New("Required ma param is missing")
 			case "dk":
-				return nil, errors.New("Required dk param is missing")
-			case "mp":
-				config["mp"] = strconv.Itoa(monPeriod)
-			case "ap":
-				config["ap"] = "0"
-			case "sh":
-				config["sh"] = "default=" + defaultService
+				if !s.provision {
+					return nil, errors.New("Required dk param is missing")
+				}
+				config["dk"] = ""
 			default:
-				config[name] = ""
+				config[name] = paramDefault(name)
 			}
 			continue
 		}
 		if sliceutils.ContainsString(configNumbers, name) {
+			if name == "dk" && val == "" && s.provision {
+				continue // The device key is yet to be obtained (see WithProvisioning).
+			}
 			if _, err := strconv.ParseInt(val, 10, 64); err != nil {
 				return nil, errors.New("Expected int for config param: " + name)
 			}
 		}
+		if name == "mp" || name == "ap" {
+			config[name] = s.clampPeriod(name, val)
+		}
+	}
+
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "ma" || name == "dk" {
+			continue
+		}
+		val := config[name]
+		err := validateParam(name, val)
+		if err != nil {
+			s.logger.Log(WarningLevel, warnConfigFileParam, "param", name, "value", Redact(name, val), "error", err.Error())
+			if def := paramDefault(name); def != "" {
+				config[name] = def
+			}
+		}
+	}
+	if s.checkMAC {
+		err := validateMAC(config["ma"], s.strictMAC)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	s.mu.Lock()
+	s.envParams, s.envShadowed = envParams, shadowed
+	s.mu.Unlock()
 	return config, nil
 }
 
+// paramDefault returns the default value of the named config param.
+func paramDefault(name string) string {
+	switch name {
+	case "mp":
+		return strconv.Itoa(monPeriod)
+	case "ap":
+		return "0"
+	case "sh":
+		return "default=" + defaultService
+	}
+	return ""
+}
+
+// envPrefix is the prefix of environment variables which override config
+// params, e.g., NETSENDER_MA overrides ma.
+const envPrefix = "NETSENDER_"
+
+// envConfig returns the config params set by environment variables.
+func envConfig() map[string]string {
+	config := make(map[string]string)
+	for _, name := range configParams {
+		if val, ok := os.LookupEnv(envPrefix + strings.ToUpper(name)); ok {
+			config[name] = val
+		}
+	}
+	return config
+}
+
+// validateMAC checks that ma is a colon-separated 48-bit MAC address.
+// If strict is true, ma must also be the hardware address of a local
+// network interface, which prevents a config file that has been moved
+// to another device from sending under the wrong identity.
+func validateMAC(ma string, strict bool) error {
+	hw, err := net.ParseMAC(ma)
+	if err != nil || len(hw) != 6 || len(ma) != 17 || ma[2] != ':' {
+		return errors.New("Invalid ma param: " + ma)
+	}
+	if !strict {
+		return nil
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("could not get network interfaces: %w", err)
+	}
+	for _, iface := range ifaces {
+		if bytes.Equal(iface.HardwareAddr, hw) {
+			return nil
+		}
+	}
+	return errors.New("ma param does not match any network interface: " + ma)
+}
+
+// clampPeriod clamps the value of a monitor period (mp) or act period
+// (ap) param to its valid range, logging a warning if it is out of
+// range. The monitor period must be at least 1 second, since a zero or
+// negative period would cause clients to busy loop, and the act period
+// must be non-negative. Both are limited to the maximum period.
+func (s *Sender) clampPeriod(name, val string) string {
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return val // Type errors are handled elsewhere.
+	}
+	lo, hi := 0, s.maxPeriod
+	if name == "mp" {
+		lo = 1
+	}
+	if hi == 0 {
+		hi = maxPeriod
+	}
+	switch {
+	case n < lo:
+		n = lo
+	case n > hi:
+		n = hi
+	default:
+		return val
+	}
+	s.logger.Log(WarningLevel, warnPeriodClamped, "name", name, "value", val, "clamped", n)
+	return strconv.Itoa(n)
+}
+
 // configServices takes a service host (sh) parameter and returns a
 // map in which keys represent the different request types and values
 // represent the corresponding service host. If a single host is
 // specified a map with a single entry {"default":sh} is returned.
+// A value may list failover hosts separated by |, in order of
+// preference, e.g., default=a.example.com|b.example.com.
 func configServices(sh string) (map[string]string, error) {
 	if !strings.ContainsAny(sh, "=,") {
 		// No comma-separated values, so the one-and-only host is the default.
@@ -1090,23 +2666,37 @@ func configServices(sh string) (map[string]string, error) {
 	return svc, nil
 }
 
-// PayloadReader implements an io.Reader for Pin payload data.
+// PayloadReader implements an io.Reader for Pin payload data. It also
+// implements io.WriterTo and io.Seeker, so that the payload is not copied
+// into a buffer when sent and can be re-read for retries. Payload data
+// is read from the DataReader of pins which have one, in which case
+// seeking requires the DataReader to implement io.Seeker.
 type PayloadReader struct {
 	pins []Pin
-	cur  int // current pin we're reading from
-	off  int // offset into the current pin
+	cur  int     // current pin we're reading from
+	off  int     // offset into the current pin
+	pos  []int64 // bytes consumed from each pin's DataReader, if any
 }
 
 // NewPayloadReader returns a pointer to a newly initialized PayloadReader.
 func NewPayloadReader(pins []Pin) *PayloadReader {
-	return &PayloadReader{pins: pins}
+	return &PayloadReader{pins: pins, pos: make([]int64, len(pins))}
+}
+
+// dataLen returns the length of a pin's payload data, which is its Value
+// if the data is read from its DataReader.
+func dataLen(pin Pin) int {
+	if pin.DataReader != nil {
+		return pin.Value
+	}
+	return len(pin.Data)
 }
 
 // Len returns the remaining number of bytes to be read from the payload.
 func (pr *PayloadReader) Len() int {
 	var n int
 	for _, d := range pr.pins[pr.cur:] {
-		n += len(d.Data)
+		n += dataLen(d)
 	}
 	n -= pr.off
 	return n
@@ -1114,25 +2704,42 @@ func (pr *PayloadReader) Len() int {
 
 // Read reads the next len(b) bytes from the payload or until the payload is drained.
 // The return value n is the number of bytes read. If the payload has no data to
-// return and len(b) is not zero, err is io.EOF, otherwise nil.
+// return and len(b) is not zero, err is io.EOF, otherwise nil. Fewer than
+// len(b) bytes may be returned without an error when reading from a
+// DataReader, and io.ErrUnexpectedEOF is returned if a DataReader has
+// less data than the pin's Value.
 func (pr *PayloadReader) Read(b []byte) (int, error) {
 	if len(b) == 0 {
 		return 0, nil
 	}
 	var n int
-	for pr.cur < len(pr.pins) {
-		pd := pr.pins[pr.cur].Data[pr.off:]
-		if len(pd) == 0 {
+	for pr.cur < len(pr.pins) && n < len(b) {
+		pin := pr.pins[pr.cur]
+		rem := dataLen(pin) - pr.off
+		if rem <= 0 {
 			pr.cur++
 			pr.off = 0
 			continue
 		}
-		_n := copy(b[n:], pd)
-		if _n == 0 {
-			break
+		if pin.DataReader == nil {
+			_n := copy(b[n:], pin.Data[pr.off:])
+			pr.off += _n
+			n += _n
+			continue
 		}
+		_n, err := pin.DataReader.Read(b[n:min(len(b), n+rem)])
 		pr.off += _n
+		pr.pos[pr.cur] += int64(_n)
 		n += _n
+		if err == io.EOF && _n < rem {
+			return n, io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if n != 0 {
+			return n, nil // Don't block on further reads.
+		}
 	}
 	if n < len(b) {
 		return n, io.EOF
@@ -1140,15 +2747,164 @@ func (pr *PayloadReader) Read(b []byte) (int, error) {
 	return n, nil
 }
 
+// WriteTo implements io.WriterTo, writing the remaining payload to w
+// without an intermediate buffer, e.g., when io.Copy sends a request body.
+func (pr *PayloadReader) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for ; pr.cur < len(pr.pins); pr.cur, pr.off = pr.cur+1, 0 {
+		pin := pr.pins[pr.cur]
+		rem := dataLen(pin) - pr.off
+		if rem <= 0 {
+			continue
+		}
+		if pin.DataReader != nil {
+			_n, err := io.CopyN(w, pin.DataReader, int64(rem))
+			pr.off += int(_n)
+			pr.pos[pr.cur] += _n
+			n += _n
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+		pd := pin.Data[pr.off:]
+		_n, err := w.Write(pd)
+		pr.off += _n
+		n += int64(_n)
+		if err == nil && _n != len(pd) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Size returns the total number of bytes in the payload.
+func (pr *PayloadReader) Size() int64 {
+	var n int64
+	for _, d := range pr.pins {
+		n += int64(dataLen(d))
+	}
+	return n
+}
+
+// Seek implements io.Seeker, so that the payload may be read again, e.g.,
+// to retry a request. Offsets beyond the end of the payload are allowed,
+// after which Read returns io.EOF. DataReaders are seeked relative to
+// their current position, so need not start at offset zero.
+func (pr *PayloadReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += pr.Size() - int64(pr.Len())
+	case io.SeekEnd:
+		offset += pr.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	pr.cur, pr.off = 0, 0
+	for rem := offset; pr.cur < len(pr.pins); pr.cur++ {
+		l := int64(dataLen(pr.pins[pr.cur]))
+		if rem < l {
+			pr.off = int(rem)
+			break
+		}
+		rem -= l
+	}
+
+	// Move each DataReader to the new position.
+	for i, pin := range pr.pins {
+		if pin.DataReader == nil {
+			continue
+		}
+		var want int64
+		switch {
+		case i < pr.cur:
+			want = int64(pin.Value)
+		case i == pr.cur:
+			want = int64(pr.off)
+		}
+		if want == pr.pos[i] {
+			continue
+		}
+		sk, ok := pin.DataReader.(io.Seeker)
+		if !ok {
+			return 0, fmt.Errorf("pin %s data reader is not seekable", pin.Name)
+		}
+		_, err := sk.Seek(want-pr.pos[i], io.SeekCurrent)
+		if err != nil {
+			return 0, fmt.Errorf("could not seek pin %s data reader: %w", pin.Name, err)
+		}
+		pr.pos[i] = want
+	}
+	return offset, nil
+}
+
 // Pin contains a pin name, its integer value and an optional payload data.
 // A "pin" may refer to a physical pin on the device, such as an
 // analog (A) or digital (D) pin or a software-defined sensor (X for a
 // scalar, B for binary data, V for video, etc.)
+// Timestamp is the optional time the value was captured. If set, it is
+// sent as a <name>.ts param in Unix seconds, otherwise the service uses
+// the time the value was received.
+// If IsFloat is true, Float is sent in place of Value as a decimal
+// number, e.g., X10=7.25, rounded to the number of decimal places given
+// by the pin's fs config param, if any, else with full precision.
+// For backwards compatibility, a Value of -1 means that the pin has no
+// value and it is not sent, unless Valid is true, e.g., for a reading of
+// -1 dB. Pins with Omit set are never sent, whatever their value, so new
+// clients should set Omit, or use SetValue, rather than relying on -1.
+// If DataReader is set, payload data is read from it as the request is
+// sent, rather than from Data, so that large payloads, e.g., video, need
+// not be held in memory. Value must then be the length of the data. Since
+// the data is consumed when sent, such pins are not retried from the
+// offline queue, and signing or redirecting the request requires the
+// DataReader to implement io.Seeker.
 type Pin struct {
-	Name     string
-	Value    int
-	Data     []byte
-	MimeType string
+	Name       string
+	Value      int
+	Data       []byte
+	MimeType   string
+	Timestamp  time.Time
+	Float      float64
+	IsFloat    bool
+	Valid      bool
+	Omit       bool
+	DataReader io.Reader `json:"-"`
+}
+
+// SetFloat sets a pin's value to the float f.
+func (p *Pin) SetFloat(f float64) {
+	p.Float = f
+	p.IsFloat = true
+}
+
+// SetValue sets a pin's value to v, which is sent even if it is -1.
+func (p *Pin) SetValue(v int) {
+	p.Value = v
+	p.Valid = true
+	p.Omit = false
+}
+
+// floatDecimals returns the number of decimal places for the named pin
+// from the fs config param, or -1 if none is specified.
+func floatDecimals(fs, name string) int {
+	if fs == "" {
+		return -1
+	}
+	d, err := strconv.Atoi(filemap.Split(fs, ",", ":")[name])
+	if err != nil || d < 0 {
+		return -1
+	}
+	return d
 }
 
 // MakePins makes a Pin array from a CSV-separated string of pin names,
@@ -1176,16 +2932,39 @@ func MakePins(csv string, restrict string) []Pin {
 	return pins
 }
 
+// pinCache caches the pins made from a CSV-separated string of pin
+// names, so that the string is only parsed when it changes.
+type pinCache struct {
+	csv  string
+	pins []Pin
+	ok   bool
+}
+
+// get returns a copy of the pins made from csv, which the caller may
+// modify. NB: Callers must hold any lock protecting the cache.
+func (pc *pinCache) get(csv string) []Pin {
+	if !pc.ok || csv != pc.csv {
+		pc.csv, pc.pins, pc.ok = csv, MakePins(csv, ""), true
+	}
+	if pc.pins == nil {
+		return nil
+	}
+	pins := make([]Pin, len(pc.pins))
+	copy(pins, pc.pins)
+	return pins
+}
+
 // JSONDecoder implements a simple JSON decoder which caches unmarshalled data between calls.
 type JSONDecoder struct {
 	data map[string]interface{}
+	raw  []byte
 }
 
 // NewJSONDecoder returns a pointer to a newly initialized JSONDecoder.
 // An error is returned if the given string cannot be unmarshalled as JSON.
 func NewJSONDecoder(jsn string) (*JSONDecoder, error) {
-	var dec JSONDecoder
-	if err := json.Unmarshal([]byte(jsn), &dec.data); err != nil {
+	dec := JSONDecoder{raw: []byte(jsn)}
+	if err := json.Unmarshal(dec.raw, &dec.data); err != nil {
 		return nil, err
 	}
 	return &dec, nil
@@ -1215,3 +2994,107 @@ func (dec *JSONDecoder) String(key string) (string, error) {
 	}
 	return v, nil
 }
+
+// Float returns a float value for a given key, or an error if one is not found.
+func (dec *JSONDecoder) Float(key string) (float64, error) {
+	v := dec.data[key]
+	if v == nil {
+		return 0, errNoKey
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return 0, errors.New(key + " is not a number")
+	}
+	return f, nil
+}
+
+// Bool returns a boolean value for a given key, or an error if one is not found.
+func (dec *JSONDecoder) Bool(key string) (bool, error) {
+	v := dec.data[key]
+	if v == nil {
+		return false, errNoKey
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, errors.New(key + " is not a bool")
+	}
+	return b, nil
+}
+
+// Array returns an array value for a given key, or an error if one is
+// not found. Elements are as decoded by encoding/json into an interface{}.
+func (dec *JSONDecoder) Array(key string) ([]interface{}, error) {
+	v := dec.data[key]
+	if v == nil {
+		return nil, errNoKey
+	}
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New(key + " is not an array")
+	}
+	return a, nil
+}
+
+// Object returns a decoder for the object value of a given key, or an
+// error if one is not found.
+func (dec *JSONDecoder) Object(key string) (*JSONDecoder, error) {
+	v := dec.data[key]
+	if v == nil {
+		return nil, errNoKey
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New(key + " is not an object")
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONDecoder{data: m, raw: raw}, nil
+}
+
+// Lookup returns the value at a path of keys through nested objects, or
+// an error if there is none. Keys which are integers index arrays, e.g.,
+// Lookup("pins", "0", "name"). Values are as decoded by encoding/json
+// into an interface{}.
+func (dec *JSONDecoder) Lookup(path ...string) (interface{}, error) {
+	var v interface{} = dec.data
+	for i, key := range path {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			v = t[key]
+		case []interface{}:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(t) {
+				return nil, fmt.Errorf("%s: invalid index: %s", strings.Join(path[:i], "."), key)
+			}
+			v = t[n]
+		default:
+			return nil, fmt.Errorf("%s is not an object or array", strings.Join(path[:i], "."))
+		}
+		if v == nil {
+			return nil, errNoKey
+		}
+	}
+	return v, nil
+}
+
+// DecodeKey decodes the value of a given key into v using encoding/json,
+// or returns an error if one is not found.
+func (dec *JSONDecoder) DecodeKey(key string, v interface{}) error {
+	val := dec.data[key]
+	if val == nil {
+		return errNoKey
+	}
+	b, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// DecodeInto decodes the whole JSON object into v using encoding/json,
+// e.g., into a struct with json field tags.
+func (dec *JSONDecoder) DecodeInto(v interface{}) error {
+	return json.Unmarshal(dec.raw, v)
+}
@@ -28,14 +28,47 @@ LICENSE
 */
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"math"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/iotest"
 	"time"
+
+	"github.com/ausocean/utils/filemap"
 )
 
 var makePinsTests = []struct {
@@ -191,6 +224,105 @@ func TestPayloadReaderCopy(t *testing.T) {
 	}
 }
 
+// TestPayloadReaderWriteTo tests that the payload is written without
+// buffering, from the current position.
+func TestPayloadReaderWriteTo(t *testing.T) {
+	for _, test := range payloadReaderTests {
+		pr := NewPayloadReader(test.pins)
+		b := make([]byte, 3)
+		io.ReadFull(pr, b)
+		var buf strings.Builder
+		n, err := pr.WriteTo(&buf)
+		if err != nil || n != int64(len(test.want)-3) || string(b)+buf.String() != test.want {
+			t.Errorf("unexpected result for %s: %q, %d, %v", test.name, string(b)+buf.String(), n, err)
+		}
+		if n, err := pr.WriteTo(&buf); n != 0 || err != nil {
+			t.Errorf("unexpected result for drained %s: %d, %v", test.name, n, err)
+		}
+	}
+}
+
+// TestPayloadReaderDataReader tests that payload data is read from pin
+// data readers, which are seeked relative to their starting position.
+func TestPayloadReaderDataReader(t *testing.T) {
+	src := strings.NewReader("xxWorld")
+	src.Seek(2, io.SeekStart)
+	pins := []Pin{{Data: []byte("Hello, ")}, {DataReader: src, Value: 5}, {Data: []byte("!")}}
+	for _, limit := range readerLimits {
+		pr := NewPayloadReader(pins)
+		got, err := io.ReadAll(limit.reader(pr))
+		if err != nil || string(got) != "Hello, World!" {
+			t.Errorf("unexpected read for %s: %q, %v", limit.name, got, err)
+		}
+		_, err = pr.Seek(0, io.SeekStart)
+		if err != nil {
+			t.Fatalf("unexpected error seeking: %v", err)
+		}
+	}
+
+	pr := NewPayloadReader(pins)
+	_, err := pr.Seek(9, io.SeekStart)
+	if err != nil {
+		t.Fatalf("unexpected error seeking: %v", err)
+	}
+	var buf strings.Builder
+	_, err = pr.WriteTo(&buf)
+	if err != nil || buf.String() != "rld!" {
+		t.Errorf("unexpected write after seek: %q, %v", buf.String(), err)
+	}
+
+	// A short reader is an error, as is seeking an unseekable reader.
+	pr = NewPayloadReader([]Pin{{DataReader: iotest.OneByteReader(strings.NewReader("abc")), Value: 5}})
+	_, err = io.ReadAll(pr)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected unexpected EOF for short reader, got %v", err)
+	}
+	if _, err = pr.Seek(0, io.SeekStart); err == nil {
+		t.Errorf("expected error seeking unseekable reader")
+	}
+}
+
+// TestPayloadReaderSeek tests that the payload can be re-read from any
+// position.
+func TestPayloadReaderSeek(t *testing.T) {
+	for _, test := range payloadReaderTests {
+		pr := NewPayloadReader(test.pins)
+		if pr.Size() != int64(len(test.want)) {
+			t.Errorf("unexpected size for %s: %d", test.name, pr.Size())
+		}
+		for _, s := range []struct {
+			offset int64
+			whence int
+			want   int64
+		}{
+			{7, io.SeekStart, 7},
+			{-2, io.SeekCurrent, 5},
+			{-1, io.SeekEnd, int64(len(test.want) - 1)},
+			{0, io.SeekStart, 0},
+			{100, io.SeekStart, 100},
+		} {
+			pos, err := pr.Seek(s.offset, s.whence)
+			if err != nil || pos != s.want {
+				t.Errorf("unexpected position for %s: %d, %v", test.name, pos, err)
+				continue
+			}
+			got, err := io.ReadAll(pr)
+			want := ""
+			if pos < int64(len(test.want)) {
+				want = test.want[pos:]
+			}
+			if err != nil || string(got) != want {
+				t.Errorf("unexpected read for %s at %d: %q, %v", test.name, pos, got, err)
+			}
+			// Restore the position for relative seeks.
+			pr.Seek(pos, io.SeekStart)
+		}
+		if _, err := pr.Seek(-1, io.SeekStart); err == nil {
+			t.Errorf("expected error for negative position")
+		}
+	}
+}
+
 var jsonStringTests = []struct {
 	jsn  string
 	key  string
@@ -214,6 +346,42 @@ var jsonStringTests = []struct {
 	},
 }
 
+// TestServerErrorCodes tests that known service error codes can be
+// tested for with errors.Is.
+func TestServerErrorCodes(t *testing.T) {
+	var er string
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"er":"`+er+`"}`)
+	})
+	for _, test := range []struct {
+		er   string
+		want error
+	}{
+		{"InvalidDeviceKey", ErrInvalidDeviceKey},
+		{"InvalidValue", ErrInvalidValue},
+		{"PinNotFound", ErrPinNotFound},
+		{"InvalidPayloadSize", ErrInvalidPayloadSize},
+		{"ReadError", ErrReadError},
+	} {
+		er = test.er
+		_, _, err := ns.Send(RequestPoll, nil)
+		if !errors.Is(err, test.want) {
+			t.Errorf("expected %s poll error, got %v", test.er, err)
+		}
+		if errors.Is(err, ErrMarshalingError) {
+			t.Errorf("unexpected match of %s poll error", test.er)
+		}
+		_, err = ns.Vars()
+		if !errors.Is(err, test.want) {
+			t.Errorf("expected %s vars error, got %v", test.er, err)
+		}
+		var se *ServerError
+		if !errors.As(err, &se) || se.Code() != test.er {
+			t.Errorf("unexpected code for %s: %v", test.er, err)
+		}
+	}
+}
+
 var jsonIntTests = []struct {
 	jsn  string
 	key  string
@@ -262,24 +430,80 @@ func TestJSONDecoder(t *testing.T) {
 	}
 }
 
+// TestJSONDecoderNested tests decoding of floats, bools, arrays and
+// nested objects.
+func TestJSONDecoderNested(t *testing.T) {
+	dec, err := NewJSONDecoder(`{"rc":0,"f":0.5,"b":true,"a":[1,"x"],"o":{"n":2,"pins":[{"name":"A0"}]}}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f, err := dec.Float("f"); err != nil || f != 0.5 {
+		t.Errorf("unexpected float: %v, %v", f, err)
+	}
+	if _, err := dec.Float("b"); err == nil {
+		t.Errorf("expected error for bool as float")
+	}
+	if b, err := dec.Bool("b"); err != nil || !b {
+		t.Errorf("unexpected bool: %v, %v", b, err)
+	}
+	if _, err := dec.Bool("missing"); !errors.Is(err, errNoKey) {
+		t.Errorf("expected missing key error, got %v", err)
+	}
+	if a, err := dec.Array("a"); err != nil || !reflect.DeepEqual(a, []interface{}{1.0, "x"}) {
+		t.Errorf("unexpected array: %v, %v", a, err)
+	}
+	o, err := dec.Object("o")
+	if err != nil {
+		t.Fatalf("unexpected error getting object: %v", err)
+	}
+	if n, err := o.Int("n"); err != nil || n != 2 {
+		t.Errorf("unexpected nested int: %v, %v", n, err)
+	}
+	if _, err := dec.Object("f"); err == nil {
+		t.Errorf("expected error for number as object")
+	}
+
+	for _, test := range []struct {
+		path []string
+		want interface{}
+		fail bool
+	}{
+		{path: []string{"o", "n"}, want: 2.0},
+		{path: []string{"o", "pins", "0", "name"}, want: "A0"},
+		{path: []string{"o", "pins", "1", "name"}, fail: true},
+		{path: []string{"o", "missing"}, fail: true},
+		{path: []string{"f", "x"}, fail: true},
+	} {
+		got, err := dec.Lookup(test.path...)
+		if (err != nil) != test.fail || !test.fail && got != test.want {
+			t.Errorf("unexpected result for path %v: %v, %v", test.path, got, err)
+		}
+	}
+
+	var pins []struct {
+		Name string `json:"name"`
+	}
+	err = o.DecodeKey("pins", &pins)
+	if err != nil || len(pins) != 1 || pins[0].Name != "A0" {
+		t.Errorf("unexpected decoded pins: %v, %v", pins, err)
+	}
+	var reply struct {
+		RC int     `json:"rc"`
+		F  float64 `json:"f"`
+	}
+	err = dec.DecodeInto(&reply)
+	if err != nil || reply.F != 0.5 {
+		t.Errorf("unexpected decoded reply: %+v, %v", reply, err)
+	}
+}
+
 const (
 	testConfig = "ma 00:00:00:00:00:01\ndk 10000001\nsh data.cloudblue.org\n" // contents of the netsender.conf used for testing.
 )
 
 // TestSync tests synchronization of client mode and error values with NetReceiver.
 func TestSync(t *testing.T) {
-	file, err := createNetsenderConfig()
-	if err != nil {
-		t.Errorf("createNetsenderConfig failed with error %v", err)
-	}
-	defer os.Remove(file)
-
-	// Create a NetSender client.
-	var logger testLogger
-	ns, err := New(&logger, nil, nil, nil, WithConfigFile(file))
-	if err != nil {
-		t.Errorf("netsender.New failed with error %v", err)
-	}
+	ns := newTestSender(t, fakeConfig(), newFakeService().ServeHTTP)
 
 	// Reset mode and error.
 	ns.setModeAndError(t, "Normal", "")
@@ -293,27 +517,22 @@ func TestSync(t *testing.T) {
 
 // TestTimeout tests timeout.
 func TestTimeout(t *testing.T) {
-	file, err := createNetsenderConfig()
-	if err != nil {
-		t.Errorf("createNetsenderConfig failed with error %v", err)
-	}
-	defer os.Remove(file)
-
-	// Create a NetSender client.
-	var logger testLogger
-	ns, err := New(&logger, nil, nil, nil, WithConfigFile(file))
-	if err != nil {
-		t.Errorf("netsender.New failed with error %v", err)
-	}
+	fs := newFakeService()
+	ns := newTestSender(t, fakeConfig(), fs.ServeHTTP)
 
 	// First call Vars with the default timeout.
-	_, err = ns.Vars()
+	_, err := ns.Vars()
 	if err != nil {
 		t.Errorf("ns.Vars failed failed with error %v", err)
 	}
 
-	// Now call Vars with an insanely small timeout.
+	// Now call Vars with an insanely small timeout, which the service's
+	// delay exceeds.
+	defer func(d time.Duration) { Timeout = d }(Timeout)
 	Timeout = 1 * time.Millisecond
+	fs.mu.Lock()
+	fs.delay = 100 * time.Millisecond
+	fs.mu.Unlock()
 	_, err = ns.Vars()
 	if err == nil {
 		t.Errorf("ns.Vars failed to time out")
@@ -382,14 +601,8 @@ func (tl *testLogger) Log(level int8, msg string, params ...interface{}) {
 
 // TestNetSpeedTests tests the TestDownload and TestUpload methods.
 func TestNetSpeedTests(t *testing.T) {
-	ns := &Sender{
-		download: -1,
-		upload:   -1,
-		services: map[string]string{
-			"default": "data.cloudblue.org",
-		},
-		logger: &testLogger{},
-	}
+	fs := newFakeService()
+	ns := newTestSender(t, nil, fs.ServeHTTP)
 
 	// Test download.
 	err := ns.TestDownload()
@@ -404,4 +617,4264 @@ func TestNetSpeedTests(t *testing.T) {
 		t.Errorf("unexpected error from TestUpload(): %v", err)
 	}
 	t.Logf("upload: %d bps", ns.upload)
+
+	if ns.DownloadSpeed() <= 0 || ns.UploadSpeed() <= 0 {
+		t.Errorf("unexpected speeds: download %d bps, upload %d bps", ns.DownloadSpeed(), ns.UploadSpeed())
+	}
+	if fs.uploaded != uploadTestSize {
+		t.Errorf("unexpected upload size: got %d, want %d", fs.uploaded, uploadTestSize)
+	}
+}
+
+// TestFakeService tests the Config, Run, Vars and Send paths against the
+// offline fake service.
+func TestFakeService(t *testing.T) {
+	fs := newFakeService()
+	fs.config = map[string]string{"ip": "X10,X11", "mp": "5"}
+	ns := newTestSender(t, fakeConfig(), fs.ServeHTTP)
+	ns.read = func(pin *Pin) error {
+		pin.Value = 42
+		return nil
+	}
+
+	rc, err := ns.Config()
+	if err != nil {
+		t.Fatalf("unexpected error from Config: %v", err)
+	}
+	if rc != ResponseOK || ns.Param("ip") != "X10,X11" || ns.Param("mp") != "5" {
+		t.Errorf("unexpected config: rc %d, ip %q, mp %q", rc, ns.Param("ip"), ns.Param("mp"))
+	}
+
+	err = ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	want := map[string]string{"X10": "42", "X11": "42"}
+	if got := fs.lastPins(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected pins polled: got %v, want %v", got, want)
+	}
+
+	// A change to the vars is detected by Run via the var sum.
+	fs.setVars(map[string]string{"Light": "On"})
+	err = ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if ns.VarSum() != 1 {
+		t.Errorf("unexpected var sum: got %d, want 1", ns.VarSum())
+	}
+	vars, err := ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	if vars["Light"] != "On" || vars["mode"] != "Normal" {
+		t.Errorf("unexpected vars: %v", vars)
+	}
+
+	fs.mu.Lock()
+	fs.rc = ResponseUpdate
+	fs.mu.Unlock()
+	_, rc, err = ns.Send(RequestPoll, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if rc != ResponseUpdate {
+		t.Errorf("unexpected response code: got %d, want %d", rc, ResponseUpdate)
+	}
+}
+
+// recordLogger implements a netsender.Logger that records logged messages.
+type recordLogger struct {
+	msgs []string
+}
+
+func (rl *recordLogger) SetLevel(level int8) {}
+
+func (rl *recordLogger) Log(level int8, msg string, params ...interface{}) {
+	rl.msgs = append(rl.msgs, msg)
+}
+
+// TestAuditLogger tests that security-relevant events are written to the audit logger.
+func TestAuditLogger(t *testing.T) {
+	var audit recordLogger
+	ns := &Sender{logger: &testLogger{}}
+	err := WithAuditLogger(&audit)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+
+	ns.SetMode("Paused")
+	ns.SetMode("Paused") // No change, so not audited.
+	ns.SetError("TestError")
+	want := []string{infoModeChange}
+	if !reflect.DeepEqual(audit.msgs, want) {
+		t.Errorf("unexpected audit messages: got %v, want %v", audit.msgs, want)
+	}
+}
+
+// TestAuditVarsMode tests that mode changes received in vars are audited,
+// but not the initial mode, nor a mode defaulted because it was not sent.
+func TestAuditVarsMode(t *testing.T) {
+	reply := `{"id":"00:00:00:00:00:01","vs":"1","mode":"Normal"}`
+	ns := newTestSender(t, map[string]string{"ma": "00:00:00:00:00:01"}, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, reply)
+	})
+	var audit recordLogger
+	err := WithAuditLogger(&audit)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+
+	for _, test := range []struct {
+		reply string
+		want  int
+	}{
+		{reply: `{"id":"00:00:00:00:00:01","vs":"1","mode":"Normal"}`, want: 0},
+		{reply: `{"id":"00:00:00:00:00:01","vs":"1","mode":"Paused"}`, want: 1},
+		{reply: `{"id":"00:00:00:00:00:01","vs":"1"}`, want: 1},
+		{reply: `{"id":"00:00:00:00:00:01","vs":"1","mode":"Paused"}`, want: 2},
+	} {
+		reply = test.reply
+		_, err := ns.Vars()
+		if err != nil {
+			t.Fatalf("unexpected error from Vars: %v", err)
+		}
+		if len(audit.msgs) != test.want {
+			t.Errorf("unexpected audit messages after %s: got %v, want %d", test.reply, audit.msgs, test.want)
+		}
+	}
+}
+
+// newTestSender returns a Sender with the given config whose default
+// service is a test server using the given handler.
+func newTestSender(t *testing.T, config map[string]string, h http.HandlerFunc) *Sender {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	if config == nil {
+		config = map[string]string{}
+	}
+	return &Sender{
+		logger:   &testLogger{},
+		config:   config,
+		services: map[string]string{"default": strings.TrimPrefix(srv.URL, "http://")},
+		download: -1,
+		upload:   -1,
+	}
+}
+
+// TestBuildVersion tests that the build version is reported on the build version pin.
+func TestBuildVersion(t *testing.T) {
+	var got string
+	ns := newTestSender(t, map[string]string{"ip": "T5"}, func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query().Get(buildVersionPin)
+		io.WriteString(w, `{"rc":0}`)
+	})
+	ns.read = func(pin *Pin) error { return nil }
+	for _, want := range []string{"v1.2.3", "v1.2.3+dirty&x=1 #2"} {
+		err := WithBuildVersion(want)(ns)
+		if err != nil {
+			t.Fatalf("unexpected error applying option: %v", err)
+		}
+		err = ns.Run()
+		if err != nil {
+			t.Fatalf("unexpected error from Run: %v", err)
+		}
+		if got != want {
+			t.Errorf("unexpected build version: got %q, want %q", got, want)
+		}
+	}
+}
+
+// TestNeverConfigured tests that Run reports a client that has never been configured.
+func TestNeverConfigured(t *testing.T) {
+	fail := true
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"rc":0}`)
+	})
+
+	err := ns.Run()
+	if !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("unexpected error from Run: got %v, want %v", err, ErrNotConfigured)
+	}
+	if ns.IsConfigured() || ns.EverConfigured() {
+		t.Errorf("unexpectedly configured")
+	}
+
+	fail = false
+	err = ns.Run()
+	if err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+	if !ns.IsConfigured() || !ns.EverConfigured() {
+		t.Errorf("unexpectedly not configured")
+	}
+
+	// Subsequent failures are not reported as never configured.
+	fail = true
+	err = ns.Run()
+	if err == nil || errors.Is(err, ErrNotConfigured) {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+	if !ns.EverConfigured() {
+		t.Errorf("unexpectedly never configured")
+	}
+}
+
+// TestWriteConfigUnchanged tests that the config file is not rewritten when its content is unchanged.
+func TestWriteConfigUnchanged(t *testing.T) {
+	file, err := createNetsenderConfig()
+	if err != nil {
+		t.Fatalf("createNetsenderConfig failed with error %v", err)
+	}
+	defer os.Remove(file)
+
+	ns := &Sender{logger: &testLogger{}, configFile: file}
+	config, err := ns.readConfig()
+	if err != nil {
+		t.Fatalf("readConfig failed with error %v", err)
+	}
+	err = ns.writeConfig(config)
+	if err != nil {
+		t.Fatalf("writeConfig failed with error %v", err)
+	}
+
+	// Backdate the file, then write the same config again.
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err = os.Chtimes(file, past, past)
+	if err != nil {
+		t.Fatalf("could not set file times: %v", err)
+	}
+	err = ns.writeConfig(config)
+	if err != nil {
+		t.Fatalf("writeConfig failed with error %v", err)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("could not stat config file: %v", err)
+	}
+	if !fi.ModTime().Equal(past) {
+		t.Errorf("config file unexpectedly rewritten")
+	}
+
+	// A material change is written.
+	config["mp"] = "120"
+	err = ns.writeConfig(config)
+	if err != nil {
+		t.Fatalf("writeConfig failed with error %v", err)
+	}
+	got, err := ns.readConfig()
+	if err != nil {
+		t.Fatalf("readConfig failed with error %v", err)
+	}
+	if got["mp"] != "120" {
+		t.Errorf("unexpected mp after write: got %q, want %q", got["mp"], "120")
+	}
+}
+
+// TestPing tests that Ping measures latency without side effects.
+func TestPing(t *testing.T) {
+	const delay = 10 * time.Millisecond
+	var path string
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		time.Sleep(delay)
+		io.WriteString(w, `{"rc":0,"vs":1234}`)
+	})
+
+	latency, err := ns.Ping(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from Ping: %v", err)
+	}
+	if path != pingPath {
+		t.Errorf("unexpected ping path: got %q, want %q", path, pingPath)
+	}
+	if latency < delay {
+		t.Errorf("unexpected latency: got %v, want at least %v", latency, delay)
+	}
+	if ns.VarSum() != 0 {
+		t.Errorf("unexpected var sum change: got %d", ns.VarSum())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ns.Ping(ctx)
+	if err == nil {
+		t.Errorf("expected error from Ping with cancelled context")
+	}
+}
+
+var clampPeriodTests = []struct {
+	name string
+	val  string
+	max  int
+	want string
+}{
+	{name: "mp", val: "60", want: "60"},
+	{name: "mp", val: "0", want: "1"},
+	{name: "mp", val: "-10", want: "1"},
+	{name: "mp", val: "1000000", want: "86400"},
+	{name: "mp", val: "600", max: 300, want: "300"},
+	{name: "ap", val: "0", want: "0"},
+	{name: "ap", val: "-1", want: "0"},
+	{name: "ap", val: "5", want: "5"},
+}
+
+func TestClampPeriod(t *testing.T) {
+	for i, test := range clampPeriodTests {
+		ns := &Sender{logger: &testLogger{}, maxPeriod: test.max}
+		got := ns.clampPeriod(test.name, test.val)
+		if got != test.want {
+			t.Errorf("unexpected result for test %d %s=%s: got %s, want %s", i, test.name, test.val, got, test.want)
+		}
+	}
+}
+
+// TestConfigPeriods tests that out of range periods are clamped on load and on config.
+func TestConfigPeriods(t *testing.T) {
+	f, err := ioutil.TempFile("", "netsender.conf")
+	if err != nil {
+		t.Fatalf("could not create config file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("ma 00:00:00:00:00:01\ndk 10000001\nmp -5\nap -1\n")
+	f.Close()
+	if err != nil {
+		t.Fatalf("could not write config file: %v", err)
+	}
+
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"rc":0,"mp":0,"ap":10}`)
+	})
+	ns.configFile = f.Name()
+	ns.config, err = ns.readConfig()
+	if err != nil {
+		t.Fatalf("readConfig failed with error %v", err)
+	}
+	if ns.Param("mp") != "1" || ns.Param("ap") != "0" {
+		t.Errorf("unexpected periods after load: mp=%s, ap=%s", ns.Param("mp"), ns.Param("ap"))
+	}
+
+	_, err = ns.Config()
+	if err != nil {
+		t.Fatalf("Config failed with error %v", err)
+	}
+	if ns.Param("mp") != "1" || ns.Param("ap") != "10" {
+		t.Errorf("unexpected periods after config: mp=%s, ap=%s", ns.Param("mp"), ns.Param("ap"))
+	}
+}
+
+// TestPinTimestamp tests that pin capture timestamps are sent only when set.
+func TestPinTimestamp(t *testing.T) {
+	var query map[string][]string
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		io.WriteString(w, `{"rc":0}`)
+	})
+
+	ts := time.Unix(1700000000, 0)
+	pins := []Pin{{Name: "X0", Value: 1, Timestamp: ts}, {Name: "X1", Value: 2}}
+	_, _, err := ns.Send(RequestPoll, pins)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if got := query["X0.ts"]; len(got) != 1 || got[0] != "1700000000" {
+		t.Errorf("unexpected X0 timestamp: got %v", got)
+	}
+	if got, ok := query["X1.ts"]; ok {
+		t.Errorf("unexpected X1 timestamp: got %v", got)
+	}
+}
+
+// TestSetReadFunc tests that the read function can be swapped safely while running.
+func TestSetReadFunc(t *testing.T) {
+	var got string
+	ns := newTestSender(t, map[string]string{"ip": "X0"}, func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query().Get("X0")
+		io.WriteString(w, `{"rc":0}`)
+	})
+	readValue := func(v int) PinReadWrite {
+		return func(pin *Pin) error { pin.Value = v; return nil }
+	}
+
+	ns.SetReadFunc(readValue(1))
+	done := make(chan struct{})
+	go func() {
+		ns.SetReadFunc(readValue(2))
+		close(done)
+	}()
+	err := ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	<-done
+	if got != "1" && got != "2" {
+		t.Errorf("unexpected X0 value: got %q", got)
+	}
+
+	err = ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if got != "2" {
+		t.Errorf("unexpected X0 value after swap: got %q, want %q", got, "2")
+	}
+}
+
+// TestEffectiveConfig tests that the effective config includes defaults and is a copy.
+func TestEffectiveConfig(t *testing.T) {
+	file, err := createNetsenderConfig()
+	if err != nil {
+		t.Fatalf("createNetsenderConfig failed with error %v", err)
+	}
+	defer os.Remove(file)
+
+	ns, err := New(&testLogger{}, nil, nil, nil, WithConfigFile(file))
+	if err != nil {
+		t.Fatalf("netsender.New failed with error %v", err)
+	}
+	config := ns.EffectiveConfig()
+	if config["ma"] != "00:00:00:00:00:01" || config["mp"] != "60" {
+		t.Errorf("unexpected effective config: %v", config)
+	}
+	config["mp"] = "1"
+	if ns.Param("mp") != "60" {
+		t.Errorf("effective config is not a copy")
+	}
+}
+
+// TestRedirect tests that redirects are followed only when they preserve the request method.
+func TestRedirect(t *testing.T) {
+	var body string
+	var code int
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/poll" {
+			http.Redirect(w, r, "/moved"+"?"+r.URL.RawQuery, code)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		io.WriteString(w, `{"rc":0}`)
+	})
+	pins := []Pin{{Name: "T0", Value: 5, Data: []byte("hello"), MimeType: "text/plain"}}
+
+	for _, code = range []int{http.StatusTemporaryRedirect, http.StatusPermanentRedirect} {
+		body = ""
+		_, _, err := ns.Send(RequestPoll, pins)
+		if err != nil {
+			t.Errorf("unexpected error from Send for %d redirect: %v", code, err)
+		}
+		if body != "hello" {
+			t.Errorf("unexpected body for %d redirect: got %q, want %q", code, body, "hello")
+		}
+	}
+
+	// A 302 redirect of a POST would become a GET without a body.
+	code = http.StatusFound
+	_, _, err := ns.Send(RequestPoll, pins)
+	if !errors.Is(err, ErrRedirect) {
+		t.Errorf("unexpected error from Send for %d redirect: got %v, want %v", code, err, ErrRedirect)
+	}
+
+	// A 302 redirect of a GET is fine.
+	_, _, err = ns.Send(RequestPoll, []Pin{{Name: "X0", Value: 1}})
+	if err != nil {
+		t.Errorf("unexpected error from Send for %d redirect of GET: %v", code, err)
+	}
+}
+
+var validateMACTests = []struct {
+	ma   string
+	fail bool
+}{
+	{ma: "00:00:00:00:00:01"},
+	{ma: "A0:b1:C2:d3:E4:f5"},
+	{ma: "", fail: true},
+	{ma: "00:00:00:00:00", fail: true},
+	{ma: "00-00-00-00-00-01", fail: true},
+	{ma: "0000.0000.0001", fail: true},
+	{ma: "00:00:00:00:00:0g", fail: true},
+	{ma: "00:00:00:00:00:01 ", fail: true},
+	{ma: "00:00:00:00:00:00:00:01", fail: true},
+}
+
+func TestValidateMAC(t *testing.T) {
+	for i, test := range validateMACTests {
+		err := validateMAC(test.ma, false)
+		if (err != nil) != test.fail {
+			t.Errorf("unexpected result for test %d %q: got error %v, want failure %t", i, test.ma, err, test.fail)
+		}
+	}
+}
+
+// TestVarChanges tests that var changes are sent on the var change channel.
+func TestVarChanges(t *testing.T) {
+	vs := 1
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/vars" {
+			fmt.Fprintf(w, `{"id":"dev","mode":"Normal","dev.x":"%d","vs":"%d"}`, vs, vs)
+			return
+		}
+		fmt.Fprintf(w, `{"rc":0,"vs":%d}`, vs)
+	})
+	ch := ns.VarChanges()
+
+	_, err := ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	select {
+	case vars := <-ch:
+		if vars["x"] != "1" {
+			t.Errorf("unexpected vars: %v", vars)
+		}
+	default:
+		t.Fatalf("expected vars notification")
+	}
+
+	// Unchanged vars are not sent again.
+	_, err = ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	_, _, err = ns.Send(RequestPoll, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	select {
+	case vars := <-ch:
+		t.Fatalf("unexpected vars notification: %v", vars)
+	default:
+	}
+
+	// A var sum change detected by a poll is sent.
+	vs = 2
+	_, _, err = ns.Send(RequestPoll, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	select {
+	case vars := <-ch:
+		if vars["x"] != "2" {
+			t.Errorf("unexpected vars: %v", vars)
+		}
+	default:
+		t.Fatalf("expected vars notification")
+	}
+}
+
+// TestNilLogger tests that a Sender works without a logger.
+func TestNilLogger(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"rc":0}`)
+	}))
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "netsender.conf")
+	if err != nil {
+		t.Fatalf("could not create config file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("ma 00:00:00:00:00:01\ndk 10000001\nsh " + strings.TrimPrefix(srv.URL, "http://") + "\n")
+	f.Close()
+	if err != nil {
+		t.Fatalf("could not write config file: %v", err)
+	}
+
+	ns, err := New(nil, nil, nil, nil, WithConfigFile(f.Name()))
+	if err != nil {
+		t.Fatalf("netsender.New failed with error %v", err)
+	}
+	err = ns.Run()
+	if err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+}
+
+// TestConcurrentSend tests that concurrent sends with options are free of data races.
+// Run with -race.
+func TestConcurrentSend(t *testing.T) {
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"rc":0}`)
+	})
+	host := ns.serviceHost("default")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, _, err := ns.Send(RequestMts, nil, WithMtsAddress(host))
+			if err != nil {
+				t.Errorf("unexpected error from mts Send: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			_, _, err := ns.Send(RequestPoll, nil)
+			if err != nil {
+				t.Errorf("unexpected error from poll Send: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestSpeedTestRace tests that speed tests may run concurrently with Run.
+// Run with -race.
+func TestSpeedTestRace(t *testing.T) {
+	ns := newTestSender(t, map[string]string{"ip": downloadTestPin + "," + uploadTestPin}, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, downloadTestPath):
+			w.Write(make([]byte, downloadTestSize))
+		case strings.HasPrefix(r.URL.Path, uploadTestPath):
+			io.Copy(io.Discard, r.Body)
+		default:
+			io.WriteString(w, `{"rc":0}`)
+		}
+	})
+	ns.read = func(pin *Pin) error { return nil }
+
+	done := make(chan error)
+	go func() {
+		err := ns.TestDownload()
+		if err == nil {
+			err = ns.TestUpload()
+		}
+		done <- err
+	}()
+	err := ns.Run()
+	if err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatalf("unexpected error from speed test: %v", err)
+	}
+	if ns.DownloadSpeed() <= 0 || ns.UploadSpeed() <= 0 {
+		t.Errorf("unexpected speeds: download %d, upload %d", ns.DownloadSpeed(), ns.UploadSpeed())
+	}
+}
+
+// TestConfigOrder tests that config files are rewritten in canonical order.
+func TestConfigOrder(t *testing.T) {
+	tests := []struct {
+		order []string
+		want  string
+	}{
+		{
+			want: "ma 00:00:00:00:00:01\ndk 10000001\nwi \nip X0\nop \nmp 60\nap 0\nct \ncv \nhw \nsh data.cloudblue.org\nfs \nrs \ncc \nck \npk \naa 1\nzz 2\n",
+		},
+		{
+			order: []string{"dk", "ma"},
+			want:  "dk 10000001\nma 00:00:00:00:00:01\naa 1\nap 0\ncc \nck \nct \ncv \nfs \nhw \nip X0\nmp 60\nop \npk \nrs \nsh data.cloudblue.org\nwi \nzz 2\n",
+		},
+	}
+	for i, test := range tests {
+		f, err := ioutil.TempFile("", "netsender.conf")
+		if err != nil {
+			t.Fatalf("could not create config file: %v", err)
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString("zz 2\nsh data.cloudblue.org\nip X0\ndk 10000001\naa 1\nma 00:00:00:00:00:01\n")
+		f.Close()
+		if err != nil {
+			t.Fatalf("could not write config file: %v", err)
+		}
+
+		ns := &Sender{logger: &testLogger{}, configFile: f.Name(), order: test.order}
+		config, err := ns.readConfig()
+		if err != nil {
+			t.Fatalf("readConfig failed with error %v", err)
+		}
+		err = ns.writeConfig(config)
+		if err != nil {
+			t.Fatalf("writeConfig failed with error %v", err)
+		}
+		got, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatalf("could not read config file: %v", err)
+		}
+		if string(got) != test.want {
+			t.Errorf("unexpected config for test %d:\ngot :%q\nwant:%q", i, got, test.want)
+		}
+	}
+}
+
+// TestReadTimeout tests that a hung pin read times out and the pin is not sent.
+func TestReadTimeout(t *testing.T) {
+	var query map[string][]string
+	ns := newTestSender(t, map[string]string{"ip": "X0,X1"}, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		io.WriteString(w, `{"rc":0}`)
+	})
+	hung := make(chan struct{})
+	defer close(hung)
+	ns.read = func(pin *Pin) error {
+		if pin.Name == "X0" {
+			<-hung
+		}
+		pin.Value = 1
+		return nil
+	}
+	err := WithReadTimeout(10 * time.Millisecond)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+
+	err = ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if _, ok := query["X0"]; ok {
+		t.Errorf("unexpected X0 value for hung read: %v", query["X0"])
+	}
+	if got := query["X1"]; len(got) != 1 || got[0] != "1" {
+		t.Errorf("unexpected X1 value: got %v, want %q", got, "1")
+	}
+}
+
+// TestConcurrentReads tests that input pins are read concurrently when
+// requested, and that per-pin read timeouts override the default.
+func TestConcurrentReads(t *testing.T) {
+	var query map[string][]string
+	ns := newTestSender(t, map[string]string{"ip": "X0,X1,X2"}, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		io.WriteString(w, `{"rc":0}`)
+	})
+	// X0 and X1 each wait for the other to start, so both are only read
+	// if the reads are concurrent.
+	started := map[string]chan struct{}{"X0": make(chan struct{}), "X1": make(chan struct{})}
+	other := map[string]string{"X0": "X1", "X1": "X0"}
+	hung := make(chan struct{})
+	defer close(hung)
+	ns.read = func(pin *Pin) error {
+		if pin.Name == "X2" {
+			<-hung
+			return nil
+		}
+		close(started[pin.Name])
+		<-started[other[pin.Name]]
+		pin.Value = 1
+		return nil
+	}
+	for _, o := range []Option{
+		WithReadTimeout(time.Minute),
+		WithPinReadTimeouts(map[string]time.Duration{"X2": 10 * time.Millisecond}),
+		WithConcurrentReads(),
+	} {
+		err := o(ns)
+		if err != nil {
+			t.Fatalf("unexpected error applying option: %v", err)
+		}
+	}
+
+	err := ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	for _, name := range []string{"X0", "X1"} {
+		if got := query[name]; len(got) != 1 || got[0] != "1" {
+			t.Errorf("unexpected %s value: got %v, want %q", name, got, "1")
+		}
+	}
+	if _, ok := query["X2"]; ok {
+		t.Errorf("unexpected X2 value for hung read: %v", query["X2"])
+	}
+
+	err = WithPinReadTimeouts(map[string]time.Duration{"X0": -1})(ns)
+	if err == nil {
+		t.Errorf("expected error for negative pin read timeout")
+	}
+}
+
+// TestClearError tests that a cleared error is synced with the service.
+func TestClearError(t *testing.T) {
+	var er string
+	var sent []bool
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		_, ok := q["er"]
+		sent = append(sent, ok)
+		if ok {
+			er = q.Get("er")
+		}
+		fmt.Fprintf(w, `{"id":"dev","mode":"Normal","error":"%s","vs":"1"}`, er)
+	})
+	ns.mode = "Normal"
+
+	ns.SetError("TestError")
+	_, err := ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	if er != "TestError" || ns.Error() != "TestError" {
+		t.Errorf("unexpected error after set: service %q, client %q", er, ns.Error())
+	}
+
+	ns.ClearError()
+	if ns.VarSum() != -1 {
+		t.Errorf("expected var sum reset after clear, got %d", ns.VarSum())
+	}
+	_, err = ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	if er != "" || ns.Error() != "" {
+		t.Errorf("unexpected error after clear: service %q, client %q", er, ns.Error())
+	}
+
+	// Once in sync, clearing again does nothing.
+	ns.ClearError()
+	if ns.VarSum() != 1 {
+		t.Errorf("unexpected var sum reset, got %d", ns.VarSum())
+	}
+	_, err = ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	want := []bool{true, true, false}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("unexpected er params sent: got %v, want %v", sent, want)
+	}
+}
+
+// TestWithHost tests that WithHost overrides the host for a single request.
+func TestWithHost(t *testing.T) {
+	var hits [2]int
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		hits[0]++
+		io.WriteString(w, `{"rc":0}`)
+	})
+	alt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[1]++
+		io.WriteString(w, `{"rc":0}`)
+	}))
+	defer alt.Close()
+
+	_, _, err := ns.Send(RequestPoll, nil, WithHost(strings.TrimPrefix(alt.URL, "http://")))
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	_, _, err = ns.Send(RequestPoll, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if hits != [2]int{1, 1} {
+		t.Errorf("unexpected requests per host: got %v, want [1 1]", hits)
+	}
+
+	// SendOptions keep their original shape, so options defined by
+	// clients still work alongside per-call options.
+	var applied bool
+	custom := SendOption(func(ns *Sender) error { applied = true; return nil })
+	_, _, err = ns.Send(RequestPoll, nil, custom, WithHost(strings.TrimPrefix(alt.URL, "http://")))
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if !applied || hits != [2]int{1, 2} {
+		t.Errorf("unexpected result of custom option: applied %t, requests per host %v", applied, hits)
+	}
+	if WithHost("a.com")(ns) == nil {
+		t.Errorf("expected error applying WithHost outside Send")
+	}
+}
+
+// TestMtsSequence tests that MTS chunks are sequenced per stream.
+func TestMtsSequence(t *testing.T) {
+	var got []string
+	fail := false
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		got = append(got, r.URL.Query().Get("V0.sq"))
+		io.WriteString(w, `{"rc":0}`)
+	})
+	pins := []Pin{{Name: "V0", Value: 4, Data: []byte("mpts"), MimeType: "video/mp2t"}}
+
+	_, ok := ns.LastAckedSeq("V0")
+	if ok {
+		t.Errorf("unexpected acknowledged sequence before sending")
+	}
+	for _, fail = range []bool{false, true, false} {
+		_, _, err := ns.Send(RequestMts, pins)
+		if (err != nil) != fail {
+			t.Errorf("unexpected error from Send: %v", err)
+		}
+	}
+	want := []string{"0", "2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected sequence numbers: got %v, want %v", got, want)
+	}
+	n, ok := ns.LastAckedSeq("V0")
+	if !ok || n != 2 {
+		t.Errorf("unexpected last acknowledged sequence: got %d, want 2", n)
+	}
+}
+
+// TestStrictConfig tests that required params must be present in the config file.
+func TestStrictConfig(t *testing.T) {
+	file, err := createNetsenderConfig()
+	if err != nil {
+		t.Fatalf("createNetsenderConfig failed with error %v", err)
+	}
+	defer os.Remove(file)
+
+	_, err = New(&testLogger{}, nil, nil, nil, WithConfigFile(file), WithStrictConfig("sh"))
+	if err != nil {
+		t.Errorf("unexpected error for present param: %v", err)
+	}
+	_, err = New(&testLogger{}, nil, nil, nil, WithConfigFile(file), WithStrictConfig("sh", "ip"))
+	if err == nil {
+		t.Errorf("expected error for missing param")
+	}
+}
+
+// TestServices tests that Services returns a copy of the parsed services.
+func TestServices(t *testing.T) {
+	services, err := configServices("default=example.com,mts=mts.example.com")
+	if err != nil {
+		t.Fatalf("configServices failed with error %v", err)
+	}
+	ns := &Sender{logger: &testLogger{}, services: services}
+	got := ns.Services()
+	want := map[string]string{"default": "example.com", "mts": "mts.example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected services: got %v, want %v", got, want)
+	}
+	got["mts"] = "other.example.com"
+	if ns.serviceHost("mts") != "mts.example.com" {
+		t.Errorf("services is not a copy")
+	}
+}
+
+// TestMissingOutput tests that a missing output pin value is skipped unless strict.
+func TestMissingOutput(t *testing.T) {
+	ns := newTestSender(t, map[string]string{"op": "D1,D2,D3"}, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"rc":0,"D1":1,"D3":3}`)
+	})
+	written := map[string]int{}
+	ns.write = func(pin *Pin) error {
+		written[pin.Name] = pin.Value
+		return nil
+	}
+
+	err := ns.Run()
+	if err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+	want := map[string]int{"D1": 1, "D3": 3}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("unexpected pins written: got %v, want %v", written, want)
+	}
+
+	err = WithStrictOutputs()(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	err = ns.Run()
+	if err == nil {
+		t.Errorf("expected error from Run with strict outputs")
+	}
+}
+
+// TestUpgradeHandler tests that the upgrade handler is called when an upgrade finishes.
+func TestUpgradeHandler(t *testing.T) {
+	ns := newTestSender(t, map[string]string{"ct": "test"}, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"rc":0}`)
+	})
+	for _, test := range []struct {
+		upgrader string
+		success  bool
+	}{
+		{upgrader: "true", success: true},
+		{upgrader: "false", success: false},
+	} {
+		called := false
+		ns.upgrader = test.upgrader
+		err := WithUpgradeHandler(func(success bool, err error) {
+			called = true
+			if success != test.success || (err == nil) != test.success {
+				t.Errorf("unexpected result for %s upgrader: success %t, error %v", test.upgrader, success, err)
+			}
+			ns.Mode() // The handler may call Sender methods.
+		})(ns)
+		if err != nil {
+			t.Fatalf("unexpected error applying option: %v", err)
+		}
+		ns.Upgrade()
+		if !called {
+			t.Errorf("upgrade handler not called for %s upgrader", test.upgrader)
+		}
+	}
+}
+
+// TestUpgradeError tests that a successful upgrade clears only the
+// errors set by a previous upgrade.
+func TestUpgradeError(t *testing.T) {
+	ns := newTestSender(t, map[string]string{"ct": "test"}, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"rc":0}`)
+	})
+	ns.upgrader = "true"
+	for _, test := range []struct {
+		error string
+		want  string
+	}{
+		{error: errorUpgrade, want: ""},
+		{error: errorUpgradeVerify, want: ""},
+		{error: errorUpgradeRolledBack, want: errorUpgradeRolledBack},
+		{error: "sensorFault", want: "sensorFault"},
+	} {
+		ns.SetError(test.error)
+		ns.Upgrade()
+		if got := ns.Error(); got != test.want {
+			t.Errorf("unexpected error after upgrade with error %s: got %q, want %q", test.error, got, test.want)
+		}
+	}
+}
+
+// TestMaxResponseSize tests that over-long responses are rejected.
+func TestMaxResponseSize(t *testing.T) {
+	reply := `{"rc":0}`
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, reply)
+	})
+	err := WithMaxResponseSize(int64(len(reply)))(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+
+	_, _, err = ns.Send(RequestPoll, nil)
+	if err != nil {
+		t.Errorf("unexpected error for response within limit: %v", err)
+	}
+	reply = `{"rc":0,"junk":"` + strings.Repeat("x", 1024) + `"}`
+	_, _, err = ns.Send(RequestPoll, nil)
+	if err == nil {
+		t.Errorf("expected error for over-long response")
+	}
+}
+
+// TestFaultInjection tests that injected faults affect service requests.
+func TestFaultInjection(t *testing.T) {
+	tests := []struct {
+		name string
+		fc   FaultConfig
+		want func(error) bool
+	}{
+		{
+			name: "drop",
+			fc:   FaultConfig{DropRate: 1},
+			want: func(err error) bool { return errors.Is(err, errInjectedDrop) },
+		},
+		{
+			name: "status",
+			fc:   FaultConfig{Status: http.StatusInternalServerError},
+			want: func(err error) bool { return err != nil },
+		},
+		{
+			name: "service error",
+			fc:   FaultConfig{ServiceError: "InvalidDeviceKey"},
+			want: func(err error) bool {
+				var se *ServerError
+				return errors.As(err, &se) && se.Error() == "InvalidDeviceKey"
+			},
+		},
+		{
+			name: "delay",
+			fc:   FaultConfig{Delay: 10 * time.Millisecond},
+			want: func(err error) bool { return err == nil },
+		},
+	}
+	for _, test := range tests {
+		ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, `{"rc":0}`)
+		})
+		err := WithFaultInjection(test.fc)(ns)
+		if err != nil {
+			t.Fatalf("unexpected error applying option for %s: %v", test.name, err)
+		}
+		start := time.Now()
+		_, _, err = ns.Send(RequestPoll, nil)
+		if !test.want(err) {
+			t.Errorf("unexpected error for %s: %v", test.name, err)
+		}
+		if time.Since(start) < test.fc.Delay {
+			t.Errorf("request for %s not delayed", test.name)
+		}
+	}
+}
+
+// TestInSync tests that the client is in sync once the service acknowledges its mode.
+func TestInSync(t *testing.T) {
+	var md string
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		if m := r.URL.Query().Get("md"); m != "" {
+			md = m
+		}
+		fmt.Fprintf(w, `{"id":"dev","mode":"%s","vs":"1"}`, md)
+	})
+	if !ns.InSync() {
+		t.Errorf("expected new client to be in sync")
+	}
+	ns.SetMode("Burst")
+	if ns.InSync() {
+		t.Errorf("expected client not to be in sync after SetMode")
+	}
+	_, err := ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	if !ns.InSync() {
+		t.Errorf("expected client to be in sync after Vars")
+	}
+}
+
+var quietHoursTests = []struct {
+	schedule string
+	time     string
+	want     bool
+	fail     bool
+}{
+	{schedule: "", time: "12:00", want: false},
+	{schedule: "22:00-06:00", time: "23:30", want: true},
+	{schedule: "22:00-06:00", time: "03:00", want: true},
+	{schedule: "22:00-06:00", time: "06:00", want: false},
+	{schedule: "22:00-06:00", time: "12:00", want: false},
+	{schedule: "01:00-05:30", time: "05:29", want: true},
+	{schedule: "01:00-05:30", time: "00:59", want: false},
+	{schedule: "22:00", fail: true},
+	{schedule: "25:00-06:00", fail: true},
+}
+
+func TestQuietHours(t *testing.T) {
+	for i, test := range quietHoursTests {
+		qh, err := ParseQuietHours(test.schedule)
+		if (err != nil) != test.fail {
+			t.Errorf("unexpected error for test %d %q: %v", i, test.schedule, err)
+			continue
+		}
+		if test.fail {
+			continue
+		}
+		tm, err := time.Parse("15:04", test.time)
+		if err != nil {
+			t.Fatalf("could not parse time: %v", err)
+		}
+		got := qh.Contains(tm)
+		if got != test.want {
+			t.Errorf("unexpected result for test %d %q at %s: got %t, want %t", i, test.schedule, test.time, got, test.want)
+		}
+	}
+}
+
+// TestQuietHoursRun tests that Run polls only once per heartbeat during quiet hours.
+func TestQuietHoursRun(t *testing.T) {
+	var polls int
+	ns := newTestSender(t, map[string]string{"ip": "X0"}, func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		io.WriteString(w, `{"rc":0}`)
+	})
+	ns.read = func(pin *Pin) error { pin.Value = 1; return nil }
+
+	// Quiet hours from an hour ago until an hour from now.
+	now := time.Now()
+	schedule := now.Add(-time.Hour).Format("15:04") + "-" + now.Add(time.Hour).Format("15:04")
+	err := WithQuietHours(schedule, time.Hour)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	if !ns.QuietHoursActive() {
+		t.Fatalf("expected quiet hours to be active")
+	}
+	for i := 0; i < 3; i++ {
+		err = ns.Run()
+		if err != nil {
+			t.Fatalf("unexpected error from Run: %v", err)
+		}
+	}
+	if polls != 1 {
+		t.Errorf("unexpected number of polls: got %d, want 1", polls)
+	}
+
+	ns.setQuietHours(map[string]string{quietHoursVar: ""})
+	if ns.QuietHoursActive() {
+		t.Errorf("expected quiet hours to be inactive")
+	}
+
+	// Without the var, the schedule reverts to that of the option, if any.
+	ns.setQuietHours(map[string]string{})
+	if !ns.QuietHoursActive() {
+		t.Errorf("expected quiet hours to revert to the option's schedule")
+	}
+	ns.quietDefault = QuietHours{}
+	ns.setQuietHours(map[string]string{quietHoursVar: schedule})
+	if !ns.QuietHoursActive() {
+		t.Errorf("expected quiet hours to be active")
+	}
+	ns.setQuietHours(map[string]string{})
+	if ns.QuietHoursActive() {
+		t.Errorf("expected quiet hours to be cleared when the var is deleted")
+	}
+}
+
+// levelLogger implements a netsender.Logger that records its level.
+type levelLogger struct {
+	level int8
+	set   bool
+}
+
+func (ll *levelLogger) SetLevel(level int8) { ll.level, ll.set = level, true }
+
+func (ll *levelLogger) Log(level int8, msg string, params ...interface{}) {}
+
+// TestLoggingVar tests handling of the logging var.
+func TestLoggingVar(t *testing.T) {
+	tests := []struct {
+		logging string // Empty for absent.
+		set     bool
+		want    int8
+	}{
+		{logging: "Debug", set: true, want: DebugLevel},
+		{logging: "Warning", set: true, want: WarningLevel},
+		{logging: "Warn", set: false},
+		{logging: "", set: false},
+	}
+	for _, test := range tests {
+		ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+			if test.logging == "" {
+				io.WriteString(w, `{"id":"dev","quietHours":"22:00-06:00","vs":"1"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"id":"dev","dev.logging":"%s","quietHours":"22:00-06:00","vs":"1"}`, test.logging)
+		})
+		var ll levelLogger
+		ns.baseLogger = &ll
+		_, err := ns.Vars()
+		if err != nil {
+			t.Fatalf("unexpected error from Vars for %q: %v", test.logging, err)
+		}
+		if ll.set != test.set || ll.level != test.want {
+			t.Errorf("unexpected level for %q: got %d (set %t), want %d (set %t)", test.logging, ll.level, ll.set, test.want, test.set)
+		}
+		// Other vars are handled regardless of the logging var.
+		if ns.quiet == (QuietHours{}) {
+			t.Errorf("quiet hours not set for %q", test.logging)
+		}
+	}
+}
+
+// filterLogger implements a Logger which records the messages logged at
+// or above its level.
+type filterLogger struct {
+	mu    sync.Mutex
+	level int8
+	msgs  []string
+}
+
+func (fl *filterLogger) SetLevel(level int8) { fl.level = level }
+
+func (fl *filterLogger) Log(level int8, msg string, params ...interface{}) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if level < fl.level {
+		return
+	}
+	fl.msgs = append(fl.msgs, strings.TrimSpace(fmt.Sprintln(append([]interface{}{msg}, params...)...)))
+}
+
+// TestSubsystemLogLevels tests that the logging.<subsystem> vars set the
+// levels of named Loggers, and that other subsystems follow the level of
+// the client's Logger, which is set by the logging var.
+func TestSubsystemLogLevels(t *testing.T) {
+	reply := `{"id":"dev","dev.logging":"Debug","dev.logging.netsender":"Warning","dev.logging.bad":"Loud","vs":"1"}`
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, reply)
+	})
+	fl := filterLogger{level: InfoLevel}
+	ns.baseLogger = &fl
+	ns.logger = ns.Logger(senderSubsystem)
+	alignment := ns.Logger("alignment")
+
+	_, err := ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	if fl.level != DebugLevel {
+		t.Errorf("unexpected base level: got %d, want %d", fl.level, DebugLevel)
+	}
+	fl.msgs = nil
+	alignment.Log(DebugLevel, "aligning")
+	ns.logger.Log(InfoLevel, "sender info")
+	ns.logger.Log(WarningLevel, "sender warning")
+	want := []string{"aligning logger alignment", "sender warning logger netsender"}
+	if !reflect.DeepEqual(fl.msgs, want) {
+		t.Errorf("unexpected messages: got %q, want %q", fl.msgs, want)
+	}
+
+	// Removing the subsystem var reverts to following the client's Logger,
+	// and subsystem vars do not change its level.
+	reply = `{"id":"dev","dev.logging":"Info","vs":"2"}`
+	_, err = ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	reply = `{"id":"dev","dev.logging.alignment":"Debug","vs":"3"}`
+	_, err = ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	if fl.level != InfoLevel {
+		t.Errorf("unexpected base level after removal: got %d, want %d", fl.level, InfoLevel)
+	}
+	fl.msgs = nil
+	alignment.Log(DebugLevel, "aligning")
+	ns.logger.Log(InfoLevel, "sender info")
+	want = []string{"sender info logger netsender"}
+	if !reflect.DeepEqual(fl.msgs, want) {
+		t.Errorf("unexpected messages after removal: got %q, want %q", fl.msgs, want)
+	}
+}
+
+// TestPinCache tests that cached pins are rebuilt when the pin names change
+// and are not affected by modification of returned pins.
+func TestPinCache(t *testing.T) {
+	var pc pinCache
+	pins := pc.get("X1,X2")
+	pins[0].Value = 1
+	got := pc.get("X1,X2")
+	want := []Pin{{Name: "X1", Value: -1}, {Name: "X2", Value: -1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected cached pins: got %v, want %v", got, want)
+	}
+	got = pc.get("A0")
+	want = []Pin{{Name: "A0", Value: -1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected pins after change: got %v, want %v", got, want)
+	}
+	if got = pc.get(""); got != nil {
+		t.Errorf("unexpected pins for empty list: got %v", got)
+	}
+}
+
+const benchPins = "A0,A1,A2,A3,D0,D1,D2,D3,X0,X1,X2,X3,X20,X21,X22,X30"
+
+func BenchmarkMakePins(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		MakePins(benchPins, "")
+	}
+}
+
+func BenchmarkPinCache(b *testing.B) {
+	b.ReportAllocs()
+	var pc pinCache
+	for i := 0; i < b.N; i++ {
+		pc.get(benchPins)
+	}
+}
+
+// TestStdLogger tests that the StdLogger formats and filters entries.
+func TestStdLogger(t *testing.T) {
+	var buf strings.Builder
+	l := NewStdLogger(InfoLevel)
+	l.w = &buf
+	l.Log(DebugLevel, "hidden")
+	l.Log(WarningLevel, "http error", "error", "timeout", "code", 3)
+	l.SetLevel(DebugLevel)
+	l.Log(DebugLevel, "shown")
+	want := "Warning: http error error:timeout code:3\nDebug: shown\n"
+	if buf.String() != want {
+		t.Errorf("unexpected log output:\ngot :%q\nwant:%q", buf.String(), want)
+	}
+
+	// The zero value is usable.
+	var zero StdLogger
+	zero.Log(DebugLevel, "hidden")
+	zero.Log(InfoLevel, "shown on standard output")
+	zero.SetLevel(WarningLevel)
+	if zero.level != WarningLevel {
+		t.Errorf("unexpected level: got %d, want %d", zero.level, WarningLevel)
+	}
+}
+
+// TestEnvConfig tests that environment variables override the config file.
+func TestEnvConfig(t *testing.T) {
+	file, err := createNetsenderConfig()
+	if err != nil {
+		t.Fatalf("createNetsenderConfig failed with error %v", err)
+	}
+	defer os.Remove(file)
+
+	t.Setenv("NETSENDER_DK", "99")
+	t.Setenv("NETSENDER_SH", "default=env.example.com")
+	ns, err := New(&testLogger{}, nil, nil, nil, WithConfigFile(file))
+	if err != nil {
+		t.Fatalf("unexpected error from New: %v", err)
+	}
+	if got := ns.Param("dk"); got != "99" {
+		t.Errorf("unexpected dk: got %s, want 99", got)
+	}
+	if got := ns.serviceHost("default"); got != "env.example.com" {
+		t.Errorf("unexpected service host: got %s, want env.example.com", got)
+	}
+	if got := ns.Param("ma"); got != "00:00:00:00:00:01" {
+		t.Errorf("unexpected ma: got %s, want file value", got)
+	}
+
+	// Environment overrides are not written to the config file, which
+	// keeps its own values.
+	before, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("could not read config file: %v", err)
+	}
+	ns.mu.Lock()
+	ns.config["mp"] = "120"
+	err = ns.writeConfig(ns.config)
+	ns.mu.Unlock()
+	if err != nil {
+		t.Fatalf("unexpected error from writeConfig: %v", err)
+	}
+	after, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("could not read config file: %v", err)
+	}
+	if !strings.Contains(string(after), "dk 10000001\n") || strings.Contains(string(after), "env.example.com") {
+		t.Errorf("environment overrides written to config file:\n%s", after)
+	}
+	if !strings.Contains(string(after), "mp 120") || bytes.Contains(before, []byte("mp 120")) {
+		t.Errorf("config file not updated:\n%s", after)
+	}
+
+	// The config file is not needed if the environment supplies the config.
+	t.Setenv("NETSENDER_MA", "00:00:00:00:00:02")
+	ns, err = New(&testLogger{}, nil, nil, nil, WithConfigFile(file+".missing"))
+	if err != nil {
+		t.Fatalf("unexpected error from New without config file: %v", err)
+	}
+	if got := ns.Param("ma"); got != "00:00:00:00:00:02" {
+		t.Errorf("unexpected ma: got %s, want 00:00:00:00:00:02", got)
+	}
+}
+
+// TestFlushAll tests that FlushAll calls registered flushers in order,
+// continues past errors and stops when the context is cancelled.
+func TestFlushAll(t *testing.T) {
+	ns := &Sender{logger: &testLogger{}}
+	var calls []string
+	errFlush := errors.New("flush failed")
+	ns.AddFlusher("a", func(ctx context.Context, ns *Sender) (int, error) {
+		calls = append(calls, "a")
+		return 0, errFlush
+	})
+	ns.AddFlusher("b", func(ctx context.Context, ns *Sender) (int, error) {
+		calls = append(calls, "b")
+		return 10, nil
+	})
+
+	err := ns.FlushAll(context.Background())
+	if !errors.Is(err, errFlush) {
+		t.Errorf("unexpected error: got %v, want %v", err, errFlush)
+	}
+	if !reflect.DeepEqual(calls, []string{"a", "b"}) {
+		t.Errorf("unexpected flusher calls: %v", calls)
+	}
+
+	calls = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = ns.FlushAll(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error for cancelled context: got %v, want %v", err, context.Canceled)
+	}
+	if len(calls) != 0 {
+		t.Errorf("unexpected flusher calls for cancelled context: %v", calls)
+	}
+}
+
+// TestRequestStats tests that request outcomes are counted per request type.
+func TestRequestStats(t *testing.T) {
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/mts" {
+			io.WriteString(w, `{"er":"InvalidValue"}`)
+			return
+		}
+		io.WriteString(w, `{"rc":0}`)
+	})
+
+	for i := 0; i < 3; i++ {
+		ns.Send(RequestPoll, nil)
+	}
+	for i := 0; i < 2; i++ {
+		ns.Send(RequestMts, nil)
+	}
+	ns.Send(-1, nil) // Invalid request types are not counted.
+
+	got := ns.RequestStats()
+	want := map[int]Stats{
+		RequestPoll: {Success: 3},
+		RequestMts:  {Failure: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected request stats: got %v, want %v", got, want)
+	}
+}
+
+// TestTLS tests that service requests use HTTPS when WithTLS is applied.
+func TestTLS(t *testing.T) {
+	var polls, pings int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/poll":
+			polls++
+			io.WriteString(w, `{"rc":0}`)
+		case pingPath:
+			pings++
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	ns := &Sender{logger: &testLogger{}, services: map[string]string{"default": host}}
+	_, _, err := ns.Send(RequestPoll, nil)
+	if err == nil {
+		t.Errorf("expected error for HTTP request to TLS server")
+	}
+
+	err = WithTLS(srv.Client().Transport.(*http.Transport).TLSClientConfig)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	_, _, err = ns.Send(RequestPoll, nil)
+	if err != nil {
+		t.Errorf("unexpected error from Send: %v", err)
+	}
+	_, err = ns.Ping(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error from Ping: %v", err)
+	}
+	if polls != 1 || pings != 1 {
+		t.Errorf("unexpected request counts: got %d polls and %d pings, want 1 of each", polls, pings)
+	}
+
+	err = WithTLS(&tls.Config{})(ns)
+	if err == nil {
+		t.Errorf("expected error applying TLS config to custom transport")
+	}
+}
+
+// TestServiceURL tests that an explicit scheme in a service host is respected.
+func TestServiceURL(t *testing.T) {
+	ns := &Sender{}
+	for _, test := range []struct {
+		host string
+		tls  bool
+		want string
+	}{
+		{host: "example.com", want: "http://example.com"},
+		{host: "example.com", tls: true, want: "https://example.com"},
+		{host: "https://example.com", want: "https://example.com"},
+		{host: "http://example.com", tls: true, want: "http://example.com"},
+	} {
+		ns.tls = test.tls
+		got := ns.serviceURL(test.host)
+		if got != test.want {
+			t.Errorf("unexpected URL for %s (tls=%t): got %s, want %s", test.host, test.tls, got, test.want)
+		}
+	}
+}
+
+// TestTransport tests that a custom Transport replaces HTTP for service requests.
+func TestTransport(t *testing.T) {
+	ns := &Sender{logger: &testLogger{}, services: map[string]string{"default": "example.com", "mts": "mts.example.com"}}
+	var hosts, paths []string
+	err := WithTransport(TransportFunc(func(ctx context.Context, host, path string, pins []Pin) (string, error) {
+		hosts = append(hosts, host)
+		paths = append(paths, path)
+		return `{"rc":0}`, nil
+	}))(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+
+	_, _, err = ns.Send(RequestPoll, []Pin{{Name: "A0", Value: 7}})
+	if err != nil {
+		t.Errorf("unexpected error from poll: %v", err)
+	}
+	_, _, err = ns.Send(RequestMts, nil)
+	if err != nil {
+		t.Errorf("unexpected error from mts: %v", err)
+	}
+
+	wantHosts := []string{"example.com", "mts.example.com"}
+	if !reflect.DeepEqual(hosts, wantHosts) {
+		t.Errorf("unexpected hosts: got %v, want %v", hosts, wantHosts)
+	}
+	if len(paths) != 2 || !strings.HasPrefix(paths[0], "/poll?") || !strings.HasSuffix(paths[0], "&A0=7") {
+		t.Errorf("unexpected paths: %v", paths)
+	}
+
+	if WithTransport(nil)(ns) == nil {
+		t.Errorf("expected error for nil transport")
+	}
+}
+
+// TestMQTT tests that service hosts with an mqtt:// scheme use the MQTT
+// transport, using a minimal fake broker.
+func TestMQTT(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer ln.Close()
+
+	type message struct {
+		topic   string
+		payload string
+	}
+	const device = "netsender/00:00:00:00:00:01/"
+	published := make(chan message, 10)
+	pings := make(chan struct{}, 10)
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conns <- conn
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			typ, body, err := readMQTTPacket(r)
+			if err != nil {
+				return
+			}
+			switch typ >> 4 {
+			case mqttConnect:
+				writeMQTTPacket(conn, mqttConnack<<4, []byte{0, 0})
+			case mqttSubscribe:
+				writeMQTTPacket(conn, mqttSuback<<4, []byte{body[0], body[1], 0, 0})
+			case mqttPingreq:
+				pings <- struct{}{}
+				writeMQTTPacket(conn, mqttPingresp<<4, nil)
+			case mqttPublish:
+				topic, payload, _ := parseMQTTPublish(body)
+				published <- message{topic, string(payload)}
+				typ, id, _ := strings.Cut(strings.TrimPrefix(topic, device), "/")
+				reply := `{"rc":0,"vs":3}`
+				if typ == "vars" {
+					reply = `{"id":"00:00:00:00:00:01","Light":"On"}`
+				}
+				writeMQTTPacket(conn, mqttPublish<<4, mqttPublishBody("netsender/other/reply/"+id, []byte(`{"er":"wrong device"}`)))
+				writeMQTTPacket(conn, mqttPublish<<4, mqttPublishBody(device+"reply/0", []byte(`{"er":"wrong request"}`)))
+				writeMQTTPacket(conn, mqttPublish<<4, mqttPublishBody(device+"reply/"+id, []byte(reply)))
+			}
+		}
+	}()
+
+	ns := &Sender{
+		logger:   &testLogger{},
+		config:   map[string]string{"ma": "00:00:00:00:00:01", "dk": "1"},
+		services: map[string]string{"default": mqttScheme + ln.Addr().String()},
+	}
+	ns.mqtt = &mqttTransport{ns: ns, keepAlive: 2 * time.Second}
+	defer func() {
+		ns.mqtt.mu.Lock()
+		ns.mqtt.close()
+		ns.mqtt.mu.Unlock()
+	}()
+	for i := 1; i <= 2; i++ {
+		_, _, err = ns.Send(RequestPoll, []Pin{{Name: "A0", Value: 5}})
+		if err != nil {
+			t.Fatalf("unexpected error from Send: %v", err)
+		}
+		msg := <-published
+		if want := device + "poll/" + strconv.Itoa(i); msg.topic != want {
+			t.Errorf("unexpected topic: got %s, want %s", msg.topic, want)
+		}
+		if !strings.HasPrefix(msg.payload, "/poll?") || !strings.HasSuffix(msg.payload, "&A0=5\n") {
+			t.Errorf("unexpected payload: %q", msg.payload)
+		}
+	}
+	if ns.VarSum() != 3 {
+		t.Errorf("unexpected var sum: got %d, want 3", ns.VarSum())
+	}
+	conn := <-conns
+
+	// A var sum notification fetches the changed vars.
+	writeMQTTPacket(conn, mqttPublish<<4, mqttPublishBody(device+"vars", []byte(`{"vs":"3"}`)))
+	writeMQTTPacket(conn, mqttPublish<<4, mqttPublishBody(device+"vars", []byte(`{"vs":"4"}`)))
+	select {
+	case msg := <-published:
+		if !strings.HasPrefix(msg.topic, device+"vars/") {
+			t.Errorf("unexpected topic after var sum notification: %s", msg.topic)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("vars not fetched after var sum notification")
+	}
+
+	// The connection is kept alive.
+	select {
+	case <-pings:
+	case <-time.After(2 * time.Second):
+		t.Errorf("no keep alive sent")
+	}
+
+	// Requests are refused if they must be signed.
+	ns.mu.Lock()
+	ns.config["rs"] = "true"
+	ns.mu.Unlock()
+	_, _, err = ns.Send(RequestPoll, []Pin{{Name: "A0", Value: 5}})
+	if !errors.Is(err, errMQTTSigning) {
+		t.Errorf("unexpected error for signed request: got %v, want %v", err, errMQTTSigning)
+	}
+	select {
+	case msg := <-published:
+		t.Errorf("unexpected publish of signed request: %+v", msg)
+	default:
+	}
+}
+
+// TestMQTTContext tests that connecting to an unresponsive broker is
+// abandoned when the request's context is done, without holding up other
+// requests.
+func TestMQTTContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ns := &Sender{
+		logger:   &testLogger{},
+		config:   map[string]string{"ma": "00:00:00:00:00:01", "dk": "1"},
+		services: map[string]string{"default": mqttScheme + ln.Addr().String()},
+	}
+	ns.mqtt = &mqttTransport{ns: ns}
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, _, err := ns.SendContext(ctx, RequestPoll, nil)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("unexpected error from SendContext: got %v, want %v", err, context.DeadlineExceeded)
+			}
+		case <-time.After(Timeout / 2):
+			t.Fatalf("SendContext not cancelled")
+		}
+	}
+}
+
+// TestContext tests that requests are cancelled when their context is done.
+func TestContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	ns := newTestSender(t, map[string]string{"ip": "A0"}, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err := ns.SendContext(ctx, RequestPoll, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error from SendContext: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	for name, f := range map[string]func(context.Context) error{
+		"RunContext":          ns.RunContext,
+		"TestDownloadContext": ns.TestDownloadContext,
+		"TestUploadContext":   ns.TestUploadContext,
+		"ConfigContext":       func(ctx context.Context) error { _, err := ns.ConfigContext(ctx); return err },
+		"VarsContext":         func(ctx context.Context) error { _, err := ns.VarsContext(ctx); return err },
+	} {
+		err := f(ctx)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error from %s: got %v, want %v", name, err, context.Canceled)
+		}
+	}
+}
+
+// TestOfflineQueue tests that polls which fail while offline are queued
+// and sent with their timestamps once online.
+func TestOfflineQueue(t *testing.T) {
+	var online bool
+	var polls []string
+	ns := &Sender{
+		logger: &testLogger{},
+		config: map[string]string{"ip": "A0"},
+		read:   func(pin *Pin) error { pin.Value = 42; return nil },
+	}
+	for _, opt := range []Option{
+		WithTransport(TransportFunc(func(ctx context.Context, host, path string, pins []Pin) (string, error) {
+			if !online {
+				return "", errors.New("network is unreachable")
+			}
+			polls = append(polls, path)
+			return `{"rc":0}`, nil
+		})),
+		WithOfflineQueue(t.TempDir(), 1<<10),
+	} {
+		err := opt(ns)
+		if err != nil {
+			t.Fatalf("unexpected error applying option: %v", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if ns.Run() == nil {
+			t.Fatalf("expected error from Run while offline")
+		}
+	}
+	if n := ns.QueuedPolls(); n != 3 {
+		t.Fatalf("unexpected number of queued polls: got %d, want 3", n)
+	}
+
+	online = true
+	err := ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	// The queued polls are sent as a single batch after the current poll.
+	if len(polls) != 2 {
+		t.Fatalf("unexpected number of polls: got %d, want 2", len(polls))
+	}
+	if n := strings.Count(polls[1], "&A0=42&A0.ts="); n != 3 {
+		t.Errorf("unexpected number of timestamped values in batch: got %d, want 3: %s", n, polls[1])
+	}
+	if n := ns.QueuedPolls(); n != 0 {
+		t.Errorf("unexpected number of queued polls after draining: got %d, want 0", n)
+	}
+
+	// The oldest polls are dropped when the queue is full.
+	online = false
+	for i := 0; i < 50; i++ {
+		ns.Run()
+	}
+	if n := ns.QueuedPolls(); n == 0 || n >= 50 {
+		t.Errorf("unexpected number of queued polls for full queue: %d", n)
+	}
+}
+
+// TestSendBatch tests that batched pins require timestamps and no MIME type.
+func TestSendBatch(t *testing.T) {
+	var paths []string
+	ns := &Sender{logger: &testLogger{}, transport: TransportFunc(func(ctx context.Context, host, path string, pins []Pin) (string, error) {
+		paths = append(paths, path)
+		return `{"rc":0}`, nil
+	})}
+	ts := time.Unix(1700000000, 0)
+	_, _, err := ns.SendBatch([][]Pin{
+		{{Name: "A0", Value: 1, Timestamp: ts}, {Name: "X1", Value: 2, Timestamp: ts}},
+		{{Name: "A0", Value: 3, Timestamp: ts.Add(time.Second)}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from SendBatch: %v", err)
+	}
+	want := "&A0=1&A0.ts=1700000000&X1=2&X1.ts=1700000000&A0=3&A0.ts=1700000001"
+	if len(paths) != 1 || !strings.HasPrefix(paths[0], "/poll?") || !strings.HasSuffix(paths[0], want) {
+		t.Errorf("unexpected request paths: got %v, want suffix %s", paths, want)
+	}
+
+	for _, pins := range [][]Pin{
+		{{Name: "A0", Value: 1}},
+		{{Name: "B0", Value: 1, Data: []byte{0}, MimeType: "image/jpeg", Timestamp: ts}},
+	} {
+		_, _, err = ns.SendBatch([][]Pin{pins})
+		if err == nil {
+			t.Errorf("expected error for batched pins %v", pins)
+		}
+	}
+}
+
+// TestMultipart tests that pins with differing MIME types are sent as
+// multipart/mixed parts, while pins with a single MIME type are concatenated.
+func TestMultipart(t *testing.T) {
+	type part struct{ name, mimeType, data string }
+	var got []part
+	var contentType string
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		got = nil
+		contentType = r.Header.Get("Content-Type")
+		mt, params, _ := mime.ParseMediaType(contentType)
+		if mt == "multipart/mixed" {
+			mr := multipart.NewReader(r.Body, params["boundary"])
+			for {
+				p, err := mr.NextPart()
+				if err != nil {
+					break
+				}
+				_, disp, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+				b, _ := io.ReadAll(p)
+				got = append(got, part{disp["name"], p.Header.Get("Content-Type"), string(b)})
+			}
+		} else {
+			b, _ := io.ReadAll(r.Body)
+			got = append(got, part{"", mt, string(b)})
+		}
+		io.WriteString(w, `{"rc":0}`)
+	})
+
+	jpeg, text := []byte("\xff\xd8jpeg"), []byte(`{"log":1}`)
+	_, _, err := ns.Send(RequestPoll, []Pin{
+		{Name: "B0", Value: len(jpeg), Data: jpeg, MimeType: "image/jpeg"},
+		{Name: "T0", Value: len(text), Data: text, MimeType: "application/json"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	want := []part{{"B0", "image/jpeg", string(jpeg)}, {"T0", "application/json", string(text)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected multipart parts: got %q, want %q", got, want)
+	}
+
+	_, _, err = ns.Send(RequestMts, []Pin{
+		{Name: "V0", Value: 2, Data: []byte("ab"), MimeType: "video/mp2t"},
+		{Name: "V1", Value: 2, Data: []byte("cd"), MimeType: "video/mp2t"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	want = []part{{"", "video/mp2t", "abcd"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected body for single MIME type: got %q, want %q", got, want)
+	}
+}
+
+// TestWatchVars tests that var changes are detected by long-polling.
+func TestWatchVars(t *testing.T) {
+	var mu sync.Mutex
+	var vs int
+	changed := make(chan struct{})
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("wt") != "" {
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		mu.Lock()
+		fmt.Fprintf(w, `{"id":"dev","vs":"%d","dev.light":"on"}`, vs)
+		mu.Unlock()
+	})
+	varCh := ns.VarChanges()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- ns.WatchVars(ctx, time.Second) }()
+
+	mu.Lock()
+	vs = 5
+	mu.Unlock()
+	changed <- struct{}{}
+	select {
+	case vars := <-varCh:
+		if vars["light"] != "on" {
+			t.Errorf("unexpected vars: %v", vars)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for var change")
+	}
+	if ns.VarSum() != 5 {
+		t.Errorf("unexpected var sum: got %d, want 5", ns.VarSum())
+	}
+
+	cancel()
+	err := <-done
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error from WatchVars: got %v, want %v", err, context.Canceled)
+	}
+}
+
+// TestOnVar tests that var callbacks are called when var values change.
+func TestOnVar(t *testing.T) {
+	vars := `{"id":"dev","vs":"1","dev.Gain":"0.5","dev.Light":"off"}`
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, vars)
+	})
+	var gains, lights []string
+	ns.OnVar("Gain", func(v string) error { gains = append(gains, v); return nil })
+	ns.OnVar("Light", func(v string) error { lights = append(lights, v); return errors.New("no light") })
+	ns.OnVar("Missing", func(v string) error { t.Errorf("unexpected call for missing var"); return nil })
+
+	for _, v := range []string{
+		`{"id":"dev","vs":"1","dev.Gain":"0.5","dev.Light":"off"}`,
+		`{"id":"dev","vs":"2","dev.Gain":"0.5","dev.Light":"on"}`,
+		`{"id":"dev","vs":"3","dev.Gain":"0.7","dev.Light":"on"}`,
+	} {
+		vars = v
+		_, err := ns.Vars()
+		if err != nil {
+			t.Fatalf("unexpected error from Vars: %v", err)
+		}
+	}
+	if want := []string{"0.5", "0.7"}; !reflect.DeepEqual(gains, want) {
+		t.Errorf("unexpected Gain values: got %v, want %v", gains, want)
+	}
+	if want := []string{"off", "on"}; !reflect.DeepEqual(lights, want) {
+		t.Errorf("unexpected Light values: got %v, want %v", lights, want)
+	}
+}
+
+// TestVarsChanged tests that VarsChanged returns only changed vars.
+func TestVarsChanged(t *testing.T) {
+	var vars string
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, vars)
+	})
+	for i, test := range []struct {
+		vars string
+		want map[string]string
+	}{
+		{
+			vars: `{"id":"dev","vs":"1","dev.Gain":"0.5","dev.Light":"off"}`,
+			want: map[string]string{"id": "dev", "Gain": "0.5", "Light": "off", "mode": "Normal", "error": ""},
+		},
+		{
+			vars: `{"id":"dev","vs":"2","dev.Gain":"0.5","dev.Light":"on"}`,
+			want: map[string]string{"Light": "on"},
+		},
+		{
+			vars: `{"id":"dev","vs":"3","dev.Light":"on","dev.Link":"a"}`,
+			want: map[string]string{"Gain": "", "Link": "a"},
+		},
+		{
+			vars: `{"id":"dev","vs":"4","dev.Light":"on","dev.Link":"a"}`,
+			want: map[string]string{},
+		},
+	} {
+		vars = test.vars
+		got, err := ns.VarsChanged()
+		if err != nil {
+			t.Fatalf("unexpected error from VarsChanged: %v", err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected changed vars for test %d: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+// TestConditionalVars tests that vars requests send the var sum of the
+// last vars received, and that a 304 Not Modified reply returns them.
+func TestConditionalVars(t *testing.T) {
+	vs := "1"
+	var tags []string
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		tag := r.Header.Get("If-None-Match")
+		tags = append(tags, tag)
+		if tag == `"`+vs+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, `{"id":"dev","vs":"`+vs+`","dev.Light":"on"}`)
+	})
+	want, err := ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	got, err := ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from unmodified Vars: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected unmodified vars: got %v, want %v", got, want)
+	}
+
+	vs = "2"
+	got, err = ns.Vars()
+	if err != nil || got["vs"] != "2" {
+		t.Errorf("unexpected modified vars: %v, %v", got, err)
+	}
+
+	// Requests which sync the mode are not conditional.
+	ns.SetMode("Paused")
+	ns.Vars()
+	if want := []string{"", `"1"`, `"1"`, ""}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("unexpected tags: got %q, want %q", tags, want)
+	}
+}
+
+// TestVarsCache tests that Vars returns the cached vars, flagged as
+// stale, when the service cannot be reached.
+func TestVarsCache(t *testing.T) {
+	var fail atomic.Bool
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"id":"dev","vs":"1","dev.Light":"off"}`)
+	}
+	path := filepath.Join(t.TempDir(), "vars.json")
+	ns := newTestSender(t, nil, handler)
+	err := WithVarsCache(path)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+
+	// No vars have been cached yet.
+	fail.Store(true)
+	vars, err := ns.Vars()
+	if vars != nil || err == nil || errors.Is(err, ErrStaleVars) {
+		t.Errorf("unexpected result without cache: %v, %v", vars, err)
+	}
+
+	fail.Store(false)
+	want, err := ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+
+	// A new Sender, e.g., after a restart, returns the cached vars.
+	fail.Store(true)
+	ns = newTestSender(t, nil, handler)
+	err = WithVarsCache(path)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	var light string
+	ns.OnVar("Light", func(v string) error { light = v; return nil })
+	vars, err = ns.Vars()
+	if !errors.Is(err, ErrStaleVars) {
+		t.Fatalf("expected stale vars error, got %v", err)
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("unexpected stale vars: got %v, want %v", vars, want)
+	}
+	if light != "off" {
+		t.Errorf("unexpected Light value from stale vars: %q", light)
+	}
+	if ns.Mode() == "Normal" {
+		t.Errorf("stale vars changed the mode")
+	}
+}
+
+// TestOnVarRun tests that Run fetches vars for callbacks when the var sum changes.
+func TestOnVarRun(t *testing.T) {
+	ns := newTestSender(t, map[string]string{"ip": "A0"}, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/vars" {
+			io.WriteString(w, `{"id":"dev","vs":"7","dev.Light":"on"}`)
+			return
+		}
+		io.WriteString(w, `{"rc":0,"vs":7}`)
+	})
+	var light string
+	ns.OnVar("Light", func(v string) error { light = v; return nil })
+	err := ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if light != "on" {
+		t.Errorf("unexpected Light value: got %q, want on", light)
+	}
+}
+
+// TestVarAccessors tests the typed var accessors.
+func TestVarAccessors(t *testing.T) {
+	vars := map[string]string{"n": " 42", "f": "0.5", "b": "True", "d": "90", "d2": "1m30s", "bad": "x"}
+	if n, err := VarInt(vars, "n"); err != nil || n != 42 {
+		t.Errorf("unexpected VarInt result: %d, %v", n, err)
+	}
+	if f, err := VarFloat(vars, "f"); err != nil || f != 0.5 {
+		t.Errorf("unexpected VarFloat result: %v, %v", f, err)
+	}
+	if b, err := VarBool(vars, "b"); err != nil || !b {
+		t.Errorf("unexpected VarBool result: %t, %v", b, err)
+	}
+	for _, name := range []string{"d", "d2"} {
+		if d, err := VarDuration(vars, name); err != nil || d != 90*time.Second {
+			t.Errorf("unexpected VarDuration result for %s: %v, %v", name, d, err)
+		}
+	}
+	if _, err := VarInt(vars, "missing"); !errors.Is(err, ErrVarMissing) {
+		t.Errorf("unexpected error for missing var: %v", err)
+	}
+	if _, err := VarFloat(vars, "bad"); err == nil || errors.Is(err, ErrVarMissing) {
+		t.Errorf("unexpected error for bad var: %v", err)
+	}
+}
+
+// TestPinMetadata tests that pin metadata is sent in the config request
+// alongside the var types.
+func TestPinMetadata(t *testing.T) {
+	ns := newTestSender(t, nil, nil)
+	err := WithPinMetadata(map[string]PinMeta{"X24": {Units: "°", Scale: 1000, Description: "Error standard deviation"}})(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	err = WithVarTypes(map[string]string{"Gain": "float"})(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	err = WithPinMetadata(map[string]PinMeta{"A0": {Units: "dB"}})(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+
+	var names []string
+	for _, pin := range ns.configPins {
+		names = append(names, pin.Name)
+	}
+	if want := []string{"vt", "pm", "la"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("unexpected config pins: got %v, want %v", names, want)
+	}
+	want := `{"A0":{"units":"dB"},"X24":{"units":"°","scale":1000,"desc":"Error standard deviation"}}`
+	if got := string(ns.configPins[1].Data); got != want {
+		t.Errorf("unexpected pin metadata: got %s, want %s", got, want)
+	}
+
+	for _, meta := range []map[string]PinMeta{
+		{"x24": {Units: "dB"}},
+		{"X24": {Scale: -1}},
+	} {
+		if err := WithPinMetadata(meta)(ns); err == nil {
+			t.Errorf("expected error for invalid metadata: %v", meta)
+		}
+	}
+}
+
+// TestWithVars tests that declared vars set var types and receive typed values.
+func TestWithVars(t *testing.T) {
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"id":"dev","vs":"1","dev.Gain":"0.25","dev.Period":"2m","dev.On":"false","dev.Count":"oops"}`)
+	})
+	var gain float64
+	var period time.Duration
+	on := true
+	err := WithVars(
+		FloatVar("Gain", func(f float64) error { gain = f; return nil }),
+		DurationVar("Period", func(d time.Duration) error { period = d; return nil }),
+		BoolVar("On", func(b bool) error { on = b; return nil }),
+		IntVar("Count", func(n int) error { t.Errorf("unexpected call for invalid int"); return nil }),
+	)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+
+	var vt map[string]string
+	err = json.Unmarshal(ns.configPins[0].Data, &vt)
+	if err != nil {
+		t.Fatalf("could not unmarshal var types: %v", err)
+	}
+	want := map[string]string{"Gain": "float", "Period": "string", "On": "bool", "Count": "int"}
+	if !reflect.DeepEqual(vt, want) {
+		t.Errorf("unexpected var types: got %v, want %v", vt, want)
+	}
+
+	_, err = ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	if gain != 0.25 || period != 2*time.Minute || on {
+		t.Errorf("unexpected var values: gain %v, period %v, on %t", gain, period, on)
+	}
+}
+
+// TestFloatPins tests that float pins are sent as decimal numbers, rounded
+// according to the fs config param, and that NaN float pins are skipped.
+func TestFloatPins(t *testing.T) {
+	var paths []string
+	ns := &Sender{
+		logger: &testLogger{},
+		config: map[string]string{"fs": "X10:2,X11:0"},
+		transport: TransportFunc(func(ctx context.Context, host, path string, pins []Pin) (string, error) {
+			paths = append(paths, path)
+			return `{"rc":0}`, nil
+		}),
+	}
+	pins := []Pin{{Name: "X10"}, {Name: "X11"}, {Name: "X12"}, {Name: "X13"}, {Name: "A0", Value: 5}}
+	pins[0].SetFloat(7.256)
+	pins[1].SetFloat(35.4)
+	pins[2].SetFloat(0.125)
+	pins[3].SetFloat(math.NaN())
+	_, _, err := ns.Send(RequestPoll, pins)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	want := "&X10=7.26&X11=35&X12=0.125&A0=5"
+	if len(paths) != 1 || !strings.HasSuffix(paths[0], want) {
+		t.Errorf("unexpected request paths: got %v, want suffix %s", paths, want)
+	}
+}
+
+// TestPinValidity tests that -1 is only treated as no value when a pin is
+// not marked valid, and that omitted pins are never sent.
+func TestPinValidity(t *testing.T) {
+	var paths []string
+	ns := &Sender{
+		logger: &testLogger{},
+		transport: TransportFunc(func(ctx context.Context, host, path string, pins []Pin) (string, error) {
+			paths = append(paths, path)
+			return `{"rc":0}`, nil
+		}),
+	}
+	pins := []Pin{{Name: "X0", Value: -1}, {Name: "X1"}, {Name: "X2", Value: 3, Omit: true}, {Name: "X3", Value: -1, Valid: true}, {Name: "X4"}}
+	pins[1].SetValue(-1)
+	pins[4].SetFloat(-1)
+	pins[4].Omit = true
+	_, _, err := ns.Send(RequestPoll, pins)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	want := "&X1=-1&X3=-1"
+	if len(paths) != 1 || !strings.HasSuffix(paths[0], want) || strings.Contains(paths[0], "X0") {
+		t.Errorf("unexpected request paths: got %v, want suffix %s", paths, want)
+	}
+}
+
+// TestPinDataReader tests that pin payload data is streamed from data
+// readers, that signed requests require them to be seekable, and that
+// requests with data readers never reuse a request ID.
+func TestPinDataReader(t *testing.T) {
+	var bodies, ids []string
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, r.Header.Get("Content-Type")+":"+string(b))
+		ids = append(ids, r.Header.Get(headerRequestID))
+		io.WriteString(w, `{"rc":0}`)
+	})
+	pins := []Pin{
+		{Name: "V0", Value: 5, MimeType: "video/mp2t", DataReader: iotest.HalfReader(strings.NewReader("video"))},
+		{Name: "X0", Value: 3},
+	}
+	_, _, err := ns.Send(RequestPoll, pins)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if want := []string{"video/mp2t:video"}; !reflect.DeepEqual(bodies, want) {
+		t.Errorf("unexpected bodies: got %q, want %q", bodies, want)
+	}
+
+	ns.config["dk"] = "10000001"
+	ns.config["rs"] = "true"
+	pins[0].DataReader = iotest.HalfReader(strings.NewReader("video"))
+	_, _, err = ns.Send(RequestPoll, pins)
+	if err == nil {
+		t.Errorf("expected error signing unseekable data reader")
+	}
+	pins[0].DataReader = strings.NewReader("video")
+	_, _, err = ns.Send(RequestPoll, pins)
+	if err != nil || bodies[len(bodies)-1] != "video/mp2t:video" {
+		t.Errorf("unexpected result for signed data reader: %v, %q", err, bodies)
+	}
+
+	pins[0].DataReader = strings.NewReader("clip2")
+	_, _, err = ns.Send(RequestPoll, pins, WithRequestID(ids[0]))
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if last := ids[len(ids)-1]; last == ids[0] || last == "" {
+		t.Errorf("expected new request ID for data reader, got %q", last)
+	}
+}
+
+// TestUploadRate tests that request payloads are paced to the upload
+// rate, which may be set by the UploadRate var.
+func TestUploadRate(t *testing.T) {
+	var body []byte
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/vars" {
+			io.WriteString(w, `{"id":"test","vs":"1","UploadRate":"20000"}`)
+			return
+		}
+		body, _ = io.ReadAll(r.Body)
+		io.WriteString(w, `{"rc":0}`)
+	})
+	err := WithUploadRate(-1)(ns)
+	if err == nil {
+		t.Errorf("expected error for negative upload rate")
+	}
+	_, err = ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	if got := ns.UploadRate(); got != 20000 {
+		t.Fatalf("unexpected upload rate: got %d, want 20000", got)
+	}
+
+	data := bytes.Repeat([]byte("x"), 4000)
+	start := time.Now()
+	_, _, err = ns.Send(RequestPoll, []Pin{{Name: "T0", Value: len(data), Data: data, MimeType: "text/plain"}})
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if !bytes.Equal(body, data) {
+		t.Errorf("unexpected body of %d bytes, want %d bytes", len(body), len(data))
+	}
+	// 4000 bytes at 20000 bytes per second should take at least 200ms.
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("upload was not paced: took %v", d)
+	}
+}
+
+// TestHTTPCapture tests that service requests are captured with device
+// keys and the WiFi password redacted, and uploaded when the DumpHTTP var
+// changes to true.
+func TestHTTPCapture(t *testing.T) {
+	var dumps [][]HTTPExchange
+	ns := newTestSender(t, map[string]string{"dk": "12345", "ip": capturePin}, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/vars" {
+			io.WriteString(w, `{"id":"test","vs":"1","DumpHTTP":"true","dk":"67890","wi":"ssid,secret"}`)
+			return
+		}
+		var d []HTTPExchange
+		err := json.NewDecoder(r.Body).Decode(&d)
+		if err != nil {
+			t.Errorf("could not decode dump: %v", err)
+		}
+		dumps = append(dumps, d)
+		io.WriteString(w, `{"rc":0}`)
+	})
+	err := WithHTTPCapture(20)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err := ns.Vars()
+		if err != nil {
+			t.Fatalf("unexpected error from Vars: %v", err)
+		}
+	}
+	if len(dumps) != 1 || len(dumps[0]) != 1 {
+		t.Fatalf("unexpected dumps: %+v", dumps)
+	}
+	x := dumps[0][0]
+	if !strings.HasPrefix(x.Request, "/vars?") || !strings.Contains(x.Request, "dk="+redacted) || strings.Contains(x.Request, "12345") {
+		t.Errorf("unexpected captured request: %s", x.Request)
+	}
+	if !strings.Contains(x.Reply, `"dk":"`+redacted+`"`) || strings.Contains(x.Reply, "67890") {
+		t.Errorf("unexpected captured reply: %s", x.Reply)
+	}
+	if !strings.Contains(x.Reply, `"wi":"ssid,***"`) || strings.Contains(x.Reply, "secret") {
+		t.Errorf("WiFi password not redacted from captured reply: %s", x.Reply)
+	}
+	if got := len(ns.HTTPCapture()); got != 3 {
+		t.Errorf("unexpected number of captured exchanges: got %d, want 3", got)
+	}
+
+	err = WithHTTPCapture(1)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	err = ns.DumpHTTP()
+	if err != nil {
+		t.Fatalf("unexpected error from DumpHTTP: %v", err)
+	}
+	if got := ns.HTTPCapture(); len(got) != 1 || !strings.HasPrefix(got[0].Request, "/poll?") {
+		t.Errorf("unexpected captured exchanges: %+v", got)
+	}
+}
+
+// TestHTTPCaptureDisabled tests that nothing is captured by default, and
+// that the capture pin is then read like any other pin.
+func TestHTTPCaptureDisabled(t *testing.T) {
+	var got string
+	ns := newTestSender(t, map[string]string{"ip": capturePin}, func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query().Get(capturePin)
+		io.WriteString(w, `{"rc":0}`)
+	})
+	ns.read = func(pin *Pin) error { pin.Value = 42; return nil }
+	err := ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if got != "42" {
+		t.Errorf("capture pin not read: got %q, want 42", got)
+	}
+	if n := len(ns.HTTPCapture()); n != 0 {
+		t.Errorf("unexpected captured exchanges: got %d, want none", n)
+	}
+}
+
+// TestRedactRequest tests that device keys and the WiFi password are
+// redacted from captured requests.
+func TestRedactRequest(t *testing.T) {
+	got := redactRequest("/config?ma=00:00:00:00:00:01&dk=12345&wi=ssid%2Csecret")
+	want := "/config?ma=00:00:00:00:00:01&dk=" + redacted + "&wi=ssid%2C%2A%2A%2A"
+	if got != want {
+		t.Errorf("unexpected redacted request: got %s, want %s", got, want)
+	}
+}
+
+// TestRequestSigning tests that signed requests omit the device key and
+// carry a valid signature, and that the service cannot disable signing.
+func TestRequestSigning(t *testing.T) {
+	const key = "10000001"
+	var errs []string
+	ns := newTestSender(t, map[string]string{"ma": "00:00:00:00:00:01", "dk": key, "rs": "true"}, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("dk") {
+			errs = append(errs, "dk sent in plaintext")
+		}
+		body, _ := io.ReadAll(r.Body)
+		h := sha256.Sum256(body)
+		want := requestMAC(key, r.Method, r.URL.RequestURI(), r.Header.Get(headerTimestamp), h[:])
+		got, _ := hex.DecodeString(r.Header.Get(headerSignature))
+		if !hmac.Equal(got, want) {
+			errs = append(errs, "invalid signature for "+r.Method+" "+r.URL.Path)
+		}
+		io.WriteString(w, `{"rc":0,"rs":"false"}`)
+	})
+	_, _, err := ns.Send(RequestPoll, []Pin{{Name: "A0", Value: 1}})
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	_, _, err = ns.Send(RequestMts, []Pin{{Name: "V0", Value: 3, Data: []byte("abc"), MimeType: "video/mp2t"}})
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	_, err = ns.Config()
+	if err != nil {
+		t.Fatalf("unexpected error from Config: %v", err)
+	}
+	if ns.Param("rs") != "true" {
+		t.Errorf("service disabled request signing")
+	}
+	for _, e := range errs {
+		t.Error(e)
+	}
+}
+
+// TestClientCert tests that the client certificate is presented to the
+// service, and that requests fail closed once the certificate expires.
+func TestClientCert(t *testing.T) {
+	var subjects []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subjects = append(subjects, r.TLS.PeerCertificates[0].Subject.CommonName)
+		io.WriteString(w, `{"rc":0}`)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	writeTestCert(t, certFile, time.Now().Add(time.Hour))
+
+	ns := &Sender{logger: &testLogger{}, services: map[string]string{"default": strings.TrimPrefix(srv.URL, "https://")}}
+	err := WithTLS(srv.Client().Transport.(*http.Transport).TLSClientConfig)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	err = ns.setClientCert(certFile, "")
+	if err != nil {
+		t.Fatalf("unexpected error from setClientCert: %v", err)
+	}
+	_, _, err = ns.Send(RequestPoll, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if len(subjects) != 1 || subjects[0] != "netsender" {
+		t.Errorf("unexpected client certificates: %v", subjects)
+	}
+
+	// Replace the certificate with an expired one.
+	writeTestCert(t, certFile, time.Now().Add(-time.Hour))
+	ns.httpClient().Transport.(*http.Transport).CloseIdleConnections()
+	_, _, err = ns.Send(RequestPoll, nil)
+	if !errors.Is(err, ErrCertExpired) {
+		t.Errorf("unexpected error for expired certificate: got %v, want %v", err, ErrCertExpired)
+	}
+	_, err = loadClientCert(certFile, "")
+	if !errors.Is(err, ErrCertExpired) {
+		t.Errorf("unexpected error loading expired certificate: got %v, want %v", err, ErrCertExpired)
+	}
+
+	// Once cleared, no certificate is presented, but HTTPS is still used
+	// since it was set by WithTLS.
+	ns.clearClientCert()
+	_, _, err = ns.Send(RequestPoll, nil)
+	if err == nil || errors.Is(err, ErrCertExpired) {
+		t.Errorf("unexpected error without client certificate: %v", err)
+	}
+	if !ns.tls || ns.httpClient().Transport.(*http.Transport).TLSClientConfig.GetClientCertificate != nil {
+		t.Errorf("unexpected TLS config after clearing client certificate")
+	}
+
+	// HTTPS enabled only for the certificate is disabled when it is cleared.
+	writeTestCert(t, certFile, time.Now().Add(time.Hour))
+	ns = &Sender{logger: &testLogger{}}
+	err = ns.setClientCert(certFile, "")
+	if err != nil || !ns.tls {
+		t.Fatalf("unexpected result from setClientCert: tls %t, error %v", ns.tls, err)
+	}
+	ns.clearClientCert()
+	if ns.tls {
+		t.Errorf("HTTPS still used after clearing client certificate")
+	}
+}
+
+// writeTestCert writes a self-signed certificate and its key, expiring at
+// notAfter, to the PEM file path.
+func writeTestCert(t *testing.T, path string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "netsender"},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+	b := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})...)
+	err = os.WriteFile(path, b, 0600)
+	if err != nil {
+		t.Fatalf("could not write certificate: %v", err)
+	}
+}
+
+// TestHTTPClient tests that service requests use the client set by
+// WithHTTPClient, and otherwise a shared transport which honours proxy
+// environment variables.
+func TestHTTPClient(t *testing.T) {
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"rc":0}`)
+	})
+	c1, c2 := ns.httpClient(), ns.httpClient()
+	if c1.Transport != c2.Transport {
+		t.Errorf("expected transport to be shared between requests")
+	}
+	if tr, ok := c1.Transport.(*http.Transport); !ok || tr.Proxy == nil {
+		t.Errorf("expected default transport with proxy support")
+	}
+	if c1.Timeout != Timeout {
+		t.Errorf("unexpected timeout: got %v, want %v", c1.Timeout, Timeout)
+	}
+
+	var requests int
+	rt := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	err := WithHTTPClient(&http.Client{Transport: rt, Timeout: time.Minute})(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	_, _, err = ns.Send(RequestPoll, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("unexpected number of requests via custom client: got %d, want 1", requests)
+	}
+	if ns.httpClient().Timeout != time.Minute {
+		t.Errorf("unexpected timeout: got %v, want %v", ns.httpClient().Timeout, time.Minute)
+	}
+	err = WithHTTPClient(&http.Client{Transport: rt})(ns)
+	if err == nil {
+		t.Errorf("expected error replacing custom transport")
+	}
+}
+
+// roundTripFunc implements an http.RoundTripper with a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip implements http.RoundTripper.RoundTrip.
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// TestRequestID tests that requests have unique IDs, except for retries
+// TestRequestID tests that requests have unique IDs, even when they
+// have the same pins as a failed request, unless the ID of an earlier
+// request is given, and that queued polls are sent with the IDs of the
+// polls that failed.
+func TestRequestID(t *testing.T) {
+	var ids []string
+	var fail bool
+	ns := &Sender{
+		logger: &testLogger{},
+		config: map[string]string{"ip": "A0"},
+		read:   func(pin *Pin) error { pin.Value = 1; return nil },
+	}
+	for _, opt := range []Option{
+		WithTransport(TransportFunc(func(ctx context.Context, host, path string, pins []Pin) (string, error) {
+			ids = append(ids, RequestID(ctx))
+			if fail {
+				return "", errors.New("network is unreachable")
+			}
+			return `{"rc":0}`, nil
+		})),
+		WithOfflineQueue(t.TempDir(), 1<<20),
+	} {
+		err := opt(ns)
+		if err != nil {
+			t.Fatalf("unexpected error applying option: %v", err)
+		}
+	}
+
+	// Failed requests with the same pins are different requests.
+	fail = true
+	pins := []Pin{{Name: "A0", Value: 1}}
+	for i := 0; i < 2; i++ {
+		ns.Send(RequestPoll, pins)
+	}
+	if len(ids) != 2 || ids[0] == "" || ids[1] == ids[0] {
+		t.Errorf("expected unique request IDs: %v", ids)
+	}
+
+	// A retry with the ID of the failed request is counted.
+	_, _, err := ns.Send(RequestPoll, pins, WithRequestID(ids[1]))
+	if err == nil {
+		t.Fatalf("expected error from Send")
+	}
+	if ids[2] != ids[1] || ns.metrics.retries != 1 {
+		t.Errorf("unexpected retry: IDs %v, retries %d", ids, ns.metrics.retries)
+	}
+
+	// A queued poll is sent with the ID of the poll that failed.
+	ids = nil
+	if ns.Run() == nil {
+		t.Fatalf("expected error from Run while offline")
+	}
+	failed := ids[0]
+	fail = false
+	ids = nil
+	err = ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if len(ids) != 2 || ids[1] != failed || ids[0] == failed {
+		t.Errorf("unexpected IDs of poll and queued poll: got %v, want [<new> %s]", ids, failed)
+	}
+
+	// A failed batch of queued polls is retried with the same ID, even if
+	// more polls have been queued since.
+	fail = true
+	for i := 0; i < 2; i++ {
+		ns.Run()
+	}
+	q := ns.queue
+	ids = nil
+	q.drain(context.Background(), ns, 0)
+	ns.Run()
+	fail = false
+	drained, err := q.drain(context.Background(), ns, 0)
+	if err != nil || drained != 3 {
+		t.Fatalf("unexpected result of drain: sent %d, error %v", drained, err)
+	}
+	if len(ids) != 4 || ids[2] != ids[0] || ids[3] == ids[0] {
+		t.Errorf("expected failed batch to be retried with the same ID: %v", ids)
+	}
+}
+
+// TestFailover tests that requests fail over to the next service host
+// when a host is down, and fail back once a health check succeeds.
+func TestFailover(t *testing.T) {
+	var mu sync.Mutex
+	var down bool
+	var got []string
+	setDown := func(d bool) {
+		mu.Lock()
+		down = d
+		mu.Unlock()
+	}
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if name == "primary" && down {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			if r.URL.Path != pingPath {
+				got = append(got, name)
+			}
+			io.WriteString(w, `{"rc":0}`)
+		}
+	}
+	primary := httptest.NewServer(handler("primary"))
+	defer primary.Close()
+	backup := httptest.NewServer(handler("backup"))
+	defer backup.Close()
+
+	sh := "default=" + strings.TrimPrefix(primary.URL, "http://") + "|" + strings.TrimPrefix(backup.URL, "http://")
+	services, err := configServices(sh)
+	if err != nil {
+		t.Fatalf("unexpected error from configServices: %v", err)
+	}
+	ns := &Sender{logger: &testLogger{}, services: services}
+
+	send := func(wantErr bool) {
+		_, _, err := ns.Send(RequestPoll, nil)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error from Send: %v", err)
+		}
+	}
+	send(false)
+	setDown(true)
+	send(true)
+	send(false)
+	send(false)
+
+	// Fail back once the primary passes a health check.
+	setDown(false)
+	ns.checkHosts(context.Background())
+	send(false)
+	ns.mu.Lock()
+	for _, hs := range ns.downHosts {
+		hs.checkAt = time.Now()
+	}
+	ns.mu.Unlock()
+	ns.checkHosts(context.Background())
+	send(false)
+
+	want := []string{"primary", "backup", "backup", "backup", "primary"}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected request hosts: got %v, want %v", got, want)
+	}
+}
+
+// TestClockSync tests that the clock skew is measured from the ts value
+// or Date header of service replies, and that the clock is stepped if
+// enabled.
+func TestClockSync(t *testing.T) {
+	var ts float64
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		if ts == 0 {
+			io.WriteString(w, `{"rc":0}`)
+			return
+		}
+		fmt.Fprintf(w, `{"rc":0,"ts":%.3f}`, ts)
+	})
+	if _, ok := ns.ClockSkew(); ok {
+		t.Errorf("expected no clock skew before first reply")
+	}
+
+	// The httptest server sets the Date header to the local time.
+	_, _, err := ns.Send(RequestPoll, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	skew, ok := ns.ClockSkew()
+	if !ok || skew.Abs() > 2*time.Second {
+		t.Errorf("unexpected clock skew from Date header: %v, %v", skew, ok)
+	}
+
+	ts = float64(time.Now().Add(time.Hour).UnixMilli()) / 1000
+	_, _, err = ns.Send(RequestPoll, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	skew, _ = ns.ClockSkew()
+	if (skew + time.Hour).Abs() > time.Second {
+		t.Errorf("unexpected clock skew from ts: got %v, want -1h", skew)
+	}
+	if d := ns.Now().Sub(time.Now().Add(time.Hour)).Abs(); d > time.Second {
+		t.Errorf("unexpected corrected time: off by %v", d)
+	}
+
+	defer func(f func(time.Time) error) { setClock = f }(setClock)
+	var stepped time.Time
+	setClock = func(t time.Time) error { stepped = t; return nil }
+	err = WithClockStep(time.Minute)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	ts = float64(time.Now().Add(2*time.Hour).UnixMilli()) / 1000
+	_, _, err = ns.Send(RequestPoll, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+	if d := stepped.Sub(time.Now().Add(2 * time.Hour)).Abs(); d > time.Second {
+		t.Errorf("unexpected stepped time: off by %v", d)
+	}
+	if skew, _ = ns.ClockSkew(); skew != 0 {
+		t.Errorf("unexpected clock skew after step: %v", skew)
+	}
+}
+
+// TestBandwidth tests that speed tests report bandwidth results, honour
+// the configured size and duration, and that the results are sent as
+// JSON on the bandwidth pin.
+func TestBandwidth(t *testing.T) {
+	const size = 100000
+	var mu sync.Mutex
+	var uploaded int64
+	var got []byte
+	ns := newTestSender(t, map[string]string{"ip": bandwidthPin}, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, downloadTestPath+strconv.Itoa(size)):
+			// Send slowly, so that a duration limited test is cut short.
+			for i := 0; i < 10; i++ {
+				w.Write(make([]byte, size/10))
+				w.(http.Flusher).Flush()
+				time.Sleep(20 * time.Millisecond)
+			}
+		case strings.HasPrefix(r.URL.Path, uploadTestPath+strconv.Itoa(size)):
+			n, _ := io.Copy(io.Discard, r.Body)
+			mu.Lock()
+			uploaded = n
+			mu.Unlock()
+		default:
+			b, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			got = b
+			mu.Unlock()
+			io.WriteString(w, `{"rc":0}`)
+		}
+	})
+	ns.read = func(pin *Pin) error { return nil }
+	err := WithSpeedTest(size, 0)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	if _, ok := ns.DownloadBandwidth(); ok {
+		t.Errorf("expected no download bandwidth before speed test")
+	}
+
+	err = ns.TestDownload()
+	if err != nil {
+		t.Fatalf("unexpected error from TestDownload: %v", err)
+	}
+	err = ns.TestUpload()
+	if err != nil {
+		t.Fatalf("unexpected error from TestUpload: %v", err)
+	}
+	down, ok := ns.DownloadBandwidth()
+	if !ok || down.Bytes != size || down.Avg <= 0 || down.Min > down.Max || down.Avg != ns.DownloadSpeed() {
+		t.Errorf("unexpected download bandwidth: %+v", down)
+	}
+	up, ok := ns.UploadBandwidth()
+	if !ok || up.Bytes != size || up.Avg <= 0 || up.Avg != ns.UploadSpeed() || uploaded != size {
+		t.Errorf("unexpected upload bandwidth: %+v, uploaded %d bytes", up, uploaded)
+	}
+
+	err = ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	var results map[string]Bandwidth
+	mu.Lock()
+	err = json.Unmarshal(got, &results)
+	mu.Unlock()
+	if err != nil || results["download"] != down || results["upload"] != up {
+		t.Errorf("unexpected bandwidth pin data: %s, error: %v", got, err)
+	}
+
+	// Duration limited tests end early without error.
+	err = WithSpeedTest(size, 50*time.Millisecond)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	err = ns.TestDownload()
+	if err != nil {
+		t.Fatalf("unexpected error from duration limited TestDownload: %v", err)
+	}
+	down, _ = ns.DownloadBandwidth()
+	if down.Bytes == 0 || down.Bytes >= size {
+		t.Errorf("unexpected duration limited download: %+v", down)
+	}
+}
+
+// TestScheduledSpeedTest tests that speed tests are scheduled by the
+// SpeedTestInterval var, and that percentiles of recent results are
+// reported on the percentile pins.
+func TestScheduledSpeedTest(t *testing.T) {
+	const size = 10000
+	var mu sync.Mutex
+	var tests int
+	var query url.Values
+	ns := newTestSender(t, map[string]string{"ip": downloadP50Pin + "," + uploadP10Pin}, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(r.URL.Path, downloadTestPath):
+			tests++
+			w.Write(make([]byte, size))
+		case strings.HasPrefix(r.URL.Path, uploadTestPath):
+			io.Copy(io.Discard, r.Body)
+		case r.URL.Path == "/vars":
+			io.WriteString(w, `{"vs":"1","SpeedTestInterval":"1h"}`)
+		default:
+			query = r.URL.Query()
+			io.WriteString(w, `{"rc":0}`)
+		}
+	})
+	ns.read = func(pin *Pin) error { return nil }
+	err := WithSpeedTest(size, 0)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	_, err = ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		err = ns.Run()
+		if err != nil {
+			t.Fatalf("unexpected error from Run: %v", err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if tests != 1 {
+		t.Errorf("unexpected number of speed tests: got %d, want 1", tests)
+	}
+	down, _ := ns.DownloadBandwidth()
+	up, _ := ns.UploadBandwidth()
+	if query.Get(downloadP50Pin) != strconv.Itoa(down.Avg) || query.Get(uploadP10Pin) != strconv.Itoa(up.Avg) {
+		t.Errorf("unexpected percentile pins: %v", query)
+	}
+}
+
+// TestPercentile tests nearest-rank percentiles.
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		vals []int
+		p    int
+		want int
+	}{
+		{nil, 50, -1},
+		{[]int{5}, 10, 5},
+		{[]int{4, 1, 3, 2}, 50, 2},
+		{[]int{4, 1, 3, 2}, 10, 1},
+		{[]int{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, 90, 9},
+	}
+	for i, test := range tests {
+		got := percentile(test.vals, test.p)
+		if got != test.want {
+			t.Errorf("test %d: got %d, want %d", i, got, test.want)
+		}
+	}
+}
+
+// TestSystemdNotify tests that systemd is notified when the client is
+// ready, on each Run and when it is closed.
+func TestSystemdNotify(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", sock)
+	t.Setenv("WATCHDOG_PID", "")
+
+	ns := newTestSender(t, map[string]string{"ma": "00:00:00:00:00:01", "dk": "10000001"}, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"rc":0}`)
+	})
+	err = WithSystemdNotify()(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	for _, f := range []func() error{
+		func() error { _, err := ns.Config(); return err },
+		ns.Run,
+		func() error { _, err := ns.Config(); return err },
+		func() error { return ns.Close(context.Background()) },
+	} {
+		err := f()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	var got []string
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		got = append(got, string(buf[:n]))
+	}
+	if want := []string{sdReady, sdWatchdog, sdStopping}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected notifications: got %q, want %q", got, want)
+	}
+}
+
+// TestClose tests that Close cancels outstanding requests, flushes
+// buffered data with requests which are not cancelled, and stops Run.
+func TestClose(t *testing.T) {
+	started := make(chan struct{}, 1)
+	ns := newTestSender(t, map[string]string{"ip": "A0"}, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("A0") == "1" {
+			started <- struct{}{}
+			<-r.Context().Done() // Hang until the client gives up.
+			return
+		}
+		io.WriteString(w, `{"rc":0}`)
+	})
+	ns.read = func(pin *Pin) error { pin.Value = 1; return nil }
+	var flushed error
+	ns.AddFlusher("test", func(ctx context.Context, ns *Sender) (int, error) {
+		_, _, err := ns.SendContext(ctx, RequestPoll, []Pin{{Name: "A0", Value: 2}})
+		flushed = err
+		return 1, err
+	})
+
+	done := make(chan error)
+	go func() { done <- ns.Run() }()
+	<-started
+	err := ns.Close(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error from Close: %v", err)
+	}
+	select {
+	case err = <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error from cancelled Run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run not cancelled by Close")
+	}
+	if flushed != nil {
+		t.Errorf("unexpected error from flush: %v", flushed)
+	}
+	err = ns.Run()
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error from Run after Close: got %v, want %v", err, ErrClosed)
+	}
+	err = ns.Close(context.Background())
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error from second Close: got %v, want %v", err, ErrClosed)
+	}
+}
+
+// TestRunActs tests that act requests are sent and outputs written once
+// per act period, independently of Run, which then does not act itself.
+func TestRunActs(t *testing.T) {
+	var acts, configs int32
+	ns := newTestSender(t, map[string]string{"op": "D1", "ap": "1"}, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/act":
+			n := atomic.AddInt32(&acts, 1)
+			fmt.Fprintf(w, `{"rc":0,"D1":%d}`, n)
+		case "/config":
+			atomic.AddInt32(&configs, 1)
+			io.WriteString(w, `{"rc":0,"op":"D1","ap":1}`)
+		}
+	})
+	written := make(chan int, 10)
+	ns.write = func(pin *Pin) error { written <- pin.Value; return nil }
+	if ns.ActPeriod() != time.Second {
+		t.Errorf("unexpected act period: got %v, want 1s", ns.ActPeriod())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- ns.RunActs(ctx) }()
+	for want := 1; want <= 2; want++ {
+		select {
+		case v := <-written:
+			if v != want {
+				t.Errorf("unexpected written value: got %d, want %d", v, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no output written")
+		}
+	}
+	n := atomic.LoadInt32(&acts)
+	err := ns.Run()
+	if err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+	if atomic.LoadInt32(&acts) != n || atomic.LoadInt32(&configs) != 1 {
+		t.Errorf("Run acted while RunActs was running: %d acts, %d configs", atomic.LoadInt32(&acts)-n, atomic.LoadInt32(&configs))
+	}
+	cancel()
+	err = <-done
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error from RunActs: %v", err)
+	}
+}
+
+// TestMetrics tests that health metrics are recorded, reported on pins
+// and served in the Prometheus text format.
+func TestMetrics(t *testing.T) {
+	fail := true
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"rc":0,"vs":1}`)
+	})
+	if m := ns.Metrics(); m.Requests != 0 || m.VarSumAge != -1 {
+		t.Errorf("unexpected initial metrics: %+v", m)
+	}
+
+	pins := []Pin{{Name: "A0", Value: 1}}
+	id := NewRequestID()
+	_, _, err := ns.Send(RequestPoll, pins, WithRequestID(id))
+	if err == nil {
+		t.Fatalf("expected error from Send")
+	}
+	fail = false
+	_, _, err = ns.Send(RequestPoll, pins, WithRequestID(id))
+	if err != nil {
+		t.Fatalf("unexpected error from Send: %v", err)
+	}
+
+	m := ns.Metrics()
+	if m.Requests != 2 || m.Failures != 1 || m.Retries != 1 {
+		t.Errorf("unexpected request metrics: %+v", m)
+	}
+	if m.BytesSent == 0 || m.LatencyP50 <= 0 || m.LatencyP95 < m.LatencyP50 {
+		t.Errorf("unexpected size or latency metrics: %+v", m)
+	}
+	if m.VarSumAge < 0 || m.VarSumAge > time.Second {
+		t.Errorf("unexpected var sum age: %v", m.VarSumAge)
+	}
+
+	for _, test := range []struct {
+		name string
+		want int
+	}{
+		{requestsPin, 2},
+		{failuresPin, 1},
+		{retriesPin, 1},
+		{varSumAgePin, 0},
+	} {
+		pin := Pin{Name: test.name}
+		ns.metricPin(&pin)
+		if pin.Value != test.want {
+			t.Errorf("unexpected value for pin %s: got %d, want %d", test.name, pin.Value, test.want)
+		}
+	}
+	pin := Pin{Name: latencyP95Pin}
+	ns.metricPin(&pin)
+	if !pin.IsFloat || pin.Float <= 0 {
+		t.Errorf("unexpected latency pin: %+v", pin)
+	}
+
+	rec := httptest.NewRecorder()
+	ns.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"netsender_requests_total 2\n",
+		"netsender_request_failures_total 1\n",
+		"netsender_request_retries_total 1\n",
+		`netsender_request_outcomes_total{type="poll",outcome="failure"} 1` + "\n",
+		`netsender_request_duration_seconds_bucket{le="+Inf"} 2` + "\n",
+		"netsender_request_duration_seconds_count 2\n",
+		"netsender_varsum_age_seconds ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q, got:\n%s", want, body)
+		}
+	}
+
+	err = WithMetricsListener("127.0.0.1:0")(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	err = ns.Close(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error from Close: %v", err)
+	}
+}
+
+// TestLatencyPercentile tests latency percentile estimation.
+func TestLatencyPercentile(t *testing.T) {
+	ns := &Sender{}
+	if p := ns.Metrics().LatencyP50; p != 0 {
+		t.Errorf("unexpected percentile without requests: %v", p)
+	}
+	for _, rtt := range []time.Duration{30, 40, 60, 70, 80, 90, 200, 300, 400, 40000} {
+		ns.recordLatency(rtt*time.Millisecond, 0)
+	}
+	m := ns.Metrics()
+	if m.LatencyP50 != 100*time.Millisecond {
+		t.Errorf("unexpected p50: got %v, want 100ms", m.LatencyP50)
+	}
+	if m.LatencyP95 != 40*time.Second {
+		t.Errorf("unexpected p95: got %v, want 40s", m.LatencyP95)
+	}
+}
+
+// TestConfigStore tests reading and writing config params in the legacy,
+// JSON and YAML formats.
+func TestConfigStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "netsender.conf",
+			content: "ma 00:00:00:00:00:01\ndk 10000001\nip X0\n",
+			want:    "ma 00:00:00:00:00:01\ndk 10000001\nip X0,A0\nsh a.com\n",
+		},
+		{
+			name:    "netsender.json",
+			content: `{"ma": "00:00:00:00:00:01", "dk": 10000001, "ip": "X0"}`,
+			want:    "{\n  \"ma\": \"00:00:00:00:00:01\",\n  \"dk\": \"10000001\",\n  \"ip\": \"X0,A0\",\n  \"sh\": \"a.com\"\n}\n",
+		},
+		{
+			name:    "netsender.yaml",
+			content: "# Device identity.\nma: \"00:00:00:00:00:01\"\ndk: 10000001 # Device key.\n\n# Inputs.\nip: 'X0'\n",
+			want:    "# Device identity.\nma: \"00:00:00:00:00:01\"\ndk: 10000001 # Device key.\n\n# Inputs.\nip: X0,A0\nsh: a.com\n",
+		},
+	}
+	order := []string{"ma", "dk", "ip", "sh"}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), test.name)
+		err := os.WriteFile(path, []byte(test.content), 0644)
+		if err != nil {
+			t.Fatalf("could not write config file: %v", err)
+		}
+		cs := NewConfigStore(path)
+		config, err := cs.Read()
+		if err != nil {
+			t.Fatalf("unexpected error reading %s: %v", test.name, err)
+		}
+		want := map[string]string{"ma": "00:00:00:00:00:01", "dk": "10000001", "ip": "X0"}
+		if !reflect.DeepEqual(config, want) {
+			t.Errorf("unexpected config from %s: got %v, want %v", test.name, config, want)
+		}
+
+		config["ip"] = "X0,A0"
+		config["sh"] = "a.com"
+		err = cs.Write(config, order)
+		if err != nil {
+			t.Fatalf("unexpected error writing %s: %v", test.name, err)
+		}
+		got, _ := os.ReadFile(path)
+		if string(got) != test.want {
+			t.Errorf("unexpected content of %s:\ngot :%q\nwant:%q", test.name, got, test.want)
+		}
+		if err := cs.Write(config, order); !errors.Is(err, ErrUnchanged) {
+			t.Errorf("expected unchanged %s, got %v", test.name, err)
+		}
+		again, err := cs.Read()
+		if err != nil || !reflect.DeepEqual(again, config) {
+			t.Errorf("unexpected config from %s after write: %v, %v", test.name, again, err)
+		}
+	}
+
+	_, err := NewConfigStore(filepath.Join(t.TempDir(), "missing.yml")).Read()
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+
+	for _, bad := range []string{"ip:\n  - X0\n", "ip X0\n", "ip: \"X0\n"} {
+		_, err := decodeYAML([]byte(bad))
+		if err == nil {
+			t.Errorf("expected error decoding %q", bad)
+		}
+	}
+	for _, val := range []string{"", "a: b", "#x", "-1", " x", "a\\b", "'q'"} {
+		config, err := decodeYAML([]byte("v: " + yamlQuote(val) + "\n"))
+		if err != nil || config["v"] != val {
+			t.Errorf("could not round trip %q: got %q, %v", val, config["v"], err)
+		}
+	}
+}
+
+// TestReloadConfig tests that changes to the config file are applied at
+// runtime.
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netsender.conf")
+	writeConf := func(s string) {
+		err := os.WriteFile(path, []byte("ma 00:00:00:00:00:01\ndk 10000001\n"+s), 0644)
+		if err != nil {
+			t.Fatalf("could not write config file: %v", err)
+		}
+	}
+	writeConf("ip A0\nmp 60\n")
+
+	var mu sync.Mutex
+	var inits []string
+	init := func(pin *Pin, data interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		inits = append(inits, pin.Name)
+		return nil
+	}
+	ns, err := New(&testLogger{}, init, nil, nil, WithConfigFile(path))
+	if err != nil {
+		t.Fatalf("unexpected error from New: %v", err)
+	}
+
+	changed, err := ns.ReloadConfig()
+	if err != nil || len(changed) != 0 {
+		t.Errorf("unexpected reload of unchanged config: %v, %v", changed, err)
+	}
+
+	writeConf("ip A0,A4\nmp 30\nsh default=a.com,mts=b.com\n")
+	changed, err = ns.ReloadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error from ReloadConfig: %v", err)
+	}
+	if want := []string{"ip", "mp", "sh"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("unexpected changed params: got %v, want %v", changed, want)
+	}
+	if ns.Param("ip") != "A0,A4" || ns.Param("mp") != "30" {
+		t.Errorf("unexpected params after reload: ip=%s, mp=%s", ns.Param("ip"), ns.Param("mp"))
+	}
+	if got := ns.Services()["mts"]; got != "b.com" {
+		t.Errorf("unexpected mts service after reload: %s", got)
+	}
+	mu.Lock()
+	if want := []string{"A0", "A4"}; !reflect.DeepEqual(inits, want) {
+		t.Errorf("unexpected pin inits: got %v, want %v", inits, want)
+	}
+	mu.Unlock()
+
+	// Removed params are detected, including those which revert to their
+	// defaults.
+	writeConf("ip A0,A4\nop D1\nmp 30\n")
+	changed, err = ns.ReloadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error from ReloadConfig: %v", err)
+	}
+	if want := []string{"op", "sh"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("unexpected changed params: got %v, want %v", changed, want)
+	}
+	if _, ok := ns.Services()["mts"]; ok {
+		t.Errorf("removed mts service still used: %v", ns.Services())
+	}
+	writeConf("ip A0,A4\nmp 30\n")
+	changed, err = ns.ReloadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error from ReloadConfig: %v", err)
+	}
+	if want := []string{"op"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("unexpected changed params: got %v, want %v", changed, want)
+	}
+	if ns.Param("op") != "" {
+		t.Errorf("removed op param not cleared: op=%s", ns.Param("op"))
+	}
+
+	// An invalid config is rejected in full.
+	writeConf("ip A1\nmp sixty\n")
+	_, err = ns.ReloadConfig()
+	if err == nil {
+		t.Errorf("expected error reloading invalid config")
+	}
+	if ns.Param("ip") != "A0,A4" {
+		t.Errorf("invalid config partially applied: ip=%s", ns.Param("ip"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- ns.WatchConfig(ctx, 10*time.Millisecond) }()
+	time.Sleep(50 * time.Millisecond)
+	writeConf("ip A2\nmp 10\n")
+	for i := 0; i < 100 && ns.Param("ip") != "A2"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ns.Param("ip") != "A2" || ns.Param("mp") != "10" {
+		t.Errorf("config change not detected: ip=%s, mp=%s", ns.Param("ip"), ns.Param("mp"))
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error from WatchConfig: %v", err)
+	}
+}
+
+// TestParseConfig tests parsing and validation of config params.
+func TestParseConfig(t *testing.T) {
+	params := map[string]string{
+		"ma": "00:00:00:00:00:01",
+		"dk": "10000001",
+		"ip": "A0,X10",
+		"op": "D4",
+		"mp": "30",
+		"ap": "0",
+		"sh": "default=a.com|b.com:8080,mts=mqtt://c.com:1883",
+		"fs": "X10:2",
+		"rs": "true",
+		"zz": "extra",
+	}
+	c, err := ParseConfig(params)
+	if err != nil {
+		t.Fatalf("unexpected error from ParseConfig: %v", err)
+	}
+	want := &Config{
+		MAC:            "00:00:00:00:00:01",
+		DeviceKey:      "10000001",
+		Inputs:         []string{"A0", "X10"},
+		Outputs:        []string{"D4"},
+		MonitorPeriod:  30 * time.Second,
+		Services:       map[string]string{"default": "a.com|b.com:8080", "mts": "mqtt://c.com:1883"},
+		FloatDecimals:  map[string]int{"X10": 2},
+		RequireSigning: true,
+		Extra:          map[string]string{"zz": "extra"},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("unexpected config:\ngot :%+v\nwant:%+v", c, want)
+	}
+	c2, err := ParseConfig(c.Params())
+	if err != nil || !reflect.DeepEqual(c2, c) {
+		t.Errorf("config did not round trip: %+v, %v", c2, err)
+	}
+
+	for _, test := range []struct {
+		name, val string
+	}{
+		{"ma", "00:00:00:00:01"},
+		{"dk", "key"},
+		{"ip", "A0,a1"},
+		{"ip", "A0,A0"},
+		{"op", "D"},
+		{"mp", "0"},
+		{"ap", "-1"},
+		{"sh", "default=a.com:http"},
+		{"sh", "default=a com"},
+		{"sh", "default=a.com/path"},
+		{"sh", "default=a.com|"},
+		{"sh", "poll=a.com"},
+		{"fs", "X10:two"},
+		{"rs", "maybe"},
+	} {
+		p := make(map[string]string)
+		for k, v := range params {
+			p[k] = v
+		}
+		p[test.name] = test.val
+		_, err := ParseConfig(p)
+		if err == nil || !strings.Contains(err.Error(), "invalid "+test.name+" param") {
+			t.Errorf("expected invalid %s param error for %q, got %v", test.name, test.val, err)
+		}
+	}
+
+	_, err = ParseConfig(map[string]string{"ip": "a0", "ck": "key.pem"})
+	if err == nil {
+		t.Fatalf("expected error for invalid config")
+	}
+	for _, want := range []string{"ma param is missing", "dk param is missing", "invalid ip param", "ck param requires cc"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to contain %q, got %v", want, err)
+		}
+	}
+
+	// Config files accepted by earlier versions are still accepted, with
+	// malformed params logged and replaced by their defaults, if any.
+	path := filepath.Join(t.TempDir(), "netsender.conf")
+	err = os.WriteFile(path, []byte("ma 00:00:00:00:01\ndk 10000001\nip A0;A1\nsh \n"), 0644)
+	if err != nil {
+		t.Fatalf("could not write config file: %v", err)
+	}
+	var rl recordLogger
+	ns, err := New(&rl, nil, nil, nil, WithConfigFile(path))
+	if err != nil {
+		t.Fatalf("unexpected error from New with legacy config: %v", err)
+	}
+	if got := ns.Param("ip"); got != "A0;A1" {
+		t.Errorf("unexpected ip param: got %q, want %q", got, "A0;A1")
+	}
+	if got := ns.Param("sh"); got != "default="+defaultService {
+		t.Errorf("unexpected sh param: got %q, want the default", got)
+	}
+	var warnings int
+	for _, msg := range rl.msgs {
+		if msg == warnConfigFileParam {
+			warnings++
+		}
+	}
+	if warnings != 2 {
+		t.Errorf("unexpected number of config warnings: got %d, want 2", warnings)
+	}
+
+	// A malformed MAC address is rejected only with MAC validation.
+	_, err = New(&testLogger{}, nil, nil, nil, WithConfigFile(path), WithMACValidation(false))
+	if err == nil {
+		t.Errorf("expected error from New with malformed ma and MAC validation")
+	}
+}
+
+// TestProvisioning tests that a device without a device key registers
+// with the service to obtain one.
+func TestProvisioning(t *testing.T) {
+	var refuse bool
+	var polls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch r.URL.Path {
+		case registerPath:
+			if refuse || q.Get("tk") != "secret token" || q.Get("ma") != "00:00:00:00:00:01" {
+				io.WriteString(w, `{"er":"unknown device"}`)
+				return
+			}
+			io.WriteString(w, `{"dk":"12345"}`)
+		case "/poll":
+			if q.Get("dk") != "12345" {
+				t.Errorf("unexpected dk in poll: %s", q.Get("dk"))
+			}
+			polls++
+			io.WriteString(w, `{"rc":0}`)
+		default:
+			io.WriteString(w, `{"rc":0}`)
+		}
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "netsender.conf")
+	err := os.WriteFile(path, []byte("ma 00:00:00:00:00:01\nip X0\nsh "+strings.TrimPrefix(srv.URL, "http://")+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("could not write config file: %v", err)
+	}
+	_, err = New(&testLogger{}, nil, nil, nil, WithConfigFile(path))
+	if err == nil {
+		t.Fatalf("expected error from New without dk")
+	}
+	ns, err := New(&testLogger{}, nil, func(pin *Pin) error { pin.Value = 1; return nil }, nil, WithConfigFile(path), WithProvisioning("secret token"))
+	if err != nil {
+		t.Fatalf("unexpected error from New: %v", err)
+	}
+
+	refuse = true
+	err = ns.RunContext(context.Background())
+	var se *ServerError
+	if !errors.Is(err, ErrNotProvisioned) || !errors.As(err, &se) {
+		t.Errorf("expected not provisioned error, got %v", err)
+	}
+
+	refuse = false
+	err = ns.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from RunContext: %v", err)
+	}
+	if ns.Param("dk") != "12345" || polls != 1 {
+		t.Errorf("unexpected dk %q or polls %d after provisioning", ns.Param("dk"), polls)
+	}
+	b, _ := os.ReadFile(path)
+	if !strings.Contains(string(b), "dk 12345\n") {
+		t.Errorf("device key not written to config file:\n%s", b)
+	}
+}
+
+// TestKeyRotation tests device key rotation, including rollback when the
+// new key is rejected, retrying an acknowledgement which failed and
+// rollback when it has failed too often.
+func TestKeyRotation(t *testing.T) {
+	var mu sync.Mutex
+	var newKey, ack string
+	var acks []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		q := r.URL.Query()
+		if r.URL.Path != "/config" {
+			io.WriteString(w, `{"rc":0}`)
+			return
+		}
+		if q.Get("ka") != "1" {
+			fmt.Fprintf(w, `{"rc":0,"dk":%s}`, newKey)
+			return
+		}
+		acks = append(acks, q.Get("dk"))
+		switch ack {
+		case "accept":
+			io.WriteString(w, `{"rc":0}`)
+		case "reject":
+			io.WriteString(w, `{"er":"InvalidDeviceKey"}`)
+		case "error":
+			io.WriteString(w, `{"er":"ReadError"}`)
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "netsender.conf")
+	err := os.WriteFile(path, []byte("ma 00:00:00:00:00:01\ndk 111\nsh "+strings.TrimPrefix(srv.URL, "http://")+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not write config file: %v", err)
+	}
+	ns, err := New(&testLogger{}, nil, nil, nil, WithConfigFile(path))
+	if err != nil {
+		t.Fatalf("unexpected error from New: %v", err)
+	}
+	check := func(dk, pk string) {
+		t.Helper()
+		if ns.Param("dk") != dk || ns.Param("pk") != pk {
+			t.Errorf("unexpected keys: got dk=%s pk=%s, want dk=%s pk=%s", ns.Param("dk"), ns.Param("pk"), dk, pk)
+		}
+		b, _ := os.ReadFile(path)
+		if conf := filemap.Split(string(b), "\n", " "); conf["dk"] != dk || conf["pk"] != pk {
+			t.Errorf("unexpected keys in config file:\n%s", b)
+		}
+	}
+	config := func(key, result string) {
+		t.Helper()
+		mu.Lock()
+		newKey, ack = key, result
+		mu.Unlock()
+		_, err := ns.Config()
+		if err != nil {
+			t.Fatalf("unexpected error from Config: %v", err)
+		}
+	}
+
+	config("111", "accept")
+	check("111", "")
+
+	config("222", "accept")
+	check("222", "")
+
+	config("333", "reject")
+	check("222", "")
+
+	config("444", "fail")
+	check("444", "222")
+	mu.Lock()
+	ack = "accept"
+	mu.Unlock()
+	err = ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	check("444", "")
+
+	// Other errors do not restore the previous key until the
+	// acknowledgement has failed maxKeyAcks times.
+	config("555", "error")
+	check("555", "444")
+	for i := 1; i < maxKeyAcks; i++ {
+		err = ns.Run()
+		if i < maxKeyAcks-1 && (err == nil || errors.Is(err, ErrKeyRejected)) {
+			t.Fatalf("unexpected error from Run: %v", err)
+		}
+	}
+	if !errors.Is(err, ErrKeyRejected) {
+		t.Errorf("unexpected error after %d failed acknowledgements: %v", maxKeyAcks, err)
+	}
+	check("444", "")
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"222", "333", "444", "444"}
+	for i := 0; i < maxKeyAcks; i++ {
+		want = append(want, "555")
+	}
+	if !reflect.DeepEqual(acks, want) {
+		t.Errorf("unexpected acknowledgements: got %v, want %v", acks, want)
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("config file mode not preserved: %v, %v", fi.Mode(), err)
+	}
+}
+
+// TestWiFi tests that wi config param changes are applied to the OS.
+func TestWiFi(t *testing.T) {
+	defer func(f func(string, string, ...string) error) { runCommand = f }(runCommand)
+	var cmds, stdins []string
+	runCommand = func(stdin, name string, args ...string) error {
+		cmds = append(cmds, name+" "+strings.Join(args, " "))
+		stdins = append(stdins, stdin)
+		return nil
+	}
+
+	path := filepath.Join(t.TempDir(), "wpa_supplicant.conf")
+	err := os.WriteFile(path, []byte("ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev\ncountry=AU\n\nnetwork={\n\tssid=\"old\"\n\tpsk=\"oldpassword\"\n}\n\nnetwork={\n\tssid=\"older\"\n\tpsk=\"olderpassword\"\n\tpriority=-1\n}\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not write wpa_supplicant config: %v", err)
+	}
+
+	wi := "old,oldpassword"
+	ns := newTestSender(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"rc":0,"wi":%q}`, wi)
+	})
+	ns.configFile = filepath.Join(t.TempDir(), "netsender.conf")
+	ns.config["wi"] = wi
+	ns.wifiApplied = wi
+	err = WithWiFi(WPASupplicant(path, "wlan0"))(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+
+	_, err = ns.Config()
+	if err != nil {
+		t.Fatalf("unexpected error from Config: %v", err)
+	}
+	if len(cmds) != 0 {
+		t.Errorf("unexpected commands for unchanged wi: %v", cmds)
+	}
+
+	wi = "new,new password, with comma"
+	_, err = ns.Config()
+	if err != nil {
+		t.Fatalf("unexpected error from Config: %v", err)
+	}
+	if want := []string{"wpa_cli -i wlan0 reconfigure"}; !reflect.DeepEqual(cmds, want) {
+		t.Errorf("unexpected commands: got %v, want %v", cmds, want)
+	}
+	got, _ := os.ReadFile(path)
+	want := "ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev\ncountry=AU\n\nnetwork={\n\tssid=\"new\"\n\tpsk=\"new password, with comma\"\n\tpriority=2\n}\n\nnetwork={\n\tssid=\"old\"\n\tpsk=\"oldpassword\"\n\tpriority=1\n}\n"
+	if string(got) != want {
+		t.Errorf("unexpected wpa_supplicant config:\ngot :%q\nwant:%q", got, want)
+	}
+	if got := Redact("wi", wi); got != "new,***" {
+		t.Errorf("unexpected redacted wi: %s", got)
+	}
+
+	// Invalid credentials are not applied.
+	wi = "bad,short"
+	_, err = ns.Config()
+	if err != nil {
+		t.Fatalf("unexpected error from Config: %v", err)
+	}
+	if len(cmds) != 1 {
+		t.Errorf("unexpected commands for invalid wi: %v", cmds)
+	}
+
+	cmds, stdins = nil, nil
+	err = NetworkManager("wlan0")("open", "")
+	if err != nil {
+		t.Fatalf("unexpected error from NetworkManager: %v", err)
+	}
+	err = NetworkManager("wlan0")("secure", "secret password")
+	if err != nil {
+		t.Fatalf("unexpected error from NetworkManager: %v", err)
+	}
+	wantCmds := []string{"nmcli device wifi connect open ifname wlan0", "nmcli --ask device wifi connect secure ifname wlan0"}
+	if !reflect.DeepEqual(cmds, wantCmds) {
+		t.Errorf("unexpected commands: got %v, want %v", cmds, wantCmds)
+	}
+	if want := []string{"", "secret password\n"}; !reflect.DeepEqual(stdins, want) {
+		t.Errorf("unexpected standard input: got %q, want %q", stdins, want)
+	}
+}
+
+// TestUpgradeVerification tests that upgrades are only installed once the
+// manifest signature and artifact checksums have been verified.
+func TestUpgradeVerification(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	artifact := []byte("new binary")
+	sum := sha256.Sum256(artifact)
+	manifest := []byte(`{"ct":"test","cv":"v1.0.0","artifacts":[{"name":"app","url":"/files/app","sha256":"` + hex.EncodeToString(sum[:]) + `"}]}`)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, manifest))
+
+	var served []byte
+	var servedSig string
+	cv := "v1.0.0"
+	ns := newTestSender(t, map[string]string{"ct": "test", "cv": cv}, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case manifestPath:
+			if r.URL.Query().Get("ct") != "test" || r.URL.Query().Get("cv") != cv {
+				t.Errorf("unexpected manifest query: %s", r.URL.RawQuery)
+			}
+			w.Write(served)
+		case manifestSigPath:
+			if servedSig == "" {
+				http.NotFound(w, r)
+				return
+			}
+			io.WriteString(w, servedSig)
+		case "/files/app":
+			w.Write(artifact)
+		default:
+			io.WriteString(w, `{"rc":0}`)
+		}
+	})
+
+	tmp := t.TempDir()
+	out := filepath.Join(tmp, "args")
+	installed := filepath.Join(tmp, "app")
+	ns.upgrader = filepath.Join(tmp, "upgrade.sh")
+	err = os.WriteFile(ns.upgrader, []byte("#!/bin/sh\necho \"$@\" > "+out+"\ncp \"$NETSENDER_UPGRADE_DIR/app\" "+installed+"\n"), 0755)
+	if err != nil {
+		t.Fatalf("could not write upgrader: %v", err)
+	}
+	dir := filepath.Join(tmp, "upgrade")
+	keep := filepath.Join(dir, "keep")
+	err = os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.WriteFile(keep, []byte("keep"), 0644)
+	}
+	if err != nil {
+		t.Fatalf("could not write file in upgrade directory: %v", err)
+	}
+	err = WithUpgradeVerification(pub, dir)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+
+	tampered := bytes.Replace(manifest, []byte("v1.0.0"), []byte("v1.0.1"), 1)
+	for _, test := range []struct {
+		name     string
+		manifest []byte
+		sig      string
+		artifact string
+		want     string
+	}{
+		{name: "unsigned", manifest: manifest, want: errorUpgradeVerify},
+		{name: "bad signature", manifest: tampered, sig: sig, want: errorUpgradeVerify},
+		{name: "bad checksum", manifest: manifest, sig: sig, artifact: "tampered binary", want: errorUpgradeVerify},
+		{name: "valid", manifest: manifest, sig: sig, artifact: string(artifact), want: ""},
+	} {
+		os.Remove(out)
+		served, servedSig = test.manifest, test.sig
+		artifact = []byte(test.artifact)
+		ns.Upgrade()
+		if got := ns.Error(); got != test.want {
+			t.Errorf("unexpected error for %s upgrade: got %q, want %q", test.name, got, test.want)
+		}
+		args, err := os.ReadFile(out)
+		if test.want != "" {
+			if err == nil {
+				t.Errorf("upgrader called for %s upgrade", test.name)
+			}
+			continue
+		}
+		if string(args) != "test v1.0.0\n" {
+			t.Errorf("unexpected upgrader args: %q, %v", args, err)
+		}
+		got, err := os.ReadFile(installed)
+		if err != nil || string(got) != string(artifact) {
+			t.Errorf("unexpected artifact: %q, %v", got, err)
+		}
+	}
+
+	// The caller's files are kept and the staging directory is removed.
+	if _, err := os.Stat(keep); err != nil {
+		t.Errorf("file in upgrade directory removed: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("staging directory not removed: %v", entries)
+	}
+
+	for _, name := range []string{"../app", "a/b", ".."} {
+		m := []byte(`{"ct":"test","cv":"v1.0.0","artifacts":[{"name":"` + name + `","url":"x","sha256":"` + hex.EncodeToString(sum[:]) + `"}]}`)
+		_, err := verifyManifest(m, []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, m))), pub, "test", "v1.0.0")
+		if !errors.Is(err, ErrUpgradeVerify) {
+			t.Errorf("expected verification error for artifact name %q, got %v", name, err)
+		}
+	}
+
+	// Upgrades to @latest must be newer than the installed version.
+	sign := func(cv string) {
+		served = bytes.Replace(manifest, []byte("v1.0.0"), []byte(cv), 1)
+		servedSig = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, served))
+	}
+	cv = "@latest"
+	ns.config["cv"] = cv
+	ns.build = "v1.2.0"
+	artifact = []byte("new binary")
+	for _, test := range []struct {
+		cv   string
+		want string
+	}{
+		{cv: "v1.1.9", want: errorUpgradeVerify},
+		{cv: "v1.2", want: errorUpgradeVerify},
+		{cv: "v1.10.0", want: ""},
+	} {
+		sign(test.cv)
+		ns.Upgrade()
+		if got := ns.Error(); got != test.want {
+			t.Errorf("unexpected error for upgrade from %s to %s: got %q, want %q", ns.build, test.cv, got, test.want)
+		}
+	}
+}
+
+// TestUpgradeRollback tests that an upgrade is rolled back if the client
+// does not pass its health check while the service is reachable.
+func TestUpgradeRollback(t *testing.T) {
+	var fail, down atomic.Bool
+	ns := newTestSender(t, map[string]string{"ct": "test", "cv": "v2", "ip": "X0"}, func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		if fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"rc":0}`)
+	})
+	ns.read = func(pin *Pin) error { pin.Value = 1; return nil }
+	tmp := t.TempDir()
+	out := filepath.Join(tmp, "args")
+	ns.upgrader = filepath.Join(tmp, "upgrade.sh")
+	err := os.WriteFile(ns.upgrader, []byte("#!/bin/sh\necho \"$@\" >> "+out+"\n"), 0755)
+	if err != nil {
+		t.Fatalf("could not write upgrader: %v", err)
+	}
+	stateFile := filepath.Join(tmp, "upgrade.json")
+	err = WithUpgradeRollback(stateFile, 50*time.Millisecond)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+	ns.build = "v1"
+	upgrades := func() string {
+		b, _ := os.ReadFile(out)
+		return string(b)
+	}
+	state := func() *upgradeState {
+		st, err := ns.readUpgradeState()
+		if err != nil {
+			t.Fatalf("could not read upgrade state: %v", err)
+		}
+		return st
+	}
+
+	// A healthy upgrade is kept.
+	ns.Upgrade()
+	if st := state(); st == nil || st.From != "v1" || st.To != "v2" {
+		t.Fatalf("unexpected upgrade state: %+v", st)
+	}
+	err = ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if st := state(); st != nil {
+		t.Errorf("upgrade state not removed after health check: %+v", st)
+	}
+	time.Sleep(60 * time.Millisecond)
+	ns.Run()
+	ns.upgrades.Wait()
+	if got := upgrades(); got != "test v2\n" {
+		t.Errorf("unexpected upgrades: %q", got)
+	}
+
+	// Time while the service is unreachable does not count.
+	os.Remove(out)
+	ns.Upgrade()
+	down.Store(true)
+	ns.Run()
+	time.Sleep(60 * time.Millisecond)
+	ns.Run()
+	ns.upgrades.Wait()
+	if st := state(); st == nil {
+		t.Errorf("upgrade state removed while the service was unreachable")
+	}
+	down.Store(false)
+	err = ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	ns.upgrades.Wait()
+	if got := upgrades(); got != "test v2\n" {
+		t.Errorf("unexpected upgrades after outage: %q", got)
+	}
+	if st := state(); st != nil {
+		t.Errorf("upgrade state not removed after health check: %+v", st)
+	}
+
+	// An upgrade whose requests to the service fail is rolled back.
+	os.Remove(out)
+	ns.Upgrade()
+	fail.Store(true)
+	ns.Run()
+	time.Sleep(60 * time.Millisecond)
+	ns.Run()
+	ns.upgrades.Wait()
+	if got := upgrades(); got != "test v2\ntest v1\n" {
+		t.Errorf("unexpected upgrades: %q", got)
+	}
+	if ns.Error() != errorUpgradeRolledBack {
+		t.Errorf("unexpected error after rollback: %q", ns.Error())
+	}
+
+	// The previous version reports the rollback.
+	ns.ClearError()
+	ns.startHealthCheck()
+	if ns.Error() != errorUpgradeRolledBack || state() != nil {
+		t.Errorf("rollback not reported on restart: error %q, state %+v", ns.Error(), state())
+	}
+
+	// An upgrade which keeps restarting is rolled back.
+	os.Remove(out)
+	err = ns.writeUpgradeState(&upgradeState{ClientType: "test", From: "v1", To: "v2"})
+	if err != nil {
+		t.Fatalf("could not write upgrade state: %v", err)
+	}
+	for i := 0; i < maxUpgradeBoots; i++ {
+		ns.startHealthCheck()
+	}
+	ns.upgrades.Wait()
+	if got := upgrades(); got != "" {
+		t.Errorf("unexpected upgrades before max restarts: %q", got)
+	}
+	ns.startHealthCheck()
+	ns.upgrades.Wait()
+	if got := upgrades(); got != "test v1\n" {
+		t.Errorf("unexpected upgrades after max restarts: %q", got)
+	}
+}
+
+// TestSelfUpdate tests that a self-update replaces the executable with
+// the verified binary for the platform and re-executes it.
+func TestSelfUpdate(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	bin := []byte("new binary")
+	sum := sha256.Sum256(bin)
+	name := binaryName("test")
+	manifest := []byte(`{"ct":"test","cv":"v1.0.0","artifacts":[{"name":"` + name + `","url":"/files/bin","sha256":"` + hex.EncodeToString(sum[:]) + `"}]}`)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, manifest))
+
+	tmp := t.TempDir()
+	exe := filepath.Join(tmp, "netsender")
+	err = os.WriteFile(exe, []byte("old binary"), 0750)
+	if err != nil {
+		t.Fatalf("could not write executable: %v", err)
+	}
+	origExecutable, origReexec := executable, reexec
+	defer func() { executable, reexec = origExecutable, origReexec }()
+	executable = func() (string, error) { return exe, nil }
+	var restarted string
+	reexec = func(path string) error { restarted = path; return nil }
+
+	ns := newTestSender(t, map[string]string{"ct": "test", "cv": "v1.0.0"}, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case manifestPath:
+			w.Write(manifest)
+		case manifestSigPath:
+			io.WriteString(w, sig)
+		case "/files/bin":
+			w.Write(bin)
+		default:
+			io.WriteString(w, `{"rc":0}`)
+		}
+	})
+	ns.upgrader = filepath.Join(tmp, "missing.sh")
+	err = WithSelfUpdate(pub)(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+
+	var ok bool
+	ns.upgradeHandler = func(success bool, err error) { ok = success }
+	ns.Upgrade()
+	if !ok || ns.Error() != "" {
+		t.Fatalf("self-update failed: %q", ns.Error())
+	}
+	if restarted != exe {
+		t.Errorf("unexpected re-executed path: %q", restarted)
+	}
+	got, err := os.ReadFile(exe)
+	if err != nil || string(got) != string(bin) {
+		t.Errorf("unexpected executable: %q, %v", got, err)
+	}
+	if fi, err := os.Stat(exe); err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("unexpected executable mode: %v, %v", fi.Mode(), err)
+	}
+	got, err = os.ReadFile(exe + prevSuffix)
+	if err != nil || string(got) != "old binary" {
+		t.Errorf("unexpected previous executable: %q, %v", got, err)
+	}
+	if _, err := os.Stat(exe + stagingDirSuffix); !os.IsNotExist(err) {
+		t.Errorf("staging directory not removed: %v", err)
+	}
+
+	// A manifest without a binary for the platform is not installed.
+	restarted = ""
+	manifest = []byte(`{"ct":"test","cv":"v1.0.0","artifacts":[{"name":"other","url":"/files/bin","sha256":"` + hex.EncodeToString(sum[:]) + `"}]}`)
+	sig = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, manifest))
+	ns.Upgrade()
+	if ns.Error() != errorUpgradeVerify {
+		t.Errorf("unexpected error for manifest without binary: %q", ns.Error())
+	}
+	if restarted != "" {
+		t.Errorf("re-executed after failed self-update")
+	}
+}
+
+// TestUpgradeProgress tests that upgrade stages are reported to the
+// service as they begin.
+func TestUpgradeProgress(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	artifact := []byte("new binary")
+	sum := sha256.Sum256(artifact)
+	manifest := []byte(`{"ct":"test","cv":"v1.0.0","artifacts":[{"name":"app","url":"/files/app","sha256":"` + hex.EncodeToString(sum[:]) + `"}]}`)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, manifest))
+
+	var mu sync.Mutex
+	var stages []string
+	ns := newTestSender(t, map[string]string{"ct": "test", "cv": "v1.0.0", "ip": "X97,X98"}, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case manifestPath:
+			w.Write(manifest)
+		case manifestSigPath:
+			io.WriteString(w, sig)
+		case "/files/app":
+			w.Write(artifact)
+		case "/poll":
+			stage := r.URL.Query().Get(upgradeStagePin)
+			mu.Lock()
+			stages = append(stages, stage)
+			mu.Unlock()
+			// Negative values are not sent, so there is no age when idle.
+			if age, err := strconv.Atoi(r.URL.Query().Get(upgradeStageAgePin)); stage != "0" && (err != nil || age < 0) {
+				t.Errorf("unexpected upgrade stage age: %q", r.URL.Query().Get(upgradeStageAgePin))
+			}
+			io.WriteString(w, `{"rc":0}`)
+		default:
+			io.WriteString(w, `{"rc":0}`)
+		}
+	})
+	tmp := t.TempDir()
+	ns.upgrader = filepath.Join(tmp, "upgrade.sh")
+	err = os.WriteFile(ns.upgrader, []byte("#!/bin/sh\nexit 0\n"), 0755)
+	if err != nil {
+		t.Fatalf("could not write upgrader: %v", err)
+	}
+	err = WithUpgradeVerification(pub, filepath.Join(tmp, "upgrade"))(ns)
+	if err != nil {
+		t.Fatalf("unexpected error applying option: %v", err)
+	}
+
+	ns.Upgrade()
+	want := []string{"1", "2", "1", "3", "0"}
+	mu.Lock()
+	got := stages
+	mu.Unlock()
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected upgrade stages: got %v, want %v", got, want)
+	}
+	if stage, age := ns.UpgradeProgress(); stage != UpgradeIdle || age != 0 {
+		t.Errorf("unexpected progress after upgrade: %v, %v", stage, age)
+	}
+
+	pin := Pin{Name: upgradeStageAgePin}
+	ns.upgradePin(&pin)
+	if pin.Value != -1 {
+		t.Errorf("unexpected upgrade stage age when idle: %d", pin.Value)
+	}
 }
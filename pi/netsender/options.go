@@ -25,9 +25,12 @@ LICENSE
 package netsender
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
+	"time"
 )
 
 // Option is the function signature returned by option functions below for
@@ -35,6 +38,8 @@ import (
 type Option func(*Sender) error
 
 // WithVarTypes returns an Option that sets the Sender var types details.
+// Var types are merged with any set by previous WithVarTypes or WithVars
+// options.
 func WithVarTypes(vt map[string]string) Option {
 	return func(s *Sender) error {
 		// Validate the varTypes.
@@ -57,30 +62,15 @@ func WithVarTypes(vt map[string]string) Option {
 			return fmt.Errorf("invalid variable type: key %s has invalid value: %s", key, val)
 		}
 
-		la := localAddr()
-		vtBytes, err := json.Marshal(vt)
-		if err != nil {
-			return fmt.Errorf("could not marshal var type map: %w", err)
-		}
-
-		// Create pins for var types (vt) and local address (la).
 		s.mu.Lock()
-		s.configPins = []Pin{
-			Pin{
-				Name:     "vt",
-				Value:    len(vtBytes),
-				Data:     vtBytes,
-				MimeType: "application/json",
-			},
-			Pin{
-				Name:  "la",
-				Value: len(la),
-				Data:  []byte(la),
-			},
+		defer s.mu.Unlock()
+		if s.varTypes == nil {
+			s.varTypes = make(map[string]string)
 		}
-		s.mu.Unlock()
-
-		return nil
+		for key, val := range vt {
+			s.varTypes[key] = val
+		}
+		return s.setConfigPins()
 	}
 }
 
@@ -100,3 +90,228 @@ func WithUpgrader(u string) Option {
 		return nil
 	}
 }
+
+// WithAuditLogger returns an option that sets a secondary logger to which
+// security-relevant events are also written, i.e., config param changes,
+// reboots, shutdowns, upgrades, service rejections and mode changes.
+func WithAuditLogger(l Logger) Option {
+	return func(s *Sender) error {
+		s.audit = l
+		return nil
+	}
+}
+
+// WithBuildVersion returns an option that sets the build version of the
+// running client, which is reported on pin T5 when T5 is an input. Unlike
+// the cv config param, this is the version actually running.
+func WithBuildVersion(v string) Option {
+	return func(s *Sender) error {
+		s.build = v
+		return nil
+	}
+}
+
+// WithMaxPeriod returns an option that sets the maximum monitor period (mp)
+// and act period (ap) in seconds. Larger periods are clamped to this value.
+func WithMaxPeriod(secs int) Option {
+	return func(s *Sender) error {
+		if secs < 1 {
+			return fmt.Errorf("invalid max period: %d", secs)
+		}
+		s.maxPeriod = secs
+		return nil
+	}
+}
+
+// WithMACValidation returns an option that checks that the ma config param
+// is a valid MAC address when the config is read. If strict is true, ma must
+// also match the hardware address of one of the device's network interfaces.
+// Without this option, a malformed ma param is accepted, as it always was.
+func WithMACValidation(strict bool) Option {
+	return func(s *Sender) error {
+		s.checkMAC = true
+		s.strictMAC = strict
+		return nil
+	}
+}
+
+// WithConfigOrder returns an option that sets the order in which config
+// params are written to the config file. Params not listed are written
+// after those listed, in string sort order.
+func WithConfigOrder(params ...string) Option {
+	return func(s *Sender) error {
+		s.order = params
+		return nil
+	}
+}
+
+// WithReadTimeout returns an option that sets the maximum time a pin read may
+// take during Run. A read that times out is logged and the pin is reported as
+// having no data, so that a hung sensor does not stop the client. By default
+// there is no timeout.
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Sender) error {
+		if d < 0 {
+			return fmt.Errorf("invalid read timeout: %v", d)
+		}
+		s.readTimeout = d
+		return nil
+	}
+}
+
+// WithPinReadTimeouts returns an option that sets the maximum time reads
+// of the named pins may take during Run, overriding any timeout set by
+// WithReadTimeout, e.g., to allow a slow sensor longer than the others.
+// A timeout of zero means no timeout for that pin.
+func WithPinReadTimeouts(timeouts map[string]time.Duration) Option {
+	return func(s *Sender) error {
+		for name, d := range timeouts {
+			if d < 0 {
+				return fmt.Errorf("invalid read timeout for pin %s: %v", name, d)
+			}
+		}
+		if s.pinTimeouts == nil {
+			s.pinTimeouts = make(map[string]time.Duration)
+		}
+		for name, d := range timeouts {
+			s.pinTimeouts[name] = d
+		}
+		return nil
+	}
+}
+
+// WithConcurrentReads returns an option that reads input pins concurrently
+// during Run, rather than one after another, so that a slow sensor does
+// not delay the reads of the others. The pin read function must then be
+// safe to call concurrently, e.g., by serializing reads of pins which
+// share a bus. Timed out reads are reported as having no data (see
+// WithReadTimeout), so do not delay the poll.
+func WithConcurrentReads() Option {
+	return func(s *Sender) error {
+		s.concurrent = true
+		return nil
+	}
+}
+
+// WithStrictConfig returns an option that requires the given config params to
+// be present in the config file, in addition to ma and dk, so that a
+// misconfigured client fails at startup rather than silently using defaults.
+func WithStrictConfig(params ...string) Option {
+	return func(s *Sender) error {
+		s.required = params
+		return nil
+	}
+}
+
+// WithStrictOutputs returns an option that causes Run to fail if the value
+// for any output pin is missing from the service reply or cannot be decoded.
+// By default such pins are logged and skipped, and other output pins are
+// still written.
+func WithStrictOutputs() Option {
+	return func(s *Sender) error {
+		s.strictOutputs = true
+		return nil
+	}
+}
+
+// WithUpgradeHandler returns an option that sets a function to be called when
+// an upgrade finishes, with success true if the upgrade succeeded and otherwise
+// the error. The handler may call Sender methods.
+func WithUpgradeHandler(h func(success bool, err error)) Option {
+	return func(s *Sender) error {
+		s.upgradeHandler = h
+		return nil
+	}
+}
+
+// WithMaxResponseSize returns an option that sets the maximum size in bytes of
+// a service response body. Larger responses are rejected with an error.
+func WithMaxResponseSize(n int64) Option {
+	return func(s *Sender) error {
+		if n < 1 {
+			return fmt.Errorf("invalid max response size: %d", n)
+		}
+		s.maxReply = n
+		return nil
+	}
+}
+
+// WithQuietHours returns an option that sets a daily quiet hours schedule of
+// the form "HH:MM-HH:MM" (see ParseQuietHours), during which Run polls at most
+// once per heartbeat period in order to save power. Config requests are not
+// affected. The schedule may be changed by the quietHours var, and reverts to
+// this schedule if the var is deleted. A heartbeat of zero means the default
+// of one hour.
+func WithQuietHours(schedule string, heartbeat time.Duration) Option {
+	return func(s *Sender) error {
+		qh, err := ParseQuietHours(schedule)
+		if err != nil {
+			return err
+		}
+		if heartbeat < 0 {
+			return fmt.Errorf("invalid heartbeat: %v", heartbeat)
+		}
+		s.quiet, s.quietDefault = qh, qh
+		s.heartbeat = heartbeat
+		return nil
+	}
+}
+
+// WithTLS returns an option that makes service requests, including speed
+// tests, use HTTPS rather than HTTP. If config is non-nil it is used for
+// TLS connections, e.g., to trust a private CA, otherwise the system
+// defaults apply. A service host in the sh param may also specify its
+// scheme explicitly, e.g., default=https://data.cloudblue.org.
+// WithTLS must precede options which wrap the transport, such as
+// WithFaultInjection, when config is non-nil.
+func WithTLS(config *tls.Config) Option {
+	return func(s *Sender) error {
+		if config != nil {
+			if s.roundTripper != nil {
+				return errors.New("cannot apply TLS config to custom transport")
+			}
+			t := newTransport()
+			t.TLSClientConfig = config
+			s.roundTripper = t
+		}
+		s.tls = true
+		return nil
+	}
+}
+
+// WithHTTPClient returns an option that makes HTTP service requests,
+// including Ping, speed tests and watch requests, use a copy of c, e.g.,
+// to set a proxy, cookie jar or connection limits. If c has a Transport,
+// it replaces the default transport, in which case WithHTTPClient must
+// precede options which wrap the transport, such as WithFaultInjection,
+// and cannot be combined with a WithTLS config. If c has no timeout,
+// Timeout applies.
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *Sender) error {
+		if c == nil {
+			return errors.New("nil HTTP client")
+		}
+		if c.Transport != nil {
+			if s.roundTripper != nil {
+				return errors.New("cannot replace custom transport")
+			}
+			s.roundTripper = c.Transport
+		}
+		s.client = c
+		return nil
+	}
+}
+
+// WithTransport returns an option that replaces the HTTP transport used for
+// service requests made by Send with t. HTTP specific options, such as
+// WithTLS and WithMaxResponseSize, and HTTP only requests, such as Ping and
+// the speed tests, are not affected.
+func WithTransport(t Transport) Option {
+	return func(s *Sender) error {
+		if t == nil {
+			return errors.New("nil transport")
+		}
+		s.transport = t
+		return nil
+	}
+}
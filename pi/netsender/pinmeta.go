@@ -0,0 +1,91 @@
+/*
+NAME
+  pinmeta.go provides pin metadata, i.e., units, scale factors and
+  descriptions, which are sent to the service so that it can render pin
+  values correctly without per-device knowledge.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// PinMeta describes the values of a pin for the service.
+type PinMeta struct {
+	Units       string  `json:"units,omitempty"` // Units of the scaled value, e.g., "µS/cm" or "dB".
+	Scale       float64 `json:"scale,omitempty"` // Factor by which values are multiplied before sending, e.g., 1000, or zero for 1.
+	Description string  `json:"desc,omitempty"`  // Human-readable description.
+}
+
+// WithPinMetadata returns an option that sends metadata for the named
+// pins, e.g., "X24", to the service in the config request, in the same
+// way as var types (see WithVarTypes). Since pin values are integers,
+// fractional readings are conventionally multiplied by a scale factor
+// before sending, e.g., 1000, and the service divides values by Scale
+// to recover the reading in Units. Metadata is merged with any set by
+// previous WithPinMetadata options.
+func WithPinMetadata(meta map[string]PinMeta) Option {
+	return func(s *Sender) error {
+		for name, m := range meta {
+			if !pinName.MatchString(name) {
+				return fmt.Errorf("invalid pin metadata: invalid pin name: %q", name)
+			}
+			if m.Scale < 0 || math.IsNaN(m.Scale) || math.IsInf(m.Scale, 0) {
+				return fmt.Errorf("invalid pin metadata: pin %s has invalid scale: %v", name, m.Scale)
+			}
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.pinMeta == nil {
+			s.pinMeta = make(map[string]PinMeta)
+		}
+		for name, m := range meta {
+			s.pinMeta[name] = m
+		}
+		return s.setConfigPins()
+	}
+}
+
+// setConfigPins sets the pins sent in the config request, namely the var
+// types (vt), pin metadata (pm), if any, and local address (la).
+// s.mu must be held.
+func (s *Sender) setConfigPins() error {
+	var pins []Pin
+	if s.varTypes != nil {
+		b, err := json.Marshal(s.varTypes)
+		if err != nil {
+			return fmt.Errorf("could not marshal var type map: %w", err)
+		}
+		pins = append(pins, Pin{Name: "vt", Value: len(b), Data: b, MimeType: "application/json"})
+	}
+	if s.pinMeta != nil {
+		b, err := json.Marshal(s.pinMeta)
+		if err != nil {
+			return fmt.Errorf("could not marshal pin metadata: %w", err)
+		}
+		pins = append(pins, Pin{Name: "pm", Value: len(b), Data: b, MimeType: "application/json"})
+	}
+	la := localAddr()
+	s.configPins = append(pins, Pin{Name: "la", Value: len(la), Data: []byte(la)})
+	return nil
+}
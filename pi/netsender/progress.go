@@ -0,0 +1,126 @@
+/*
+NAME
+  progress.go provides upgrade progress reporting, so that the service can
+  distinguish an upgrade in progress from one which has hung.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Upgrade progress pins, which report the stage of any upgrade in
+// progress when included in the inputs.
+const (
+	upgradeStagePin    = "X97" // Upgrade stage (see UpgradeStage).
+	upgradeStageAgePin = "X98" // Seconds since the upgrade stage began, or -1 if not upgrading.
+)
+
+// UpgradeStage is a stage of an upgrade.
+type UpgradeStage int
+
+// Upgrade stages, in order. An upgrade which is not verified (see
+// WithUpgradeVerification) goes straight to installing, and only a
+// self-update (see WithSelfUpdate) restarts the client itself.
+const (
+	UpgradeIdle        UpgradeStage = iota // Not upgrading.
+	UpgradeDownloading                     // Downloading the manifest or artifacts.
+	UpgradeVerifying                       // Verifying the manifest signature.
+	UpgradeInstalling                      // Installing, e.g., running the upgrader.
+	UpgradeRestarting                      // Restarting into the new version.
+)
+
+// String returns the name of the stage.
+func (s UpgradeStage) String() string {
+	switch s {
+	case UpgradeIdle:
+		return "idle"
+	case UpgradeDownloading:
+		return "downloading"
+	case UpgradeVerifying:
+		return "verifying"
+	case UpgradeInstalling:
+		return "installing"
+	case UpgradeRestarting:
+		return "restarting"
+	default:
+		return "unknown"
+	}
+}
+
+// UpgradeProgress returns the current upgrade stage and the time since it
+// began, or UpgradeIdle and zero if not upgrading.
+func (ns *Sender) UpgradeProgress() (UpgradeStage, time.Duration) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.upgradeStage == UpgradeIdle {
+		return UpgradeIdle, 0
+	}
+	return ns.upgradeStage, time.Since(ns.upgradeStageAt)
+}
+
+// setUpgradeStage sets the upgrade stage and, if the upgrade stage pin is
+// an input, reports it to the service immediately rather than waiting
+// for the next poll, since an upgrade may restart the client before then.
+func (ns *Sender) setUpgradeStage(stage UpgradeStage) {
+	ns.mu.Lock()
+	if stage == ns.upgradeStage {
+		ns.mu.Unlock()
+		return
+	}
+	ns.upgradeStage = stage
+	ns.upgradeStageAt = time.Now()
+	ns.mu.Unlock()
+	ns.logger.Log(InfoLevel, infoUpgradeStage, "stage", stage.String())
+
+	var pins []Pin
+	for _, name := range strings.Split(ns.Param("ip"), ",") {
+		if name == upgradeStagePin || name == upgradeStageAgePin {
+			pin := Pin{Name: name}
+			ns.upgradePin(&pin)
+			pins = append(pins, pin)
+		}
+	}
+	if len(pins) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	_, _, err := ns.SendContext(ctx, RequestPoll, pins)
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnUpgradeStage, "error", err.Error())
+	}
+}
+
+// upgradePin sets the value of an upgrade progress pin.
+func (ns *Sender) upgradePin(pin *Pin) {
+	stage, age := ns.UpgradeProgress()
+	switch pin.Name {
+	case upgradeStagePin:
+		pin.Value = int(stage)
+	case upgradeStageAgePin:
+		pin.Value = -1
+		if stage != UpgradeIdle {
+			pin.Value = int(age.Seconds())
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+NAME
+  provision.go provides first-boot provisioning, in which a device without
+  a device key registers with the service to obtain one.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// registerPath is the path of registration requests.
+const registerPath = "/register"
+
+// ErrNotProvisioned is returned, wrapped, by Run when the device key has
+// not yet been obtained by provisioning (see WithProvisioning).
+var ErrNotProvisioned = errors.New("device key not provisioned")
+
+// WithProvisioning returns an option that allows the dk config param to
+// be absent, for zero-touch deployment. If dk is absent or empty, Run
+// registers the device with the service before doing anything else,
+// using its MAC address and the enrollment token, if any, and writes the
+// device key in the reply to the config file. Until registration
+// succeeds, Run returns an error wrapping ErrNotProvisioned.
+//
+// The registration request is
+//
+//	/register?vn=<version>&ma=<MAC address>&tk=<token>
+//
+// to which the service replies with {"dk":"<device key>"}, or an er
+// param if registration is refused, e.g., for an unknown token.
+func WithProvisioning(token string) Option {
+	return func(s *Sender) error {
+		s.provision = true
+		s.enrollToken = token
+		return nil
+	}
+}
+
+// needsProvisioning returns true if provisioning is enabled and the
+// device key has not yet been obtained.
+func (ns *Sender) needsProvisioning() bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.provision && ns.config["dk"] == ""
+}
+
+// register obtains a device key from the service and writes it to the
+// config file.
+func (ns *Sender) register(ctx context.Context) error {
+	ns.mu.Lock()
+	token := ns.enrollToken
+	ns.mu.Unlock()
+
+	path := fmt.Sprintf("%s?vn=%d&ma=%s", registerPath, version, ns.Param("ma"))
+	if token != "" {
+		path += "&tk=" + url.QueryEscape(token)
+	}
+	host := ns.serviceHost("default")
+	reply, err := ns.requestTransport(host).Request(ctx, host, path, nil)
+	if err != nil {
+		return fmt.Errorf("%w: registration failed: %w", ErrNotProvisioned, err)
+	}
+	if !strings.HasPrefix(reply, "{") {
+		return fmt.Errorf("%w: expected JSON registration reply", ErrNotProvisioned)
+	}
+	dec, err := NewJSONDecoder(reply)
+	if err != nil {
+		return fmt.Errorf("%w: could not decode registration reply: %w", ErrNotProvisioned, err)
+	}
+	if er, err := dec.String("er"); err == nil {
+		return fmt.Errorf("%w: registration refused: %w", ErrNotProvisioned, &ServerError{er: er})
+	}
+	dk, err := dec.String("dk")
+	if err != nil {
+		n, ierr := dec.Int("dk")
+		if ierr != nil {
+			return fmt.Errorf("%w: dk missing from registration reply", ErrNotProvisioned)
+		}
+		dk = strconv.Itoa(n)
+	}
+	err = validateParam("dk", dk)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNotProvisioned, err)
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.config["dk"] = dk
+	ns.auditLog(InfoLevel, infoProvisioned, "ma", ns.config["ma"])
+	err = ns.writeConfig(ns.config)
+	if err != nil {
+		ns.logger.Log(ErrorLevel, errorConfigWrite, "error", err.Error())
+	}
+	return nil
+}
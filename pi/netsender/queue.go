@@ -0,0 +1,332 @@
+/*
+NAME
+  queue.go provides a disk-backed store-and-forward queue for poll pin
+  data, so that readings taken while offline are not lost.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queueDrainBatch is the maximum number of queued polls sent per Run, so
+// that draining a long outage does not delay the current poll cycle.
+const queueDrainBatch = 100
+
+// queueBatchSize is the maximum number of queued polls sent per request.
+const queueBatchSize = 20
+
+// queueExt is the file extension of queued poll files.
+const queueExt = ".poll"
+
+// queue implements a bounded, disk-backed FIFO of poll pins. Each entry
+// is stored in its own file, named by its enqueue time and the request ID
+// of the failed poll, so the queue survives restarts and a queued poll is
+// sent with the ID of the poll that failed. When the total size exceeds
+// the maximum, the oldest entries are dropped.
+type queue struct {
+	mu     sync.Mutex
+	dir    string
+	max    int64
+	last   int64 // Most recent entry time, to keep names unique and ordered.
+	failed int   // Size of the last batch that failed, which is retried as is.
+}
+
+// newQueue returns a queue stored in dir, which is created if necessary.
+func newQueue(dir string, max int64) (*queue, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create queue directory: %w", err)
+	}
+	return &queue{dir: dir, max: max}, nil
+}
+
+// push adds pins with valid data, which were sent by the request with the
+// given ID, to the queue, stamping pins without a timestamp with the
+// current time, and drops the oldest entries if the queue is full.
+func (q *queue) push(id string, pins []Pin) error {
+	now := time.Now()
+	var stamped []Pin
+	for _, pin := range pins {
+		// Data read from a DataReader has been consumed, so is not queued.
+		if !hasValidData(pin) || pin.DataReader != nil {
+			continue
+		}
+		if pin.Timestamp.IsZero() {
+			pin.Timestamp = now
+		}
+		stamped = append(stamped, pin)
+	}
+	if len(stamped) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(stamped)
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) > q.max {
+		return errors.New("poll too large for queue")
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	name := now.UnixNano()
+	if name <= q.last {
+		name = q.last + 1
+	}
+	q.last = name
+	err = os.WriteFile(filepath.Join(q.dir, strconv.FormatInt(name, 10)+"-"+id+queueExt), b, 0644)
+	if err != nil {
+		return err
+	}
+
+	entries, size, err := q.list()
+	if err != nil {
+		return err
+	}
+	for i := 0; size > q.max && i < len(entries); i++ {
+		fi, err := os.Stat(entries[i])
+		if err != nil {
+			continue
+		}
+		if os.Remove(entries[i]) == nil {
+			size -= fi.Size()
+		}
+	}
+	return nil
+}
+
+// list returns the queued entry files, oldest first, and their total size.
+// Entries queued by earlier versions, without an ID, are oldest, since
+// their names are shorter. q.mu must be held.
+func (q *queue) list() ([]string, int64, error) {
+	entries, err := filepath.Glob(filepath.Join(q.dir, "*"+queueExt))
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := filepath.Base(entries[i]), filepath.Base(entries[j])
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+	var size int64
+	for _, e := range entries {
+		fi, err := os.Stat(e)
+		if err == nil {
+			size += fi.Size()
+		}
+	}
+	return entries, size, nil
+}
+
+// entryID returns the request ID of the poll queued in the named file.
+// Entries without an ID, queued by earlier versions, are identified by
+// their time.
+func entryID(name string) string {
+	name = strings.TrimSuffix(filepath.Base(name), queueExt)
+	if _, id, ok := strings.Cut(name, "-"); ok {
+		return id
+	}
+	return "q" + name
+}
+
+// len returns the number of queued entries.
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries, _, _ := q.list()
+	return len(entries)
+}
+
+// drain sends up to n queued polls, or all if n is zero, oldest first,
+// stopping at the first failure. Polls without binary data are sent in
+// batches of up to queueBatchSize (see SendBatchContext), and a batch
+// which fails is retried as is, with the same request ID. Entries which
+// cannot be decoded are discarded. It returns the number of polls sent.
+func (q *queue) drain(ctx context.Context, ns *Sender, n int) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries, _, err := q.list()
+	if err != nil {
+		return 0, err
+	}
+	if n != 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+
+	var sent int
+	var batch [][]Pin
+	var files, ids []string
+	size := queueBatchSize
+	if q.failed != 0 {
+		size = q.failed
+	}
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, _, err := ns.SendBatchContext(ctx, batch, WithRequestID(batchRequestID(ids)))
+		if err != nil {
+			q.failed = len(batch)
+			return err
+		}
+		q.failed = 0
+		size = queueBatchSize
+		for _, f := range files {
+			os.Remove(f)
+		}
+		sent += len(batch)
+		batch, files, ids = nil, nil, nil
+		return nil
+	}
+
+	for _, e := range entries {
+		b, err := os.ReadFile(e)
+		if err != nil {
+			return sent, err
+		}
+		var pins []Pin
+		err = json.Unmarshal(b, &pins)
+		if err != nil {
+			ns.logger.Log(WarningLevel, warnQueueDecode, "file", e, "error", err.Error())
+			os.Remove(e)
+			continue
+		}
+
+		if !hasMimeType(pins) {
+			batch = append(batch, pins)
+			files = append(files, e)
+			ids = append(ids, entryID(e))
+			if len(batch) == size {
+				err = send()
+				if err != nil {
+					return sent, err
+				}
+			}
+			continue
+		}
+
+		// Polls with binary data are sent individually, in order.
+		err = send()
+		if err != nil {
+			return sent, err
+		}
+		_, _, err = ns.SendContext(ctx, RequestPoll, pins, WithRequestID(entryID(e)))
+		if err != nil {
+			return sent, err
+		}
+		os.Remove(e)
+		sent++
+	}
+	return sent, send()
+}
+
+// hasMimeType returns true if any of the pins has a MIME type.
+func hasMimeType(pins []Pin) bool {
+	for _, pin := range pins {
+		if pin.MimeType != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// WithOfflineQueue returns an option that queues the pins of polls which
+// fail to reach the service in dir, and sends them, with their original
+// timestamps, once the service is reachable again. At most maxSize bytes
+// are queued, beyond which the oldest polls are dropped. Polls rejected
+// by the service are not queued. Queued polls are also sent by FlushAll.
+func WithOfflineQueue(dir string, maxSize int64) Option {
+	return func(s *Sender) error {
+		if maxSize < 1 {
+			return fmt.Errorf("invalid max queue size: %d", maxSize)
+		}
+		q, err := newQueue(dir, maxSize)
+		if err != nil {
+			return err
+		}
+		s.queue = q
+		s.flushers = append(s.flushers, flusher{name: "offline queue", flush: func(ctx context.Context, ns *Sender) (int, error) {
+			return q.drain(ctx, ns, 0)
+		}})
+		return nil
+	}
+}
+
+// QueuedPolls returns the number of polls in the offline queue, or zero if
+// there is no offline queue.
+func (ns *Sender) QueuedPolls() int {
+	ns.mu.Lock()
+	q := ns.queue
+	ns.mu.Unlock()
+	if q == nil {
+		return 0
+	}
+	return q.len()
+}
+
+// enqueuePoll queues the pins of the poll with the given request ID which
+// failed with err, if there is an offline queue and the failure was not a
+// service error.
+func (ns *Sender) enqueuePoll(id string, pins []Pin, err error) {
+	ns.mu.Lock()
+	q := ns.queue
+	ns.mu.Unlock()
+	var se *ServerError
+	if q == nil || errors.As(err, &se) {
+		return
+	}
+	qerr := q.push(id, pins)
+	if qerr != nil {
+		ns.logger.Log(WarningLevel, warnQueueWrite, "error", qerr.Error())
+		return
+	}
+	ns.logger.Log(DebugLevel, debugQueuedPoll)
+}
+
+// drainQueue sends a batch of queued polls, if there is an offline queue.
+func (ns *Sender) drainQueue(ctx context.Context) {
+	ns.mu.Lock()
+	q := ns.queue
+	ns.mu.Unlock()
+	if q == nil {
+		return
+	}
+	n, err := q.drain(ctx, ns, queueDrainBatch)
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnQueueDrain, "sent", n, "error", err.Error())
+		return
+	}
+	if n != 0 {
+		ns.logger.Log(InfoLevel, infoQueueDrained, "sent", n)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+NAME
+  quiet.go provides a quiet hours schedule, during which netsender
+  clients suppress routine sends to save power.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// quietHoursVar is the var which sets the quiet hours schedule.
+const quietHoursVar = "quietHours"
+
+// defaultHeartbeat is the default period between polls during quiet hours.
+const defaultHeartbeat = time.Hour
+
+// QuietHours is a daily schedule, in device local time, during which
+// routine polls are reduced to a periodic heartbeat. If End is before
+// Start the schedule spans midnight. The zero value has no quiet hours.
+type QuietHours struct {
+	Start time.Duration // Offset of the start from midnight.
+	End   time.Duration // Offset of the end from midnight.
+}
+
+// ParseQuietHours parses a quiet hours schedule of the form
+// "HH:MM-HH:MM", e.g., "22:00-06:00". An empty string means no quiet hours.
+func ParseQuietHours(s string) (QuietHours, error) {
+	if s == "" {
+		return QuietHours{}, nil
+	}
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return QuietHours{}, errors.New("invalid quiet hours: " + s)
+	}
+	var qh QuietHours
+	for _, v := range []struct {
+		s string
+		d *time.Duration
+	}{{start, &qh.Start}, {end, &qh.End}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(v.s))
+		if err != nil {
+			return QuietHours{}, errors.New("invalid quiet hours: " + s)
+		}
+		*v.d = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return qh, nil
+}
+
+// Contains returns true if t is within the quiet hours.
+func (qh QuietHours) Contains(t time.Time) bool {
+	if qh.Start == qh.End {
+		return false
+	}
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if qh.Start < qh.End {
+		return d >= qh.Start && d < qh.End
+	}
+	return d >= qh.Start || d < qh.End
+}
+
+// QuietHoursActive returns true if quiet hours are currently in effect.
+// NB: The device clock may be inaccurate if the device is not networked.
+func (ns *Sender) QuietHoursActive() bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.quiet.Contains(time.Now())
+}
+
+// setQuietHours sets the quiet hours from the quiet hours var. If the var
+// is absent, the schedule reverts to that set by WithQuietHours, if any,
+// else there are no quiet hours.
+func (ns *Sender) setQuietHours(vars map[string]string) {
+	v, present := vars[quietHoursVar]
+	if !present {
+		ns.mu.Lock()
+		ns.quiet = ns.quietDefault
+		ns.mu.Unlock()
+		return
+	}
+	qh, err := ParseQuietHours(v)
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnQuietHours, "error", err.Error())
+		return
+	}
+	ns.mu.Lock()
+	ns.quiet = qh
+	ns.mu.Unlock()
+}
+
+// suppressPoll returns true if a routine poll should be suppressed
+// because it is quiet hours and a heartbeat poll is not yet due.
+func (ns *Sender) suppressPoll() bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	now := time.Now()
+	if !ns.quiet.Contains(now) {
+		return false
+	}
+	hb := ns.heartbeat
+	if hb == 0 {
+		hb = defaultHeartbeat
+	}
+	if !ns.lastBeat.IsZero() && now.Sub(ns.lastBeat) < hb {
+		return true
+	}
+	ns.lastBeat = now
+	return false
+}
@@ -0,0 +1,163 @@
+/*
+NAME
+  reload.go provides config hot-reloading, so that changes made to the
+  config file in the field take effect without restarting the client.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"time"
+
+	"github.com/ausocean/utils/sliceutils"
+)
+
+// defaultReloadInterval is the default interval between config file checks.
+const defaultReloadInterval = 5 * time.Second
+
+// WatchConfig checks the config for changes every interval until ctx is
+// done, or the Sender is closed, then returns the context error. Changed
+// params are applied with ReloadConfig. For config files, changes are
+// detected by polling the file's modification time and size, otherwise
+// the config store is read each interval. An interval of zero means the
+// default of 5 seconds.
+//
+// WatchConfig is intended to be called in its own goroutine alongside the
+// usual Run loop.
+func (ns *Sender) WatchConfig(ctx context.Context, interval time.Duration) error {
+	ctx, cancel := ns.bindLifetime(ctx)
+	defer cancel()
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	last := ns.configVersion()
+	for {
+		sleepContext(ctx, interval)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		v := ns.configVersion()
+		if v != "" && v == last {
+			continue
+		}
+		last = v
+		_, err := ns.ReloadConfig()
+		if err != nil {
+			ns.logger.Log(WarningLevel, warnConfigReload, "error", err.Error())
+		}
+	}
+}
+
+// configVersion returns a string which changes when the config file
+// changes, or the empty string if the config is not stored in a file or
+// the file cannot be read.
+func (ns *Sender) configVersion() string {
+	ns.mu.Lock()
+	fs, ok := ns.configStore().(*fileStore)
+	ns.mu.Unlock()
+	if !ok {
+		return ""
+	}
+	fi, err := os.Stat(fs.path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// ReloadConfig re-reads the config and applies any params which differ
+// from the current config, including params which have been removed,
+// returning the names of the changed params. The new config is validated
+// in full before any param is applied, so an invalid config leaves the
+// current config unchanged. Pins are re-initialized if ip or op change,
+// service hosts are updated if sh changes, the client certificate is
+// reloaded if cc or ck change, or no longer used if cc is removed, and
+// WiFi is configured if wi changes (see WithWiFi).
+func (ns *Sender) ReloadConfig() ([]string, error) {
+	config, err := ns.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	services, err := configServices(config["sh"])
+	if err != nil {
+		return nil, err
+	}
+
+	// Diff against all previous params, so that removed params are detected.
+	ns.mu.Lock()
+	all := maps.Clone(config)
+	for name, val := range ns.config {
+		if _, ok := all[name]; !ok {
+			all[name] = val
+		}
+	}
+	var changed []string
+	for _, name := range ns.configOrder(all) {
+		if ns.config[name] != config[name] {
+			changed = append(changed, name)
+		}
+	}
+	ns.mu.Unlock()
+	if len(changed) == 0 {
+		return nil, nil
+	}
+
+	if sliceutils.ContainsString(changed, "cc") || sliceutils.ContainsString(changed, "ck") {
+		if config["cc"] == "" {
+			ns.clearClientCert()
+		} else {
+			err = ns.setClientCert(config["cc"], config["ck"])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ns.mu.Lock()
+	if ns.config == nil {
+		ns.config = make(map[string]string)
+	}
+	for _, name := range changed {
+		val, ok := config[name]
+		if ok {
+			ns.config[name] = val
+		} else {
+			delete(ns.config, name)
+		}
+		ns.auditLog(InfoLevel, infoConfigParamChange, "name", name, "value", Redact(name, val))
+	}
+	ns.services = services
+	ns.mu.Unlock()
+
+	if sliceutils.ContainsString(changed, "wi") {
+		ns.applyWiFi()
+	}
+	if sliceutils.ContainsString(changed, "ip") || sliceutils.ContainsString(changed, "op") {
+		err = ns.initPins()
+		if err != nil {
+			return changed, fmt.Errorf("could not initialize pins: %w", err)
+		}
+	}
+	ns.logger.Log(InfoLevel, infoConfigReloaded, "changed", changed)
+	return changed, nil
+}
@@ -0,0 +1,143 @@
+/*
+NAME
+  requestid.go provides request IDs, so that the service can recognise
+  retried requests which it has already processed as duplicates.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// headerRequestID is the HTTP header which carries the request ID.
+//
+// Every request has an ID, which is unique unless the request is a retry
+// of an earlier request which failed without a service error. Since such
+// a request may have been processed by the service despite the failure,
+// e.g., if the reply timed out, the service should discard a request with
+// an ID it has already processed. A request is a retry only if its sender
+// says so, by passing the earlier request's ID with WithRequestID. The
+// offline queue does so when it sends a queued poll (see
+// WithOfflineQueue), and netlogger when it resends logs.
+const headerRequestID = "X-Netsender-Request-Id"
+
+// retryWindow is how long a failed request's ID is remembered, so that
+// retries with the same ID are counted (see retriesPin).
+const retryWindow = 10 * time.Minute
+
+// requestIDKey is the context key for request IDs.
+type requestIDKey struct{}
+
+// RequestID returns the request ID of a service request from the context
+// passed to Transport.Request, or the empty string if there is none.
+// Custom transports should forward the ID to the service.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a new random request ID.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithRequestID sets the request ID of a single Send call to id, which
+// should be the ID of an earlier request with the same pins if this is a
+// retry of it, or else a new ID (see NewRequestID). The caller must
+// ensure that different requests have different IDs, since the service
+// may discard a request with the ID of one it has already processed.
+// Requests with DataReader pins always have a new ID, since their data,
+// e.g., fixed-size video chunks, cannot be known to be the same as that
+// of an earlier request.
+func WithRequestID(id string) SendOption {
+	return callOption(func(so *sendOptions) error {
+		if id == "" {
+			return errors.New("empty request ID")
+		}
+		so.id = id
+		return nil
+	})
+}
+
+// batchRequestID returns the request ID for a batch of requests with the
+// given IDs, which is the same whenever the same requests are batched.
+func batchRequestID(ids []string) string {
+	if len(ids) == 1 {
+		return ids[0]
+	}
+	h := sha256.New()
+	for _, id := range ids {
+		h.Write([]byte(id + "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// hasDataReader returns true if any of the pins has a DataReader.
+func hasDataReader(pins []Pin) bool {
+	for _, pin := range pins {
+		if pin.DataReader != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// requestID returns the ID for a request, which is id if not empty, else
+// a new random ID. Retries of failed requests are counted.
+func (ns *Sender) requestID(id string) string {
+	if id == "" {
+		return NewRequestID()
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if at, ok := ns.failed[id]; ok && time.Since(at) < retryWindow {
+		ns.metrics.retries++
+	}
+	return id
+}
+
+// ackRequest updates the failed request records once the request with
+// the given ID completes with err. Requests rejected by the service are
+// not retried, so are forgotten along with successful requests.
+func (ns *Sender) ackRequest(id string, err error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	var se *ServerError
+	if err == nil || errors.As(err, &se) {
+		delete(ns.failed, id)
+		return
+	}
+	if ns.failed == nil {
+		ns.failed = make(map[string]time.Time)
+	}
+	for k, at := range ns.failed {
+		if time.Since(at) >= retryWindow {
+			delete(ns.failed, k)
+		}
+	}
+	ns.failed[id] = time.Now()
+}
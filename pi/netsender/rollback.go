@@ -0,0 +1,321 @@
+/*
+NAME
+  rollback.go provides upgrade rollback, which reverts to the previous
+  version if an upgraded client fails to reach the service.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// errorUpgradeRolledBack is the client error set when an upgrade is
+// rolled back.
+const errorUpgradeRolledBack = "upgradeRolledBack"
+
+// maxUpgradeBoots is the number of times an upgraded client may start
+// without passing its health check before the upgrade is rolled back,
+// e.g., if it crashes soon after starting.
+const maxUpgradeBoots = 3
+
+// upgradeState records an upgrade awaiting its health check. It is
+// written to the rollback state file so that it survives the restart
+// into the new version.
+type upgradeState struct {
+	ClientType string `json:"ct"`         // Client type.
+	From       string `json:"from"`       // Version before the upgrade.
+	To         string `json:"to"`         // Version after the upgrade.
+	Boots      int    `json:"boots"`      // Number of starts since the upgrade.
+	RolledBack bool   `json:"rolledBack"` // True once rolled back, so that the previous version reports it.
+}
+
+// WithUpgradeRollback returns an option that rolls back an upgrade if the
+// upgraded client does not complete a successful config request and poll,
+// or act, request within window of the upgrade or of each restart, or if
+// it is restarted more than 3 times without doing so. Only time while the
+// service is reachable counts towards the window (see Ping), so that a
+// network outage does not roll back a healthy upgrade. An upgrade which
+// itself breaks the network is therefore only rolled back if it also
+// restarts. The upgrade is rolled back by calling the upgrader with the
+// previous version, which is the build version (see WithBuildVersion), if
+// any, else the cv param when the Sender was initialized. The error is
+// then set to upgradeRolledBack, which is also reported by the previous
+// version, if it supports rollback. The upgrade state is kept in
+// stateFile, which must be in persistent storage.
+//
+// Rollback cannot recover from a version which fails before the Sender is
+// initialized.
+func WithUpgradeRollback(stateFile string, window time.Duration) Option {
+	return func(s *Sender) error {
+		if stateFile == "" {
+			return errors.New("empty rollback state file")
+		}
+		if window <= 0 {
+			return fmt.Errorf("invalid rollback window: %v", window)
+		}
+		s.rollbackFile = stateFile
+		s.rollbackWindow = window
+		return nil
+	}
+}
+
+// readUpgradeState reads the upgrade state, returning nil if there is
+// none.
+func (ns *Sender) readUpgradeState() (*upgradeState, error) {
+	b, err := os.ReadFile(ns.rollbackFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st upgradeState
+	err = json.Unmarshal(b, &st)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upgrade state: %w", err)
+	}
+	return &st, nil
+}
+
+// writeUpgradeState writes the upgrade state, or removes it if st is nil.
+func (ns *Sender) writeUpgradeState(st *upgradeState) error {
+	if st == nil {
+		err := os.Remove(ns.rollbackFile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := ns.rollbackFile + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, ns.rollbackFile)
+}
+
+// startHealthCheck starts the health check of an upgrade, if there is one
+// pending, when the Sender is initialized, or rolls it back if it has
+// restarted too many times. If the previous version was rolled back to,
+// the error is set to upgradeRolledBack.
+func (ns *Sender) startHealthCheck() {
+	ns.mu.Lock()
+	ns.installedCV = ns.config["cv"]
+	ns.mu.Unlock()
+	if ns.rollbackFile == "" {
+		return
+	}
+	st, err := ns.readUpgradeState()
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnUpgradeState, "error", err.Error())
+		ns.writeUpgradeState(nil)
+		return
+	}
+	switch {
+	case st == nil:
+		return
+	case st.RolledBack:
+		ns.auditLog(WarningLevel, warnRolledBack, "ct", st.ClientType, "from", st.To, "to", st.From)
+		ns.SetError(errorUpgradeRolledBack)
+		ns.writeUpgradeState(nil)
+		return
+	}
+
+	st.Boots++
+	if st.Boots > maxUpgradeBoots {
+		ns.upgrades.Add(1)
+		go func() {
+			defer ns.upgrades.Done()
+			ns.rollback(st)
+		}()
+		return
+	}
+	err = ns.writeUpgradeState(st)
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnUpgradeState, "error", err.Error())
+	}
+	ns.mu.Lock()
+	ns.healthChecked = time.Now()
+	ns.healthDeadline = ns.healthChecked.Add(ns.rollbackWindow)
+	ns.healthConfig, ns.healthPoll = false, false
+	ns.mu.Unlock()
+}
+
+// prepareRollback records an upgrade of client type ct to version cv, if
+// rollback is enabled, so that it can be rolled back.
+func (ns *Sender) prepareRollback(ct, cv string) {
+	if ns.rollbackFile == "" {
+		return
+	}
+	ns.mu.Lock()
+	from := ns.build
+	if from == "" {
+		from = ns.installedCV
+	}
+	ns.mu.Unlock()
+	if from == "" || from == cv {
+		ns.logger.Log(WarningLevel, warnNoRollback, "ct", ct, "cv", cv)
+		return
+	}
+	err := ns.writeUpgradeState(&upgradeState{ClientType: ct, From: from, To: cv})
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnUpgradeState, "error", err.Error())
+	}
+}
+
+// upgradeInstalled starts the health check of an upgrade which was
+// installed without restarting the client, or discards the upgrade state
+// if the upgrade failed.
+func (ns *Sender) upgradeInstalled(err error) {
+	if ns.rollbackFile == "" {
+		return
+	}
+	if err != nil {
+		ns.writeUpgradeState(nil)
+		return
+	}
+	ns.mu.Lock()
+	ns.healthChecked = time.Now()
+	ns.healthDeadline = ns.healthChecked.Add(ns.rollbackWindow)
+	ns.healthConfig, ns.healthPoll = false, false
+	ns.mu.Unlock()
+}
+
+// Health check results.
+const (
+	healthConfig = iota
+	healthPoll
+)
+
+// reportHealth records a successful config or poll request for the
+// health check of an upgrade, which passes once there have been both.
+func (ns *Sender) reportHealth(kind int) {
+	ns.mu.Lock()
+	if ns.healthDeadline.IsZero() {
+		ns.mu.Unlock()
+		return
+	}
+	switch kind {
+	case healthConfig:
+		ns.healthConfig = true
+	case healthPoll:
+		ns.healthPoll = true
+	}
+	passed := ns.healthConfig && ns.healthPoll
+	if passed {
+		ns.healthDeadline = time.Time{}
+	}
+	ns.mu.Unlock()
+	if !passed {
+		return
+	}
+	err := ns.writeUpgradeState(nil)
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnUpgradeState, "error", err.Error())
+	}
+	ns.auditLog(InfoLevel, infoUpgradeHealthy)
+}
+
+// checkHealth is called at the start of each Run during the health check
+// of an upgrade. If the service is unreachable, the deadline is extended
+// by the time since the last check, since the upgrade cannot be faulted
+// for the outage. Otherwise, it rolls back the upgrade once the deadline
+// has passed, and makes a config request if there has not yet been a
+// successful one.
+func (ns *Sender) checkHealth(ctx context.Context) {
+	ns.mu.Lock()
+	deadline := ns.healthDeadline
+	ns.mu.Unlock()
+	if deadline.IsZero() {
+		return
+	}
+	_, err := ns.Ping(ctx)
+	now := time.Now()
+	ns.mu.Lock()
+	if err != nil && !ns.healthDeadline.IsZero() {
+		ns.healthDeadline = ns.healthDeadline.Add(now.Sub(ns.healthChecked))
+	}
+	ns.healthChecked = now
+	deadline, configured := ns.healthDeadline, ns.healthConfig
+	ns.mu.Unlock()
+	switch {
+	case err != nil || deadline.IsZero():
+		return
+	case now.After(deadline):
+		st, err := ns.readUpgradeState()
+		if err != nil || st == nil {
+			ns.mu.Lock()
+			ns.healthDeadline = time.Time{}
+			ns.mu.Unlock()
+			return
+		}
+		ns.upgrades.Add(1)
+		go func() {
+			defer ns.upgrades.Done()
+			ns.rollback(st)
+		}()
+	case !configured:
+		ns.ConfigContext(ctx)
+	}
+}
+
+// rollback reinstalls the version before the upgrade described by st.
+func (ns *Sender) rollback(st *upgradeState) {
+	ns.mu.Lock()
+	if ns.upgrading {
+		ns.mu.Unlock()
+		return
+	}
+	ns.upgrading = true
+	ns.healthDeadline = time.Time{}
+	ns.mu.Unlock()
+	defer func() {
+		ns.setUpgradeStage(UpgradeIdle)
+		ns.mu.Lock()
+		ns.upgrading = false
+		ns.mu.Unlock()
+	}()
+
+	ns.auditLog(WarningLevel, warnRollingBack, "ct", st.ClientType, "from", st.To, "to", st.From, "boots", st.Boots)
+	st.RolledBack = true
+	err := ns.writeUpgradeState(st)
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnUpgradeState, "error", err.Error())
+	}
+	err = ns.install(st.ClientType, st.From)
+	if err != nil {
+		ns.auditLog(WarningLevel, warnUpgraderError, "upgrader", ns.upgrader, "ct", st.ClientType, "cv", st.From, "error", err.Error())
+		ns.writeUpgradeState(nil)
+		ns.SetError(errorUpgrade)
+		return
+	}
+	ns.auditLog(WarningLevel, warnRolledBack, "ct", st.ClientType, "from", st.To, "to", st.From)
+	ns.SetError(errorUpgradeRolledBack)
+	ns.restart()
+}
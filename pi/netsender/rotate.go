@@ -0,0 +1,130 @@
+/*
+NAME
+  rotate.go provides service-driven device key rotation.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// keyAckParams are the URL params of a key rotation acknowledgement,
+// which is a config request made with the new device key.
+const keyAckParams = "&ka=1"
+
+// maxKeyAcks is the number of failed acknowledgements of a new device key
+// after which the previous key is restored.
+const maxKeyAcks = 10
+
+// ErrKeyRejected is returned, wrapped, when the service rejects the
+// acknowledgement of a new device key with ErrInvalidDeviceKey, or the
+// acknowledgement fails maxKeyAcks times, in which case the previous
+// device key is restored.
+var ErrKeyRejected = errors.New("new device key rejected")
+
+// Device key rotation proceeds as follows:
+//
+//  1. The service sends a new dk in a config reply.
+//  2. The Sender writes the new key to the config file, along with the
+//     previous key as the pk param, in a single atomic write, and uses
+//     the new key for subsequent requests.
+//  3. The Sender acknowledges the new key with a config request, signed
+//     or authenticated with the new key, with the param ka=1.
+//  4. If the service accepts the acknowledgement, the rotation is
+//     complete and pk is cleared. If the service rejects the new key with
+//     ErrInvalidDeviceKey, the previous key is restored. If the
+//     acknowledgement fails otherwise, e.g., the network is down or the
+//     service returns another error, it is retried by Run, including
+//     after a restart, until it has failed maxKeyAcks times since the
+//     Sender started, after which the previous key is restored.
+
+// rotateKey switches to the device key dk and acknowledges it.
+func (ns *Sender) rotateKey(ctx context.Context, dk string) error {
+	ns.mu.Lock()
+	if ns.config["pk"] == "" {
+		ns.config["pk"] = ns.config["dk"]
+	}
+	ns.config["dk"] = dk
+	ns.keyAcks = 0
+	err := ns.writeConfig(ns.config)
+	ns.mu.Unlock()
+	if err != nil {
+		ns.logger.Log(ErrorLevel, errorConfigWrite, "error", err.Error())
+	}
+	ns.auditLog(InfoLevel, infoKeyRotating)
+	return ns.ackKey(ctx)
+}
+
+// keyPending returns true if a key rotation has not been acknowledged.
+func (ns *Sender) keyPending() bool {
+	return ns.Param("pk") != ""
+}
+
+// ackKey acknowledges a new device key, restoring the previous key if the
+// service rejects it or the acknowledgement has failed too often.
+func (ns *Sender) ackKey(ctx context.Context) error {
+	_, _, err := ns.SendContext(ctx, RequestConfig, ns.configPins, withParams(keyAckParams))
+	if err == nil {
+		ns.mu.Lock()
+		ns.config["pk"] = ""
+		ns.keyAcks = 0
+		werr := ns.writeConfig(ns.config)
+		ns.mu.Unlock()
+		if werr != nil {
+			ns.logger.Log(ErrorLevel, errorConfigWrite, "error", werr.Error())
+		}
+		ns.auditLog(InfoLevel, infoKeyRotated)
+		return nil
+	}
+
+	if errors.Is(err, ErrInvalidDeviceKey) {
+		ns.restoreKey()
+		ns.auditLog(WarningLevel, warnKeyRejected, "error", err.Error())
+		return fmt.Errorf("%w: %w", ErrKeyRejected, err)
+	}
+
+	ns.mu.Lock()
+	ns.keyAcks++
+	acks := ns.keyAcks
+	ns.mu.Unlock()
+	if acks >= maxKeyAcks {
+		ns.restoreKey()
+		ns.auditLog(WarningLevel, warnKeyUnacked, "error", err.Error(), "attempts", acks)
+		return fmt.Errorf("%w: %d failed acknowledgements: %w", ErrKeyRejected, acks, err)
+	}
+	return fmt.Errorf("could not acknowledge new device key: %w", err)
+}
+
+// restoreKey restores the previous device key, if any.
+func (ns *Sender) restoreKey() {
+	ns.mu.Lock()
+	if ns.config["pk"] != "" {
+		ns.config["dk"] = ns.config["pk"]
+		ns.config["pk"] = ""
+	}
+	ns.keyAcks = 0
+	err := ns.writeConfig(ns.config)
+	ns.mu.Unlock()
+	if err != nil {
+		ns.logger.Log(ErrorLevel, errorConfigWrite, "error", err.Error())
+	}
+}
@@ -0,0 +1,162 @@
+/*
+NAME
+  selfupdate.go provides self-updating, in which the client replaces its
+  own executable with a verified prebuilt binary and re-executes itself,
+  rather than calling an upgrader script.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// Self-update files, relative to the executable.
+const (
+	stagingDirSuffix = ".update" // Suffix of the directory to which binaries are downloaded.
+	prevSuffix       = ".prev"   // Suffix of the previous executable, kept for recovery.
+)
+
+// selfUpdateFlushTimeout is the time allowed for flushing buffered data
+// before re-executing.
+const selfUpdateFlushTimeout = 10 * time.Second
+
+// executable returns the path of the running executable. It is a variable
+// so that it may be replaced in tests.
+var executable = func() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// reexec replaces the running process with the executable at path. It is
+// a variable so that it may be replaced in tests.
+var reexec = func(path string) error {
+	return syscall.Exec(path, os.Args, os.Environ())
+}
+
+// WithSelfUpdate returns an option that upgrades the client by replacing
+// its own executable, rather than calling the upgrader script, which
+// requires no build tools on the device. The upgrade manifest for the ct
+// and cv params is fetched and verified as for WithUpgradeVerification,
+// with key, and must list a binary named <ct>-<GOOS>-<GOARCH>, e.g.,
+// rv-linux-arm, or else named <ct>. Once verified, the binary replaces
+// the executable atomically, the previous executable is kept with a .prev
+// suffix, and the client re-executes itself with the same arguments and
+// environment once the upgrade has been reported to the service.
+func WithSelfUpdate(key ed25519.PublicKey) Option {
+	return func(s *Sender) error {
+		if len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid upgrade verification key size: %d", len(key))
+		}
+		exe, err := executable()
+		if err != nil {
+			return fmt.Errorf("could not find executable: %w", err)
+		}
+		s.upgradeKey = key
+		s.upgradeDir = exe + stagingDirSuffix
+		s.selfUpdate = true
+		return nil
+	}
+}
+
+// binaryName returns the artifact name of the binary for client type ct
+// and the running platform.
+func binaryName(ct string) string {
+	return ct + "-" + runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// installBinary replaces the executable with the binary for client type
+// ct, which has been downloaded and verified in dir. The executable is
+// re-executed by the next call to restart.
+func (ns *Sender) installBinary(ct, dir string) error {
+	exe, err := executable()
+	if err != nil {
+		return fmt.Errorf("could not find executable: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, binaryName(ct))
+	if _, err := os.Stat(bin); err != nil {
+		bin = filepath.Join(dir, ct)
+		if _, err := os.Stat(bin); err != nil {
+			return fmt.Errorf("%w: no binary for %s in manifest", ErrUpgradeVerify, binaryName(ct))
+		}
+	}
+
+	mode := os.FileMode(0755)
+	if fi, err := os.Stat(exe); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	err = os.Chmod(bin, mode)
+	if err != nil {
+		return err
+	}
+
+	// Keep the previous executable by hard link, so that the executable
+	// path is never missing, then atomically replace it.
+	prev := exe + prevSuffix
+	os.Remove(prev)
+	err = os.Link(exe, prev)
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnKeepPrevious, "error", err.Error())
+	}
+	err = os.Rename(bin, exe)
+	if err != nil {
+		return fmt.Errorf("could not replace executable: %w", err)
+	}
+
+	ns.mu.Lock()
+	ns.restartPath = exe
+	ns.mu.Unlock()
+	return nil
+}
+
+// restart re-executes the client after a self-update, if any, first
+// flushing buffered data, since the process is replaced without exiting.
+func (ns *Sender) restart() {
+	ns.mu.Lock()
+	path := ns.restartPath
+	ns.restartPath = ""
+	ns.mu.Unlock()
+	if path == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfUpdateFlushTimeout)
+	defer cancel()
+	err := ns.FlushAll(ctx)
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnFlushError, "error", err.Error())
+	}
+	ns.setUpgradeStage(UpgradeRestarting)
+	ns.auditLog(InfoLevel, infoRestarting, "path", path)
+	err = reexec(path)
+	if err != nil {
+		ns.logger.Log(ErrorLevel, errorRestart, "error", err.Error())
+	}
+}
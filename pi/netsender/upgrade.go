@@ -0,0 +1,303 @@
+/*
+NAME
+  upgrade.go provides verification of upgrade artifacts against a signed
+  manifest before they are installed.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upgrade manifest paths and limits.
+const (
+	manifestPath        = "/api/upgrade/manifest"     // Path of upgrade manifests, with ct and cv params.
+	manifestSigPath     = "/api/upgrade/manifest.sig" // Path of manifest signatures, with ct and cv params.
+	maxManifestSize     = 1 << 20                     // Maximum manifest size in bytes.
+	upgradeFetchTimeout = 30 * time.Minute            // Time allowed for fetching the manifest and artifacts.
+	upgradeDirEnv       = "NETSENDER_UPGRADE_DIR"     // Environment variable passing the artifact directory to the upgrader.
+)
+
+// ErrUpgradeVerify is returned, wrapped, when an upgrade manifest or
+// artifact fails verification.
+var ErrUpgradeVerify = errors.New("upgrade verification failed")
+
+// UpgradeManifest describes the artifacts of an upgrade. The manifest is
+// signed by the service with an Ed25519 key, and the signature of its
+// JSON encoding, as served, is served separately in base64.
+type UpgradeManifest struct {
+	ClientType    string            `json:"ct"`        // Client type, which must match the ct param.
+	ClientVersion string            `json:"cv"`        // Client version, which must match the cv param unless upgrading to @latest.
+	Artifacts     []UpgradeArtifact `json:"artifacts"` // Artifacts to be installed.
+}
+
+// UpgradeArtifact is a file to be installed by an upgrade.
+type UpgradeArtifact struct {
+	Name   string `json:"name"`   // File name, without a directory.
+	URL    string `json:"url"`    // Download URL, which may be relative to the service host.
+	SHA256 string `json:"sha256"` // Hex-encoded SHA-256 checksum.
+}
+
+// WithUpgradeVerification returns an option that verifies upgrades before
+// they are installed. Rather than the upgrader fetching the new version
+// itself, the Sender fetches the upgrade manifest for the ct and cv params
+// from the service, verifies its signature with key, downloads the
+// artifacts it lists to a new temporary directory within dir and verifies
+// their checksums. Only then is the upgrader called, as usual, with the
+// temporary directory in the NETSENDER_UPGRADE_DIR environment variable,
+// i.e.,
+//
+//	NETSENDER_UPGRADE_DIR=<dir>/upgrade-XXXX pkg-upgrade.sh <ct> <cv>
+//
+// The upgrader must install the artifacts from there, since the temporary
+// directory is removed once it returns. Other files in dir are left alone.
+//
+// Unsigned manifests and artifacts which fail verification are refused,
+// in which case the error is set to upgradeVerifyError. When upgrading to
+// @latest, manifests for a version that is not newer than the installed
+// version are also refused, i.e., downgrades are not permitted. The
+// installed version is the build version, if any, else the cv param at
+// startup, and the check is skipped if neither is a version.
+func WithUpgradeVerification(key ed25519.PublicKey, dir string) Option {
+	return func(s *Sender) error {
+		if len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid upgrade verification key size: %d", len(key))
+		}
+		if dir == "" {
+			return errors.New("empty upgrade directory")
+		}
+		s.upgradeKey = key
+		s.upgradeDir = dir
+		return nil
+	}
+}
+
+// fetchUpgrade fetches and verifies the upgrade manifest for ct and cv,
+// and its artifacts, which are written to a new temporary directory
+// within dir, whose path is returned. The caller is responsible for
+// removing it.
+func (ns *Sender) fetchUpgrade(ctx context.Context, key ed25519.PublicKey, dir, ct, cv string) (string, error) {
+	base := ns.serviceURL(ns.serviceHost("default"))
+	query := "?ct=" + url.QueryEscape(ct) + "&cv=" + url.QueryEscape(cv)
+	ns.setUpgradeStage(UpgradeDownloading)
+	manifest, err := ns.fetch(ctx, base+manifestPath+query, maxManifestSize)
+	if err != nil {
+		return "", fmt.Errorf("could not fetch upgrade manifest: %w", err)
+	}
+	sig, err := ns.fetch(ctx, base+manifestSigPath+query, maxManifestSize)
+	if err != nil {
+		return "", fmt.Errorf("%w: could not fetch manifest signature: %w", ErrUpgradeVerify, err)
+	}
+	ns.setUpgradeStage(UpgradeVerifying)
+	m, err := verifyManifest(manifest, sig, key, ct, cv)
+	if err != nil {
+		return "", err
+	}
+	if cv == "@latest" {
+		ns.mu.Lock()
+		installed := ns.build
+		if installed == "" {
+			installed = ns.installedCV
+		}
+		ns.mu.Unlock()
+		if isVersion(installed) && !newerVersion(m.ClientVersion, installed) {
+			return "", fmt.Errorf("%w: manifest version %s is not newer than installed version %s", ErrUpgradeVerify, m.ClientVersion, installed)
+		}
+	}
+	ns.setUpgradeStage(UpgradeDownloading)
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	staging, err := os.MkdirTemp(dir, "upgrade-")
+	if err != nil {
+		return "", err
+	}
+	for _, a := range m.Artifacts {
+		u, err := resolveURL(base, a.URL)
+		if err != nil {
+			os.RemoveAll(staging)
+			return "", fmt.Errorf("%w: invalid URL for %s: %w", ErrUpgradeVerify, a.Name, err)
+		}
+		err = ns.downloadArtifact(ctx, u, filepath.Join(staging, a.Name), a.SHA256)
+		if err != nil {
+			os.RemoveAll(staging)
+			return "", err
+		}
+	}
+	return staging, nil
+}
+
+// isVersion returns true if v is a version, such as v1.2.3 or 1.2,
+// i.e., it starts with a number, optionally prefixed by v.
+func isVersion(v string) bool {
+	v = strings.TrimPrefix(v, "v")
+	return v != "" && v[0] >= '0' && v[0] <= '9'
+}
+
+// newerVersion returns true if version a is newer than version b.
+// Versions are compared part by part, where parts are separated by dots,
+// numerically if both parts are numbers, else lexically. Missing parts
+// are treated as zero, so that v1.2 and v1.2.0 are equal.
+func newerVersion(a, b string) bool {
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		x, y := "0", "0"
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		nx, errx := strconv.Atoi(x)
+		ny, erry := strconv.Atoi(y)
+		switch {
+		case errx == nil && erry == nil && nx != ny:
+			return nx > ny
+		case (errx != nil || erry != nil) && x != y:
+			return x > y
+		}
+	}
+	return false
+}
+
+// verifyManifest verifies the signature of a manifest, whose signature
+// is base64 encoded, and checks that it is for ct and cv and that its
+// artifacts are valid.
+func verifyManifest(manifest, sig []byte, key ed25519.PublicKey, ct, cv string) (*UpgradeManifest, error) {
+	s, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || len(s) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: invalid manifest signature", ErrUpgradeVerify)
+	}
+	if !ed25519.Verify(key, manifest, s) {
+		return nil, fmt.Errorf("%w: manifest signature does not match", ErrUpgradeVerify)
+	}
+	var m UpgradeManifest
+	err = json.Unmarshal(manifest, &m)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not decode manifest: %w", ErrUpgradeVerify, err)
+	}
+	if !strings.EqualFold(m.ClientType, ct) || (cv != "@latest" && !strings.EqualFold(m.ClientVersion, cv)) {
+		return nil, fmt.Errorf("%w: manifest is for %s %s, not %s %s", ErrUpgradeVerify, m.ClientType, m.ClientVersion, ct, cv)
+	}
+	if len(m.Artifacts) == 0 {
+		return nil, fmt.Errorf("%w: manifest has no artifacts", ErrUpgradeVerify)
+	}
+	for _, a := range m.Artifacts {
+		if a.Name == "" || a.Name != path.Base(a.Name) || a.Name == "." || a.Name == ".." || strings.Contains(a.Name, "\\") {
+			return nil, fmt.Errorf("%w: invalid artifact name: %q", ErrUpgradeVerify, a.Name)
+		}
+		if b, err := hex.DecodeString(a.SHA256); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("%w: invalid checksum for %s", ErrUpgradeVerify, a.Name)
+		}
+	}
+	return &m, nil
+}
+
+// resolveURL resolves ref relative to base.
+func resolveURL(base, ref string) (string, error) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return b.ResolveReference(r).String(), nil
+}
+
+// fetch returns the body of a GET request to u, of at most max bytes.
+func (ns *Sender) fetch(ctx context.Context, u string, max int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ns.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response status is %d and not 200 OK", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, errors.New("response too large")
+	}
+	return b, nil
+}
+
+// downloadArtifact writes the body of a GET request to u to file, checking that
+// its SHA-256 checksum is sum.
+func (ns *Sender) downloadArtifact(ctx context.Context, u, file, sum string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	client := ns.httpClient()
+	client.Timeout = 0 // Bounded by ctx.
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not download %s: %w", filepath.Base(file), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not download %s: response status is %d and not 200 OK", filepath.Base(file), resp.StatusCode)
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not download %s: %w", filepath.Base(file), err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, sum) {
+		return fmt.Errorf("%w: checksum mismatch for %s: got %s, want %s", ErrUpgradeVerify, filepath.Base(file), got, sum)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+/*
+NAME
+  uploadrate.go provides upload pacing, which limits the rate at which
+  request payloads are sent so that bulk uploads do not saturate the link.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadRateVar is the var which sets the maximum upload rate in bytes
+// per second. Zero means no limit.
+const uploadRateVar = "UploadRate"
+
+// paceInterval is the approximate interval between paced reads, which
+// determines the size of each read.
+const paceInterval = 100 * time.Millisecond
+
+// WithUploadRate returns an option that limits the rate at which request
+// payloads, e.g., logs and video, are sent to the service to the given
+// number of bytes per second, so that bulk uploads do not starve other
+// traffic. The limit applies to all requests made by the HTTP transport
+// combined. Zero, the default, means no limit. The limit may be changed
+// by the UploadRate var.
+func WithUploadRate(bytesPerSec int) Option {
+	return func(s *Sender) error {
+		if bytesPerSec < 0 {
+			return fmt.Errorf("invalid upload rate: %d", bytesPerSec)
+		}
+		s.pacer.setRate(bytesPerSec)
+		return nil
+	}
+}
+
+// UploadRate returns the upload rate limit in bytes per second, or zero
+// if there is no limit.
+func (ns *Sender) UploadRate() int {
+	return ns.pacer.getRate()
+}
+
+// setUploadRate sets the upload rate limit from the UploadRate var, if
+// present.
+func (ns *Sender) setUploadRate(vars map[string]string) {
+	v, present := vars[uploadRateVar]
+	if !present {
+		return
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 0 {
+		ns.logger.Log(WarningLevel, warnUploadRate, "value", v)
+		return
+	}
+	ns.pacer.setRate(n)
+}
+
+// pacer limits the combined rate of paced reads. The zero value has no
+// limit.
+type pacer struct {
+	mu   sync.Mutex
+	rate int       // Bytes per second, or 0 for no limit.
+	next time.Time // Time at which the bytes read so far are due.
+}
+
+// setRate sets the rate in bytes per second.
+func (p *pacer) setRate(rate int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rate = rate
+}
+
+// getRate returns the rate in bytes per second.
+func (p *pacer) getRate() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rate
+}
+
+// chunk returns the maximum size of a paced read, or 0 for no limit.
+func (p *pacer) chunk() int {
+	rate := p.getRate()
+	if rate == 0 {
+		return 0
+	}
+	return max(1, int(int64(rate)*int64(paceInterval)/int64(time.Second)))
+}
+
+// wait accounts for n bytes and waits until they are due at the current
+// rate, or until ctx is done, in which case ctx.Err() is returned.
+func (p *pacer) wait(ctx context.Context, n int) error {
+	p.mu.Lock()
+	if p.rate == 0 || n == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	p.next = p.next.Add(time.Duration(int64(n) * int64(time.Second) / int64(p.rate)))
+	d := p.next.Sub(now)
+	p.mu.Unlock()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pacedReader implements an io.Reader whose reads from r are paced by p.
+type pacedReader struct {
+	ctx context.Context
+	r   io.Reader
+	p   *pacer
+}
+
+// pace returns r paced by p, or r if p is nil.
+func pace(ctx context.Context, r io.Reader, p *pacer) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &pacedReader{ctx: ctx, r: r, p: p}
+}
+
+// Read implements io.Reader.Read.
+func (pr *pacedReader) Read(b []byte) (int, error) {
+	if c := pr.p.chunk(); c != 0 && len(b) > c {
+		b = b[:c]
+	}
+	n, err := pr.r.Read(b)
+	werr := pr.p.wait(pr.ctx, n)
+	if err == nil {
+		err = werr
+	}
+	return n, err
+}
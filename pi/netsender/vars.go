@@ -0,0 +1,294 @@
+/*
+NAME
+  vars.go provides var change callbacks, so that clients can declare how
+  to handle each var rather than comparing var sums and values themselves.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VarFunc handles the value of a var.
+type VarFunc func(value string) error
+
+// OnVar registers fn to be called with the value of the named var
+// whenever Vars returns a value for the var that differs from the value
+// most recently passed to the var's callbacks. The first value received
+// after registration is always passed, to all of the var's callbacks.
+// The name is without the device ID prefix, e.g., "Gain". Callbacks are
+// called in registration order, without holding the Sender's lock, so
+// they may call Sender methods. Callback errors are logged. Once a
+// callback is registered, Send calls Vars when a reply indicates that
+// the var sum has changed, so a client which calls Run regularly need
+// not call Vars itself.
+func (ns *Sender) OnVar(name string, fn VarFunc) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.varFuncs == nil {
+		ns.varFuncs = make(map[string][]VarFunc)
+	}
+	ns.varFuncs[name] = append(ns.varFuncs[name], fn)
+	delete(ns.varVals, name) // Pass the current value to the new callback.
+}
+
+// dispatchVars calls the var callbacks for vars which have changed.
+func (ns *Sender) dispatchVars(vars map[string]string) {
+	type call struct {
+		name, value string
+		fns         []VarFunc
+	}
+	var calls []call
+	ns.mu.Lock()
+	for name, fns := range ns.varFuncs {
+		val, ok := vars[name]
+		if !ok {
+			continue
+		}
+		if prev, ok := ns.varVals[name]; ok && prev == val {
+			continue
+		}
+		if ns.varVals == nil {
+			ns.varVals = make(map[string]string)
+		}
+		ns.varVals[name] = val
+		calls = append(calls, call{name: name, value: val, fns: append([]VarFunc(nil), fns...)})
+	}
+	ns.mu.Unlock()
+
+	for _, c := range calls {
+		for _, fn := range c.fns {
+			err := fn(c.value)
+			if err != nil {
+				ns.logger.Log(WarningLevel, warnVarFunc, "name", c.name, "value", c.value, "error", err.Error())
+			}
+		}
+	}
+}
+
+// VarsChanged is like Vars, but returns only the vars which have changed
+// since the previous call to VarsChanged, so that clients need not
+// re-apply every var whenever the var sum changes. Vars which have been
+// removed are returned with an empty value. The first call returns all
+// vars. The var sum (vs) is not included, since it changes whenever any
+// other var does. If Vars fails, the snapshot is unchanged, so the changes
+// are returned by a later call.
+func (ns *Sender) VarsChanged() (map[string]string, error) {
+	return ns.VarsChangedContext(context.Background())
+}
+
+// VarsChangedContext is like VarsChanged, but the request is cancelled
+// when ctx is done.
+func (ns *Sender) VarsChangedContext(ctx context.Context) (map[string]string, error) {
+	vars, err := ns.VarsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	changed := make(map[string]string)
+	for k, v := range vars {
+		if prev, ok := ns.varSnapshot[k]; k != "vs" && (!ok || prev != v) {
+			changed[k] = v
+		}
+	}
+	for k := range ns.varSnapshot {
+		if _, ok := vars[k]; !ok && k != "vs" {
+			changed[k] = ""
+		}
+	}
+	ns.varSnapshot = vars
+	return changed, nil
+}
+
+// LastVars returns a copy of the vars most recently received from the
+// service, without making a request, or nil if none have been received.
+func (ns *Sender) LastVars() map[string]string {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return maps.Clone(ns.lastVars)
+}
+
+// ErrVarMissing is returned by the typed var accessors for a missing var.
+var ErrVarMissing = errors.New("var missing")
+
+// VarString returns the value of the named var.
+func VarString(vars map[string]string, name string) (string, error) {
+	v, ok := vars[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrVarMissing, name)
+	}
+	return v, nil
+}
+
+// VarInt returns the value of the named var as an int.
+func VarInt(vars map[string]string, name string) (int, error) {
+	v, err := VarString(vars, name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return 0, fmt.Errorf("could not parse %s var as int: %w", name, err)
+	}
+	return n, nil
+}
+
+// VarFloat returns the value of the named var as a float64.
+func VarFloat(vars map[string]string, name string) (float64, error) {
+	v, err := VarString(vars, name)
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse %s var as float: %w", name, err)
+	}
+	return f, nil
+}
+
+// VarBool returns the value of the named var as a bool. Values are
+// parsed by strconv.ParseBool, so "true", "True" and "1" are all true.
+func VarBool(vars map[string]string, name string) (bool, error) {
+	v, err := VarString(vars, name)
+	if err != nil {
+		return false, err
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		return false, fmt.Errorf("could not parse %s var as bool: %w", name, err)
+	}
+	return b, nil
+}
+
+// VarDuration returns the value of the named var as a time.Duration.
+// The value may be a Go duration, e.g., "1m30s", or a whole number of
+// seconds.
+func VarDuration(vars map[string]string, name string) (time.Duration, error) {
+	v, err := VarString(vars, name)
+	if err != nil {
+		return 0, err
+	}
+	d, err := parseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse %s var as duration: %w", name, err)
+	}
+	return d, nil
+}
+
+// parseDuration parses a Go duration or a whole number of seconds.
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.Atoi(s); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Var describes a client var for WithVars. Type is a var type as for
+// WithVarTypes, e.g., "int", and Update is called with the var's value
+// whenever it changes (see OnVar). Var values are usually created with
+// the typed constructors, e.g., IntVar, which parse the value.
+type Var struct {
+	Name   string
+	Type   string
+	Update VarFunc
+}
+
+// StringVar returns a string Var which calls update with the var's value.
+func StringVar(name string, update func(string) error) Var {
+	return Var{Name: name, Type: "string", Update: VarFunc(update)}
+}
+
+// IntVar returns an int Var which calls update with the var's value.
+func IntVar(name string, update func(int) error) Var {
+	return Var{Name: name, Type: "int", Update: func(v string) error {
+		n, err := VarInt(map[string]string{name: v}, name)
+		if err != nil {
+			return err
+		}
+		return update(n)
+	}}
+}
+
+// FloatVar returns a float Var which calls update with the var's value.
+func FloatVar(name string, update func(float64) error) Var {
+	return Var{Name: name, Type: "float", Update: func(v string) error {
+		f, err := VarFloat(map[string]string{name: v}, name)
+		if err != nil {
+			return err
+		}
+		return update(f)
+	}}
+}
+
+// BoolVar returns a bool Var which calls update with the var's value.
+func BoolVar(name string, update func(bool) error) Var {
+	return Var{Name: name, Type: "bool", Update: func(v string) error {
+		b, err := VarBool(map[string]string{name: v}, name)
+		if err != nil {
+			return err
+		}
+		return update(b)
+	}}
+}
+
+// DurationVar returns a Var which calls update with the var's value as
+// a duration (see VarDuration). Its type is string, since the service
+// has no duration type.
+func DurationVar(name string, update func(time.Duration) error) Var {
+	return Var{Name: name, Type: "string", Update: func(v string) error {
+		d, err := VarDuration(map[string]string{name: v}, name)
+		if err != nil {
+			return err
+		}
+		return update(d)
+	}}
+}
+
+// WithVars returns an option that declares client vars. The var types are
+// sent to the service (see WithVarTypes) and each var's Update func is
+// registered with OnVar.
+func WithVars(vars ...Var) Option {
+	return func(s *Sender) error {
+		vt := make(map[string]string, len(vars))
+		for _, v := range vars {
+			if v.Name == "" || v.Update == nil {
+				return fmt.Errorf("invalid var: %q", v.Name)
+			}
+			vt[v.Name] = v.Type
+		}
+		err := WithVarTypes(vt)(s)
+		if err != nil {
+			return err
+		}
+		for _, v := range vars {
+			s.OnVar(v.Name, v.Update)
+		}
+		return nil
+	}
+}
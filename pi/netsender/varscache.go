@@ -0,0 +1,93 @@
+/*
+NAME
+  varscache.go provides a disk cache of the most recently received vars,
+  so that a client which starts without connectivity can use its
+  last-known vars rather than defaults.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrStaleVars is returned, wrapped with the cause, by Vars when the
+// service cannot be reached and the cached vars are returned instead
+// (see WithVarsCache).
+var ErrStaleVars = errors.New("vars are stale")
+
+// WithVarsCache returns an option that caches the vars most recently
+// received by Vars in a JSON file at path. If a later Vars request fails
+// without a reply from the service, e.g., because the device started
+// without connectivity, Vars returns the cached vars together with an
+// error wrapping ErrStaleVars, so that clients can choose to use them
+// rather than defaults, e.g.,
+//
+//	vars, err := ns.Vars()
+//	if errors.Is(err, netsender.ErrStaleVars) {
+//		apply(vars)
+//	}
+//
+// Stale vars are passed to OnVar callbacks, but do not change the mode or
+// error, nor are they sent to VarChanges receivers. The cache is only
+// rewritten when the vars change.
+func WithVarsCache(path string) Option {
+	return func(s *Sender) error {
+		if path == "" {
+			return errors.New("empty vars cache path")
+		}
+		s.varsCache = &fileStore{path: path, decode: decodeJSON, encode: encodeJSON}
+		return nil
+	}
+}
+
+// cacheVars writes vars to the vars cache, if any.
+func (ns *Sender) cacheVars(vars map[string]string) {
+	ns.mu.Lock()
+	c := ns.varsCache
+	ns.mu.Unlock()
+	if c == nil {
+		return
+	}
+	err := c.Write(vars, nil)
+	if err != nil && !errors.Is(err, ErrUnchanged) {
+		ns.logger.Log(WarningLevel, warnVarsCache, "error", err.Error())
+	}
+}
+
+// staleVars returns the cached vars, if any, with an error wrapping
+// ErrStaleVars and cause, else nil and cause. The service must not have
+// replied, i.e., cause is not a ServerError.
+func (ns *Sender) staleVars(cause error) (map[string]string, error) {
+	ns.mu.Lock()
+	c := ns.varsCache
+	ns.mu.Unlock()
+	var se *ServerError
+	if c == nil || errors.As(cause, &se) {
+		return nil, cause
+	}
+	vars, err := c.Read()
+	if err != nil || len(vars) == 0 {
+		return nil, cause
+	}
+	ns.logger.Log(WarningLevel, warnStaleVars, "error", cause.Error())
+	ns.dispatchVars(vars)
+	return vars, fmt.Errorf("%w: %w", ErrStaleVars, cause)
+}
@@ -0,0 +1,154 @@
+/*
+NAME
+  watch.go provides long-poll based var change notification, so that var
+  changes reach the client within seconds rather than once per monitor
+  period.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Long-poll timing.
+const (
+	defaultWatchWait = 60 * time.Second // Default time the service may hold a watch request.
+	minWatchInterval = time.Second      // Minimum time between watch requests.
+	watchRetry       = 10 * time.Second // Time to wait after a failed watch request.
+)
+
+// WatchVars long-polls the service for var changes until ctx is done or
+// the Sender is closed, then returns the context error. Each watch
+// request sends the current var sum with a wait time (wt) in seconds, and
+// the service replies as soon as the var sum differs, or after the wait
+// time, with {"vs":"<var sum>"}. When the var sum changes the vars are
+// fetched with Vars, which notifies any VarChanges receiver. A wait of
+// zero means the default of 60 seconds.
+//
+// WatchVars is intended to be called in its own goroutine alongside the
+// usual Run loop, which continues to detect var changes once per monitor
+// period if the service does not support watch requests. Watch requests
+// are rate limited, so a service which replies immediately degrades to
+// polling once per second. WatchVars uses HTTP regardless of WithTransport.
+func (ns *Sender) WatchVars(ctx context.Context, wait time.Duration) error {
+	ctx, cancel := ns.bindLifetime(ctx)
+	defer cancel()
+	if wait <= 0 {
+		wait = defaultWatchWait
+	}
+	for {
+		start := time.Now()
+		changed, err := ns.watchVars(ctx, wait)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			ns.logger.Log(WarningLevel, warnWatchVars, "error", err.Error())
+			sleepContext(ctx, watchRetry)
+			continue
+		case changed:
+			_, err = ns.VarsContext(ctx)
+			if err != nil {
+				ns.logger.Log(WarningLevel, warnVarsError, "error", err.Error())
+			}
+		}
+		sleepContext(ctx, minWatchInterval-time.Since(start))
+	}
+}
+
+// watchVars makes a single watch request, returning true if the var sum
+// in the reply differs from the current var sum.
+func (ns *Sender) watchVars(ctx context.Context, wait time.Duration) (bool, error) {
+	ns.mu.Lock()
+	vs := ns.varSum
+	ns.mu.Unlock()
+
+	url := fmt.Sprintf("%s/%s?vn=%d&ma=%s%s&vs=%d&wt=%d",
+		ns.serviceURL(ns.serviceHost(requestTypes[RequestVars])), requestTypes[RequestVars],
+		version, ns.Param("ma"), ns.keyParam(), vs, int(wait.Seconds()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if key := ns.signingKey(); key != "" {
+		h := sha256.Sum256(nil)
+		signRequest(req, key, h[:])
+	}
+	client := ns.httpClient()
+	client.Timeout = wait + Timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("watch request response status is %d and not 200 OK", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, defaultMaxReply))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := parseVarSum(string(body))
+	if err != nil {
+		return false, err
+	}
+	return n != vs, nil
+}
+
+// parseVarSum returns the var sum of a {"vs":"<var sum>"} reply.
+func parseVarSum(reply string) (int, error) {
+	dec, err := NewJSONDecoder(reply)
+	if err != nil {
+		return 0, err
+	}
+	if er, err := dec.String("er"); err == nil {
+		return 0, &ServerError{er: er}
+	}
+	val, err := dec.String("vs")
+	if err != nil {
+		return 0, fmt.Errorf("vs missing: %w", err)
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, errors.New("vs not an integer: " + val)
+	}
+	return n, nil
+}
+
+// sleepContext sleeps for d or until ctx is done, whichever is first.
+func sleepContext(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,100 @@
+/*
+NAME
+  watchdog.go provides systemd service notifications, so that systemd can
+  restart a client which has stopped running, using its watchdog.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Systemd notification states (see sd_notify(3)).
+const (
+	sdReady    = "READY=1"
+	sdWatchdog = "WATCHDOG=1"
+	sdStopping = "STOPPING=1"
+)
+
+// WithSystemdNotify returns an option that notifies systemd when the
+// client is ready, i.e., after its first successful config request, and
+// pings the systemd watchdog each time Run is called, so that a client
+// which stops running, e.g., because it is blocked, is restarted. This
+// requires a service unit with Type=notify and, for the watchdog,
+// WatchdogSec longer than the monitor period (mp) plus the time taken to
+// read pins and make requests, e.g.,
+//
+//	[Service]
+//	Type=notify
+//	WatchdogSec=5min
+//	Restart=on-failure
+//
+// Notifications are not sent unless the client is run by systemd.
+func WithSystemdNotify() Option {
+	return func(s *Sender) error {
+		s.sdNotify = true
+		return nil
+	}
+}
+
+// notifySystemd sends a notification to systemd, if enabled.
+func (ns *Sender) notifySystemd(state string) {
+	ns.mu.Lock()
+	enabled := ns.sdNotify
+	if state == sdReady {
+		enabled = enabled && !ns.sdReady
+		ns.sdReady = true
+	}
+	ns.mu.Unlock()
+	if !enabled {
+		return
+	}
+	if state == sdWatchdog {
+		pid := os.Getenv("WATCHDOG_PID")
+		if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+			return // The watchdog is for another process.
+		}
+	}
+	err := sdNotify(state)
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnSystemdNotify, "state", state, "error", err.Error())
+	}
+}
+
+// sdNotify sends state to the systemd notification socket, if any.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil // Not run by systemd.
+	}
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:] // Abstract socket.
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,224 @@
+/*
+NAME
+  wifi.go provides WiFi configuration from the wi config param, so that
+  WiFi credentials can be managed from the service.
+
+LICENSE
+  netsender is Copyright (C) 2017-2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with netsender in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package netsender
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// WiFiConfigurator configures the OS to connect to the WiFi network with
+// the given SSID and password, which is empty for an open network.
+type WiFiConfigurator func(ssid, password string) error
+
+// runCommand runs a command with the given standard input, if any,
+// returning its output in any error. It is a variable so that it may be
+// replaced in tests.
+var runCommand = func(stdin, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// WithWiFi returns an option that applies the wi config param, i.e.,
+// "SSID,password", to the OS with cfg when it changes, whether by the
+// service or by editing the config file. The wi param is assumed to be
+// applied already when the Sender is initialized. For example,
+//
+//	netsender.WithWiFi(netsender.WPASupplicant("/etc/wpa_supplicant/wpa_supplicant.conf", "wlan0"))
+func WithWiFi(cfg WiFiConfigurator) Option {
+	return func(s *Sender) error {
+		if cfg == nil {
+			return errors.New("nil WiFi configurator")
+		}
+		s.wifi = cfg
+		return nil
+	}
+}
+
+// splitWiFi splits a wi param into its SSID and password. The SSID may
+// not contain a comma, but the password may.
+func splitWiFi(wi string) (ssid, password string) {
+	ssid, password, _ = strings.Cut(wi, ",")
+	return ssid, password
+}
+
+// Redact returns the value of the named config param for logging or
+// display, with any secret removed, e.g., the WiFi password of wi.
+func Redact(name, val string) string {
+	if name == "wi" && val != "" {
+		ssid, _ := splitWiFi(val)
+		return ssid + ",***"
+	}
+	return val
+}
+
+// applyWiFi applies the wi param with the WiFi configurator, if any and
+// if wi has changed since last applied.
+func (ns *Sender) applyWiFi() {
+	ns.mu.Lock()
+	cfg, wi, applied := ns.wifi, ns.config["wi"], ns.wifiApplied
+	ns.mu.Unlock()
+	if cfg == nil || wi == applied || wi == "" {
+		return
+	}
+	ssid, password := splitWiFi(wi)
+	err := cfg(ssid, password)
+	if err != nil {
+		ns.logger.Log(WarningLevel, warnWiFi, "ssid", ssid, "error", err.Error())
+		return
+	}
+	ns.mu.Lock()
+	ns.wifiApplied = wi
+	ns.mu.Unlock()
+	ns.auditLog(InfoLevel, infoWiFiApplied, "ssid", ssid)
+}
+
+// checkWiFi returns an error if the SSID or password cannot be used in
+// a WiFi configuration.
+func checkWiFi(ssid, password string) error {
+	if ssid == "" || len(ssid) > 32 {
+		return fmt.Errorf("invalid SSID length: %d", len(ssid))
+	}
+	if password != "" && (len(password) < 8 || len(password) > 63) {
+		return fmt.Errorf("invalid WPA password length: %d", len(password))
+	}
+	if strings.ContainsAny(ssid+password, "\"\n\r\x00") {
+		return errors.New("SSID or password contains invalid characters")
+	}
+	return nil
+}
+
+// WPASupplicant returns a WiFiConfigurator which writes the network to the
+// wpa_supplicant config file at path and reconfigures the interface iface.
+// Settings outside network blocks are preserved. The most recently
+// configured existing network is kept, with a lower priority, as a
+// fallback in case the new credentials are wrong, and any others are
+// removed.
+func WPASupplicant(path, iface string) WiFiConfigurator {
+	return func(ssid, password string) error {
+		err := checkWiFi(ssid, password)
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		header, prev := parseWPASupplicant(string(b))
+
+		var buf strings.Builder
+		buf.WriteString(header)
+		buf.WriteString("\nnetwork={\n\tssid=\"" + ssid + "\"\n")
+		if password == "" {
+			buf.WriteString("\tkey_mgmt=NONE\n")
+		} else {
+			buf.WriteString("\tpsk=\"" + password + "\"\n")
+		}
+		buf.WriteString("\tpriority=2\n}\n")
+		if prev != nil && prev.ssid != ssid {
+			buf.WriteString("\nnetwork={\n")
+			for _, line := range prev.lines {
+				buf.WriteString(line + "\n")
+			}
+			buf.WriteString("\tpriority=1\n}\n")
+		}
+
+		tmp := path + ".tmp"
+		err = os.WriteFile(tmp, []byte(buf.String()), 0600)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmp, path)
+		if err != nil {
+			return err
+		}
+		return runCommand("", "wpa_cli", "-i", iface, "reconfigure")
+	}
+}
+
+// wpaNetwork is a network block of a wpa_supplicant config file.
+type wpaNetwork struct {
+	ssid     string
+	priority int
+	lines    []string // Lines other than priority.
+}
+
+// parseWPASupplicant parses a wpa_supplicant config file, returning the
+// content outside network blocks, without trailing blank lines, and the
+// highest priority network, or the last if they have equal priorities,
+// or nil if there are none.
+func parseWPASupplicant(content string) (string, *wpaNetwork) {
+	var header []string
+	var best, cur *wpaNetwork
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case cur == nil && strings.HasPrefix(trimmed, "network={"):
+			cur = &wpaNetwork{}
+		case cur == nil:
+			header = append(header, line)
+		case trimmed == "}":
+			if best == nil || cur.priority >= best.priority {
+				best = cur
+			}
+			cur = nil
+		case strings.HasPrefix(trimmed, "priority="):
+			cur.priority, _ = strconv.Atoi(strings.TrimPrefix(trimmed, "priority="))
+		default:
+			if strings.HasPrefix(trimmed, "ssid=") {
+				cur.ssid = strings.Trim(strings.TrimPrefix(trimmed, "ssid="), "\"")
+			}
+			cur.lines = append(cur.lines, line)
+		}
+	}
+	return strings.TrimRight(strings.Join(header, "\n"), "\n") + "\n", best
+}
+
+// NetworkManager returns a WiFiConfigurator which connects the interface
+// iface to the network using NetworkManager, which retains previously
+// configured networks. The password is written to nmcli's standard input,
+// rather than passed as an argument, so that it is not visible to other
+// processes.
+func NetworkManager(iface string) WiFiConfigurator {
+	return func(ssid, password string) error {
+		err := checkWiFi(ssid, password)
+		if err != nil {
+			return err
+		}
+		if password == "" {
+			return runCommand("", "nmcli", "device", "wifi", "connect", ssid, "ifname", iface)
+		}
+		return runCommand(password+"\n", "nmcli", "--ask", "device", "wifi", "connect", ssid, "ifname", iface)
+	}
+}
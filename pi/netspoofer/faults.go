@@ -0,0 +1,214 @@
+/*
+NAME
+	faults.go - fault injection for netspoofer, so that client resilience can be tested without toxiproxy.
+
+LICENSE
+  faults.go is Copyright (C) 2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with revid in gpl.txt.  If not, see [GNU licenses](http://www.gnu.org/licenses).
+*/
+
+package netspoofer
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency distributions.
+const (
+	Fixed       = "fixed"       // Latency is always Latency.
+	Uniform     = "uniform"     // Latency is uniformly distributed between Latency and Latency+Jitter.
+	Exponential = "exponential" // Latency is Latency plus an exponentially distributed delay with mean Jitter.
+)
+
+// malformedJSON is the body of replies with malformed JSON.
+const malformedJSON = `{"rc":0,"vs":`
+
+// Faults describes the faults injected into replies to service requests. Rates are
+// the probability of the fault for each request, from 0 to 1. Faults are not injected
+// into replies to the control endpoints.
+type Faults struct {
+	Latency       time.Duration // Minimum latency added to each reply.
+	Jitter        time.Duration // Variation of the added latency (see Distribution).
+	Distribution  string        // Distribution of the added latency: Fixed (the default), Uniform or Exponential.
+	ErrorRate     float64       // Rate of replies with an HTTP error status.
+	ErrorStatus   int           // HTTP error status, or 0 for 503 Service Unavailable.
+	TruncateRate  float64       // Rate of replies whose body is cut short.
+	MalformedRate float64       // Rate of replies whose body is malformed JSON.
+	Seed          int64         // Seed of the random faults, so that tests are repeatable.
+}
+
+var (
+	faults    Faults
+	faultRand = rand.New(rand.NewSource(0))
+	faultMu   sync.Mutex // Guards faults and faultRand.
+)
+
+// SetFaults sets the faults injected into replies. The zero Faults injects none.
+func SetFaults(f Faults) error {
+	switch f.Distribution {
+	case "", Fixed, Uniform, Exponential:
+	default:
+		return errors.New("invalid latency distribution: " + f.Distribution)
+	}
+	for _, r := range []float64{f.ErrorRate, f.TruncateRate, f.MalformedRate} {
+		if r < 0 || r > 1 {
+			return errors.New("invalid fault rate: " + strconv.FormatFloat(r, 'g', -1, 64))
+		}
+	}
+	if f.Latency < 0 || f.Jitter < 0 {
+		return errors.New("negative latency")
+	}
+	faultMu.Lock()
+	faults = f
+	faultRand = rand.New(rand.NewSource(f.Seed))
+	faultMu.Unlock()
+	return nil
+}
+
+// fault is the fault injected into a reply.
+type fault int
+
+const (
+	noFault fault = iota
+	errorFault
+	truncateFault
+	malformedFault
+)
+
+// nextFault returns the latency and fault for the next reply.
+func nextFault() (time.Duration, fault, int) {
+	faultMu.Lock()
+	defer faultMu.Unlock()
+	f := faults
+	d := f.Latency
+	switch f.Distribution {
+	case Uniform:
+		d += time.Duration(faultRand.Int63n(int64(f.Jitter) + 1))
+	case Exponential:
+		d += time.Duration(faultRand.ExpFloat64() * float64(f.Jitter))
+	}
+	status := f.ErrorStatus
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	switch p := faultRand.Float64(); {
+	case p < f.ErrorRate:
+		return d, errorFault, status
+	case p < f.ErrorRate+f.TruncateRate:
+		return d, truncateFault, status
+	case p < f.ErrorRate+f.TruncateRate+f.MalformedRate:
+		return d, malformedFault, status
+	}
+	return d, noFault, status
+}
+
+// faultHandler returns a handler which injects faults into the replies of h.
+func faultHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/control") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		d, f, status := nextFault()
+		if d > 0 {
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		switch f {
+		case noFault:
+			h.ServeHTTP(w, r)
+		case errorFault:
+			http.Error(w, http.StatusText(status), status)
+		case malformedFault:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(malformedJSON))
+		case truncateFault:
+			// The full length is declared but only half the body is written, so the
+			// connection is closed before the client has read the whole reply.
+			rec := &recorder{header: make(http.Header), status: http.StatusOK}
+			h.ServeHTTP(rec, r)
+			for k, v := range rec.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(rec.body.Len()))
+			w.WriteHeader(rec.status)
+			w.Write(rec.body.Bytes()[:rec.body.Len()/2])
+		}
+	})
+}
+
+// recorder is an http.ResponseWriter which records a reply.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header         { return r.header }
+func (r *recorder) Write(p []byte) (int, error) { return r.body.Write(p) }
+func (r *recorder) WriteHeader(status int)      { r.status = status }
+
+// faultsHandler handles POST /control/faults, setting the faults from form values
+// named like the fields of Faults, with durations such as 100ms, e.g.,
+// latency=100ms&jitter=1s&distribution=exponential&errorrate=0.1.
+// Fields not given are zero.
+func faultsHandler(w http.ResponseWriter, r *http.Request) {
+	var f Faults
+	var err error
+	duration := func(name string) time.Duration {
+		v := r.FormValue(name)
+		if v == "" || err != nil {
+			return 0
+		}
+		var d time.Duration
+		d, err = time.ParseDuration(v)
+		return d
+	}
+	number := func(name string) float64 {
+		v := r.FormValue(name)
+		if v == "" || err != nil {
+			return 0
+		}
+		var n float64
+		n, err = strconv.ParseFloat(v, 64)
+		return n
+	}
+	f.Latency = duration("latency")
+	f.Jitter = duration("jitter")
+	f.Distribution = r.FormValue("distribution")
+	f.ErrorRate = number("errorrate")
+	f.ErrorStatus = int(number("errorstatus"))
+	f.TruncateRate = number("truncaterate")
+	f.MalformedRate = number("malformedrate")
+	f.Seed = int64(number("seed"))
+	if err == nil {
+		err = SetFaults(f)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
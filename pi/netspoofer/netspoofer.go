@@ -1,6 +1,7 @@
 /*
 NAME
-	netspoofer - netspoofer simulates netreceiver responses for the purpose of testing. It currently only supports log receiving.
+	netspoofer - netspoofer simulates netreceiver responses for the purpose of testing. It supports log receiving,
+	and vars, modes and response codes which can be changed at runtime to drive device behaviour.
 
 DESCRIPTION
 	See Readme.md
@@ -28,31 +29,76 @@ LICENSE
 package netspoofer
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"maps"
 	"net/http"
+	"strconv"
 	"sync"
+
+	"github.com/ausocean/client/pi/netsender"
 )
 
 const testPin = "T0"
 
+// responseCodes maps the names of response codes, as set by /control/rc, to codes.
+var responseCodes = map[string]int{
+	"OK":       netsender.ResponseOK,
+	"Update":   netsender.ResponseUpdate,
+	"Reboot":   netsender.ResponseReboot,
+	"Debug":    netsender.ResponseDebug,
+	"Upgrade":  netsender.ResponseUpgrade,
+	"Alarm":    netsender.ResponseAlarm,
+	"Test":     netsender.ResponseTest,
+	"Shutdown": netsender.ResponseShutdown,
+}
+
 var (
 	pins    = []string{testPin}
 	storage string
+	vars    = map[string]string{"mode": "Normal"} // Vars returned by /vars.
+	varSum  int                                   // Var sum returned in replies.
+	rc      = netsender.ResponseOK                // Response code returned by the next poll or config reply.
 	mutex   = &sync.Mutex{}
 )
 
 // Run starts up server and listens for requests.
 func Run() {
-	http.HandleFunc("/poll", pollHandler)
-	err := http.ListenAndServe("localhost:8000", nil)
+	err := http.ListenAndServe("localhost:8000", Handler())
 	if err != nil {
 		log.Fatalf("Httpserver: ListenAndServe() error: %s\n", err)
 	}
 }
 
+// Handler returns a handler for the service requests and the control endpoints,
+// e.g., for use with httptest. The control endpoints, which test scripts use to drive
+// device behaviour, are:
+//
+//	GET  /control        returns the vars, var sum and pending response code as JSON.
+//	POST /control/vars   sets the vars given as form values, deleting those with empty values.
+//	POST /control/mode   sets the mode to the mode form value.
+//	POST /control/varsum increments the var sum, so that devices fetch the vars.
+//	POST /control/rc     sets the response code for the next poll or config reply to the
+//	                     rc form value, which is a name, e.g., Reboot, or a number.
+//	POST /control/faults sets the faults injected into replies (see Faults and faultsHandler).
+//	POST /control/reset  resets the logs, vars, response code and faults.
+//
+// Setting vars or the mode increments the var sum.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/poll", pollHandler)
+	mux.HandleFunc("/config", configHandler)
+	mux.HandleFunc("/vars", varsHandler)
+	mux.HandleFunc("/ping", pingHandler)
+	mux.HandleFunc("/control", controlHandler)
+	mux.HandleFunc("/control/", controlHandler)
+	return faultHandler(mux)
+}
+
 // Logs returns all logs recieved by server.
 func Logs() string {
 	mutex.Lock()
@@ -60,14 +106,69 @@ func Logs() string {
 	return storage
 }
 
-// Reset deletes logs on server.
+// Reset deletes logs on server, and resets the vars, response code and faults.
 func Reset() {
+	SetFaults(Faults{})
 	mutex.Lock()
 	storage = ""
+	vars = map[string]string{"mode": "Normal"}
+	varSum++
+	rc = netsender.ResponseOK
+	mutex.Unlock()
+}
+
+// Vars returns a copy of the vars.
+func Vars() map[string]string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return maps.Clone(vars)
+}
+
+// SetVars sets the given vars, deleting those with empty values, and increments the var sum.
+func SetVars(v map[string]string) {
+	mutex.Lock()
+	for name, val := range v {
+		if val == "" {
+			delete(vars, name)
+			continue
+		}
+		vars[name] = val
+	}
+	varSum++
 	mutex.Unlock()
 }
 
-// pollHandler handles a poll request from a client. It currently only acts upon pin T0 (log files).
+// SetMode sets the mode and increments the var sum.
+func SetMode(mode string) {
+	SetVars(map[string]string{"mode": mode})
+}
+
+// BumpVarSum increments the var sum, so that devices fetch the vars.
+func BumpVarSum() {
+	mutex.Lock()
+	varSum++
+	mutex.Unlock()
+}
+
+// SetResponseCode sets the response code, e.g., netsender.ResponseReboot, returned by the
+// next poll or config reply. Subsequent replies return netsender.ResponseOK.
+func SetResponseCode(code int) {
+	mutex.Lock()
+	rc = code
+	mutex.Unlock()
+}
+
+// takeResponseCode returns the pending response code, which is then reset, and the var sum.
+func takeResponseCode() (int, int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	code := rc
+	rc = netsender.ResponseOK
+	return code, varSum
+}
+
+// pollHandler handles a poll request from a client. It currently only acts upon pin T0 (log files),
+// and replies to polls without it with just the response code and var sum.
 func pollHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Body == nil {
 		writeError(w, "InvalidPayloadSize")
@@ -77,9 +178,14 @@ func pollHandler(w http.ResponseWriter, r *http.Request) {
 
 	r.ParseForm()
 
+	code, vs := takeResponseCode()
 	response := map[string]interface{}{
-		"rc": 0,
-		"vs": 0,
+		"rc": code,
+		"vs": vs,
+	}
+	if _, ok := r.Form[testPin]; !ok {
+		writeJSON(w, response)
+		return
 	}
 
 	var found bool
@@ -101,7 +207,17 @@ func pollHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	response[testPin] = val
 
-	log, err := ioutil.ReadAll(r.Body)
+	var err error
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Type") == "application/gzip" {
+		body, err = gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, "ReadError")
+			return
+		}
+	}
+	log, err := ioutil.ReadAll(body)
 	if err != nil {
 		writeError(w, "ReadError")
 		return
@@ -112,8 +228,91 @@ func pollHandler(w http.ResponseWriter, r *http.Request) {
 	mutex.Unlock()
 
 	response["ma"] = r.FormValue("ma")
+	writeJSON(w, response)
+}
+
+// configHandler handles a config request from a client, replying with the response code and var sum.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	code, vs := takeResponseCode()
+	writeJSON(w, map[string]interface{}{"ma": r.FormValue("ma"), "rc": code, "vs": vs})
+}
+
+// varsHandler handles a vars request from a client, replying with the vars and var sum.
+func varsHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	response := make(map[string]interface{}, len(vars)+1)
+	for name, val := range vars {
+		response[name] = val
+	}
+	response["vs"] = strconv.Itoa(varSum)
+	mutex.Unlock()
+	writeJSON(w, response)
+}
+
+// controlHandler handles the control endpoints (see Handler).
+func controlHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/control" && r.Method == http.MethodGet {
+		mutex.Lock()
+		state := map[string]interface{}{"vars": maps.Clone(vars), "vs": varSum, "rc": rc}
+		mutex.Unlock()
+		faultMu.Lock()
+		state["faults"] = faults
+		faultMu.Unlock()
+		writeJSON(w, state)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	data, err := json.Marshal(response)
+	switch r.URL.Path {
+	case "/control/vars":
+		v := make(map[string]string, len(r.PostForm))
+		for name := range r.PostForm {
+			v[name] = r.PostForm.Get(name)
+		}
+		SetVars(v)
+	case "/control/mode":
+		mode := r.FormValue("mode")
+		if mode == "" {
+			http.Error(w, "missing mode", http.StatusBadRequest)
+			return
+		}
+		SetMode(mode)
+	case "/control/varsum":
+		BumpVarSum()
+	case "/control/rc":
+		code, ok := responseCodes[r.FormValue("rc")]
+		if !ok {
+			code, err = strconv.Atoi(r.FormValue("rc"))
+			if err != nil {
+				http.Error(w, "invalid response code: "+r.FormValue("rc"), http.StatusBadRequest)
+				return
+			}
+		}
+		SetResponseCode(code)
+	case "/control/faults":
+		faultsHandler(w, r)
+		return
+	case "/control/reset":
+		Reset()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
 	if err != nil {
 		writeError(w, "MarshalingError")
 		return
@@ -122,6 +321,11 @@ func pollHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+// pingHandler handles a ping request from a client, which simply checks reachability.
+func pingHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
 // writeError writes a JSON response containing a NetReceiver error code.
 func writeError(w http.ResponseWriter, er string) {
 	w.Header().Add("Content-Type", "application/json")
@@ -0,0 +1,360 @@
+/*
+NAME
+	netspoofer_test.go - tests for netspoofer.
+
+LICENSE
+  netspoofer_test.go is Copyright (C) 2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with revid in gpl.txt.  If not, see [GNU licenses](http://www.gnu.org/licenses).
+*/
+
+package netspoofer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ausocean/client/pi/netsender"
+)
+
+// newServer returns a test server for Handler, with the state of the
+// service reset.
+func newServer(t *testing.T) *httptest.Server {
+	Reset()
+	srv := httptest.NewServer(Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		Reset()
+	})
+	return srv
+}
+
+// post posts the form values to the path of srv, and returns the HTTP status.
+func post(t *testing.T, srv *httptest.Server, path string, form url.Values) int {
+	resp, err := http.PostForm(srv.URL+path, form)
+	if err != nil {
+		t.Fatalf("could not post to %s: %v", path, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// get gets the path of srv, and returns the HTTP status and the reply body.
+func get(t *testing.T, srv *httptest.Server, path string) (int, string) {
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatalf("could not get %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read reply to %s: %v", path, err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+// reply gets the path of srv and decodes the JSON reply.
+func reply(t *testing.T, srv *httptest.Server, path string) map[string]interface{} {
+	status, body := get(t, srv, path)
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status for %s: %d", path, status)
+	}
+	var r map[string]interface{}
+	err := json.Unmarshal([]byte(body), &r)
+	if err != nil {
+		t.Fatalf("could not decode reply to %s: %v: %s", path, err, body)
+	}
+	return r
+}
+
+// TestControl tests that the control endpoints change the vars, var sum and
+// response codes returned to devices.
+func TestControl(t *testing.T) {
+	srv := newServer(t)
+	vs := reply(t, srv, "/config")["vs"].(float64)
+
+	if status := post(t, srv, "/control/vars", url.Values{"Light": {"On"}}); status != http.StatusOK {
+		t.Fatalf("unexpected status setting vars: %d", status)
+	}
+	if status := post(t, srv, "/control/mode", url.Values{"mode": {"Paused"}}); status != http.StatusOK {
+		t.Fatalf("unexpected status setting mode: %d", status)
+	}
+	vars := reply(t, srv, "/vars")
+	if vars["Light"] != "On" || vars["mode"] != "Paused" {
+		t.Errorf("unexpected vars: %v", vars)
+	}
+	if vars["vs"] != strconv.Itoa(int(vs)+2) {
+		t.Errorf("var sum not incremented by vars and mode: %v", vars["vs"])
+	}
+
+	post(t, srv, "/control/varsum", nil)
+	post(t, srv, "/control/vars", url.Values{"Light": {""}})
+	vars = reply(t, srv, "/vars")
+	if _, ok := vars["Light"]; ok {
+		t.Errorf("var not deleted: %v", vars)
+	}
+	if vars["vs"] != strconv.Itoa(int(vs)+4) {
+		t.Errorf("unexpected var sum: %v", vars["vs"])
+	}
+
+	for _, test := range []struct {
+		rc   string
+		want int
+	}{
+		{"Reboot", netsender.ResponseReboot},
+		{"Upgrade", netsender.ResponseUpgrade},
+		{"7", 7},
+	} {
+		if status := post(t, srv, "/control/rc", url.Values{"rc": {test.rc}}); status != http.StatusOK {
+			t.Fatalf("unexpected status setting rc %s: %d", test.rc, status)
+		}
+		state := reply(t, srv, "/control")
+		if int(state["rc"].(float64)) != test.want {
+			t.Errorf("rc %s: unexpected pending response code: %v", test.rc, state["rc"])
+		}
+		if got := reply(t, srv, "/poll"); int(got["rc"].(float64)) != test.want {
+			t.Errorf("rc %s: unexpected response code: %v", test.rc, got["rc"])
+		}
+		if got := reply(t, srv, "/config"); int(got["rc"].(float64)) != netsender.ResponseOK {
+			t.Errorf("rc %s: response code not reset: %v", test.rc, got["rc"])
+		}
+	}
+
+	post(t, srv, "/control/reset", nil)
+	state := reply(t, srv, "/control")
+	if vars := state["vars"].(map[string]interface{}); len(vars) != 1 || vars["mode"] != "Normal" {
+		t.Errorf("vars not reset: %v", vars)
+	}
+	if state["vs"].(float64) <= vs {
+		t.Errorf("var sum not incremented by reset: %v", state["vs"])
+	}
+
+	for _, test := range []struct {
+		method string
+		path   string
+		form   url.Values
+		want   int
+	}{
+		{http.MethodPost, "/control/rc", url.Values{"rc": {"Nonsense"}}, http.StatusBadRequest},
+		{http.MethodPost, "/control/mode", nil, http.StatusBadRequest},
+		{http.MethodPost, "/control/nonsense", nil, http.StatusNotFound},
+		{http.MethodGet, "/control/vars", nil, http.StatusMethodNotAllowed},
+	} {
+		req, err := http.NewRequest(test.method, srv.URL+test.path, strings.NewReader(test.form.Encode()))
+		if err != nil {
+			t.Fatalf("could not create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", test.method, test.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.path, resp.StatusCode, test.want)
+		}
+	}
+}
+
+// TestPollLogs tests that logs sent with the test pin are stored.
+func TestPollLogs(t *testing.T) {
+	srv := newServer(t)
+	resp, err := http.Post(srv.URL+"/poll?ma=00:00:00:00:00:01&"+testPin+"=5", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("could not poll: %v", err)
+	}
+	defer resp.Body.Close()
+	var r map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		t.Fatalf("could not decode poll reply: %v", err)
+	}
+	if r[testPin] != "5" || r["ma"] != "00:00:00:00:00:01" {
+		t.Errorf("unexpected poll reply: %v", r)
+	}
+	if Logs() != "hello" {
+		t.Errorf("unexpected logs: %q", Logs())
+	}
+}
+
+// TestFaults tests the faults injected into replies to service requests, but
+// not the control endpoints.
+func TestFaults(t *testing.T) {
+	srv := newServer(t)
+
+	for _, test := range []struct {
+		name  string
+		form  url.Values
+		check func(status int, body string, err error) bool
+	}{
+		{
+			name: "error",
+			form: url.Values{"errorrate": {"1"}, "errorstatus": {"502"}},
+			check: func(status int, body string, err error) bool {
+				return err == nil && status == http.StatusBadGateway
+			},
+		},
+		{
+			name: "malformed",
+			form: url.Values{"malformedrate": {"1"}},
+			check: func(status int, body string, err error) bool {
+				return err == nil && status == http.StatusOK && body == malformedJSON
+			},
+		},
+		{
+			name: "truncate",
+			form: url.Values{"truncaterate": {"1"}},
+			check: func(status int, body string, err error) bool {
+				return err != nil
+			},
+		},
+		{
+			name: "latency",
+			form: url.Values{"latency": {"50ms"}},
+			check: func(status int, body string, err error) bool {
+				return err == nil && status == http.StatusOK && json.Valid([]byte(body))
+			},
+		},
+	} {
+		if status := post(t, srv, "/control/faults", test.form); status != http.StatusOK {
+			t.Fatalf("%s: unexpected status setting faults: %d", test.name, status)
+		}
+		start := time.Now()
+		var status int
+		var body []byte
+		resp, err := http.Get(srv.URL + "/config")
+		if err == nil {
+			status = resp.StatusCode
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if !test.check(status, string(body), err) {
+			t.Errorf("%s: unexpected reply: status %d, body %q, error %v", test.name, status, body, err)
+		}
+		if test.name == "latency" && time.Since(start) < 50*time.Millisecond {
+			t.Errorf("latency not added: %v", time.Since(start))
+		}
+
+		// Control endpoints are never faulted.
+		if _, ok := reply(t, srv, "/control")["faults"]; !ok {
+			t.Errorf("%s: faults missing from state", test.name)
+		}
+	}
+
+	for _, form := range []url.Values{
+		{"errorrate": {"2"}},
+		{"distribution": {"normal"}},
+		{"latency": {"soon"}},
+		{"latency": {"-1s"}},
+	} {
+		if status := post(t, srv, "/control/faults", form); status != http.StatusBadRequest {
+			t.Errorf("invalid faults %v: got status %d", form, status)
+		}
+	}
+
+	post(t, srv, "/control/reset", nil)
+	if status, body := get(t, srv, "/config"); status != http.StatusOK || !json.Valid([]byte(body)) {
+		t.Errorf("faults not reset: status %d, body %q", status, body)
+	}
+}
+
+// TestRecordReplay tests that sessions are recorded without device keys or
+// WiFi passwords, and replayed in order.
+func TestRecordReplay(t *testing.T) {
+	var n int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/config":
+			io.WriteString(w, `{"rc":0,"dk":"12345","wi":"ssid,secret","mp":60}`)
+		case "/poll":
+			io.WriteString(w, `{"rc":0,"vs":`+strings.Repeat("1", n)+`}`)
+		}
+	}))
+	defer upstream.Close()
+
+	_, err := NewRecorder("data.cloudblue.org", io.Discard)
+	if err == nil {
+		t.Error("expected error for relative upstream")
+	}
+
+	var rec bytes.Buffer
+	h, err := NewRecorder(upstream.URL, &rec)
+	if err != nil {
+		t.Fatalf("could not create recorder: %v", err)
+	}
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	for _, path := range []string{
+		"/config?dk=12345&wi=ssid,secret&ma=00:00:00:00:00:01",
+		"/poll?dk=12345",
+		"/poll?dk=12345",
+	} {
+		resp, err := http.Post(proxy.URL+path, "text/plain", strings.NewReader("body"))
+		if err != nil {
+			t.Fatalf("could not send %s: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	recorded := rec.String()
+	for _, secret := range []string{"12345", "secret"} {
+		if strings.Contains(recorded, secret) {
+			t.Errorf("recording contains %q: %s", secret, recorded)
+		}
+	}
+	var first Exchange
+	err = json.NewDecoder(strings.NewReader(recorded)).Decode(&first)
+	if err != nil {
+		t.Fatalf("could not decode exchange: %v", err)
+	}
+	q, _ := url.ParseQuery(first.Query)
+	if q.Get("wi") != "ssid,***" || q.Get("dk") != "REDACTED" || q.Get("ma") != "00:00:00:00:00:01" {
+		t.Errorf("unexpected recorded query: %s", first.Query)
+	}
+	if first.Body != `{"mp":60,"rc":0}` || first.RequestSize != 4 {
+		t.Errorf("unexpected recorded exchange: %+v", first)
+	}
+
+	h, err = NewReplayer(strings.NewReader(recorded))
+	if err != nil {
+		t.Fatalf("could not create replayer: %v", err)
+	}
+	replay := httptest.NewServer(h)
+	defer replay.Close()
+	for i, want := range []string{`{"rc":0,"vs":11}`, `{"rc":0,"vs":111}`, `{"rc":0,"vs":111}`} {
+		status, body := get(t, replay, "/poll")
+		if status != http.StatusOK || body != want {
+			t.Errorf("poll %d: got status %d, body %s, want %s", i, status, body, want)
+		}
+	}
+	if status, _ := get(t, replay, "/vars"); status != http.StatusNotFound {
+		t.Errorf("unrecorded path: got status %d", status)
+	}
+
+	_, err = NewReplayer(strings.NewReader("{"))
+	if err == nil {
+		t.Error("expected error for malformed recording")
+	}
+}
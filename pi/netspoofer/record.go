@@ -0,0 +1,188 @@
+/*
+NAME
+	record.go - recording of real device sessions with the service, and their replay, for regression testing.
+
+LICENSE
+  record.go is Copyright (C) 2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with revid in gpl.txt.  If not, see [GNU licenses](http://www.gnu.org/licenses).
+*/
+
+package netspoofer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ausocean/client/pi/netsender"
+)
+
+// redactedParams are the request params whose values are not recorded, and the reply
+// fields, e.g., in config replies, which are not recorded. The WiFi password in the wi
+// param is also not recorded (see netsender.Redact).
+var redactedParams = []string{"dk", "pk", "wi"}
+
+// Exchange is a recorded request to the service and its reply.
+type Exchange struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Query       string    `json:"query"`   // Query params, with device keys and WiFi password redacted.
+	RequestSize int64     `json:"reqSize"` // Size of the request body, which is not recorded.
+	Status      int       `json:"status"`  // HTTP status of the reply.
+	ContentType string    `json:"type"`    // Content type of the reply.
+	Body        string    `json:"body"`    // Body of the reply, without device keys or WiFi settings.
+}
+
+// NewRecorder returns a handler which proxies requests to the service at upstream, e.g.,
+// "http://data.cloudblue.org", and writes each request and its reply to w as a line of
+// JSON (see Exchange), so that a device's session with the real service can be replayed
+// later (see NewReplayer). Request bodies, e.g., logs and video, are not recorded.
+func NewRecorder(upstream string, w io.Writer) (http.Handler, error) {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream: %w", err)
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return nil, errors.New("upstream must be an absolute URL: " + upstream)
+	}
+
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = target.Host
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+
+		r := resp.Request
+		ex := Exchange{
+			Time:        time.Now().UTC(),
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			Query:       redactQuery(r.URL.Query()),
+			RequestSize: r.ContentLength,
+			Status:      resp.StatusCode,
+			ContentType: resp.Header.Get("Content-Type"),
+			Body:        redactBody(body),
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return enc.Encode(ex)
+	}
+	return proxy, nil
+}
+
+// redactQuery returns the encoded query params q with device keys and the WiFi password
+// redacted. The SSID is kept, e.g., wi=ssid,***.
+func redactQuery(q url.Values) string {
+	for _, p := range redactedParams {
+		if !q.Has(p) {
+			continue
+		}
+		if p == "wi" {
+			q.Set(p, netsender.Redact(p, q.Get(p)))
+			continue
+		}
+		q.Set(p, "REDACTED")
+	}
+	return q.Encode()
+}
+
+// redactBody returns a reply body without device keys or WiFi settings. These are removed,
+// rather than replaced, since a replayed config reply with a different key would cause a
+// key rotation, and one with a redacted WiFi password would break the device's WiFi.
+func redactBody(body []byte) string {
+	var reply map[string]json.RawMessage
+	if json.Unmarshal(body, &reply) != nil {
+		return string(body)
+	}
+	var redacted bool
+	for _, p := range redactedParams {
+		if _, ok := reply[p]; ok {
+			delete(reply, p)
+			redacted = true
+		}
+	}
+	if !redacted {
+		return string(body)
+	}
+	b, err := json.Marshal(reply)
+	if err != nil {
+		return string(body)
+	}
+	return string(b)
+}
+
+// NewReplayer returns a handler which replays the replies recorded by NewRecorder and read
+// from r. Requests are matched by path, and the replies for each path are returned in the
+// order recorded, after which the last reply is repeated, so that a client's behaviour
+// against an actual session of the service can be tested. Requests for paths which were not
+// recorded get 404 Not Found.
+func NewReplayer(r io.Reader) (http.Handler, error) {
+	replies := make(map[string][]Exchange)
+	dec := json.NewDecoder(r)
+	for {
+		var ex Exchange
+		err := dec.Decode(&ex)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decode exchange: %w", err)
+		}
+		replies[ex.Path] = append(replies[ex.Path], ex)
+	}
+
+	var mu sync.Mutex
+	next := make(map[string]int)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		exs := replies[r.URL.Path]
+		if len(exs) == 0 {
+			mu.Unlock()
+			http.NotFound(w, r)
+			return
+		}
+		i := min(next[r.URL.Path], len(exs)-1)
+		next[r.URL.Path] = i + 1
+		ex := exs[i]
+		mu.Unlock()
+
+		if r.Body != nil {
+			io.Copy(io.Discard, r.Body)
+		}
+		if ex.ContentType != "" {
+			w.Header().Set("Content-Type", ex.ContentType)
+		}
+		w.WriteHeader(ex.Status)
+		io.WriteString(w, ex.Body)
+	}), nil
+}
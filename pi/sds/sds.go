@@ -36,11 +36,16 @@ import (
 
 // Errors specific to the sds package:
 var (
-	ErrUnimplemented   = errors.New("Unimplemented")
-	ErrParsingCpuTemp  = errors.New("Error parsing CPU temperature")
-	ErrParsingCpuUsage = errors.New("Error parsing CPU usage")
+	ErrUnimplemented    = errors.New("Unimplemented")
+	ErrParsingCpuTemp   = errors.New("Error parsing CPU temperature")
+	ErrParsingCpuUsage  = errors.New("Error parsing CPU usage")
+	ErrParsingThrottled = errors.New("Error parsing throttled state")
 )
 
+// throttledFile is the sysfs file reporting the throttled state, used
+// when vcgencmd is unavailable, e.g., on 64-bit Raspberry Pi OS.
+const throttledFile = "/sys/devices/platform/soc/soc:firmware/get_throttled"
+
 // CPU stats reported by /proc/stat
 const (
 	cpuNumber = iota
@@ -58,9 +63,14 @@ const (
 )
 
 // ReadSystem implements netsender.PinRead for system information about the Raspberry Pi.
-//  X20 - CPU temperature determined by /opt/vc/bin/vcgencmd.
-//  X21 - CPU usage determined by read /proc/stat.
-//  X22 - Virtual memory (kB) as returned by runtime.ReadMemStats.
+//
+//	X20 - CPU temperature determined by /opt/vc/bin/vcgencmd.
+//	X21 - CPU usage determined by read /proc/stat.
+//	X22 - Virtual memory (kB) as returned by runtime.ReadMemStats.
+//	X30 - Throttled state bitmask determined by /opt/vc/bin/vcgencmd or sysfs.
+//	      Bits 0-3 indicate current under-voltage, frequency capping, throttling
+//	      and soft temperature limit, and bits 16-19 indicate that these have
+//	      occurred since boot.
 func ReadSystem(pin *netsender.Pin) error {
 	var val float64
 	pin.Value = -1
@@ -101,6 +111,13 @@ func ReadSystem(pin *netsender.Pin) error {
 		runtime.ReadMemStats(&ms)
 		val = float64(ms.Sys) / 1024
 
+	case "X30":
+		n, err := throttled()
+		if err != nil {
+			return err
+		}
+		val = float64(n)
+
 	default:
 		return ErrUnimplemented
 	}
@@ -108,6 +125,28 @@ func ReadSystem(pin *netsender.Pin) error {
 	return nil
 }
 
+// throttled returns the throttled state bitmask, as reported by
+// "vcgencmd get_throttled" in the form "throttled=0x50005", or else by
+// sysfs as a hex value without the 0x prefix.
+func throttled() (int, error) {
+	var s string
+	out, err := exec.Command("/opt/vc/bin/vcgencmd", "get_throttled").Output()
+	if err == nil {
+		s = strings.TrimPrefix(strings.TrimSpace(string(out)), "throttled=")
+	} else {
+		content, err := ioutil.ReadFile(throttledFile)
+		if err != nil {
+			return 0, err
+		}
+		s = strings.TrimSpace(string(content))
+	}
+	n, err := strconv.ParseInt(strings.TrimPrefix(s, "0x"), 16, 64)
+	if err != nil {
+		return 0, ErrParsingThrottled
+	}
+	return int(n), nil
+}
+
 // cpuStats reads CPU stats from /proc/stat
 // ToDo: extend for multiple cores
 func cpuStats() (stats []int, err error) {
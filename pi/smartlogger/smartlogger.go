@@ -29,26 +29,65 @@ LICENSE
 package smartlogger
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 
 	"github.com/ausocean/client/pi/netsender"
 )
 
-const mimeType = "text/plain" // mime-type to send to NetReceiver
+const (
+	mimeType     = "text/plain"       // mime-type to send to NetReceiver
+	gzipMimeType = "application/gzip" // mime-type of compressed log files
+)
+
+// manifestFile is the name of the file, in the log directory, listing the upload IDs of
+// the log files most recently sent, and maxManifest is the maximum number of IDs it keeps.
+const (
+	manifestFile = "sent-manifest"
+	maxManifest  = 100
+)
+
+// flushLogsVar is the var which, while true, causes log files to be sent by SendLogs
+// even when sending would otherwise be deferred.
+const flushLogsVar = "FlushLogs"
 
 type Smartlogger struct {
-	path      string
-	LogRoller lumberjack.Logger
-	keepLogs  bool
+	path       string
+	LogRoller  lumberjack.Logger
+	keepLogs   bool
+	gzipUpload bool  // True if log files are compressed with gzip before sending.
+	quota      int64 // Maximum size of the log directory in bytes, or 0 for no limit.
+	dropped    int   // Log files deleted to keep within the quota.
+
+	minUpload      int  // Minimum upload speed in bits per second for sending, or 0 for any.
+	deferStreaming bool // True if sending is deferred while MTS data is being sent.
+	mtsRequests    int  // MTS requests made as of the last SendLogs.
+	deferred       bool // True if the last SendLogs was deferred.
+
+	manifest []string // Upload IDs of the log files most recently sent, oldest first.
 }
 
-// Rotate closes the current log file and dates it, followed by opening a new log file
+// Rotate closes the current log file and dates it, followed by opening a new log file.
+// Backups are then deleted if the quota is exceeded (see SetQuota).
 func (s *Smartlogger) Rotate() error {
-	return s.LogRoller.Rotate()
+	err := s.LogRoller.Rotate()
+	if err != nil {
+		return err
+	}
+	s.enforceQuota()
+	return nil
 }
 
 // New generates and returns a new logger object
@@ -69,13 +108,136 @@ func (s *Smartlogger) SetKeepLogs(kl bool) {
 	s.keepLogs = kl
 }
 
-// SendLogs uses netsender to send all backup log files as text to netreciever. On a succesful send, the file is deleted.
-// On failure, the log file is retained and will be sent at next call of SendLogs.
-// A call to SendLogs should be preceded by a call to Rotate if most recent log messages are required to be sent.
+// SetQuota sets the maximum total size in bytes of the log files, including backups kept
+// by SetKeepLogs, so that unsent logs cannot fill the filesystem. When the quota is
+// exceeded, backups are deleted, oldest first, starting with those which have been sent.
+// The current log file is never deleted, so LogRoller.MaxSize is reduced, if need be, to
+// the quota, or to one megabyte, the smallest size LogRoller supports, if the quota is less.
+// Zero, the default, means no quota.
+func (s *Smartlogger) SetQuota(bytes int64) {
+	s.quota = bytes
+	if bytes <= 0 {
+		return
+	}
+	mb := int(max(bytes>>20, 1))
+	if s.LogRoller.MaxSize <= 0 || s.LogRoller.MaxSize > mb {
+		s.LogRoller.MaxSize = mb
+	}
+}
+
+// Dropped returns the number of log files which have been deleted to keep within the quota.
+func (s *Smartlogger) Dropped() int {
+	return s.dropped
+}
+
+// enforceQuota deletes backups, oldest first, while the log files exceed the quota.
+// Sent backups are deleted before unsent backups.
+func (s *Smartlogger) enforceQuota() {
+	if s.quota <= 0 {
+		return
+	}
+	sent, _ := filepath.Glob(filepath.Join(s.path, "backups", "netsender-*"))
+	unsent, _ := filepath.Glob(filepath.Join(s.path, "netsender-*"))
+	sort.Strings(sent)
+	sort.Strings(unsent)
+	backups := append(sent, unsent...)
+
+	var total int64
+	sizes := make(map[string]int64)
+	for _, f := range append(backups, s.LogRoller.Filename) {
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		sizes[f] = fi.Size()
+		total += fi.Size()
+	}
+
+	var n int
+	for _, f := range backups {
+		if total <= s.quota {
+			break
+		}
+		if err := os.Remove(f); err != nil {
+			s.LogRoller.Write([]byte("Can't delete logFile" + filepath.Base(f) + ". Err: " + err.Error() + "\n"))
+			continue
+		}
+		total -= sizes[f]
+		n++
+	}
+	if n != 0 {
+		s.dropped += n
+		s.LogRoller.Write([]byte("Deleted " + strconv.Itoa(n) + " log files to keep within quota; " + strconv.Itoa(s.dropped) + " deleted in total\n"))
+	}
+}
+
+// SetMinUploadSpeed sets the minimum upload speed in bits per second, as measured by the
+// Sender's upload speed test (see netsender.Sender.UploadSpeed), for log files to be sent.
+// While the upload speed is lower, SendLogs defers sending, so that bulk uploads do not
+// use a poor link. Sending is not deferred if the upload speed has not been measured.
+// Zero, the default, means any speed.
+func (s *Smartlogger) SetMinUploadSpeed(bps int) {
+	s.minUpload = bps
+}
+
+// SetDeferWhileStreaming sets whether SendLogs defers sending while video or other MTS
+// data is being sent, i.e., if the Sender has made MTS requests since the last call.
+func (s *Smartlogger) SetDeferWhileStreaming(d bool) {
+	s.deferStreaming = d
+}
+
+// deferSend returns a reason for SendLogs to defer sending, or an empty string if
+// log files should be sent now. Sending is never deferred while the FlushLogs var is true.
+func (s *Smartlogger) deferSend(ns *netsender.Sender) string {
+	stats := ns.RequestStats()[netsender.RequestMts]
+	mts := stats.Success + stats.Failure
+	streaming := mts != s.mtsRequests
+	s.mtsRequests = mts
+
+	if flush, _ := strconv.ParseBool(ns.LastVars()[flushLogsVar]); flush {
+		return ""
+	}
+	if up := ns.UploadSpeed(); s.minUpload > 0 && up >= 0 && up < s.minUpload {
+		return "upload speed " + strconv.Itoa(up) + " bps is below " + strconv.Itoa(s.minUpload) + " bps"
+	}
+	if s.deferStreaming && streaming {
+		return "streaming is active"
+	}
+	return ""
+}
+
+// SetCompressLogs sets whether log files are compressed with gzip before
+// sending them to the cloud. This is off by default, since the service
+// must accept gzip log files. Log files which are already compressed,
+// e.g., by LogRoller, are always sent as is.
+func (s *Smartlogger) SetCompressLogs(c bool) {
+	s.gzipUpload = c
+}
+
+// SendLogs uses netsender to send all backup log files to netreciever, compressed if
+// SetCompressLogs(true) was called. Sending may be deferred until a later call, depending
+// on the upload speed and streaming (see SetMinUploadSpeed and SetDeferWhileStreaming),
+// unless the FlushLogs var is true. Each file is sent with an upload ID, which is a hash
+// of its content, so that the cloud can detect duplicates. The IDs of files sent are kept
+// in a manifest, so that a file which was sent but could not then be deleted is not sent
+// again. On a succesful send, the file is deleted. On failure, the log file is retained
+// and will be sent at next call of SendLogs. A call to SendLogs should be preceded by a
+// call to Rotate if most recent log messages are required to be sent.
 func (s *Smartlogger) SendLogs(ns *netsender.Sender) {
 	var err error
 	var logFiles []string
 
+	s.enforceQuota()
+
+	if reason := s.deferSend(ns); reason != "" {
+		if !s.deferred {
+			s.LogRoller.Write([]byte("Deferring sending log files: " + reason + "\n"))
+		}
+		s.deferred = true
+		return
+	}
+	s.deferred = false
+
 	logFiles, err = filepath.Glob(filepath.Join(s.path, "netsender-*"))
 	if err != nil {
 		s.LogRoller.Write([]byte("Can't glob matching log files\n"))
@@ -92,23 +254,45 @@ func (s *Smartlogger) SendLogs(ns *netsender.Sender) {
 			s.LogRoller.Write([]byte("Can't read log file" + lf + "\n"))
 		}
 
+		mt := mimeType
+		id := uploadID(logFileContent)
+		switch {
+		case strings.HasSuffix(lf, ".gz"):
+			mt = gzipMimeType
+			if content, err := decompress(logFileContent); err == nil {
+				id = uploadID(content)
+			}
+		case s.gzipUpload:
+			gz, err := compress(logFileContent)
+			if err != nil {
+				s.LogRoller.Write([]byte("Can't compress log file" + lf + ". Err: " + err.Error() + "\n"))
+				break
+			}
+			logFileContent, mt = gz, gzipMimeType
+		}
+
 		for i := range pins {
 			if pins[i].Name == "T0" {
 				pins[i].Value = len(logFileContent)
 				pins[i].Data = logFileContent
-				pins[i].MimeType = mimeType
+				pins[i].MimeType = mt
 			}
 		}
-		_, _, err = ns.Send(netsender.RequestPoll, pins)
-
-		if err != nil {
-			s.LogRoller.Write([]byte("Can't send Log File contents for " + lf + ". Received error: " + err.Error() + "\n"))
-			continue
+		// A log file which was sent but could not then be deleted or moved is not sent again.
+		if s.sent(id) {
+			s.LogRoller.Write([]byte("Not resending duplicate log file " + lf + " with ID " + id + "\n"))
+		} else {
+			_, _, err = ns.Send(netsender.RequestPoll, pins, netsender.WithUploadID("T0", id))
+			if err != nil {
+				s.LogRoller.Write([]byte("Can't send Log File contents for " + lf + ". Received error: " + err.Error() + "\n"))
+				continue
+			}
+			s.recordSent(id)
 		}
+
 		if !s.keepLogs {
 			if err = os.Remove(ff); err != nil {
 				s.LogRoller.Write([]byte("Can't delete logFile" + lf + ". Err: " + err.Error() + "\n"))
-				//TODO: should we try redelete / signal this is a duplicate now or leave to cloud to detect duplicates??
 			}
 		} else {
 			if _, err := os.Stat(filepath.Join(s.path, "backups")); os.IsNotExist(err) {
@@ -116,9 +300,84 @@ func (s *Smartlogger) SendLogs(ns *netsender.Sender) {
 			}
 			if err = os.Rename(ff, filepath.Join(s.path, "backups", lf)); err != nil {
 				s.LogRoller.Write([]byte("Can't move logFile" + lf + ". Err: " + err.Error() + "\n"))
-				//TODO: should we try redelete / signal this is a duplicate now or leave to cloud to detect duplicates??
 			}
 		}
 
 	}
 }
+
+// uploadID returns the upload ID of a log file, which is a hash of its uncompressed content.
+// The same log file therefore has the same ID whether or not it is compressed.
+func uploadID(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:16])
+}
+
+// loadManifest reads the upload IDs of the log files most recently sent, if not already read.
+func (s *Smartlogger) loadManifest() {
+	if s.manifest != nil {
+		return
+	}
+	s.manifest = []string{}
+	f, err := os.Open(filepath.Join(s.path, manifestFile))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if id := strings.TrimSpace(sc.Text()); id != "" {
+			s.manifest = append(s.manifest, id)
+		}
+	}
+}
+
+// sent returns true if the log file with the given upload ID has been sent.
+func (s *Smartlogger) sent(id string) bool {
+	s.loadManifest()
+	for _, m := range s.manifest {
+		if m == id {
+			return true
+		}
+	}
+	return false
+}
+
+// recordSent adds an upload ID to the manifest of sent log files, dropping the oldest IDs
+// beyond maxManifest, and writes the manifest to disk.
+func (s *Smartlogger) recordSent(id string) {
+	s.loadManifest()
+	s.manifest = append(s.manifest, id)
+	if n := len(s.manifest) - maxManifest; n > 0 {
+		s.manifest = s.manifest[n:]
+	}
+	err := os.WriteFile(filepath.Join(s.path, manifestFile), []byte(strings.Join(s.manifest, "\n")+"\n"), 0644)
+	if err != nil {
+		s.LogRoller.Write([]byte("Can't write sent manifest. Err: " + err.Error() + "\n"))
+	}
+}
+
+// compress returns data compressed with gzip.
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress returns data decompressed with gzip.
+func decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
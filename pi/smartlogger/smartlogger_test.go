@@ -2,14 +2,18 @@ package smartlogger
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -268,3 +272,215 @@ func dropout(proxy *toxiproxy.Proxy, off, on time.Duration) func() (done chan st
 		return done
 	}
 }
+
+// testLogger implements a netsender.Logger which discards logs.
+type testLogger struct{}
+
+func (testLogger) SetLevel(int8)                    {}
+func (testLogger) Log(int8, string, ...interface{}) {}
+
+// upload is a log file received by a logServer.
+type upload struct {
+	id       string // Upload ID.
+	mimeType string // MIME type.
+	data     []byte // Content, as sent.
+}
+
+// logServer is a test service which records the log files sent on T0,
+// and replies to vars requests with vars, if not empty.
+type logServer struct {
+	mu      sync.Mutex
+	uploads []upload
+	vars    string
+}
+
+func (s *logServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	vars := s.vars
+	s.mu.Unlock()
+	if r.URL.Path == "/vars" && vars != "" {
+		io.WriteString(w, vars)
+		return
+	}
+	if r.URL.Path == "/poll" && r.URL.Query().Get("T0") != "" {
+		b, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.uploads = append(s.uploads, upload{id: r.URL.Query().Get("T0.id"), mimeType: r.Header.Get("Content-Type"), data: b})
+		s.mu.Unlock()
+	}
+	io.WriteString(w, `{"rc":0}`)
+}
+
+// received returns the log files received so far.
+func (s *logServer) received() []upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]upload(nil), s.uploads...)
+}
+
+// newService returns a logServer and a Sender with T0 as an input, which
+// sends to it.
+func newService(t *testing.T) (*logServer, *netsender.Sender) {
+	svc := &logServer{}
+	srv := httptest.NewServer(svc)
+	t.Cleanup(srv.Close)
+	conf := filepath.Join(t.TempDir(), "netsender.conf")
+	err := os.WriteFile(conf, []byte("ma 00:00:00:00:00:01\ndk 10000001\nip T0\nmp 1\nsh "+srv.URL+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("could not write config: %v", err)
+	}
+	ns, err := netsender.New(testLogger{}, nil, nil, nil, netsender.WithConfigFile(conf))
+	if err != nil {
+		t.Fatalf("unexpected error from netsender.New: %v", err)
+	}
+	return svc, ns
+}
+
+// writeBackup writes a backup log file to dir, as rotated by LogRoller n
+// minutes ago. Backups must be recent, since LogRoller removes old ones.
+func writeBackup(t *testing.T, dir string, n int, content string) string {
+	stamp := time.Now().UTC().Add(-time.Duration(n) * time.Minute).Format("2006-01-02T15-04-05.000")
+	path := filepath.Join(dir, "netsender-"+stamp+".log")
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("could not write backup: %v", err)
+	}
+	return path
+}
+
+// TestCompressLogs tests that log files are sent uncompressed by default,
+// and compressed with gzip once enabled.
+func TestCompressLogs(t *testing.T) {
+	svc, ns := newService(t)
+	dir := t.TempDir()
+	sl := New(dir)
+
+	writeBackup(t, dir, 2, "plain\n")
+	sl.SendLogs(ns)
+	got := svc.received()
+	if len(got) != 1 || got[0].mimeType != mimeType || string(got[0].data) != "plain\n" {
+		t.Fatalf("unexpected upload by default: %+v", got)
+	}
+
+	sl.SetCompressLogs(true)
+	writeBackup(t, dir, 1, "compressed\n")
+	sl.SendLogs(ns)
+	got = svc.received()
+	if len(got) != 2 || got[1].mimeType != gzipMimeType {
+		t.Fatalf("unexpected upload with compression: %+v", got)
+	}
+	data, err := decompress(got[1].data)
+	if err != nil || string(data) != "compressed\n" {
+		t.Errorf("unexpected compressed content: %q, %v", data, err)
+	}
+	if got[1].id != uploadID([]byte("compressed\n")) {
+		t.Errorf("upload ID is not of the uncompressed content: %s", got[1].id)
+	}
+}
+
+// TestQuotaMaxSize tests that SetQuota limits the size of the current log
+// file to the quota.
+func TestQuotaMaxSize(t *testing.T) {
+	for _, test := range []struct {
+		quota int64
+		want  int
+	}{
+		{quota: 0, want: 500},
+		{quota: 1 << 30, want: 500},
+		{quota: 10 << 20, want: 10},
+		{quota: 1000, want: 1},
+	} {
+		sl := New(t.TempDir())
+		sl.SetQuota(test.quota)
+		if sl.LogRoller.MaxSize != test.want {
+			t.Errorf("unexpected max size for quota %d: got %d MB, want %d MB", test.quota, sl.LogRoller.MaxSize, test.want)
+		}
+	}
+}
+
+// TestDeferSend tests that sending is deferred on a slow link and while
+// streaming, unless the FlushLogs var is true.
+func TestDeferSend(t *testing.T) {
+	svc, ns := newService(t)
+	dir := t.TempDir()
+	sl := New(dir)
+	setVars := func(vars string) {
+		svc.mu.Lock()
+		svc.vars = vars
+		svc.mu.Unlock()
+		_, err := ns.Vars()
+		if err != nil {
+			t.Fatalf("unexpected error from Vars: %v", err)
+		}
+	}
+
+	// The upload speed is below the minimum.
+	err := ns.TestUpload()
+	if err != nil {
+		t.Fatalf("unexpected error from TestUpload: %v", err)
+	}
+	sl.SetMinUploadSpeed(ns.UploadSpeed() + 1)
+	backup := writeBackup(t, dir, 2, "slow\n")
+	sl.SendLogs(ns)
+	if got := svc.received(); len(got) != 0 {
+		t.Fatalf("unexpected upload on a slow link: %+v", got)
+	}
+	if _, err := os.Stat(backup); err != nil {
+		t.Errorf("deferred log file removed: %v", err)
+	}
+
+	// FlushLogs overrides the deferral.
+	setVars(`{"vs":"1","FlushLogs":"true"}`)
+	sl.SendLogs(ns)
+	if got := svc.received(); len(got) != 1 || string(got[0].data) != "slow\n" {
+		t.Fatalf("unexpected uploads with FlushLogs: %+v", got)
+	}
+
+	// MTS requests have been made since the last call.
+	setVars(`{"vs":"2","FlushLogs":"false"}`)
+	sl.SetMinUploadSpeed(0)
+	sl.SetDeferWhileStreaming(true)
+	ns.Send(netsender.RequestMts, nil)
+	writeBackup(t, dir, 1, "streaming\n")
+	sl.SendLogs(ns)
+	if got := svc.received(); len(got) != 1 {
+		t.Fatalf("unexpected upload while streaming: %+v", got)
+	}
+
+	// Streaming has stopped.
+	sl.SendLogs(ns)
+	if got := svc.received(); len(got) != 2 || string(got[1].data) != "streaming\n" {
+		t.Errorf("unexpected uploads after streaming: %+v", got)
+	}
+}
+
+// TestManifest tests that a log file which was sent, but could not then
+// be moved or deleted, is not sent again, including after a restart.
+func TestManifest(t *testing.T) {
+	svc, ns := newService(t)
+	dir := t.TempDir()
+	sl := New(dir)
+	sl.SetKeepLogs(true)
+
+	// Log files cannot be moved to the backups directory if it is a file.
+	err := os.WriteFile(filepath.Join(dir, "backups"), nil, 0644)
+	if err != nil {
+		t.Fatalf("could not write backups file: %v", err)
+	}
+	backup := writeBackup(t, dir, 1, "once\n")
+	sl.SendLogs(ns)
+	if _, err := os.Stat(backup); err != nil {
+		t.Fatalf("log file not kept after failed move: %v", err)
+	}
+	if got := svc.received(); len(got) != 1 || string(got[0].data) != "once\n" {
+		t.Fatalf("unexpected uploads: %+v", got)
+	}
+
+	for _, sl := range []*Smartlogger{sl, New(dir)} {
+		sl.SetKeepLogs(true)
+		sl.SendLogs(ns)
+		if got := svc.received(); len(got) != 1 {
+			t.Errorf("log file sent again: %+v", got)
+		}
+	}
+}
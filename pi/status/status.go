@@ -0,0 +1,312 @@
+/*
+NAME
+  status
+
+DESCRIPTION
+  status provides a local HTTP server showing the state of a netsender
+  client.
+
+LICENSE
+  status is Copyright (C) 2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with status in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+// Package status provides an opt-in HTTP server for the local network
+// which shows the state of a netsender client, i.e., its config, the last
+// vars received, pin values, connectivity and recent logs, so that the
+// state of a device can be checked without logging in to it. The state
+// is served as an HTML page at / and as JSON at /status. A Server is an
+// io.Writer, to which logs are written, e.g.,
+//
+//	st, err := status.New(":8000")
+//	if err != nil {
+//		...
+//	}
+//	log := logging.New(logVerbosity, io.MultiWriter(fileLog, netLog, st), logSuppress)
+//
+// The server is usually run by the client run loop (see
+// client.WithStatusServer). NB: The server is unauthenticated, so should
+// only be used on trusted networks. Device keys are never shown.
+package status
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ausocean/client/pi/netsender"
+)
+
+// Server defaults.
+const (
+	defaultLogLines = 100
+	readTimeout     = 10 * time.Second // Time allowed to read request headers.
+	shutdownTimeout = 5 * time.Second  // Time allowed for requests to finish on shutdown.
+)
+
+// secretParams are config params which are not shown. The wi param is
+// shown without its password (see netsender.Redact).
+var secretParams = []string{"dk", "pk"}
+
+// Server serves the state of a netsender client. Server implements
+// io.Writer, keeping the most recent log lines written to it. Server is
+// safe for concurrent use.
+type Server struct {
+	addr     string
+	logLines int
+
+	mu      sync.Mutex // Guards logs and partial.
+	logs    []string   // Recent log lines, oldest first.
+	partial []byte     // Incomplete last line.
+}
+
+// Option is a functional option for New.
+type Option func(*Server) error
+
+// New returns a Server which listens on addr, e.g., ":8000", configured
+// by the given options.
+func New(addr string, options ...Option) (*Server, error) {
+	s := &Server{addr: addr, logLines: defaultLogLines}
+	for i, o := range options {
+		if o == nil {
+			return nil, errors.New("cannot apply nil option")
+		}
+		err := o(s)
+		if err != nil {
+			return nil, fmt.Errorf("could not apply option no. %d, %w", i, err)
+		}
+	}
+	return s, nil
+}
+
+// WithLogLines returns an option that sets the number of recent log
+// lines shown. The default is 100.
+func WithLogLines(n int) Option {
+	return func(s *Server) error {
+		if n < 1 {
+			return fmt.Errorf("invalid log lines: %d", n)
+		}
+		s.logLines = n
+		return nil
+	}
+}
+
+// Write implements io.Writer, keeping the most recent log lines.
+func (s *Server) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		s.logs = append(s.logs, string(s.partial[:i]))
+		s.partial = s.partial[i+1:]
+	}
+	if len(s.logs) > s.logLines {
+		s.logs = s.logs[len(s.logs)-s.logLines:]
+	}
+	if len(s.partial) == 0 {
+		s.partial = nil // Release the buffer.
+	}
+	return len(p), nil
+}
+
+// Logs returns the recent log lines, oldest first.
+func (s *Server) Logs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.logs...)
+}
+
+// Status is the state of a netsender client.
+type Status struct {
+	Time         time.Time         `json:"time"`
+	Mode         string            `json:"mode"`
+	Error        string            `json:"error,omitempty"`
+	Config       map[string]string `json:"config"`
+	Vars         map[string]string `json:"vars"`
+	Pins         []Pin             `json:"pins"`
+	Connectivity Connectivity      `json:"connectivity"`
+	Logs         []string          `json:"logs"`
+}
+
+// Pin is the most recent value of a pin. For pins with payload data, the
+// value is the length of the data.
+type Pin struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
+// Connectivity describes the recent service requests of a client.
+type Connectivity struct {
+	Online      bool      `json:"online"`                // True if the last request succeeded.
+	LastRequest time.Time `json:"lastRequest,omitempty"` // Time of the last request, if known.
+	LastError   string    `json:"lastError,omitempty"`   // Error from the last request, if any.
+	Requests    int64     `json:"requests"`
+	Failures    int64     `json:"failures"`
+	LatencyP50  string    `json:"latencyP50"`
+	VarSumAge   string    `json:"varSumAge,omitempty"`
+	Services    []string  `json:"services"`
+}
+
+// Status returns the state of the client using ns.
+func (s *Server) Status(ns *netsender.Sender) Status {
+	st := Status{
+		Time:   time.Now(),
+		Mode:   ns.Mode(),
+		Error:  ns.Error(),
+		Config: ns.EffectiveConfig(),
+		Vars:   ns.LastVars(),
+		Logs:   s.Logs(),
+	}
+	for _, k := range secretParams {
+		if _, ok := st.Config[k]; ok {
+			st.Config[k] = "********"
+		}
+	}
+	if wi, ok := st.Config["wi"]; ok {
+		st.Config["wi"] = netsender.Redact("wi", wi)
+	}
+	for _, pin := range ns.PinValues() {
+		p := Pin{Name: pin.Name, Value: float64(pin.Value)}
+		if pin.IsFloat {
+			p.Value = pin.Float
+		}
+		st.Pins = append(st.Pins, p)
+	}
+
+	m := ns.Metrics()
+	c := &st.Connectivity
+	c.Requests, c.Failures = m.Requests, m.Failures
+	c.LatencyP50 = m.LatencyP50.String()
+	if m.VarSumAge >= 0 {
+		c.VarSumAge = m.VarSumAge.Round(time.Second).String()
+	}
+	if x := ns.HTTPCapture(); len(x) != 0 {
+		last := x[len(x)-1]
+		c.LastRequest, c.LastError, c.Online = last.Time, last.Error, last.Error == ""
+	} else {
+		c.Online = m.Requests > m.Failures
+	}
+	for k, v := range ns.Services() {
+		c.Services = append(c.Services, k+"="+v)
+	}
+	sort.Strings(c.Services)
+	return st
+}
+
+// Handler returns an HTTP handler which serves the state of the client
+// using ns, as HTML at / and as JSON at /status.
+func (s *Server) Handler(ns *netsender.Sender) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(s.Status(ns))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := page.Execute(w, s.Status(ns))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	return mux
+}
+
+// Run serves the state of the client using ns until ctx is done, then
+// shuts down the server and returns ctx.Err(), or returns an error if
+// the server fails.
+func (s *Server) Run(ctx context.Context, ns *netsender.Sender) error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("could not listen: %w", err)
+	}
+	srv := &http.Server{Handler: s.Handler(ns), ReadHeaderTimeout: readTimeout}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(l) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+	return ctx.Err()
+}
+
+// page is the HTML status page template.
+var page = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="10">
+<title>{{.Config.ma}} status</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; }
+pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+.bad { color: #c00; }
+</style>
+</head>
+<body>
+<h1>{{.Config.ma}}</h1>
+<p>Mode: {{.Mode}}{{if .Error}}, error: <span class="bad">{{.Error}}</span>{{end}}. Updated {{.Time.Format "2006-01-02 15:04:05 MST"}}.</p>
+<h2>Connectivity</h2>
+{{with .Connectivity}}<table>
+<tr><th>Online</th><td{{if not .Online}} class="bad"{{end}}>{{.Online}}</td></tr>
+<tr><th>Last request</th><td>{{if not .LastRequest.IsZero}}{{.LastRequest.Format "15:04:05"}}{{end}} {{.LastError}}</td></tr>
+<tr><th>Requests</th><td>{{.Requests}} ({{.Failures}} failed)</td></tr>
+<tr><th>Median latency</th><td>{{.LatencyP50}}</td></tr>
+<tr><th>Var sum age</th><td>{{.VarSumAge}}</td></tr>
+<tr><th>Services</th><td>{{range .Services}}{{.}} {{end}}</td></tr>
+</table>{{end}}
+<h2>Pins</h2>
+<table>
+<tr><th>Pin</th><th>Value</th></tr>
+{{range .Pins}}<tr><td>{{.Name}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+<h2>Config</h2>
+<table>
+{{range $k, $v := .Config}}<tr><th>{{$k}}</th><td>{{$v}}</td></tr>
+{{end}}</table>
+<h2>Vars</h2>
+<table>
+{{range $k, $v := .Vars}}<tr><th>{{$k}}</th><td>{{$v}}</td></tr>
+{{end}}</table>
+<h2>Logs</h2>
+<pre>{{range .Logs}}{{.}}
+{{end}}</pre>
+</body>
+</html>
+`))
@@ -0,0 +1,113 @@
+/*
+NAME
+  status_test.go
+
+LICENSE
+  status is Copyright (C) 2026 the Australian Ocean Lab (AusOcean).
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with status in gpl.txt. If not, see http://www.gnu.org/licenses.
+*/
+
+package status
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ausocean/client/pi/netsender"
+)
+
+// testLogger implements a netsender.Logger which discards logs.
+type testLogger struct{}
+
+func (testLogger) SetLevel(int8)                    {}
+func (testLogger) Log(int8, string, ...interface{}) {}
+
+// TestStatus tests that the status shows the client's state, without
+// its device key, as JSON and HTML.
+func TestStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/vars":
+			io.WriteString(w, `{"vs":"1","mode":"Normal","Light":"On"}`)
+		default:
+			io.WriteString(w, `{"rc":0}`)
+		}
+	}))
+	defer srv.Close()
+
+	conf := filepath.Join(t.TempDir(), "netsender.conf")
+	err := os.WriteFile(conf, []byte("ma 00:00:00:00:00:01\ndk 10000001\nip X10\nmp 1\nwi ssid,password\nsh "+srv.URL+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("could not write config: %v", err)
+	}
+	read := func(pin *netsender.Pin) error { pin.Value = 42; return nil }
+	ns, err := netsender.New(testLogger{}, nil, read, nil, netsender.WithConfigFile(conf))
+	if err != nil {
+		t.Fatalf("unexpected error from netsender.New: %v", err)
+	}
+	err = ns.Run()
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	_, err = ns.Vars()
+	if err != nil {
+		t.Fatalf("unexpected error from Vars: %v", err)
+	}
+
+	s, err := New(":0", WithLogLines(2))
+	if err != nil {
+		t.Fatalf("unexpected error from New: %v", err)
+	}
+	io.WriteString(s, "one\ntwo\nthr")
+	io.WriteString(s, "ee\nfour")
+
+	h := s.Handler(ns)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	var st Status
+	err = json.NewDecoder(rec.Body).Decode(&st)
+	if err != nil {
+		t.Fatalf("could not decode status: %v", err)
+	}
+	if st.Config["dk"] == "10000001" || st.Config["wi"] != "ssid,***" || st.Config["ma"] != "00:00:00:00:00:01" {
+		t.Errorf("unexpected config: %v", st.Config)
+	}
+	if st.Vars["Light"] != "On" {
+		t.Errorf("unexpected vars: %v", st.Vars)
+	}
+	if want := []Pin{{Name: "X10", Value: 42}}; !reflect.DeepEqual(st.Pins, want) {
+		t.Errorf("unexpected pins: got %v, want %v", st.Pins, want)
+	}
+	if want := []string{"two", "three"}; !reflect.DeepEqual(st.Logs, want) {
+		t.Errorf("unexpected logs: got %q, want %q", st.Logs, want)
+	}
+	if !st.Connectivity.Online || st.Connectivity.Requests == 0 {
+		t.Errorf("unexpected connectivity: %+v", st.Connectivity)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "00:00:00:00:00:01") || strings.Contains(body, "10000001") {
+		t.Errorf("unexpected status page: %d %s", rec.Code, body)
+	}
+}
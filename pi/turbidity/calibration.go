@@ -0,0 +1,105 @@
+/*
+DESCRIPTION
+  Provides a calibration curve which maps sharpness scores from the
+  turbidity sensor to turbidity values.
+
+AUTHORS
+  Russell Stanley <russell@ausocean.org>
+
+LICENSE
+  Copyright (C) 2021-2026 the Australian Ocean Lab (AusOcean)
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  in gpl.txt.  If not, see http://www.gnu.org/licenses.
+*/
+
+package turbidity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// CalibrationPoint is a reference point relating a sharpness score to a known turbidity value.
+type CalibrationPoint struct {
+	Sharpness float64 `json:"sharpness"`
+	Turbidity float64 `json:"turbidity"`
+}
+
+// Calibration is a piecewise linear calibration curve fit through known reference points.
+type Calibration struct {
+	Points []CalibrationPoint `json:"points"` // Reference points sorted by sharpness.
+}
+
+// NewCalibration returns a new Calibration fit through the given reference points.
+// At least two points with distinct sharpness scores are required.
+func NewCalibration(pts []CalibrationPoint) (*Calibration, error) {
+	if len(pts) < 2 {
+		return nil, fmt.Errorf("need at least 2 calibration points, got %d", len(pts))
+	}
+	c := &Calibration{Points: make([]CalibrationPoint, len(pts))}
+	copy(c.Points, pts)
+	sort.Slice(c.Points, func(i, j int) bool { return c.Points[i].Sharpness < c.Points[j].Sharpness })
+	for i := 1; i < len(c.Points); i++ {
+		if c.Points[i].Sharpness == c.Points[i-1].Sharpness {
+			return nil, fmt.Errorf("duplicate calibration sharpness: %v", c.Points[i].Sharpness)
+		}
+	}
+	return c, nil
+}
+
+// LoadCalibration reads a Calibration from a JSON file.
+func LoadCalibration(path string) (*Calibration, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read calibration file: %w", err)
+	}
+	var c Calibration
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal calibration: %w", err)
+	}
+	return NewCalibration(c.Points)
+}
+
+// Save writes the Calibration to a JSON file.
+func (c *Calibration) Save(path string) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal calibration: %w", err)
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// Turbidity returns the turbidity value for the given sharpness score by
+// interpolating between the nearest reference points. Scores outside the
+// calibrated range are clamped to the turbidity of the nearest end point.
+func (c *Calibration) Turbidity(sharpness float64) (float64, error) {
+	if c == nil || len(c.Points) < 2 {
+		return 0, errors.New("turbidity sensor is not calibrated")
+	}
+	pts := c.Points
+	if sharpness <= pts[0].Sharpness {
+		return pts[0].Turbidity, nil
+	}
+	if sharpness >= pts[len(pts)-1].Sharpness {
+		return pts[len(pts)-1].Turbidity, nil
+	}
+	i := sort.Search(len(pts), func(i int) bool { return pts[i].Sharpness >= sharpness })
+	lo, hi := pts[i-1], pts[i]
+	t := (sharpness - lo.Sharpness) / (hi.Sharpness - lo.Sharpness)
+	return lo.Turbidity + t*(hi.Turbidity-lo.Turbidity), nil
+}
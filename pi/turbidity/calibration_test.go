@@ -0,0 +1,87 @@
+/*
+DESCRIPTION
+  Testing functions for the turbidity sensor calibration curve.
+
+AUTHORS
+  Russell Stanley <russell@ausocean.org>
+
+LICENSE
+  Copyright (C) 2021-2026 the Australian Ocean Lab (AusOcean)
+
+  It is free software: you can redistribute it and/or modify them
+  under the terms of the GNU General Public License as published by the
+  Free Software Foundation, either version 3 of the License, or (at your
+  option) any later version.
+
+  It is distributed in the hope that it will be useful, but WITHOUT
+  ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+  FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+  for more details.
+
+  You should have received a copy of the GNU General Public License
+  in gpl.txt.  If not, see http://www.gnu.org/licenses.
+*/
+
+package turbidity
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestCalibration tests interpolation, clamping and round tripping of a calibration curve.
+func TestCalibration(t *testing.T) {
+	c, err := NewCalibration([]CalibrationPoint{
+		{Sharpness: 2.0, Turbidity: 0},
+		{Sharpness: 0.5, Turbidity: 30},
+		{Sharpness: 1.0, Turbidity: 10},
+	})
+	if err != nil {
+		t.Fatalf("could not create calibration: %v", err)
+	}
+
+	tests := []struct {
+		sharpness float64
+		want      float64
+	}{
+		{sharpness: 3.0, want: 0},
+		{sharpness: 2.0, want: 0},
+		{sharpness: 1.5, want: 5},
+		{sharpness: 1.0, want: 10},
+		{sharpness: 0.75, want: 20},
+		{sharpness: 0.1, want: 30},
+	}
+	for i, test := range tests {
+		got, err := c.Turbidity(test.sharpness)
+		if err != nil {
+			t.Errorf("unexpected error for test %d: %v", i, err)
+		}
+		if got != test.want {
+			t.Errorf("unexpected turbidity for test %d: got %v, want %v", i, got, test.want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "calibration.json")
+	err = c.Save(path)
+	if err != nil {
+		t.Fatalf("could not save calibration: %v", err)
+	}
+	got, err := LoadCalibration(path)
+	if err != nil {
+		t.Fatalf("could not load calibration: %v", err)
+	}
+	if !reflect.DeepEqual(got, c) {
+		t.Errorf("unexpected loaded calibration: got %v, want %v", got, c)
+	}
+
+	_, err = NewCalibration([]CalibrationPoint{{Sharpness: 1, Turbidity: 0}})
+	if err == nil {
+		t.Errorf("expected error for single point calibration")
+	}
+	var empty *Calibration
+	_, err = empty.Turbidity(1)
+	if err == nil {
+		t.Errorf("expected error for missing calibration")
+	}
+}
@@ -48,6 +48,7 @@ type TurbiditySensor struct {
 	TransformMatrix         gocv.Mat // The current perspective transformation matrix to extract the target from the frame.
 	k1, k2, sobelFilterSize int
 	scale, alpha            float64
+	calibration             *Calibration // Maps sharpness to turbidity, or nil if uncalibrated.
 	log                     logging.Logger
 }
 
@@ -99,6 +100,29 @@ func (ts TurbiditySensor) Evaluate(imgs []gocv.Mat) (*Results, error) {
 	return result, nil
 }
 
+// SetCalibration sets the calibration curve used by Turbidity.
+func (ts *TurbiditySensor) SetCalibration(c *Calibration) {
+	ts.calibration = c
+}
+
+// Turbidity evaluates a single frame and returns a turbidity index by
+// applying the calibration curve to its sharpness score.
+func (ts TurbiditySensor) Turbidity(frame gocv.Mat) (float64, error) {
+	marker, err := ts.transform(frame)
+	if err != nil {
+		return math.NaN(), fmt.Errorf("could not transform image: %w", err)
+	}
+	defer marker.Close()
+	edge := ts.sobel(marker)
+	defer edge.Close()
+
+	sharpness, _, err := ts.EvaluateImage(marker, edge)
+	if err != nil {
+		return math.NaN(), fmt.Errorf("could not evaluate image: %w", err)
+	}
+	return ts.calibration.Turbidity(sharpness)
+}
+
 // EvaluateImage will evaluate image sharpness and contrast using blocks of size k1 by k2. Return the respective scores.
 func (ts TurbiditySensor) EvaluateImage(img, edge gocv.Mat) (float64, float64, error) {
 	var sharpness float64